@@ -1,6 +1,10 @@
 package agent
 
 import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mackerelio/mackerel-agent/checks"
@@ -14,6 +18,40 @@ type Agent struct {
 	MetricsGenerators []metrics.Generator
 	PluginGenerators  []metrics.PluginGenerator
 	Checkers          []checks.Checker
+
+	// FastPluginGenerators are the plugins on the fast path, which are collected by CollectFastMetrics
+	// instead of CollectMetrics.
+	FastPluginGenerators []metrics.PluginGenerator
+
+	// Timestamp is the policy of timestamping metric values (see config.Config.Timestamp).
+	Timestamp string
+
+	// GraphDefsCacheFile caches the hashes of the posted graph definitions of the plugins,
+	// so that the unchanged ones are not posted again. No cache is used if empty.
+	GraphDefsCacheFile string
+	// ForceGraphDefs posts all the graph definitions regardless of the cache.
+	ForceGraphDefs bool
+
+	// Interval is the interval of collecting the metrics (config.PostMetricsInterval if zero),
+	// which is not changed by Reload.
+	Interval time.Duration
+
+	// BeforeCollect and AfterCollect are called before and after each collection of the metrics if set.
+	BeforeCollect func()
+	AfterCollect  func()
+
+	// DiagnosticGenerators generate the metrics of the agent itself in the diagnostic mode in addition to
+	// metrics.AgentGenerator, e.g. the state of posting the metrics. They are not changed by Reload.
+	DiagnosticGenerators []metrics.Generator
+
+	// OnResume is called when the host seems to have been resumed from the suspension or live-migrated if set.
+	// It must be set before Watch, and is not changed by Reload.
+	OnResume func()
+
+	diagnostic int32 // accessed atomically
+	timings    generatorTimings
+
+	mu sync.RWMutex // guards the generators, the checkers, the timestamp policy and the hooks against Reload
 }
 
 // MetricsResult XXX
@@ -22,36 +60,176 @@ type MetricsResult struct {
 	Values  []metrics.ValuesCustomIdentifier
 }
 
-// CollectMetrics collects metrics with generators.
-func (agent *Agent) CollectMetrics(collectedTime time.Time) *MetricsResult {
-	generators := agent.MetricsGenerators
+// SetDiagnostic enables or disables the diagnostic mode, which generates the metrics of the agent itself.
+// It can be changed while the agent is running.
+func (agent *Agent) SetDiagnostic(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&agent.diagnostic, v)
+}
+
+// Diagnostic reports whether the diagnostic mode is enabled.
+func (agent *Agent) Diagnostic() bool {
+	return atomic.LoadInt32(&agent.diagnostic) == 1
+}
+
+// Reload replaces the generators, the checkers, the timestamp policy and the collection hooks with the ones of newAgent
+// while the agent is running. The checkers are not restarted by the agent itself.
+// The generators running in the background are stopped, and the new ones are started.
+func (agent *Agent) Reload(newAgent *Agent) {
+	agent.mu.Lock()
+	backgrounds := agent.backgrounds()
+	agent.MetricsGenerators = newAgent.MetricsGenerators
+	agent.PluginGenerators = newAgent.PluginGenerators
+	agent.FastPluginGenerators = newAgent.FastPluginGenerators
+	agent.Checkers = newAgent.Checkers
+	agent.Timestamp = newAgent.Timestamp
+	agent.BeforeCollect = newAgent.BeforeCollect
+	agent.AfterCollect = newAgent.AfterCollect
+	agent.mu.Unlock()
+
+	for _, b := range backgrounds {
+		b.Stop()
+	}
+	agent.startBackgrounds()
+}
+
+// backgrounds returns the generators running in the background, e.g. the stream plugins.
+// The caller must hold agent.mu.
+func (agent *Agent) backgrounds() []metrics.Background {
+	var backgrounds []metrics.Background
+	for _, g := range agent.MetricsGenerators {
+		if b, ok := g.(metrics.Background); ok {
+			backgrounds = append(backgrounds, b)
+		}
+	}
+	for _, gs := range [][]metrics.PluginGenerator{agent.PluginGenerators, agent.FastPluginGenerators} {
+		for _, g := range gs {
+			if b, ok := g.(metrics.Background); ok {
+				backgrounds = append(backgrounds, b)
+			}
+		}
+	}
+	return backgrounds
+}
+
+// startBackgrounds starts the generators running in the background.
+func (agent *Agent) startBackgrounds() {
+	agent.mu.RLock()
+	backgrounds := agent.backgrounds()
+	agent.mu.RUnlock()
+	for _, b := range backgrounds {
+		b.Start()
+	}
+}
+
+// Stop stops the generators running in the background, e.g. kills the commands of the stream plugins.
+// It is called when the collections by Watch stop.
+func (agent *Agent) Stop() {
+	agent.mu.RLock()
+	backgrounds := agent.backgrounds()
+	agent.mu.RUnlock()
+	for _, b := range backgrounds {
+		b.Stop()
+	}
+}
+
+// GeneratorTimings returns the time taken by each generator in the last collection, sorted by the names.
+func (agent *Agent) GeneratorTimings() []GeneratorTiming {
+	return agent.timings.list()
+}
+
+// CollectMetrics collects metrics with generators. The commands of the plugins are killed when ctx is done.
+func (agent *Agent) CollectMetrics(ctx context.Context, collectedTime time.Time) *MetricsResult {
+	agent.mu.RLock()
+	generators := make([]metrics.Generator, 0, len(agent.MetricsGenerators)+len(agent.PluginGenerators)+1)
+	generators = append(generators, agent.MetricsGenerators...)
 	for _, g := range agent.PluginGenerators {
 		generators = append(generators, g)
 	}
-	result := generateValues(generators)
+	timestamp := agent.Timestamp
+	before, after := agent.BeforeCollect, agent.AfterCollect
+	agent.mu.RUnlock()
+	if agent.Diagnostic() {
+		generators = append(generators, &metrics.AgentGenerator{})
+		generators = append(generators, agent.DiagnosticGenerators...)
+	}
+	if before != nil {
+		before()
+	}
+	result := generateValues(ctx, generators, timestamp, &agent.timings)
 	values := <-result
+	if after != nil {
+		after()
+	}
+	return &MetricsResult{Created: collectedTime, Values: values}
+}
+
+// CollectFastMetrics collects the metrics of the plugins on the fast path.
+// The collection hooks are not called.
+func (agent *Agent) CollectFastMetrics(ctx context.Context, collectedTime time.Time) *MetricsResult {
+	agent.mu.RLock()
+	generators := make([]metrics.Generator, 0, len(agent.FastPluginGenerators))
+	for _, g := range agent.FastPluginGenerators {
+		generators = append(generators, g)
+	}
+	timestamp := agent.Timestamp
+	agent.mu.RUnlock()
+	values := <-generateValues(ctx, generators, timestamp, nil)
 	return &MetricsResult{Created: collectedTime, Values: values}
 }
 
-// Watch XXX
-func (agent *Agent) Watch() chan *MetricsResult {
+// Watch collects the metrics at every interval, and sends the results to the channel returned.
+// The generators running in the background are started before the first collection.
+// The collections stop when ctx is done, and the generators are stopped by Stop.
+func (agent *Agent) Watch(ctx context.Context) chan *MetricsResult {
+	agent.startBackgrounds()
 
 	metricsResult := make(chan *MetricsResult)
 	ticker := make(chan time.Time)
 
+	interval := agent.Interval
+	if interval <= 0 {
+		interval = config.PostMetricsInterval
+	}
+
 	go func() {
-		c := time.Tick(1 * time.Second)
+		defer close(ticker)
+		defer agent.Stop()
+		c := time.NewTicker(1 * time.Second)
+		defer c.Stop()
+		detector := newResumeDetector()
 
 		last := time.Now()
-		ticker <- last // sends tick once at first
+		detector.detect(last)
+		select {
+		case ticker <- last: // sends tick once at first
+		case <-ctx.Done():
+			return
+		}
 
-		for t := range c {
-			// Fire an event at 0 second per minute.
+		for {
+			var t time.Time
+			select {
+			case t = <-c.C:
+			case <-ctx.Done():
+				return
+			}
+			if detector.detect(t) {
+				agent.resumed()
+			}
+			// Fire an event at 0 second per interval (e.g. per minute).
 			// Because ticks may not be accurate,
-			// fire an event if t - last is more than 1 minute
-			if t.Second()%int(config.PostMetricsInterval.Seconds()) == 0 || t.After(last.Add(config.PostMetricsInterval)) {
+			// fire an event if t - last is more than the interval
+			if t.Unix()%int64(interval.Seconds()) == 0 || t.After(last.Add(interval)) {
 				last = t
-				ticker <- t
+				select {
+				case ticker <- t:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
@@ -66,8 +244,12 @@ func (agent *Agent) Watch() chan *MetricsResult {
 			ti := tickedTime
 			sem <- 1
 			go func() {
-				metricsResult <- agent.CollectMetrics(ti)
-				<-sem
+				defer func() { <-sem }()
+				result := agent.CollectMetrics(ctx, ti)
+				select {
+				case metricsResult <- result:
+				case <-ctx.Done():
+				}
 			}()
 		}
 	}()
@@ -79,7 +261,10 @@ func (agent *Agent) Watch() chan *MetricsResult {
 func (agent *Agent) CollectGraphDefsOfPlugins() []mackerel.CreateGraphDefsPayload {
 	payloads := []mackerel.CreateGraphDefsPayload{}
 
-	for _, g := range agent.PluginGenerators {
+	agent.mu.RLock()
+	pluginGenerators := append(append([]metrics.PluginGenerator(nil), agent.PluginGenerators...), agent.FastPluginGenerators...)
+	agent.mu.RUnlock()
+	for _, g := range pluginGenerators {
 		p, err := g.PrepareGraphDefs()
 		if err != nil {
 			logger.Debugf("Failed to fetch meta information from plugin %s (non critical); seems that this plugin does not have meta information: %s", g, err)
@@ -96,10 +281,36 @@ func (agent *Agent) CollectGraphDefsOfPlugins() []mackerel.CreateGraphDefsPayloa
 func (agent *Agent) InitPluginGenerators(api *mackerel.API) {
 	payloads := agent.CollectGraphDefsOfPlugins()
 
+	var cache *graphDefsCache
+	if agent.GraphDefsCacheFile != "" {
+		account := accountFingerprint(api)
+		if agent.ForceGraphDefs {
+			cache = &graphDefsCache{Account: account, Graphs: map[string]string{}}
+		} else {
+			cache = loadGraphDefsCache(agent.GraphDefsCacheFile, account)
+		}
+		changed := cache.changedGraphDefs(payloads)
+		if skipped := len(payloads) - len(changed); skipped > 0 {
+			logger.Debugf("Skip posting %d unchanged graph definitions", skipped)
+		}
+		payloads = changed
+	}
+
 	if len(payloads) > 0 {
 		err := api.CreateGraphDefs(payloads)
+		if errors.Is(err, mackerel.ErrUnsupported) {
+			logger.Debugf("Skip creating graphdefs: %s", err)
+			return
+		}
 		if err != nil {
 			logger.Errorf("Failed to create graphdefs: %s", err)
+			return
+		}
+		if cache != nil {
+			cache.update(payloads)
+			if err := cache.save(agent.GraphDefsCacheFile); err != nil {
+				logger.Warningf("Failed to save the graph definitions cache: %s", err)
+			}
 		}
 	}
 }
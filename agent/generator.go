@@ -1,15 +1,76 @@
 package agent
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/logging"
 	"github.com/mackerelio/mackerel-agent/metrics"
 )
 
 var logger = logging.GetLogger("agent")
 
-func generateValues(generators []metrics.Generator) chan []metrics.ValuesCustomIdentifier {
+// GeneratorTiming is the time taken by a generator in the last collection
+type GeneratorTiming struct {
+	Name     string
+	Started  time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// generatorTimings keeps the last timings of the generators by the names
+type generatorTimings struct {
+	mu      sync.Mutex
+	timings map[string]GeneratorTiming
+}
+
+// record records the timing. The timings are nil-safe, recording nothing.
+func (ts *generatorTimings) record(timing GeneratorTiming) {
+	if ts == nil {
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.timings == nil {
+		ts.timings = make(map[string]GeneratorTiming)
+	}
+	ts.timings[timing.Name] = timing
+}
+
+func (ts *generatorTimings) list() []GeneratorTiming {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	list := make([]GeneratorTiming, 0, len(ts.timings))
+	for _, timing := range ts.timings {
+		list = append(list, timing)
+	}
+	sort.Sort(generatorTimingsByName(list))
+	return list
+}
+
+type generatorTimingsByName []GeneratorTiming
+
+func (ts generatorTimingsByName) Len() int           { return len(ts) }
+func (ts generatorTimingsByName) Less(i, j int) bool { return ts[i].Name < ts[j].Name }
+func (ts generatorTimingsByName) Swap(i, j int)      { ts[i], ts[j] = ts[j], ts[i] }
+
+// generatorName returns the name of the generator for the timings
+func generatorName(g metrics.Generator) string {
+	if s, ok := g.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", g)
+}
+
+// generateValues runs the generators concurrently and merges their values.
+// timestamp is the global policy of timestamping the values, which may be
+// overridden by each plugin generator. The time taken by each generator is recorded to timings.
+// The commands of the generators (see metrics.ContextGenerator) are killed when ctx is done.
+func generateValues(ctx context.Context, generators []metrics.Generator, timestamp string, timings *generatorTimings) chan []metrics.ValuesCustomIdentifier {
 	processed := make(chan metrics.ValuesCustomIdentifier)
 	finish := make(chan bool)
 	result := make(chan []metrics.ValuesCustomIdentifier)
@@ -39,18 +100,35 @@ func generateValues(generators []metrics.Generator) chan []metrics.ValuesCustomI
 					wg.Done()
 				}()
 
-				values, err := g.Generate()
+				started := time.Now()
+				values, err := metrics.GenerateContext(ctx, g)
+				finished := time.Now()
+				timings.record(GeneratorTiming{Name: generatorName(g), Started: started, Duration: finished.Sub(started), Err: err})
 				if err != nil {
 					logger.Errorf("Failed to generate value in %T (skip this metric): %s", g, err.Error())
 					return
 				}
+
 				var customIdentifier *string
+				policy := timestamp
 				if pluginGenerator, ok := g.(metrics.PluginGenerator); ok {
 					customIdentifier = pluginGenerator.CustomIdentifier()
+					if t := pluginGenerator.Timestamp(); t != "" {
+						policy = t
+					}
+				}
+
+				var sampled time.Time
+				switch policy {
+				case config.TimestampPluginStart:
+					sampled = started
+				case config.TimestampPluginEnd:
+					sampled = finished
 				}
 				processed <- metrics.ValuesCustomIdentifier{
 					Values:           values,
 					CustomIdentifier: customIdentifier,
+					Time:             sampled,
 				}
 			}(g)
 		}
@@ -1,8 +1,11 @@
 package agent
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/metrics"
 )
 
@@ -24,10 +27,29 @@ func TestGenerateValues(t *testing.T) {
 	tg := &testGenerator{}
 	tpg := &testPanicGenerator{}
 	generators := []metrics.Generator{tg, tpg}
-	result := generateValues(generators)
+	var timings generatorTimings
+	result := generateValues(context.Background(), generators, config.TimestampCycleStart, &timings)
 	values := <-result
 
 	if len(values) != 1 {
 		t.Errorf("Num of results should be 1, but %d", len(values))
 	}
+	if list := timings.list(); len(list) != 1 || list[0].Name != "*agent.testGenerator" || list[0].Err != nil {
+		t.Errorf("the timing of the generator should be recorded: %v", list)
+	}
+}
+
+func TestGenerateValuesTimestamp(t *testing.T) {
+	generators := []metrics.Generator{&testGenerator{}}
+
+	values := <-generateValues(context.Background(), generators, config.TimestampCycleStart, nil)
+	if !values[0].Time.IsZero() {
+		t.Errorf("Time should be zero with %q but %v", config.TimestampCycleStart, values[0].Time)
+	}
+
+	before := time.Now()
+	values = <-generateValues(context.Background(), generators, config.TimestampPluginEnd, nil)
+	if values[0].Time.Before(before) || values[0].Time.After(time.Now()) {
+		t.Errorf("Time should be the time when the generator finished but %v", values[0].Time)
+	}
 }
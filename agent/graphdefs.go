@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// graphDefsCache holds the hashes of the graph definitions posted to the account,
+// keyed by the names of the graphs.
+type graphDefsCache struct {
+	Account string            `json:"account"`
+	Graphs  map[string]string `json:"graphs"`
+}
+
+// accountFingerprint identifies the organization the graph definitions are posted to,
+// without storing the API key itself.
+func accountFingerprint(api *mackerel.API) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(api.BaseURL.String()+"\n"+api.APIKey)))
+}
+
+func graphDefHash(payload mackerel.CreateGraphDefsPayload) string {
+	b, _ := json.Marshal(payload)
+	return fmt.Sprintf("%x", sha1.Sum(b))
+}
+
+// loadGraphDefsCache loads the cache from file. An empty cache is returned if the file does not exist,
+// is broken or is for another account.
+func loadGraphDefsCache(file, account string) *graphDefsCache {
+	cache := &graphDefsCache{Account: account, Graphs: map[string]string{}}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read the graph definitions cache: %s", err)
+		}
+		return cache
+	}
+	var saved graphDefsCache
+	if err := json.Unmarshal(content, &saved); err != nil {
+		logger.Warningf("Ignoring the broken graph definitions cache %s: %s", file, err)
+		return cache
+	}
+	if saved.Account != account || saved.Graphs == nil {
+		return cache
+	}
+	return &saved
+}
+
+func (cache *graphDefsCache) save(file string) error {
+	content, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+// changedGraphDefs returns the payloads which differ from the cached ones.
+func (cache *graphDefsCache) changedGraphDefs(payloads []mackerel.CreateGraphDefsPayload) []mackerel.CreateGraphDefsPayload {
+	changed := []mackerel.CreateGraphDefsPayload{}
+	for _, p := range payloads {
+		if cache.Graphs[p.Name] != graphDefHash(p) {
+			changed = append(changed, p)
+		}
+	}
+	return changed
+}
+
+func (cache *graphDefsCache) update(payloads []mackerel.CreateGraphDefsPayload) {
+	for _, p := range payloads {
+		cache.Graphs[p.Name] = graphDefHash(p)
+	}
+}
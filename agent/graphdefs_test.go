@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+type testPluginGenerator struct {
+	testGenerator
+	graphDefs []mackerel.CreateGraphDefsPayload
+}
+
+func (g *testPluginGenerator) PrepareGraphDefs() ([]mackerel.CreateGraphDefsPayload, error) {
+	return g.graphDefs, nil
+}
+
+func (g *testPluginGenerator) CustomIdentifier() *string {
+	return nil
+}
+
+func (g *testPluginGenerator) Timestamp() string {
+	return config.TimestampCycleStart
+}
+
+func TestInitPluginGeneratorsWithCache(t *testing.T) {
+	posted := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		posted++
+	}))
+	defer ts.Close()
+	api, _ := mackerel.NewAPI(ts.URL, "dummy-key", false)
+
+	dir, err := ioutil.TempDir("", "mackerel-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := &testPluginGenerator{graphDefs: []mackerel.CreateGraphDefsPayload{{Name: "custom.dice", Unit: "integer"}}}
+	agent := &Agent{
+		PluginGenerators:   []metrics.PluginGenerator{g},
+		GraphDefsCacheFile: filepath.Join(dir, "graphdefs.json"),
+	}
+
+	agent.InitPluginGenerators(api)
+	if posted != 1 {
+		t.Errorf("graph definitions should be posted at first but %d", posted)
+	}
+
+	agent.InitPluginGenerators(api)
+	if posted != 1 {
+		t.Errorf("unchanged graph definitions should not be posted again but %d", posted)
+	}
+
+	g.graphDefs[0].Unit = "float"
+	agent.InitPluginGenerators(api)
+	if posted != 2 {
+		t.Errorf("changed graph definitions should be posted but %d", posted)
+	}
+
+	agent.ForceGraphDefs = true
+	agent.InitPluginGenerators(api)
+	if posted != 3 {
+		t.Errorf("graph definitions should be posted when forced but %d", posted)
+	}
+
+	api, _ = mackerel.NewAPI(ts.URL, "another-key", false)
+	agent.ForceGraphDefs = false
+	agent.InitPluginGenerators(api)
+	if posted != 4 {
+		t.Errorf("graph definitions should be posted to another account but %d", posted)
+	}
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// resumeThreshold is the least gap between the ticks of Watch regarded as the resume of the host
+// from the suspension or the live migration.
+var resumeThreshold = 30 * time.Second
+
+// uptimeFile reports the uptime including the time suspended, which is not available except on Linux.
+var uptimeFile = "/proc/uptime"
+
+// readUptime returns the uptime of the host in seconds
+func readUptime() (float64, error) {
+	content, err := ioutil.ReadFile(uptimeFile)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// resumeDetector detects the resume of the host by the jump of the clock between the ticks.
+// The jump is not regarded as the resume if the uptime has not advanced as much as the clock,
+// since it is an adjustment of the clock (e.g. by NTP) then.
+type resumeDetector struct {
+	uptime func() (float64, error)
+
+	lastTick   time.Time
+	lastUptime float64 // zero if unknown
+}
+
+func newResumeDetector() *resumeDetector {
+	return &resumeDetector{uptime: readUptime}
+}
+
+// detect reports whether the host seems to have been resumed since the previous tick
+func (d *resumeDetector) detect(now time.Time) bool {
+	uptime, err := d.uptime()
+	if err != nil {
+		uptime = 0
+	}
+	lastTick, lastUptime := d.lastTick, d.lastUptime
+	d.lastTick, d.lastUptime = now, uptime
+	if lastTick.IsZero() || now.Sub(lastTick) < resumeThreshold {
+		return false
+	}
+	if uptime == 0 || lastUptime == 0 {
+		return true
+	}
+	return uptime-lastUptime >= resumeThreshold.Seconds()
+}
+
+// resumed discards the baselines of the deltas kept by the generators, which are broken by the jump
+// of the clock and the reset of the counters on the new host, and calls OnResume.
+func (agent *Agent) resumed() {
+	logger.Infof("The host seems to have been resumed or migrated. The baselines of the metrics are reset.")
+	agent.mu.RLock()
+	generators := make([]metrics.Generator, 0, len(agent.MetricsGenerators)+len(agent.PluginGenerators))
+	generators = append(generators, agent.MetricsGenerators...)
+	for _, g := range agent.PluginGenerators {
+		generators = append(generators, g)
+	}
+	for _, g := range agent.FastPluginGenerators {
+		generators = append(generators, g)
+	}
+	agent.mu.RUnlock()
+	for _, g := range generators {
+		if r, ok := g.(metrics.Resetter); ok {
+			r.Reset()
+		}
+	}
+	if agent.OnResume != nil {
+		agent.OnResume()
+	}
+}
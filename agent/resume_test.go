@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+func TestResumeDetector(t *testing.T) {
+	uptime := 1000.0
+	d := &resumeDetector{uptime: func() (float64, error) { return uptime, nil }}
+	now := time.Now()
+	if d.detect(now) {
+		t.Errorf("the first tick should not be regarded as the resume")
+	}
+
+	now, uptime = now.Add(time.Second), uptime+1
+	if d.detect(now) {
+		t.Errorf("the usual tick should not be regarded as the resume")
+	}
+
+	now, uptime = now.Add(time.Hour), uptime+1
+	if d.detect(now) {
+		t.Errorf("the adjustment of the clock should not be regarded as the resume")
+	}
+
+	now, uptime = now.Add(10*time.Minute), uptime+600
+	if !d.detect(now) {
+		t.Errorf("the jump of both the clock and the uptime should be regarded as the resume")
+	}
+
+	now = now.Add(-time.Hour)
+	if d.detect(now) {
+		t.Errorf("the clock going back should not be regarded as the resume")
+	}
+
+	d.uptime = func() (float64, error) { return 0, errors.New("not available") }
+	now = now.Add(time.Minute)
+	if !d.detect(now) {
+		t.Errorf("the jump of the clock should be regarded as the resume without the uptime")
+	}
+}
+
+type testResetGenerator struct {
+	testGenerator
+	reset bool
+}
+
+func (g *testResetGenerator) Reset() {
+	g.reset = true
+}
+
+func TestAgentResumed(t *testing.T) {
+	g := &testResetGenerator{}
+	called := false
+	ag := &Agent{
+		MetricsGenerators: []metrics.Generator{g, &testGenerator{}},
+		OnResume:          func() { called = true },
+	}
+	ag.resumed()
+	if !g.reset || !called {
+		t.Errorf("the generators should be reset and OnResume should be called")
+	}
+}
@@ -0,0 +1,178 @@
+package checks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+const (
+	defaultCertWarningDays  = 30
+	defaultCertCriticalDays = 14
+	defaultCertTimeout      = 10 * time.Second
+)
+
+// certCheck checks the certificate chain served at the address or stored in the PEM file
+type certCheck struct {
+	address    string
+	path       string
+	serverName string
+	roots      *x509.CertPool // the system roots if nil
+	warning    time.Duration
+	critical   time.Duration
+	timeout    time.Duration
+}
+
+// NewCertFunc returns a Checker.Func which checks the certificate chain served by TLS at conf.Address ("host:port")
+// or stored in the PEM file conf.Path (the leaf certificate followed by the intermediates).
+// It reports CRITICAL when the chain is not verified by the system roots (or the certificates of conf.CAFile)
+// or expires within conf.CriticalDays (14 by default), and WARNING when it expires within conf.WarningDays (30 by default).
+// The server name (the host of the address by default) is verified by conf.ServerName.
+func NewCertFunc(conf config.PluginConfig) (func() (Status, string), error) {
+	if (conf.Address == "") == (conf.Path == "") {
+		return nil, fmt.Errorf("either address or path is required")
+	}
+	c := &certCheck{
+		address:    conf.Address,
+		path:       conf.Path,
+		serverName: conf.ServerName,
+		warning:    certDays(conf.WarningDays, defaultCertWarningDays),
+		critical:   certDays(conf.CriticalDays, defaultCertCriticalDays),
+		timeout:    defaultCertTimeout,
+	}
+	if conf.Timeout != nil && *conf.Timeout > 0 {
+		c.timeout = time.Duration(*conf.Timeout) * time.Second
+	}
+	if c.address != "" && c.serverName == "" {
+		host, _, err := net.SplitHostPort(c.address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %s", err)
+		}
+		c.serverName = host
+	}
+	if conf.CAFile != "" {
+		b, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA file: %s", err)
+		}
+		c.roots = x509.NewCertPool()
+		if !c.roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates are found in the CA file %q", conf.CAFile)
+		}
+	}
+	return c.check, nil
+}
+
+func certDays(days *int32, defaultDays int) time.Duration {
+	if days != nil && *days >= 0 {
+		return time.Duration(*days) * 24 * time.Hour
+	}
+	return time.Duration(defaultDays) * 24 * time.Hour
+}
+
+func (c *certCheck) target() string {
+	if c.address != "" {
+		return c.address
+	}
+	return c.path
+}
+
+func (c *certCheck) check() (Status, string) {
+	var certs []*x509.Certificate
+	var err error
+	if c.address != "" {
+		certs, err = c.fetch()
+	} else {
+		certs, err = c.load()
+	}
+	if err != nil {
+		return StatusUnknown, fmt.Sprintf("%s: %s", c.target(), err)
+	}
+	return c.report(certs, time.Now())
+}
+
+// fetch returns the certificates presented by the server, which are verified by report
+func (c *certCheck) fetch() ([]*x509.Certificate, error) {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", c.address, &tls.Config{
+		ServerName:         c.serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates, nil
+}
+
+// load returns the certificates in the PEM file
+func (c *certCheck) load() ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates are found")
+	}
+	return certs, nil
+}
+
+// report verifies the chain of certs (the leaf first) at now, and reports the expiry of the earliest one
+func (c *certCheck) report(certs []*x509.Certificate, now time.Time) (Status, string) {
+	target := c.target()
+	earliest := certs[0]
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(earliest.NotAfter) {
+			earliest = cert
+		}
+	}
+	left := earliest.NotAfter.Sub(now)
+	if left <= 0 {
+		return StatusCritical, fmt.Sprintf("%s: the certificate %q expired at %s", target, earliest.Subject.CommonName, earliest.NotAfter.Format(time.RFC3339))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       c.serverName,
+		Roots:         c.roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	}); err != nil {
+		return StatusCritical, fmt.Sprintf("%s: failed to verify the certificate: %s", target, err)
+	}
+
+	status := StatusOK
+	switch {
+	case left < c.critical:
+		status = StatusCritical
+	case left < c.warning:
+		status = StatusWarning
+	}
+	return status, fmt.Sprintf("%s: the certificate %q expires in %d days (%s)",
+		target, earliest.Subject.CommonName, int(left.Hours()/24), earliest.NotAfter.Format(time.RFC3339))
+}
@@ -0,0 +1,152 @@
+package checks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// issueCert issues the certificate expiring at notAfter by the parent (self-signed if nil)
+func issueCert(t *testing.T, cn string, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-48 * time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		template.IsCA = true
+		parent, parentKey = template, key
+	} else {
+		template.DNSNames = []string{cn}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writeCerts(t *testing.T, file string, certs ...*x509.Certificate) {
+	var b []byte
+	for _, cert := range certs {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewCertFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-checkcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	ca, caKey := issueCert(t, "Test CA", now.Add(3650*24*time.Hour), nil, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeCerts(t, caFile, ca)
+
+	int32p := func(i int32) *int32 { return &i }
+	testCases := []struct {
+		name       string
+		notAfter   time.Time
+		serverName string
+		caFile     string
+		status     Status
+		message    string
+	}{
+		{"ok", now.Add(60 * 24 * time.Hour), "api.example.com", caFile, StatusOK, "expires in 59 days"},
+		{"warning", now.Add(20 * 24 * time.Hour), "api.example.com", caFile, StatusWarning, "expires in 19 days"},
+		{"critical", now.Add(10 * 24 * time.Hour), "api.example.com", caFile, StatusCritical, "expires in 9 days"},
+		{"expired", now.Add(-time.Hour), "api.example.com", caFile, StatusCritical, "expired at"},
+		{"wrong server name", now.Add(60 * 24 * time.Hour), "www.example.com", caFile, StatusCritical, "failed to verify"},
+		{"unknown authority", now.Add(60 * 24 * time.Hour), "api.example.com", "", StatusCritical, "failed to verify"},
+	}
+	for _, tc := range testCases {
+		leaf, _ := issueCert(t, "api.example.com", tc.notAfter, ca, caKey)
+		path := filepath.Join(dir, "leaf.pem")
+		writeCerts(t, path, leaf)
+		check, err := NewCertFunc(config.PluginConfig{
+			Path:         path,
+			ServerName:   tc.serverName,
+			CAFile:       tc.caFile,
+			CriticalDays: int32p(14),
+		})
+		if err != nil {
+			t.Fatalf("%s: should not raise error: %v", tc.name, err)
+		}
+		status, message := check()
+		if status != tc.status || !strings.Contains(message, tc.message) {
+			t.Errorf("%s: unexpected report: %s %q", tc.name, status, message)
+		}
+	}
+}
+
+func TestNewCertFunc_address(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "mackerel-agent-checkcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeCerts(t, caFile, ts.Certificate())
+
+	address := ts.Listener.Addr().String()
+	check, err := NewCertFunc(config.PluginConfig{Address: address, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if status, message := check(); status != StatusOK {
+		t.Errorf("the certificate of the server should be OK: %s %q", status, message)
+	}
+
+	check, _ = NewCertFunc(config.PluginConfig{Address: address})
+	if status, message := check(); status != StatusCritical {
+		t.Errorf("the certificate of the unknown authority should be CRITICAL: %s %q", status, message)
+	}
+}
+
+func TestNewCertFunc_invalid(t *testing.T) {
+	confs := []config.PluginConfig{
+		{},
+		{Address: "www.example.com:443", Path: "/etc/ssl/cert.pem"},
+		{Address: "www.example.com"},
+		{Address: "www.example.com:443", CAFile: "/nonexistent/ca.pem"},
+	}
+	for _, conf := range confs {
+		if _, err := NewCertFunc(conf); err == nil {
+			t.Errorf("should raise error: %+v", conf)
+		}
+	}
+}
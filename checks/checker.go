@@ -1,6 +1,8 @@
 package checks
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -27,6 +29,10 @@ const (
 
 const defaultCheckInterval = 1 * time.Minute
 
+// ErrConditionNotSatisfied is returned by Check when the check is skipped
+// because the condition of the check is not satisfied.
+var ErrConditionNotSatisfied = errors.New("condition is not satisfied")
+
 var exitCodeToStatus = map[int]Status{
 	0: StatusOK,
 	1: StatusWarning,
@@ -44,6 +50,9 @@ type Checker struct {
 	// If the configuration of checks.Checker and/or metrics.pluginGenerator changes,
 	// we should reconsider using config.PluginConfig.
 	Config config.PluginConfig
+	// Func is invoked instead of Config.Command if set.
+	// It is used for the checks built in the agent.
+	Func func() (Status, string)
 }
 
 // Report is what Checker produces by invoking its command.
@@ -57,23 +66,48 @@ type Report struct {
 }
 
 func (c Checker) String() string {
+	if c.Func != nil {
+		return fmt.Sprintf("checker %q (built-in)", c.Name)
+	}
 	return fmt.Sprintf("checker %q command=[%s]", c.Name, c.Config.Command)
 }
 
+func (c Checker) conditionSatisfied() bool {
+	return util.ConditionSatisfied(c.Config.Condition, c.Config.ConditionFile, c.Config.User)
+}
+
 // Check invokes the command and transforms its result to a Report.
+// It returns ErrConditionNotSatisfied without invoking the command when the condition is not satisfied.
 func (c Checker) Check() (*Report, error) {
+	return c.CheckContext(context.Background())
+}
+
+// CheckContext invokes the command like Check, but kills it when ctx is done, e.g. when the agent terminates.
+func (c Checker) CheckContext(ctx context.Context) (*Report, error) {
 	now := time.Now()
 
+	if !c.conditionSatisfied() {
+		return nil, ErrConditionNotSatisfied
+	}
+
+	if c.Func != nil {
+		status, message := c.Func()
+		logger.Debugf("Checker %q status=%s message=%q", c.Name, status, message)
+		return c.newReport(status, message, now), nil
+	}
+
 	command := c.Config.Command
 	logger.Debugf("Checker %q executing command %q", c.Name, command)
-	message, stderr, exitCode, err := util.RunCommand(command, c.Config.User)
+	message, stderr, exitCode, err := util.RunCommandContext(ctx, command, c.Config.User, c.Config.EnvList(), c.Timeout())
 	if stderr != "" {
 		logger.Warningf("Checker %q output stderr: %s", c.Name, stderr)
 	}
 
 	status := StatusUnknown
 
-	if err != nil {
+	if err == util.ErrCommandTimedOut && c.Timeout() > 0 {
+		message = fmt.Sprintf("command timed out after %s", c.Timeout())
+	} else if err != nil {
 		message = err.Error()
 	} else {
 		if s, ok := exitCodeToStatus[exitCode]; ok {
@@ -83,14 +117,18 @@ func (c Checker) Check() (*Report, error) {
 		logger.Debugf("Checker %q status=%s message=%q", c.Name, status, message)
 	}
 
+	return c.newReport(status, message, now), nil
+}
+
+func (c Checker) newReport(status Status, message string, occurredAt time.Time) *Report {
 	return &Report{
 		Name:                 c.Name,
 		Status:               status,
 		Message:              message,
-		OccurredAt:           now,
+		OccurredAt:           occurredAt,
 		NotificationInterval: c.Config.NotificationInterval,
 		MaxCheckAttempts:     c.Config.MaxCheckAttempts,
-	}, nil
+	}
 }
 
 // Interval is the interval where the command is invoked.
@@ -107,3 +145,25 @@ func (c Checker) Interval() time.Duration {
 	}
 	return defaultCheckInterval
 }
+
+// Timeout is the time limit of the command, after which the command is killed and reported as UNKNOWN.
+// It is 0 if not configured, and the default timeout of util.RunCommand is applied.
+func (c Checker) Timeout() time.Duration {
+	if c.Config.Timeout == nil || *c.Config.Timeout <= 0 {
+		return 0
+	}
+	return time.Duration(*c.Config.Timeout) * time.Second
+}
+
+// Jitter is the maximum delay of the invocations from the boundaries of the wall clock
+// when AlignToClock is configured. It is less than the interval.
+func (c Checker) Jitter() time.Duration {
+	if c.Config.Jitter == nil || *c.Config.Jitter <= 0 {
+		return 0
+	}
+	jitter := time.Duration(*c.Config.Jitter) * time.Second
+	if interval := c.Interval(); jitter >= interval {
+		jitter = interval - time.Second
+	}
+	return jitter
+}
@@ -2,6 +2,7 @@ package checks
 
 import (
 	"testing"
+	"time"
 
 	"github.com/mackerelio/mackerel-agent/config"
 )
@@ -45,3 +46,38 @@ func TestChecker_Check(t *testing.T) {
 		}
 	}
 }
+
+func TestChecker_Jitter(t *testing.T) {
+	int32p := func(v int32) *int32 { return &v }
+
+	checker := Checker{}
+	if checker.Jitter() != 0 {
+		t.Errorf("jitter should be 0 by default: %v", checker.Jitter())
+	}
+
+	checker.Config.Jitter = int32p(10)
+	if checker.Jitter() != 10*time.Second {
+		t.Errorf("jitter should be 10s: %v", checker.Jitter())
+	}
+
+	checker.Config.Jitter = int32p(300)
+	if checker.Jitter() >= checker.Interval() {
+		t.Errorf("jitter should be less than the interval: %v", checker.Jitter())
+	}
+}
+
+func TestChecker_CheckCondition(t *testing.T) {
+	checker := Checker{
+		Config: config.PluginConfig{
+			Command:   "go run testdata/exit.go -code 2 -message NG",
+			Condition: "false",
+		},
+	}
+	report, err := checker.Check()
+	if err != ErrConditionNotSatisfied {
+		t.Errorf("err should be ErrConditionNotSatisfied: %v", err)
+	}
+	if report != nil {
+		t.Errorf("report should be nil: %v", report)
+	}
+}
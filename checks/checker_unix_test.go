@@ -36,3 +36,49 @@ func TestChecker_CheckTimeout(t *testing.T) {
 		}
 	}
 }
+
+func TestChecker_CheckConfiguredTimeout(t *testing.T) {
+	timeout := int32(1)
+	checker := Checker{
+		Config: config.PluginConfig{
+			// the descendants of the shell are killed as well
+			Command: "sleep 10 | cat",
+			Timeout: &timeout,
+		},
+	}
+
+	start := time.Now()
+	report, err := checker.Check()
+	if err != nil {
+		t.Errorf("err should be nil: %v", err)
+	}
+	if report.Status != StatusUnknown {
+		t.Errorf("status should be UNKNOWN: %v", report.Status)
+	}
+	if report.Message != "command timed out after 1s" {
+		t.Errorf("wrong message: %q", report.Message)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the command should be killed by the timeout but took %s", elapsed)
+	}
+}
+
+func TestChecker_CheckEnv(t *testing.T) {
+	checker := Checker{
+		Config: config.PluginConfig{
+			Command: `test "$API_TOKEN" = "secret" && echo "$ENDPOINT"`,
+			Env:     map[string]string{"API_TOKEN": "secret", "ENDPOINT": "https://example.com/"},
+		},
+	}
+
+	report, err := checker.Check()
+	if err != nil {
+		t.Errorf("err should be nil: %v", err)
+	}
+	if report.Status != StatusOK {
+		t.Errorf("status should be OK: %v", report.Status)
+	}
+	if report.Message != "https://example.com/\n" {
+		t.Errorf("wrong message: %q", report.Message)
+	}
+}
@@ -0,0 +1,95 @@
+package checks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ConnectivityTarget is a destination the agent requires to reach.
+// Network is "tcp" or "ntp", which sends an NTP request over UDP.
+type ConnectivityTarget struct {
+	Name    string
+	Network string
+	Address string
+}
+
+func (t ConnectivityTarget) String() string {
+	return fmt.Sprintf("%s (%s %s)", t.Name, t.Network, t.Address)
+}
+
+var connectivityTimeout = 10 * time.Second
+
+// NewConnectivityFunc returns a Checker.Func which checks the reachability of the targets.
+// It reports WARNING listing the blocked destinations.
+func NewConnectivityFunc(targets []ConnectivityTarget) func() (Status, string) {
+	return func() (Status, string) {
+		errs := make([]error, len(targets))
+		done := make(chan struct{})
+		for i, t := range targets {
+			go func(i int, t ConnectivityTarget) {
+				errs[i] = t.reach(connectivityTimeout)
+				done <- struct{}{}
+			}(i, t)
+		}
+		for range targets {
+			<-done
+		}
+
+		var blocked, reachable []string
+		for i, t := range targets {
+			if errs[i] != nil {
+				blocked = append(blocked, fmt.Sprintf("%s: %s", t, errs[i]))
+			} else {
+				reachable = append(reachable, t.String())
+			}
+		}
+		if len(blocked) > 0 {
+			return StatusWarning, "blocked destinations:\n" + strings.Join(blocked, "\n")
+		}
+		return StatusOK, "reachable: " + strings.Join(reachable, ", ")
+	}
+}
+
+func (t ConnectivityTarget) reach(timeout time.Duration) error {
+	switch t.Network {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", t.Address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "ntp":
+		return queryNTP(t.Address, timeout)
+	}
+	return fmt.Errorf("unknown network %q", t.Network)
+}
+
+// queryNTP sends a SNTP client request (RFC 4330) and waits for the server's reply
+func queryNTP(address string, timeout time.Duration) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "123")
+	}
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := make([]byte, 48)
+	req[0] = 0x1B // LI = 0, VN = 3, Mode = 3 (client)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	res := make([]byte, 48)
+	n, err := conn.Read(res)
+	if err != nil {
+		return err
+	}
+	if n < 48 || res[0]&0x07 != 4 { // Mode = 4 (server)
+		return fmt.Errorf("invalid NTP response")
+	}
+	return nil
+}
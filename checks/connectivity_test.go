@@ -0,0 +1,64 @@
+package checks
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewConnectivityFunc(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer ln.Close()
+
+	ntp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer ntp.Close()
+	go func() {
+		buf := make([]byte, 48)
+		for {
+			_, addr, err := ntp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			res := make([]byte, 48)
+			res[0] = 0x1C // LI = 0, VN = 3, Mode = 4 (server)
+			ntp.WriteTo(res, addr)
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	original := connectivityTimeout
+	connectivityTimeout = time.Second
+	defer func() { connectivityTimeout = original }()
+
+	status, msg := NewConnectivityFunc([]ConnectivityTarget{
+		{Name: "apibase", Network: "tcp", Address: ln.Addr().String()},
+		{Name: "ntp", Network: "ntp", Address: ntp.LocalAddr().String()},
+	})()
+	if status != StatusOK {
+		t.Errorf("status should be OK but %s: %s", status, msg)
+	}
+
+	status, msg = NewConnectivityFunc([]ConnectivityTarget{
+		{Name: "apibase", Network: "tcp", Address: ln.Addr().String()},
+		{Name: "target", Network: "tcp", Address: closedAddr},
+	})()
+	if status != StatusWarning {
+		t.Errorf("status should be WARNING but %s", status)
+	}
+	if !strings.Contains(msg, "target (tcp "+closedAddr+")") || strings.Contains(msg, "apibase") {
+		t.Errorf("only the blocked destination should be listed: %s", msg)
+	}
+}
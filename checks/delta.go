@@ -0,0 +1,64 @@
+package checks
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewDeltaFunc returns a Checker.Func which compares the set of items
+// returned by collect with the one collected at the previous invocation.
+// It reports WARNING when new items appear, and OK otherwise.
+// The first invocation only records the items as the baseline.
+func NewDeltaFunc(subject string, collect func() ([]string, error)) func() (Status, string) {
+	var (
+		mu       sync.Mutex
+		previous map[string]bool
+	)
+	return func() (Status, string) {
+		items, err := collect()
+		if err != nil {
+			return StatusUnknown, fmt.Sprintf("failed to collect %s: %s", subject, err)
+		}
+
+		current := make(map[string]bool, len(items))
+		for _, item := range items {
+			current[item] = true
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if previous == nil {
+			previous = current
+			return StatusOK, fmt.Sprintf("%d %s found", len(current), subject)
+		}
+
+		added := setDifference(current, previous)
+		removed := setDifference(previous, current)
+		previous = current
+
+		if len(added) > 0 {
+			msg := fmt.Sprintf("new %s: %s", subject, strings.Join(added, ", "))
+			if len(removed) > 0 {
+				msg += fmt.Sprintf("\ndisappeared %s: %s", subject, strings.Join(removed, ", "))
+			}
+			return StatusWarning, msg
+		}
+		if len(removed) > 0 {
+			return StatusOK, fmt.Sprintf("disappeared %s: %s", subject, strings.Join(removed, ", "))
+		}
+		return StatusOK, fmt.Sprintf("no changes in %d %s", len(current), subject)
+	}
+}
+
+func setDifference(a, b map[string]bool) []string {
+	diff := []string{}
+	for item := range a {
+		if !b[item] {
+			diff = append(diff, item)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
@@ -0,0 +1,59 @@
+package checks
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewDeltaFunc(t *testing.T) {
+	var items []string
+	var collectErr error
+	f := NewDeltaFunc("listening ports", func() ([]string, error) {
+		return items, collectErr
+	})
+
+	items = []string{"tcp 0.0.0.0:22 (sshd)"}
+	if status, _ := f(); status != StatusOK {
+		t.Errorf("first invocation should be OK but %s", status)
+	}
+
+	if status, _ := f(); status != StatusOK {
+		t.Errorf("status should be OK when nothing has changed but %s", status)
+	}
+
+	items = []string{"tcp 0.0.0.0:22 (sshd)", "tcp 0.0.0.0:4444 (nc)"}
+	status, msg := f()
+	if status != StatusWarning {
+		t.Errorf("status should be WARNING when a new item appears but %s", status)
+	}
+	if msg != "new listening ports: tcp 0.0.0.0:4444 (nc)" {
+		t.Errorf("wrong message: %q", msg)
+	}
+
+	items = []string{"tcp 0.0.0.0:22 (sshd)"}
+	if status, _ := f(); status != StatusOK {
+		t.Errorf("status should be OK when an item disappears but %s", status)
+	}
+
+	collectErr = fmt.Errorf("permission denied")
+	if status, _ := f(); status != StatusUnknown {
+		t.Errorf("status should be UNKNOWN when collecting failed but %s", status)
+	}
+}
+
+func TestChecker_CheckFunc(t *testing.T) {
+	checker := Checker{
+		Name: "builtin",
+		Func: func() (Status, string) {
+			return StatusCritical, "something is wrong"
+		},
+	}
+
+	report, err := checker.Check()
+	if err != nil {
+		t.Errorf("err should be nil: %v", err)
+	}
+	if report.Name != "builtin" || report.Status != StatusCritical || report.Message != "something is wrong" {
+		t.Errorf("wrong report: %#v", report)
+	}
+}
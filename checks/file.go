@@ -0,0 +1,39 @@
+package checks
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// NewFileFunc returns a Checker.Func which checks the file specified by conf.Path.
+// It reports CRITICAL when the file is missing, and WARNING when the file is
+// older than conf.MaxAge seconds or larger than conf.MaxSize bytes.
+func NewFileFunc(conf config.PluginConfig) func() (Status, string) {
+	return func() (Status, string) {
+		fi, err := os.Stat(conf.Path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return StatusCritical, fmt.Sprintf("%s does not exist", conf.Path)
+			}
+			return StatusUnknown, err.Error()
+		}
+
+		age := int64(time.Since(fi.ModTime()).Seconds())
+		size := fi.Size()
+
+		status := StatusOK
+		message := fmt.Sprintf("%s: %d bytes, modified %d seconds ago", conf.Path, size, age)
+		if conf.MaxAge != nil && age > int64(*conf.MaxAge) {
+			status = StatusWarning
+			message += fmt.Sprintf("\nolder than %d seconds", *conf.MaxAge)
+		}
+		if conf.MaxSize != nil && size > *conf.MaxSize {
+			status = StatusWarning
+			message += fmt.Sprintf("\nlarger than %d bytes", *conf.MaxSize)
+		}
+		return status, message
+	}
+}
@@ -0,0 +1,45 @@
+package checks
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestNewFileFunc(t *testing.T) {
+	f, err := ioutil.TempFile("", "mackerel-agent-checkfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("0123456789")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	old := time.Now().Add(-1 * time.Hour)
+	os.Chtimes(f.Name(), old, old)
+
+	int32p := func(i int32) *int32 { return &i }
+	int64p := func(i int64) *int64 { return &i }
+
+	testCases := []struct {
+		conf   config.PluginConfig
+		status Status
+	}{
+		{config.PluginConfig{Path: f.Name()}, StatusOK},
+		{config.PluginConfig{Path: f.Name() + ".missing"}, StatusCritical},
+		{config.PluginConfig{Path: f.Name(), MaxAge: int32p(7200)}, StatusOK},
+		{config.PluginConfig{Path: f.Name(), MaxAge: int32p(60)}, StatusWarning},
+		{config.PluginConfig{Path: f.Name(), MaxSize: int64p(10)}, StatusOK},
+		{config.PluginConfig{Path: f.Name(), MaxSize: int64p(9)}, StatusWarning},
+	}
+
+	for _, tc := range testCases {
+		status, message := NewFileFunc(tc.conf)()
+		if status != tc.status {
+			t.Errorf("status should be %s with %+v but %s: %s", tc.status, tc.conf, status, message)
+		}
+	}
+}
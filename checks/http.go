@@ -0,0 +1,156 @@
+package checks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/version"
+)
+
+const (
+	defaultHTTPTimeout = 10 * time.Second
+	// httpCheckMaxBody is the maximum size of the response body checked by the assertions
+	httpCheckMaxBody = 1 << 20
+)
+
+// httpCheck checks the response of the HTTP endpoint
+type httpCheck struct {
+	url         string
+	method      string
+	headers     map[string]string
+	statusCodes []int // 2xx and 3xx if empty
+	expect      string
+	pattern     *regexp.Regexp
+	warning     time.Duration // not checked if 0
+	critical    time.Duration // not checked if 0
+	client      *http.Client
+}
+
+// NewHTTPFunc returns a Checker.Func which requests conf.URL by conf.Method (GET by default) with conf.Headers.
+// It reports CRITICAL when the request fails in conf.Timeout (10 seconds by default), the status code is not one
+// of conf.StatusCodes (2xx or 3xx by default, the redirects are not followed), or the response body does not
+// contain conf.Expect or match conf.Pattern. The latency over conf.WarningLatency (or conf.CriticalLatency)
+// in milliseconds is reported as WARNING (or CRITICAL).
+func NewHTTPFunc(conf config.PluginConfig) (func() (Status, string), error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url should be http or https: %q", conf.URL)
+	}
+	c := &httpCheck{
+		url:         conf.URL,
+		method:      strings.ToUpper(conf.Method),
+		headers:     conf.Headers,
+		statusCodes: conf.StatusCodes,
+		expect:      conf.Expect,
+		warning:     httpLatency(conf.WarningLatency),
+		critical:    httpLatency(conf.CriticalLatency),
+	}
+	if c.method == "" {
+		c.method = "GET"
+	}
+	if conf.Pattern != "" {
+		if c.pattern, err = regexp.Compile(conf.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %s", err)
+		}
+	}
+	timeout := defaultHTTPTimeout
+	if conf.Timeout != nil && *conf.Timeout > 0 {
+		timeout = time.Duration(*conf.Timeout) * time.Second
+	}
+	transport := &http.Transport{}
+	if conf.CAFile != "" {
+		b, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA file: %s", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates are found in the CA file %q", conf.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	c.client = &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return c.check, nil
+}
+
+func httpLatency(ms *int32) time.Duration {
+	if ms == nil || *ms <= 0 {
+		return 0
+	}
+	return time.Duration(*ms) * time.Millisecond
+}
+
+func (c *httpCheck) check() (Status, string) {
+	req, err := http.NewRequest(c.method, c.url, nil)
+	if err != nil {
+		return StatusUnknown, err.Error()
+	}
+	req.Header.Set("User-Agent", version.UserAgent())
+	for key, value := range c.headers {
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return StatusCritical, fmt.Sprintf("%s %s: %s", c.method, c.url, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpCheckMaxBody))
+	latency := time.Since(start)
+	if err != nil {
+		return StatusCritical, fmt.Sprintf("%s %s: failed to read the response: %s", c.method, c.url, err)
+	}
+
+	summary := fmt.Sprintf("%s %s: %s (%.3f seconds)", c.method, c.url, resp.Status, latency.Seconds())
+	if !c.expectedStatus(resp.StatusCode) {
+		return StatusCritical, summary + ": unexpected status code"
+	}
+	if c.expect != "" && !strings.Contains(string(body), c.expect) {
+		return StatusCritical, fmt.Sprintf("%s: the response does not contain %q", summary, c.expect)
+	}
+	if c.pattern != nil && !c.pattern.Match(body) {
+		return StatusCritical, fmt.Sprintf("%s: the response does not match %q", summary, c.pattern)
+	}
+	switch {
+	case c.critical > 0 && latency >= c.critical:
+		return StatusCritical, fmt.Sprintf("%s: slower than %s", summary, c.critical)
+	case c.warning > 0 && latency >= c.warning:
+		return StatusWarning, fmt.Sprintf("%s: slower than %s", summary, c.warning)
+	}
+	return StatusOK, summary
+}
+
+func (c *httpCheck) expectedStatus(code int) bool {
+	if len(c.statusCodes) == 0 {
+		return 200 <= code && code < 400
+	}
+	for _, expected := range c.statusCodes {
+		if code == expected {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package checks
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestNewHTTPFunc(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"status":"ok"}`)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(w, "ok")
+		case "/moved":
+			http.Redirect(w, r, "/health", http.StatusMovedPermanently)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	int32p := func(i int32) *int32 { return &i }
+	headers := map[string]string{"Authorization": "Bearer token"}
+	testCases := []struct {
+		name    string
+		conf    config.PluginConfig
+		status  Status
+		message string
+	}{
+		{"ok", config.PluginConfig{URL: ts.URL + "/health", Headers: headers, Expect: `"status":"ok"`}, StatusOK, "200 OK"},
+		{"pattern", config.PluginConfig{URL: ts.URL + "/health", Headers: headers, Pattern: `"status":"(ok|degraded)"`}, StatusOK, "200 OK"},
+		{"unauthorized", config.PluginConfig{URL: ts.URL + "/health"}, StatusCritical, "unexpected status code"},
+		{"not found", config.PluginConfig{URL: ts.URL + "/nonexistent"}, StatusCritical, "404 Not Found"},
+		{"expected status", config.PluginConfig{URL: ts.URL + "/nonexistent", StatusCodes: []int{404}}, StatusOK, "404 Not Found"},
+		{"redirect", config.PluginConfig{URL: ts.URL + "/moved"}, StatusOK, "301 Moved Permanently"},
+		{"unexpected body", config.PluginConfig{URL: ts.URL + "/health", Headers: headers, Expect: "healthy"}, StatusCritical, `does not contain "healthy"`},
+		{"slow", config.PluginConfig{URL: ts.URL + "/slow", WarningLatency: int32p(100)}, StatusWarning, "slower than 100ms"},
+		{"too slow", config.PluginConfig{URL: ts.URL + "/slow", WarningLatency: int32p(50), CriticalLatency: int32p(100)}, StatusCritical, "slower than 100ms"},
+		{"refused", config.PluginConfig{URL: "http://127.0.0.1:1/"}, StatusCritical, "GET http://127.0.0.1:1/: "},
+	}
+	for _, tc := range testCases {
+		check, err := NewHTTPFunc(tc.conf)
+		if err != nil {
+			t.Fatalf("%s: should not raise error: %v", tc.name, err)
+		}
+		status, message := check()
+		if status != tc.status || !strings.Contains(message, tc.message) {
+			t.Errorf("%s: unexpected report: %s %q", tc.name, status, message)
+		}
+	}
+}
+
+func TestNewHTTPFunc_invalid(t *testing.T) {
+	confs := []config.PluginConfig{
+		{},
+		{URL: "ftp://example.com/"},
+		{URL: "http://example.com/", Pattern: "("},
+		{URL: "https://example.com/", CAFile: "/nonexistent/ca.pem"},
+	}
+	for _, conf := range confs {
+		if _, err := NewHTTPFunc(conf); err == nil {
+			t.Errorf("should raise error: %+v", conf)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package checks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// logCheckMaxMessages is the maximum number of the matched lines in the message of the report
+const logCheckMaxMessages = 5
+
+// logCheck checks the lines appended to the log file since the previous check
+type logCheck struct {
+	path      string
+	warning   *regexp.Regexp
+	critical  *regexp.Regexp
+	exclude   *regexp.Regexp
+	stateFile string
+
+	mu    sync.Mutex
+	state *logCheckState
+}
+
+// logCheckState is the position of the log file checked, which is saved in the state file
+type logCheckState struct {
+	FileID string `json:"fileId"` // the identity of the file to detect the rotation ("" if not supported)
+	Offset int64  `json:"offset"`
+}
+
+// NewLogFunc returns a Checker.Func which checks the lines appended to the log file conf.Path since the previous check.
+// It reports CRITICAL when any line matches conf.CriticalPattern, and WARNING when any line matches conf.Pattern,
+// skipping the lines matching conf.Exclude. The position in the file is kept in stateFile not to check the lines
+// again after the restart of the agent. The rotated (replaced) or truncated file is checked from the beginning,
+// while the file is checked from its end at first.
+func NewLogFunc(conf config.PluginConfig, stateFile string) (func() (Status, string), error) {
+	l := &logCheck{path: conf.Path, stateFile: stateFile}
+	var err error
+	if l.warning, err = compileLogPattern(conf.Pattern); err != nil {
+		return nil, fmt.Errorf("invalid pattern: %s", err)
+	}
+	if l.critical, err = compileLogPattern(conf.CriticalPattern); err != nil {
+		return nil, fmt.Errorf("invalid critical_pattern: %s", err)
+	}
+	if l.exclude, err = compileLogPattern(conf.Exclude); err != nil {
+		return nil, fmt.Errorf("invalid exclude: %s", err)
+	}
+	if l.warning == nil && l.critical == nil {
+		return nil, fmt.Errorf("pattern or critical_pattern is required")
+	}
+	return l.check, nil
+}
+
+func compileLogPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+func (l *logCheck) check() (Status, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return StatusUnknown, fmt.Sprintf("%s does not exist", l.path)
+		}
+		return StatusUnknown, err.Error()
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return StatusUnknown, err.Error()
+	}
+	fileID := logFileID(fi)
+
+	if l.state == nil {
+		l.state = l.loadState()
+	}
+	switch {
+	case l.state == nil:
+		// check the lines appended after the first check
+		l.state = &logCheckState{FileID: fileID, Offset: fi.Size()}
+	case l.state.FileID != fileID:
+		logger.Infof("The log file %s has been rotated. It is checked from the beginning.", l.path)
+		l.state = &logCheckState{FileID: fileID}
+	case l.state.Offset > fi.Size():
+		logger.Infof("The log file %s has been truncated. It is checked from the beginning.", l.path)
+		l.state.Offset = 0
+	}
+
+	warnings, criticals, offset, err := l.scan(f, l.state.Offset)
+	l.state.Offset = offset
+	if err := l.saveState(); err != nil {
+		logger.Warningf("Failed to save the state of the log check of %s: %s", l.path, err)
+	}
+	if err != nil {
+		return StatusUnknown, fmt.Sprintf("failed to read %s: %s", l.path, err)
+	}
+
+	switch {
+	case len(criticals) > 0:
+		return StatusCritical, logCheckMessage(l.path, criticals, warnings)
+	case len(warnings) > 0:
+		return StatusWarning, logCheckMessage(l.path, warnings, nil)
+	}
+	return StatusOK, fmt.Sprintf("%s: no matches", l.path)
+}
+
+// scan reads the complete lines from offset, and returns the lines matching the patterns and the offset after them
+func (l *logCheck) scan(f *os.File, offset int64) (warnings, criticals []string, next int64, err error) {
+	next = offset
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	r := bufio.NewReader(f)
+	for {
+		var line string
+		line, err = r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				// the incomplete line is checked after it is completed
+				err = nil
+			}
+			return
+		}
+		next += int64(len(line))
+		line = strings.TrimRight(line, "\r\n")
+		if l.exclude != nil && l.exclude.MatchString(line) {
+			continue
+		}
+		if l.critical != nil && l.critical.MatchString(line) {
+			criticals = append(criticals, line)
+		} else if l.warning != nil && l.warning.MatchString(line) {
+			warnings = append(warnings, line)
+		}
+	}
+}
+
+// logCheckMessage lists the matched lines up to logCheckMaxMessages
+func logCheckMessage(path string, matched, others []string) string {
+	message := fmt.Sprintf("%s: %d matches", path, len(matched))
+	if len(others) > 0 {
+		message += fmt.Sprintf(" (and %d warnings)", len(others))
+	}
+	for i, m := range matched {
+		if i >= logCheckMaxMessages {
+			message += fmt.Sprintf("\n... and %d more", len(matched)-logCheckMaxMessages)
+			break
+		}
+		message += "\n" + m
+	}
+	return message
+}
+
+// loadState loads the state saved by the previous run of the agent, or returns nil if not found
+func (l *logCheck) loadState() *logCheckState {
+	content, err := ioutil.ReadFile(l.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read the state of the log check of %s: %s", l.path, err)
+		}
+		return nil
+	}
+	var state logCheckState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil
+	}
+	return &state
+}
+
+func (l *logCheck) saveState() error {
+	content, err := json.Marshal(l.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.stateFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.stateFile, content, 0644)
+}
@@ -0,0 +1,88 @@
+package checks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestNewLogFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-checklog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	stateFile := filepath.Join(dir, "state", "app.json")
+	appendLog := func(s string) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(s)
+		f.Close()
+	}
+	conf := config.PluginConfig{Path: path, Pattern: "ERROR", CriticalPattern: "FATAL", Exclude: "ignored"}
+
+	check, err := NewLogFunc(conf, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := check(); status != StatusUnknown {
+		t.Errorf("the missing file should be UNKNOWN but %s", status)
+	}
+
+	appendLog("ERROR before the first check\n")
+	if status, message := check(); status != StatusOK {
+		t.Errorf("the lines before the first check should not be checked: %s %s", status, message)
+	}
+
+	appendLog("INFO ok\nERROR something\nERROR ignored\nERROR incomple")
+	if status, message := check(); status != StatusWarning || message != path+": 1 matches\nERROR something" {
+		t.Errorf("unexpected report: %s %q", status, message)
+	}
+	appendLog("te\nFATAL crashed\n")
+	if status, message := check(); status != StatusCritical || message != path+": 1 matches (and 1 warnings)\nFATAL crashed" {
+		t.Errorf("unexpected report: %s %q", status, message)
+	}
+	if status, _ := check(); status != StatusOK {
+		t.Errorf("the lines should not be checked again but %s", status)
+	}
+
+	// the position is kept over the restart
+	appendLog("ERROR after the restart\n")
+	check, _ = NewLogFunc(conf, stateFile)
+	if status, message := check(); status != StatusWarning || message != path+": 1 matches\nERROR after the restart" {
+		t.Errorf("unexpected report after the restart: %s %q", status, message)
+	}
+
+	// rotated
+	os.Rename(path, path+".1")
+	appendLog("ERROR in the new file\n")
+	if status, message := check(); status != StatusWarning || message != path+": 1 matches\nERROR in the new file" {
+		t.Errorf("unexpected report after the rotation: %s %q", status, message)
+	}
+
+	// truncated
+	ioutil.WriteFile(path, []byte("FATAL\n"), 0644)
+	if status, _ := check(); status != StatusCritical {
+		t.Errorf("the truncated file should be checked from the beginning but %s", status)
+	}
+}
+
+func TestNewLogFunc_invalid(t *testing.T) {
+	confs := []config.PluginConfig{
+		{Path: "/var/log/app.log"},
+		{Path: "/var/log/app.log", Pattern: "("},
+		{Path: "/var/log/app.log", Pattern: "ERROR", Exclude: "["},
+	}
+	for _, conf := range confs {
+		if _, err := NewLogFunc(conf, ""); err == nil {
+			t.Errorf("should raise error: %+v", conf)
+		}
+	}
+}
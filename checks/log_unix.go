@@ -0,0 +1,18 @@
+// +build linux darwin freebsd netbsd
+
+package checks
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// logFileID returns the device and the inode number of the file, which are changed by the rotation
+func logFileID(fi os.FileInfo) string {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
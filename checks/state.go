@@ -0,0 +1,38 @@
+package checks
+
+// State tracks the soft and hard states of a check like Nagios.
+// A failure (a status other than OK) is soft until it continues for MaxCheckAttempts consecutive
+// checks, and then it becomes hard. The changes from a hard failure (including the recovery to OK)
+// are hard immediately.
+type State struct {
+	MaxCheckAttempts int
+
+	attempts int    // consecutive failures while the state is soft
+	hard     Status // the last hard status
+}
+
+// NewState returns the state of the checker, which has no soft states unless max_check_attempts is configured.
+func NewState(c Checker) *State {
+	s := &State{MaxCheckAttempts: 1}
+	if c.Config.MaxCheckAttempts != nil && *c.Config.MaxCheckAttempts > 1 {
+		s.MaxCheckAttempts = int(*c.Config.MaxCheckAttempts)
+	}
+	return s
+}
+
+// Update records the status checked, and reports whether it is hard along with the number of the attempts.
+func (s *State) Update(status Status) (hard bool, attempts int) {
+	if status == StatusOK || (s.hard != StatusOK && s.hard != StatusUndefined) {
+		s.hard = status
+		s.attempts = 0
+		return true, 0
+	}
+	s.attempts++
+	if s.attempts >= s.MaxCheckAttempts {
+		s.hard = status
+		attempts = s.attempts
+		s.attempts = 0
+		return true, attempts
+	}
+	return false, s.attempts
+}
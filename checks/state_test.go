@@ -0,0 +1,40 @@
+package checks
+
+import (
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestState(t *testing.T) {
+	maxCheckAttempts := int32(3)
+	s := NewState(Checker{Config: config.PluginConfig{MaxCheckAttempts: &maxCheckAttempts}})
+
+	testCases := []struct {
+		status   Status
+		hard     bool
+		attempts int
+	}{
+		{StatusOK, true, 0},
+		{StatusCritical, false, 1},
+		{StatusWarning, false, 2},
+		{StatusOK, true, 0}, // recovered while soft
+		{StatusCritical, false, 1},
+		{StatusCritical, false, 2},
+		{StatusCritical, true, 3},
+		{StatusWarning, true, 0}, // the changes from a hard failure are hard
+		{StatusOK, true, 0},
+		{StatusUnknown, false, 1},
+	}
+	for i, tc := range testCases {
+		hard, attempts := s.Update(tc.status)
+		if hard != tc.hard || attempts != tc.attempts {
+			t.Errorf("%d: %s should be hard=%t attempts=%d but hard=%t attempts=%d", i, tc.status, tc.hard, tc.attempts, hard, attempts)
+		}
+	}
+
+	s = NewState(Checker{})
+	if hard, _ := s.Update(StatusCritical); !hard {
+		t.Errorf("the failures should be hard without max_check_attempts")
+	}
+}
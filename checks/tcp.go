@@ -0,0 +1,143 @@
+package checks
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+const (
+	defaultTCPTimeout = 10 * time.Second
+	// tcpCheckMaxRead is the maximum size of the response read to find the expected string
+	tcpCheckMaxRead = 4096
+)
+
+// tcpCheck checks the TCP ports accepting the connections (and responding as expected)
+type tcpCheck struct {
+	targets    []string
+	send       string
+	expect     string
+	tls        bool
+	serverName string
+	timeout    time.Duration
+}
+
+// NewTCPFunc returns a Checker.Func which connects to each of conf.Targets ("host:port") in parallel.
+// It reports CRITICAL when any of them is not connected in conf.Timeout (10 seconds by default), or does not
+// respond with conf.Expect after conf.Send is sent. The connections are made by TLS with conf.TLS
+// (verified by conf.ServerName, the host of each target by default).
+func NewTCPFunc(conf config.PluginConfig) (func() (Status, string), error) {
+	if len(conf.Targets) == 0 {
+		return nil, fmt.Errorf("targets are required")
+	}
+	for _, target := range conf.Targets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("invalid target: %s", err)
+		}
+	}
+	c := &tcpCheck{
+		targets:    conf.Targets,
+		send:       conf.Send,
+		expect:     conf.Expect,
+		tls:        conf.TLS,
+		serverName: conf.ServerName,
+		timeout:    defaultTCPTimeout,
+	}
+	if conf.Timeout != nil && *conf.Timeout > 0 {
+		c.timeout = time.Duration(*conf.Timeout) * time.Second
+	}
+	return c.check, nil
+}
+
+func (c *tcpCheck) check() (Status, string) {
+	errs := make([]error, len(c.targets))
+	elapsed := make([]time.Duration, len(c.targets))
+	var wg sync.WaitGroup
+	for i, target := range c.targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = c.probe(target)
+			elapsed[i] = time.Since(start)
+		}(i, target)
+	}
+	wg.Wait()
+
+	status := StatusOK
+	var messages []string
+	for i, target := range c.targets {
+		if errs[i] != nil {
+			status = StatusCritical
+			messages = append(messages, fmt.Sprintf("%s: %s", target, errs[i]))
+		} else {
+			messages = append(messages, fmt.Sprintf("%s: OK (%.3f seconds)", target, elapsed[i].Seconds()))
+		}
+	}
+	return status, strings.Join(messages, "\n")
+}
+
+// probe connects to the target, and sends and expects the strings if configured
+func (c *tcpCheck) probe(target string) error {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.tls {
+		serverName := c.serverName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(target)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", target, &tls.Config{ServerName: serverName})
+	} else {
+		conn, err = dialer.Dial("tcp", target)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if c.send == "" && c.expect == "" {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if c.send != "" {
+		if _, err := io.WriteString(conn, c.send); err != nil {
+			return fmt.Errorf("failed to send: %s", err)
+		}
+	}
+	if c.expect == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	b := make([]byte, 512)
+	for buf.Len() < tcpCheckMaxRead {
+		n, err := conn.Read(b)
+		buf.Write(b[:n])
+		if strings.Contains(buf.String(), c.expect) {
+			return nil
+		}
+		if err != nil {
+			if err != io.EOF && buf.Len() == 0 {
+				return fmt.Errorf("failed to receive %q: %s", c.expect, err)
+			}
+			break
+		}
+	}
+	return fmt.Errorf("unexpected response (%q is expected): %q", c.expect, truncateResponse(buf.String()))
+}
+
+// truncateResponse shortens the response shown in the message of the report
+func truncateResponse(s string) string {
+	const max = 64
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
@@ -0,0 +1,87 @@
+package checks
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// listenTCP serves the connections by responding "+PONG" to "PING" lines
+func listenTCP(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.TrimSpace(line) == "PING" {
+						conn.Write([]byte("+PONG\r\n"))
+					} else {
+						conn.Write([]byte("-ERR\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestNewTCPFunc(t *testing.T) {
+	ln := listenTCP(t)
+	defer ln.Close()
+	address := ln.Addr().String()
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddress := closed.Addr().String()
+	closed.Close()
+
+	int32p := func(i int32) *int32 { return &i }
+	testCases := []struct {
+		name    string
+		conf    config.PluginConfig
+		status  Status
+		message string
+	}{
+		{"connected", config.PluginConfig{Targets: []string{address}}, StatusOK, address + ": OK"},
+		{"expected", config.PluginConfig{Targets: []string{address}, Send: "PING\r\n", Expect: "+PONG"}, StatusOK, address + ": OK"},
+		{"unexpected", config.PluginConfig{Targets: []string{address}, Send: "PONG\r\n", Expect: "+PONG", Timeout: int32p(1)}, StatusCritical, "-ERR"},
+		{"refused", config.PluginConfig{Targets: []string{address, closedAddress}}, StatusCritical, closedAddress + ": "},
+	}
+	for _, tc := range testCases {
+		check, err := NewTCPFunc(tc.conf)
+		if err != nil {
+			t.Fatalf("%s: should not raise error: %v", tc.name, err)
+		}
+		status, message := check()
+		if status != tc.status || !strings.Contains(message, tc.message) {
+			t.Errorf("%s: unexpected report: %s %q", tc.name, status, message)
+		}
+	}
+}
+
+func TestNewTCPFunc_invalid(t *testing.T) {
+	confs := []config.PluginConfig{
+		{},
+		{Targets: []string{"localhost"}},
+	}
+	for _, conf := range confs {
+		if _, err := NewTCPFunc(conf); err == nil {
+			t.Errorf("should raise error: %+v", conf)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package checks
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+const (
+	defaultTrafficFactor         = 3.0
+	defaultTrafficBaselineWindow = 60 * time.Minute
+	// minTrafficBaselineSamples is the number of the samples required before detecting the anomalies
+	minTrafficBaselineSamples = 3
+	// minTrafficBaseline is the baseline (bytes/sec) under which the interfaces are regarded as idle and not checked
+	minTrafficBaseline = 1024.0
+)
+
+// trafficSample is the throughput of an interface (received and transmitted bytes/sec) at the time
+type trafficSample struct {
+	time time.Time
+	rate float64
+}
+
+// trafficCheck learns the rolling baseline of the throughput of the network interfaces
+type trafficCheck struct {
+	include, exclude *regexp.Regexp
+	factor           float64
+	window           time.Duration
+
+	counters func() (map[string]float64, error) // the received and transmitted bytes by the interfaces
+	now      func() time.Time
+
+	mu       sync.Mutex
+	last     map[string]float64
+	lastTime time.Time
+	samples  map[string][]trafficSample
+}
+
+// NewTrafficFunc returns a Checker.Func which learns the baseline of the throughput of each network interface
+// (the average in the last conf.BaselineWindow minutes, 60 by default) and reports WARNING when the throughput
+// exceeds the baseline multiplied by conf.Factor (3 by default) or falls below the baseline divided by it,
+// e.g. a sudden drop to zero on an uplink. The interfaces are selected by conf.Include and conf.Exclude
+// (regular expressions of the names), and the idle ones whose baseline is less than 1KB/sec are not checked.
+func NewTrafficFunc(conf config.PluginConfig) (func() (Status, string), error) {
+	c := &trafficCheck{
+		factor:   defaultTrafficFactor,
+		window:   defaultTrafficBaselineWindow,
+		counters: interfaceTrafficCounters,
+		now:      time.Now,
+		samples:  make(map[string][]trafficSample),
+	}
+	var err error
+	if conf.Include != "" {
+		if c.include, err = regexp.Compile(conf.Include); err != nil {
+			return nil, fmt.Errorf("invalid include: %s", err)
+		}
+	}
+	if conf.Exclude != "" {
+		if c.exclude, err = regexp.Compile(conf.Exclude); err != nil {
+			return nil, fmt.Errorf("invalid exclude: %s", err)
+		}
+	}
+	if conf.Factor != nil {
+		if *conf.Factor <= 1 {
+			return nil, fmt.Errorf("factor should be greater than 1 but %g", *conf.Factor)
+		}
+		c.factor = *conf.Factor
+	}
+	if conf.BaselineWindow != nil && *conf.BaselineWindow > 0 {
+		c.window = time.Duration(*conf.BaselineWindow) * time.Minute
+	}
+	return c.check, nil
+}
+
+func (c *trafficCheck) selected(name string) bool {
+	if c.include != nil && !c.include.MatchString(name) {
+		return false
+	}
+	return c.exclude == nil || !c.exclude.MatchString(name)
+}
+
+func (c *trafficCheck) check() (Status, string) {
+	counters, err := c.counters()
+	if err != nil {
+		return StatusUnknown, fmt.Sprintf("failed to collect the traffic of the interfaces: %s", err)
+	}
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, elapsed := c.last, now.Sub(c.lastTime).Seconds()
+	c.last, c.lastTime = counters, now
+	if last == nil || elapsed <= 0 {
+		return StatusOK, "learning the baseline of the traffic"
+	}
+
+	var names []string
+	for name := range counters {
+		if c.selected(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var anomalies []string
+	for _, name := range names {
+		prev, ok := last[name]
+		if !ok || counters[name] < prev { // the counters are reset
+			continue
+		}
+		rate := (counters[name] - prev) / elapsed
+
+		samples := c.expire(c.samples[name], now)
+		if baseline, ok := trafficBaseline(samples); ok {
+			switch {
+			case rate > baseline*c.factor:
+				anomalies = append(anomalies, fmt.Sprintf("%s: %s/sec is over %g times the baseline %s/sec", name, formatBytes(rate), c.factor, formatBytes(baseline)))
+			case rate < baseline/c.factor:
+				anomalies = append(anomalies, fmt.Sprintf("%s: %s/sec is under 1/%g of the baseline %s/sec", name, formatBytes(rate), c.factor, formatBytes(baseline)))
+			}
+		}
+		c.samples[name] = append(samples, trafficSample{time: now, rate: rate})
+	}
+	for name := range c.samples {
+		if _, ok := counters[name]; !ok {
+			delete(c.samples, name)
+		}
+	}
+
+	if len(anomalies) == 0 {
+		return StatusOK, fmt.Sprintf("the traffic of %d interfaces is within the baseline", len(names))
+	}
+	return StatusWarning, strings.Join(anomalies, "\n")
+}
+
+// expire drops the samples older than the window
+func (c *trafficCheck) expire(samples []trafficSample, now time.Time) []trafficSample {
+	for len(samples) > 0 && now.Sub(samples[0].time) > c.window {
+		samples = samples[1:]
+	}
+	return samples
+}
+
+// trafficBaseline returns the average of the samples if enough samples are learned and the interface is not idle
+func trafficBaseline(samples []trafficSample) (float64, bool) {
+	if len(samples) < minTrafficBaselineSamples {
+		return 0, false
+	}
+	var sum float64
+	for _, s := range samples {
+		sum += s.rate
+	}
+	baseline := sum / float64(len(samples))
+	return baseline, baseline >= minTrafficBaseline
+}
+
+func formatBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0fB", b)
+	}
+	div, exp := float64(unit), 0
+	for n := b / unit; n >= unit && exp < 3; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", b/div, "KMGT"[exp])
+}
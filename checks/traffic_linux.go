@@ -0,0 +1,46 @@
+// +build linux
+
+package checks
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// interfaceTrafficCounters returns the received and transmitted bytes of the network interfaces
+// except the loopback from /proc/net/dev
+func interfaceTrafficCounters() (map[string]float64, error) {
+	out, err := ioutil.ReadFile(util.HostPath("/proc/net/dev"))
+	if err != nil {
+		return nil, err
+	}
+	return parseNetdevBytes(out), nil
+}
+
+func parseNetdevBytes(out []byte) map[string]float64 {
+	counters := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(kv[0])
+		cols := strings.Fields(kv[1])
+		if name == "lo" || len(cols) < 9 {
+			continue
+		}
+		rx, err1 := strconv.ParseFloat(cols[0], 64)
+		tx, err2 := strconv.ParseFloat(cols[8], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		counters[name] = rx + tx
+	}
+	return counters
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package checks
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// interfaceTrafficCounters is not supported except on Linux
+func interfaceTrafficCounters() (map[string]float64, error) {
+	return nil, fmt.Errorf("the traffic of the interfaces is not supported on %s", runtime.GOOS)
+}
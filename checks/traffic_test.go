@@ -0,0 +1,81 @@
+package checks
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestNewTrafficFunc(t *testing.T) {
+	_, err := NewTrafficFunc(config.PluginConfig{Include: "^eth", Exclude: "^docker"})
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	factor := 0.5
+	for _, conf := range []config.PluginConfig{{Include: "("}, {Exclude: "("}, {Factor: &factor}} {
+		if _, err := NewTrafficFunc(conf); err == nil {
+			t.Errorf("should raise error: %+v", conf)
+		}
+	}
+}
+
+func TestTrafficCheck(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	counters := map[string]float64{"eth0": 0, "eth1": 0, "docker0": 0}
+	// the bytes/sec of the interfaces in each minute
+	rates := []map[string]float64{
+		{"eth0": 10000, "eth1": 100, "docker0": 10000},
+		{"eth0": 12000, "eth1": 100, "docker0": 10000},
+		{"eth0": 8000, "eth1": 100, "docker0": 10000},
+		{"eth0": 11000, "eth1": 100, "docker0": 10000},
+		{"eth0": 0, "eth1": 0, "docker0": 0},
+		{"eth0": 50000, "eth1": 100, "docker0": 10000},
+	}
+	c := &trafficCheck{
+		factor:   3,
+		window:   time.Hour,
+		counters: func() (map[string]float64, error) { return copyCounters(counters), nil },
+		now:      func() time.Time { return now },
+		include:  regexp.MustCompile("^eth"),
+		samples:  make(map[string][]trafficSample),
+	}
+
+	if status, _ := c.check(); status != StatusOK {
+		t.Errorf("the first check should be OK while learning: %s", status)
+	}
+	expected := []struct {
+		status  Status
+		message string
+	}{
+		{StatusOK, "within the baseline"},
+		{StatusOK, "within the baseline"},
+		{StatusOK, "within the baseline"},
+		{StatusOK, "within the baseline"},
+		{StatusWarning, "eth0: 0B/sec is under 1/3 of the baseline"},
+		{StatusWarning, "eth0: 48.8KB/sec is over 3 times the baseline"},
+	}
+	for i, r := range rates {
+		now = now.Add(time.Minute)
+		for name, rate := range r {
+			counters[name] += rate * 60
+		}
+		status, message := c.check()
+		if status != expected[i].status || !strings.Contains(message, expected[i].message) {
+			t.Errorf("%d: unexpected report: %s %q", i, status, message)
+		}
+		if strings.Contains(message, "eth1") || strings.Contains(message, "docker0") {
+			t.Errorf("%d: the idle and the excluded interfaces should not be checked: %q", i, message)
+		}
+	}
+}
+
+func copyCounters(counters map[string]float64) map[string]float64 {
+	copied := make(map[string]float64, len(counters))
+	for k, v := range counters {
+		copied[k] = v
+	}
+	return copied
+}
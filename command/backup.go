@@ -0,0 +1,218 @@
+package command
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+const (
+	backupDirName        = "backup"
+	backupFileNameFormat = "mackerel-agent-backup-20060102-150405.tar.gz"
+	backupFilePattern    = "mackerel-agent-backup-*.tar.gz"
+)
+
+// the state files under Root to be backed up other than the host ID
+var backupStateFiles = []string{
+	checkHistoryFileName,
+	graphDefsCacheFileName,
+	kernelLogCursorFileName,
+}
+
+func backupDir(conf *config.Config) string {
+	if conf.Backup.Dir != "" {
+		return conf.Backup.Dir
+	}
+	return filepath.Join(conf.Root, backupDirName)
+}
+
+// backupLoop makes the backup at the start and every IntervalHours of [backup]
+func backupLoop(ctx context.Context, conf *config.Config) {
+	interval := time.Duration(conf.Backup.IntervalHours) * time.Hour
+	for {
+		if file, err := makeBackup(conf, time.Now()); err != nil {
+			logger.Warningf("Failed to make the backup: %s", err)
+		} else {
+			logger.Debugf("Made the backup: %s", file)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// backupFiles returns the config files and the state files existing
+func backupFiles(conf *config.Config) []string {
+	var files []string
+	if len(conf.MergedFiles) > 0 {
+		files = append(files, conf.MergedFiles...)
+	} else {
+		if conf.Conffile != "" {
+			files = append(files, conf.Conffile)
+		}
+		if conf.Include != "" {
+			included, _ := filepath.Glob(conf.Include)
+			files = append(files, included...)
+		}
+	}
+	files = append(files, config.FileSystemHostIDStorage{Root: conf.Root}.HostIDFile())
+	for _, name := range backupStateFiles {
+		files = append(files, filepath.Join(conf.Root, name))
+	}
+	existing := files[:0]
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil && fi.Mode().IsRegular() {
+			existing = append(existing, file)
+		}
+	}
+	return existing
+}
+
+// makeBackup writes the tarball of the files to be backed up in the backup directory, removing the old ones
+// beyond the generations, and returns its path. The files are stored by their absolute paths without the
+// volume names, so that they are restored to the same paths.
+func makeBackup(conf *config.Config, now time.Time) (string, error) {
+	dir := backupDir(conf)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, now.Format(backupFileNameFormat))
+	tmp := file + ".tmp"
+	if err := writeBackup(tmp, backupFiles(conf)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return "", err
+	}
+
+	backups, err := filepath.Glob(filepath.Join(dir, backupFilePattern))
+	if err != nil {
+		return file, err
+	}
+	// the names are sorted by the times
+	sort.Strings(backups)
+	for i := 0; i < len(backups)-conf.Backup.Generations; i++ {
+		if err := os.Remove(backups[i]); err != nil {
+			logger.Warningf("Failed to remove the old backup: %s", err)
+		}
+	}
+	return file, nil
+}
+
+func writeBackup(file string, files []string) error {
+	// the backup contains the apikey
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+	for _, f := range files {
+		if err := addBackupFile(tw, f); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func addBackupFile(tw *tar.Writer, file string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = backupEntryName(abs)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// backupEntryName returns the name of the entry of the absolute path in the tarball
+func backupEntryName(abs string) string {
+	return strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(abs, filepath.VolumeName(abs))), "/")
+}
+
+// RestoreBackup extracts the files in the backup tarball under dest ("/" to restore them to the original paths),
+// and writes the paths restored to w. It should be run while the agent is stopped.
+func RestoreBackup(tarball, dest string, w io.Writer) error {
+	in, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	gr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("%s is not a backup: %s", tarball, err)
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid entry in the backup: %s", hdr.Name)
+		}
+		file := filepath.Join(dest, name)
+		if err := restoreBackupFile(file, tr, os.FileMode(hdr.Mode).Perm()); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, file)
+	}
+}
+
+func restoreBackupFile(file string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,64 @@
+package command
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestBackup(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-backup")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	conffile := filepath.Join(root, "mackerel-agent.conf")
+	ioutil.WriteFile(conffile, []byte("apikey = \"abcde\"\ninclude = \""+filepath.Join(root, "conf.d", "*.conf")+"\"\n"), 0600)
+	os.MkdirAll(filepath.Join(root, "conf.d"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "conf.d", "roles.conf"), []byte("roles = [\"service:app\"]\n"), 0644)
+	conf := &config.Config{
+		Root:     root,
+		Conffile: conffile,
+		Include:  filepath.Join(root, "conf.d", "*.conf"),
+		Backup:   config.Backup{Enabled: true, Generations: 2},
+	}
+	conf.SaveHostID("xyzabc12345")
+
+	now := time.Now()
+	var file string
+	for i := 0; i < 3; i++ {
+		if file, err = makeBackup(conf, now.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+	}
+	backups, _ := filepath.Glob(filepath.Join(root, "backup", backupFilePattern))
+	if len(backups) != 2 || backups[1] != file {
+		t.Errorf("the last 2 backups should be kept: %v", backups)
+	}
+
+	dest := filepath.Join(root, "restored")
+	var buf bytes.Buffer
+	if err := RestoreBackup(file, dest, &buf); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if restored := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(restored) != 3 {
+		t.Errorf("the config files and the host ID should be restored: %v", restored)
+	}
+	for _, f := range []string{conffile, filepath.Join(root, "conf.d", "roles.conf"), filepath.Join(root, "id")} {
+		original, _ := ioutil.ReadFile(f)
+		content, err := ioutil.ReadFile(filepath.Join(dest, backupEntryName(f)))
+		if err != nil || !bytes.Equal(content, original) {
+			t.Errorf("%s should be restored: %v", f, err)
+		}
+	}
+	if err := RestoreBackup(conffile, dest, &buf); err == nil {
+		t.Errorf("should raise error for the file other than the backup")
+	}
+}
@@ -0,0 +1,126 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// metricBudget tracks the unique metric names posted per host against config.MetricBudget.
+type metricBudget struct {
+	max     int
+	warning int
+	enforce bool
+
+	mu       sync.Mutex
+	names    map[string]map[string]bool // host ID -> metric names
+	points   int                        // posted since the last Generate
+	rejected map[string]bool            // metric names not posted because of the enforcement
+}
+
+func newMetricBudget(conf config.MetricBudget) *metricBudget {
+	return &metricBudget{
+		max:      conf.MaxMetrics,
+		warning:  conf.MaxMetrics * conf.WarningPercentage / 100,
+		enforce:  conf.Enforce,
+		names:    make(map[string]map[string]bool),
+		rejected: make(map[string]bool),
+	}
+}
+
+// prepareMetricBudget creates the metric budget if configured, and registers its metrics generator
+// and checker to the agent.
+func prepareMetricBudget(conf *config.Config, ag *agent.Agent) *metricBudget {
+	if conf.MetricBudget.MaxMetrics <= 0 {
+		return nil
+	}
+	b := newMetricBudget(conf.MetricBudget)
+	ag.MetricsGenerators = append(ag.MetricsGenerators, b)
+	ag.Checkers = append(ag.Checkers, checks.Checker{
+		Name: config.MetricBudgetCheckName,
+		Config: config.PluginConfig{
+			NotificationInterval: conf.MetricBudget.NotificationInterval,
+			CheckInterval:        conf.MetricBudget.CheckInterval,
+		},
+		Func: b.check,
+	})
+	return b
+}
+
+// admit records the metric posted for the host, and reports whether it should be posted.
+// The budget is nil-safe, admitting every metric.
+func (b *metricBudget) admit(hostID, name string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names, ok := b.names[hostID]
+	if !ok {
+		names = make(map[string]bool)
+		b.names[hostID] = names
+	}
+	if !names[name] {
+		if b.enforce && len(names) >= b.max {
+			if !b.rejected[name] {
+				logger.Warningf("The metric budget (%d) is exhausted. %q is not posted.", b.max, name)
+				b.rejected[name] = true
+			}
+			return false
+		}
+		names[name] = true
+	}
+	b.points++
+	return true
+}
+
+// usage returns the largest number of the unique metric names among the hosts
+func (b *metricBudget) usage() int {
+	n := 0
+	for _, names := range b.names {
+		if len(names) > n {
+			n = len(names)
+		}
+	}
+	return n
+}
+
+// Generate generates the usage of the budget
+func (b *metricBudget) Generate() (metrics.Values, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	points := b.points
+	b.points = 0
+	return metrics.Values{
+		"custom.agent.metric_budget.names":  float64(b.usage()),
+		"custom.agent.metric_budget.max":    float64(b.max),
+		"custom.agent.metric_budget.points": float64(points),
+	}, nil
+}
+
+func (b *metricBudget) check() (checks.Status, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.usage()
+	if len(b.rejected) > 0 {
+		var rejected []string
+		for name := range b.rejected {
+			rejected = append(rejected, name)
+		}
+		sort.Strings(rejected)
+		return checks.StatusCritical, fmt.Sprintf("metric budget is exhausted: %d/%d metrics. not posted: %s", n, b.max, strings.Join(rejected, ", "))
+	}
+	if n > b.max {
+		return checks.StatusCritical, fmt.Sprintf("metric budget is exceeded: %d/%d metrics", n, b.max)
+	}
+	if n >= b.warning {
+		return checks.StatusWarning, fmt.Sprintf("metric budget is approaching the limit: %d/%d metrics", n, b.max)
+	}
+	return checks.StatusOK, fmt.Sprintf("%d/%d metrics", n, b.max)
+}
@@ -0,0 +1,83 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestMetricBudget(t *testing.T) {
+	b := newMetricBudget(config.MetricBudget{MaxMetrics: 5, WarningPercentage: 80})
+
+	for _, name := range []string{"loadavg5", "memory.used", "memory.used", "cpu.user.percentage"} {
+		if !b.admit("xyzabc12345", name) {
+			t.Errorf("%q should be admitted", name)
+		}
+	}
+	if status, msg := b.check(); status != checks.StatusOK {
+		t.Errorf("status should be OK but %s: %s", status, msg)
+	}
+
+	b.admit("xyzabc12345", "custom.foo")
+	if status, msg := b.check(); status != checks.StatusWarning {
+		t.Errorf("status should be WARNING at 80%% of the budget but %s: %s", status, msg)
+	}
+
+	b.admit("xyzabc12345", "custom.bar")
+	if !b.admit("xyzabc12345", "custom.baz") {
+		t.Errorf("metrics should be admitted beyond the budget without enforcement")
+	}
+	if status, msg := b.check(); status != checks.StatusCritical {
+		t.Errorf("status should be CRITICAL beyond the budget but %s: %s", status, msg)
+	}
+
+	values, _ := b.Generate()
+	if values["custom.agent.metric_budget.names"] != 6 || values["custom.agent.metric_budget.points"] != 7 || values["custom.agent.metric_budget.max"] != 5 {
+		t.Errorf("unexpected values: %v", values)
+	}
+	values, _ = b.Generate()
+	if values["custom.agent.metric_budget.points"] != 0 {
+		t.Errorf("points should be reset: %v", values)
+	}
+}
+
+func TestMetricBudget_enforce(t *testing.T) {
+	b := newMetricBudget(config.MetricBudget{MaxMetrics: 2, WarningPercentage: 80, Enforce: true})
+
+	b.admit("xyzabc12345", "loadavg5")
+	b.admit("xyzabc12345", "memory.used")
+	if b.admit("xyzabc12345", "custom.foo") {
+		t.Errorf("a new metric should not be admitted beyond the budget with enforcement")
+	}
+	if !b.admit("xyzabc12345", "loadavg5") {
+		t.Errorf("a known metric should be admitted")
+	}
+	if !b.admit("customhost1", "custom.foo") {
+		t.Errorf("the budget should be tracked per host")
+	}
+	if status, msg := b.check(); status != checks.StatusCritical || msg != "metric budget is exhausted: 2/2 metrics. not posted: custom.foo" {
+		t.Errorf("status should be CRITICAL with the metrics not posted but %s: %s", status, msg)
+	}
+}
+
+func TestPrepareMetricBudget(t *testing.T) {
+	conf := &config.Config{}
+	b := prepareMetricBudget(conf, &agent.Agent{})
+	if b != nil {
+		t.Errorf("budget should not be created without max_metrics")
+	}
+	if !b.admit("xyzabc12345", "loadavg5") {
+		t.Errorf("nil budget should admit every metric")
+	}
+
+	conf.MetricBudget = config.MetricBudget{MaxMetrics: 100, WarningPercentage: 80}
+	ag := &agent.Agent{}
+	if b := prepareMetricBudget(conf, ag); b == nil {
+		t.Errorf("budget should be created with max_metrics")
+	}
+	if len(ag.MetricsGenerators) != 1 || len(ag.Checkers) != 1 || ag.Checkers[0].Name != config.MetricBudgetCheckName {
+		t.Errorf("the generator and the checker of the budget should be registered: %+v", ag)
+	}
+}
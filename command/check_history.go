@@ -0,0 +1,142 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+const checkHistoryFileName = "check_history.json"
+
+// checkTransition is a transition of the status of a check
+type checkTransition struct {
+	From       checks.Status `json:"from"`
+	To         checks.Status `json:"to"`
+	Message    string        `json:"message"`
+	OccurredAt time.Time     `json:"occurredAt"`
+}
+
+// checkHistory keeps the last transitions of the statuses of the checks in a file,
+// so that they survive the restarts of the agent.
+type checkHistory struct {
+	path string
+	size int
+
+	mu          sync.Mutex
+	transitions map[string][]checkTransition // check name -> transitions, the oldest first
+}
+
+func newCheckHistory(conf *config.Config) *checkHistory {
+	if !conf.CheckHistory.Enabled {
+		return nil
+	}
+	h := &checkHistory{
+		path:        filepath.Join(conf.Root, checkHistoryFileName),
+		size:        conf.CheckHistory.Size,
+		transitions: make(map[string][]checkTransition),
+	}
+	if err := h.load(); err != nil {
+		logger.Warningf("Failed to load the check history (it is started over): %s", err)
+	}
+	return h
+}
+
+func (h *checkHistory) load() error {
+	content, err := ioutil.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, &h.transitions)
+}
+
+func (h *checkHistory) save() error {
+	content, err := json.Marshal(h.transitions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return err
+	}
+	tmp := h.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// record records the report if its status differs from the last one of the check, including the one
+// recorded before the restart. The history is nil-safe, recording nothing.
+func (h *checkHistory) record(report *checks.Report) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	transitions := h.transitions[report.Name]
+	from := checks.StatusUndefined
+	if len(transitions) > 0 {
+		from = transitions[len(transitions)-1].To
+	}
+	if report.Status == from {
+		return
+	}
+	transitions = append(transitions, checkTransition{
+		From:       from,
+		To:         report.Status,
+		Message:    report.Message,
+		OccurredAt: report.OccurredAt,
+	})
+	if len(transitions) > h.size {
+		transitions = transitions[len(transitions)-h.size:]
+	}
+	h.transitions[report.Name] = transitions
+	if err := h.save(); err != nil {
+		logger.Warningf("Failed to save the check history: %s", err)
+	}
+}
+
+// get returns the transitions of the check, the oldest first
+func (h *checkHistory) get(name string) []checkTransition {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]checkTransition(nil), h.transitions[name]...)
+}
+
+// DumpCheckHistory writes the history of the transitions of the check named name in JSON,
+// or of all the checks keyed by the names if name is empty. The history is read from the file
+// saved by the running agent.
+func DumpCheckHistory(conf *config.Config, name string, w io.Writer) error {
+	if !conf.CheckHistory.Enabled {
+		return fmt.Errorf("check_history is not enabled")
+	}
+	h := &checkHistory{
+		path:        filepath.Join(conf.Root, checkHistoryFileName),
+		transitions: make(map[string][]checkTransition),
+	}
+	if err := h.load(); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	if name == "" {
+		return enc.Encode(h.transitions)
+	}
+	transitions, ok := h.transitions[name]
+	if !ok {
+		return fmt.Errorf("no history of the check %q", name)
+	}
+	return enc.Encode(transitions)
+}
@@ -0,0 +1,63 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestCheckHistory(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-check-history")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+	conf := &config.Config{Root: root, CheckHistory: config.CheckHistory{Enabled: true, Size: 3}}
+
+	h := newCheckHistory(conf)
+	now := time.Unix(1500000000, 0)
+	for i, status := range []checks.Status{checks.StatusOK, checks.StatusOK, checks.StatusCritical, checks.StatusOK, checks.StatusWarning} {
+		h.record(&checks.Report{Name: "foo", Status: status, Message: string(status), OccurredAt: now.Add(time.Duration(i) * time.Minute)})
+	}
+	transitions := h.get("foo")
+	if len(transitions) != 3 {
+		t.Fatalf("the last 3 transitions should be kept: %v", transitions)
+	}
+	if transitions[0].From != checks.StatusOK || transitions[0].To != checks.StatusCritical || !transitions[0].OccurredAt.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("unexpected transition: %v", transitions[0])
+	}
+	if transitions[2].To != checks.StatusWarning || transitions[2].Message != "WARNING" {
+		t.Errorf("unexpected transition: %v", transitions[2])
+	}
+
+	// the history survives the restart
+	h = newCheckHistory(conf)
+	h.record(&checks.Report{Name: "foo", Status: checks.StatusWarning, OccurredAt: now.Add(10 * time.Minute)})
+	if len(h.get("foo")) != 3 {
+		t.Errorf("the same status should not be recorded after the restart: %v", h.get("foo"))
+	}
+
+	var buf bytes.Buffer
+	if err := DumpCheckHistory(conf, "foo", &buf); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	var dumped []checkTransition
+	if err := json.Unmarshal(buf.Bytes(), &dumped); err != nil || len(dumped) != 3 {
+		t.Errorf("the transitions should be dumped in JSON: %s", buf.String())
+	}
+	if err := DumpCheckHistory(conf, "bar", &buf); err == nil {
+		t.Errorf("should raise error for the unknown check")
+	}
+
+	var nilHistory *checkHistory
+	nilHistory.record(&checks.Report{Name: "foo", Status: checks.StatusOK})
+	if nilHistory.get("foo") != nil {
+		t.Errorf("the nil history should be empty")
+	}
+}
@@ -0,0 +1,162 @@
+package command
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// latestValues holds the metric values of the host collected last, which are referred by
+// the message templates of the checks.
+type latestValues struct {
+	mu     sync.RWMutex
+	values metrics.Values
+}
+
+// namedValue is an element of the result of the "metrics" function in the message templates
+type namedValue struct {
+	Name  string
+	Value float64
+}
+
+// update replaces the values with the ones of the host in result.
+// The values of the hosts of custom identifiers are ignored.
+func (l *latestValues) update(result *agent.MetricsResult) {
+	if l == nil {
+		return
+	}
+	values := metrics.Values{}
+	for _, v := range result.Values {
+		if v.CustomIdentifier == nil {
+			values.Merge(v.Values)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.values = values
+}
+
+func (l *latestValues) get(name string) (float64, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	value, ok := l.values[name]
+	return value, ok
+}
+
+// match returns the values whose names match the pattern of path.Match, sorted by the names
+func (l *latestValues) match(pattern string) []namedValue {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var matched []namedValue
+	for name, value := range l.values {
+		if ok, _ := path.Match(pattern, name); ok {
+			matched = append(matched, namedValue{Name: name, Value: value})
+		}
+	}
+	sort.Sort(namedValues(matched))
+	return matched
+}
+
+type namedValues []namedValue
+
+func (vs namedValues) Len() int           { return len(vs) }
+func (vs namedValues) Less(i, j int) bool { return vs[i].Name < vs[j].Name }
+func (vs namedValues) Swap(i, j int)      { vs[i], vs[j] = vs[j], vs[i] }
+
+// renderCheckMessage renders the message template of the check with the report and the latest values.
+// The template can refer to .Name, .Status and .Message of the report, and the functions:
+//
+//	metric "<name>"     the latest value of the metric (an error if not collected)
+//	metrics "<glob>"    the latest values (.Name and .Value) of the metrics matching the pattern
+//
+// The original message is returned if the template fails.
+func renderCheckMessage(text string, report *checks.Report, latest *latestValues) string {
+	funcs := template.FuncMap{
+		"metric": func(name string) (float64, error) {
+			value, ok := latest.get(name)
+			if !ok {
+				return 0, fmt.Errorf("metric %s is not collected", name)
+			}
+			return value, nil
+		},
+		"metrics": latest.match,
+	}
+	tmpl, err := template.New(report.Name).Funcs(funcs).Parse(text)
+	if err != nil {
+		logger.Warningf("Invalid message_template of the check %q: %s", report.Name, err)
+		return report.Message
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, report); err != nil {
+		logger.Warningf("Failed to render the message of the check %q: %s", report.Name, err)
+		return report.Message
+	}
+	return buf.String()
+}
+
+// defaultFullMessageInterval is the interval of reporting the full messages of the checks with CompactMessage
+const defaultFullMessageInterval = 60 * time.Minute
+
+// compactMessageMaxLength is the maximum length of the first line in the compact messages
+const compactMessageMaxLength = 200
+
+// messageCompactor keeps the full message of a check reported last, to report the compact form of the messages
+// while the status does not change (see config.PluginConfig.CompactMessage)
+type messageCompactor struct {
+	interval time.Duration
+	status   checks.Status
+	sentAt   time.Time
+}
+
+// newMessageCompactor returns the messageCompactor of the checker, or nil if CompactMessage is not configured
+func newMessageCompactor(checker checks.Checker) *messageCompactor {
+	if !checker.Config.CompactMessage {
+		return nil
+	}
+	interval := defaultFullMessageInterval
+	if i := checker.Config.FullMessageInterval; i != nil && *i > 0 {
+		interval = time.Duration(*i) * time.Minute
+	}
+	return &messageCompactor{interval: interval}
+}
+
+// compact returns the message of the report to be sent at now, which is the full one when the status has changed
+// or the full one has not been sent in the interval, and the first line with the digest of the message otherwise.
+func (m *messageCompactor) compact(report *checks.Report, now time.Time) string {
+	if m == nil {
+		return report.Message
+	}
+	if report.Status != m.status || now.Sub(m.sentAt) >= m.interval {
+		m.status = report.Status
+		m.sentAt = now
+		return report.Message
+	}
+	line := report.Message
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	if len(line) > compactMessageMaxLength {
+		line = line[:compactMessageMaxLength] + "..."
+	}
+	if line == report.Message {
+		return report.Message
+	}
+	digest := sha1.Sum([]byte(report.Message))
+	return fmt.Sprintf("%s (digest: %x, the full message was reported at %s)", line, digest[:8], m.sentAt.Format(time.RFC3339))
+}
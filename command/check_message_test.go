@@ -0,0 +1,78 @@
+package command
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+func TestRenderCheckMessage(t *testing.T) {
+	customIdentifier := "app.example.com"
+	latest := &latestValues{}
+	latest.update(&agent.MetricsResult{
+		Created: time.Now(),
+		Values: []metrics.ValuesCustomIdentifier{
+			{Values: metrics.Values{"filesystem.sda1.used": 100, "filesystem.sdb1.used": 200, "loadavg5": 1.5}},
+			{Values: metrics.Values{"filesystem.sdc1.used": 300}, CustomIdentifier: &customIdentifier},
+		},
+	})
+	report := &checks.Report{Name: "disk", Status: checks.StatusWarning, Message: "DISK WARNING"}
+
+	testCases := []struct {
+		template string
+		expected string
+	}{
+		{`{{.Status}}: {{.Message}} (load: {{metric "loadavg5"}})`, "WARNING: DISK WARNING (load: 1.5)"},
+		{`{{.Message}}{{range metrics "filesystem.*.used"}} {{.Name}}={{.Value}}{{end}}`, "DISK WARNING filesystem.sda1.used=100 filesystem.sdb1.used=200"},
+		{`{{.Message}} {{metric "memory.used"}}`, "DISK WARNING"}, // not collected
+		{`{{.Message`, "DISK WARNING"}, // invalid
+	}
+	for _, tc := range testCases {
+		if message := renderCheckMessage(tc.template, report, latest); message != tc.expected {
+			t.Errorf("message should be %q but %q", tc.expected, message)
+		}
+	}
+
+	if message := renderCheckMessage(`{{.Message}} {{metric "loadavg5"}}`, report, nil); message != "DISK WARNING" {
+		t.Errorf("the original message should be reported before the metrics are collected: %q", message)
+	}
+}
+
+func TestMessageCompactor(t *testing.T) {
+	fullMessageInterval := int32(10)
+	compactor := newMessageCompactor(checks.Checker{Config: config.PluginConfig{CompactMessage: true, FullMessageInterval: &fullMessageInterval}})
+	now := time.Now()
+	full := "RAID WARNING: 1 degraded\n" + strings.Repeat("disk status\n", 100)
+	compact := func(status checks.Status, message string, elapsed time.Duration) string {
+		return compactor.compact(&checks.Report{Status: status, Message: message}, now.Add(elapsed))
+	}
+
+	if message := compact(checks.StatusWarning, full, 0); message != full {
+		t.Errorf("the full message should be reported at first: %q", message)
+	}
+	message := compact(checks.StatusWarning, full, time.Minute)
+	if !strings.HasPrefix(message, "RAID WARNING: 1 degraded (digest: ") || len(message) > 200 {
+		t.Errorf("the compact message should be reported while the status does not change: %q", message)
+	}
+	if message := compact(checks.StatusWarning, "RAID WARNING: 1 degraded", 2*time.Minute); message != "RAID WARNING: 1 degraded" {
+		t.Errorf("the message of a line should be reported as it is: %q", message)
+	}
+	if message := compact(checks.StatusCritical, full, 3*time.Minute); message != full {
+		t.Errorf("the full message should be reported when the status changes: %q", message)
+	}
+	if message := compact(checks.StatusCritical, full, 12*time.Minute); message == full {
+		t.Errorf("the compact message should be reported in the interval: %q", message)
+	}
+	if message := compact(checks.StatusCritical, full, 13*time.Minute); message != full {
+		t.Errorf("the full message should be reported every interval: %q", message)
+	}
+
+	if compactor := newMessageCompactor(checks.Checker{}); compactor.compact(&checks.Report{Message: full}, now) != full {
+		t.Error("the message should not be compacted without compact_message")
+	}
+}
@@ -0,0 +1,34 @@
+package command
+
+import (
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// prepareCollectionHook sets the commands of config.CollectionHook to the agent.
+func prepareCollectionHook(conf config.CollectionHook, ag *agent.Agent) {
+	if conf.Pre != "" {
+		ag.BeforeCollect = collectionHookFunc("pre", conf.Pre, conf)
+	}
+	if conf.Post != "" {
+		ag.AfterCollect = collectionHookFunc("post", conf.Post, conf)
+	}
+}
+
+func collectionHookFunc(name, command string, conf config.CollectionHook) func() {
+	timeout := time.Duration(conf.Timeout) * time.Second
+	return func() {
+		logger.Debugf("Running the %s collection hook %q", name, command)
+		_, stderr, exitCode, err := util.RunCommandWithEnv(command, conf.User, config.CommandEnv(command), timeout)
+		if err != nil {
+			logger.Warningf("The %s collection hook %q failed: %s", name, command, err)
+			return
+		}
+		if exitCode != 0 {
+			logger.Warningf("The %s collection hook %q exited with %d: %q", name, command, exitCode, stderr)
+		}
+	}
+}
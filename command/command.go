@@ -1,14 +1,26 @@
 package command
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Songmu/retry"
 	"github.com/mackerelio/mackerel-agent/agent"
 	"github.com/mackerelio/mackerel-agent/checks"
 	"github.com/mackerelio/mackerel-agent/config"
@@ -22,44 +34,76 @@ import (
 var logger = logging.GetLogger("command")
 var metricsInterval = 60 * time.Second
 
+const graphDefsCacheFileName = "graphdefs.json"
+
+// ErrForceTerminated is returned by Run when the agent is instructed to terminate again while terminating.
+var ErrForceTerminated = errors.New("received terminate instruction again. force return")
+
 var retryNum uint = 20
 var retryInterval = 3 * time.Second
 
 // prepareHost collects specs of the host and sends them to Mackerel server.
 // A unique host-id is returned by the server if one is not specified.
-func prepareHost(conf *config.Config, api *mackerel.API) (*mackerel.Host, error) {
+// The retries are interrupted when ctx is done, e.g. the agent is stopped while the API is down.
+func prepareHost(ctx context.Context, conf *config.Config, api *mackerel.API) (*mackerel.Host, error) {
 	// XXX this configuration should be moved to under spec/linux
 	os.Setenv("PATH", "/sbin:/usr/sbin:/bin:/usr/bin:"+os.Getenv("PATH"))
 	os.Setenv("LANG", "C") // prevent changing outputs of some command, e.g. ifconfig.
 
-	doRetry := func(f func() error) {
-		retry.Retry(retryNum, retryInterval, f)
-	}
-
 	filterErrorForRetry := func(err error) error {
 		if err != nil {
 			logger.Warningf("%s", err.Error())
 		}
-		if apiErr, ok := err.(*mackerel.Error); ok && apiErr.IsClientError() {
-			// don't retry when client error (APIKey error etc.) occurred
+		if errors.Is(err, mackerel.ErrUnsupported) {
+			return nil
+		}
+		var apiErr *mackerel.Error
+		if errors.As(err, &apiErr) && apiErr.IsClientError() {
+			// don't retry when client error (mackerel.ErrInvalidAPIKey, mackerel.ErrHostNotFound etc.) occurred
 			return nil
 		}
 		return err
 	}
 
-	hostname, meta, interfaces, customIdentifier, lastErr := collectHostSpecs()
+	hostname, meta, interfaces, customIdentifier, lastErr := collectHostSpecs(conf)
 	if lastErr != nil {
 		return nil, fmt.Errorf("error while collecting host specs: %s", lastErr.Error())
 	}
 
+	doRetry := func(f func() error) {
+		if err := retryHonoringBackoff(ctx, retryNum, retryInterval, f); err != nil {
+			lastErr = err
+		}
+	}
+
 	var result *mackerel.Host
-	if hostID, err := conf.LoadHostID(); err != nil { // create
+	hostID, err := conf.LoadHostID()
+	if err != nil && conf.Registration.HostIDFile != "" {
+		// the host registered in advance (e.g. by the user-data of the autoscaling group) skips the registration
+		if hostID, err = loadProvisionedHostID(conf.Registration.HostIDFile); err != nil {
+			logger.Warningf("Failed to load the host id provisioned in %s: %s", conf.Registration.HostIDFile, err)
+		} else {
+			logger.Infof("Using the host id provisioned in %s", conf.Registration.HostIDFile)
+		}
+	}
+	if err != nil { // create
+		if delay := registrationDelay(conf.Registration, hostname, customIdentifier); delay > 0 {
+			logger.Infof("Delaying the registration of this host by %s", delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
 
 		if customIdentifier != "" {
-			retry.Retry(3, 2*time.Second, func() error {
+			err := retryHonoringBackoff(ctx, 3, 2*time.Second, func() error {
 				result, lastErr = api.FindHostByCustomIdentifier(customIdentifier)
 				return filterErrorForRetry(lastErr)
 			})
+			if err != nil {
+				return nil, err
+			}
 			if result != nil {
 				hostID = result.ID
 			}
@@ -98,7 +142,10 @@ func prepareHost(conf *config.Config, api *mackerel.API) (*mackerel.Host, error)
 			return filterErrorForRetry(lastErr)
 		})
 		if lastErr != nil {
-			if fsStorage, ok := conf.HostIDStorage.(*config.FileSystemHostIDStorage); ok {
+			if errors.Is(lastErr, mackerel.ErrInvalidAPIKey) {
+				return nil, fmt.Errorf("Failed to find this host on mackerel (Check the apikey in the config file): %s", lastErr.Error())
+			}
+			if fsStorage, ok := conf.HostIDStorage.(*config.FileSystemHostIDStorage); ok && errors.Is(lastErr, mackerel.ErrHostNotFound) {
 				return nil, fmt.Errorf("Failed to find this host on mackerel (You may want to delete file \"%s\" to register this host to an another organization): %s", fsStorage.HostIDFile(), lastErr.Error())
 			}
 			return nil, fmt.Errorf("Failed to find this host on mackerel: %s", lastErr.Error())
@@ -124,6 +171,84 @@ func prepareHost(conf *config.Config, api *mackerel.API) (*mackerel.Host, error)
 	return result, nil
 }
 
+// verifyOrg confirms that the API key is accepted by the apibase, and logs the name of its organization.
+// It fails fast when the key is rejected (e.g. by the apibase of another region) instead of retrying
+// the registration, while the other errors are left to the retries of the following requests.
+func verifyOrg(conf *config.Config, api *mackerel.API) error {
+	org, err := api.GetOrg()
+	if err != nil {
+		if errors.Is(err, mackerel.ErrUnsupported) {
+			logger.Debugf("Skip confirming the organization of the API key: %s", err)
+			return nil
+		}
+		if errors.Is(err, mackerel.ErrInvalidAPIKey) {
+			return fmt.Errorf("The API key is rejected by %s. Check apikey and apibase (the API endpoint of the region of the organization): %s", conf.Apibase, err)
+		}
+		logger.Warningf("Failed to confirm the organization of the API key: %s", err)
+		return nil
+	}
+	logger.Infof("Posting to the organization %q at %s", org.Name, conf.Apibase)
+	return nil
+}
+
+// retryHonoringBackoff calls f up to n times until it succeeds like retry.Retry, waiting for interval between the calls,
+// or for the delay requested by Retry-After of the API (e.g. rate-limited) if longer, up to rateLimitBackoffCapSeconds.
+// It returns the error of the last call if all of them fail, or ctx.Err() when ctx is done and it stops retrying,
+// e.g. the agent is requested to stop.
+func retryHonoringBackoff(ctx context.Context, n uint, interval time.Duration, f func() error) error {
+	for i := uint(0); i < n; i++ {
+		err := f()
+		if err == nil || i == n-1 {
+			return err
+		}
+		wait := interval
+		var apiErr *mackerel.Error
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > wait {
+			wait = apiErr.RetryAfter
+			if wait > rateLimitBackoffCapSeconds*time.Second {
+				wait = rateLimitBackoffCapSeconds * time.Second
+			}
+			logger.Infof("Retrying after %s requested by the API", wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			logger.Infof("Stopped retrying: %s", ctx.Err())
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// registrationDelay returns the delay of the registration of the host up to MaxJitter, which is derived from
+// the identity of the instance (the custom identifier, or the hostname) to spread the registrations of the
+// instances booting at once.
+func registrationDelay(conf config.Registration, hostname, customIdentifier string) time.Duration {
+	if conf.MaxJitter <= 0 {
+		return 0
+	}
+	identity := customIdentifier
+	if identity == "" {
+		identity = hostname
+	}
+	s := sha1.Sum([]byte(identity))
+	n := uint32(s[0])<<24 | uint32(s[1])<<16 | uint32(s[2])<<8 | uint32(s[3])
+	return time.Duration(n%uint32(conf.MaxJitter*1000)) * time.Millisecond
+}
+
+// loadProvisionedHostID reads the host id written in the file in advance
+func loadProvisionedHostID(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	hostID := strings.TrimSpace(string(content))
+	if hostID == "" {
+		return "", fmt.Errorf("the file is empty")
+	}
+	return hostID, nil
+}
+
 // prepareCustomIdentiferHosts collects the host information based on the
 // configuration of the custom_identifier fields.
 func prepareCustomIdentiferHosts(conf *config.Config, api *mackerel.API) map[string]*mackerel.Host {
@@ -139,6 +264,14 @@ func prepareCustomIdentiferHosts(conf *config.Config, api *mackerel.API) map[str
 	for customIdentifier := range customIdentifiers {
 		host, err := api.FindHostByCustomIdentifier(customIdentifier)
 		if err != nil {
+			if errors.Is(err, mackerel.ErrUnsupported) {
+				logger.Warningf("custom_identifier of the plugins is ignored: %s", err)
+				break
+			}
+			if errors.Is(err, mackerel.ErrHostNotFound) {
+				logger.Warningf("No host was found for custom_identifier: %s", customIdentifier)
+				continue
+			}
 			logger.Warningf("Failed to retrieve the host of custom_identifier: %s, %s", customIdentifier, err)
 			continue
 		}
@@ -147,12 +280,14 @@ func prepareCustomIdentiferHosts(conf *config.Config, api *mackerel.API) map[str
 	return customIdentifierHosts
 }
 
-// Interval between each updating host specs.
+// specsUpdateInterval is the longest interval of updating the host specs,
+// and the default update interval of each spec (see config.HostSpec).
 var specsUpdateInterval = 1 * time.Hour
 
-func delayByHost(host *mackerel.Host) int {
+// delayByHost returns the delay of posting in the interval in seconds, which is specific to the host
+func delayByHost(host *mackerel.Host, interval time.Duration) int {
 	s := sha1.Sum([]byte(host.ID))
-	return int(s[len(s)-1]) % int(config.PostMetricsInterval.Seconds())
+	return int(s[len(s)-1]) % int(interval.Seconds())
 }
 
 // Context context object
@@ -162,15 +297,74 @@ type Context struct {
 	Host                  *mackerel.Host
 	API                   *mackerel.API
 	CustomIdentifierHosts map[string]*mackerel.Host
+
+	budget *metricBudget
+	guard  *metricGuard
+	expect *expectedMetrics
+	drops  *postQueueDrops
+	spool  *spool
+	tracer *tracer
+	statsd *metrics.StatsdGenerator
+	latest *latestValues
+
+	history    *checkHistory
+	checkSpool *spool            // the spool of the check reports failed to be reported
+	shared     *sharedCheckLease // elects the agent reporting the shared checks
+
+	postStats postStats     // reported by DumpDiagnostics and the control endpoint
+	flushCh   chan struct{} // requested by Flush
+	term      *termination  // of the running loop, requested by Stop (guarded by stateMu)
+	retire    int32         // 1 if the host is retired after the agent stopped (see Stop and watchTermination)
+
+	reloadMu    sync.Mutex   // serializes Reload, and guards checkRunner and statsd
+	stateMu     sync.RWMutex // guards Config, CustomIdentifierHosts and the pipeline replaced by Reload, and term
+	checkRunner *checkRunner
+
+	hooksMu          sync.RWMutex // guards the hooks registered by Runner
+	metricsHooks     []func([]*mackerel.CreatingMetricsValue)
+	checkReportHooks []func(*checks.Report)
+}
+
+// config returns the configuration, which is replaced by Reload while the agent is running
+func (c *Context) config() *config.Config {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.Config
+}
+
+// pipelineState is the state of the pipeline converting the collected metrics into the values to be posted,
+// which is replaced by Reload at once
+type pipelineState struct {
+	conf                  *config.Config
+	customIdentifierHosts map[string]*mackerel.Host
+	budget                *metricBudget
+	guard                 *metricGuard
+	expect                *expectedMetrics
+	tracer                *tracer
+}
+
+// pipeline returns the current state of the pipeline
+func (c *Context) pipeline() pipelineState {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return pipelineState{
+		conf:                  c.Config,
+		customIdentifierHosts: c.CustomIdentifierHosts,
+		budget:                c.budget,
+		guard:                 c.guard,
+		expect:                c.expect,
+		tracer:                c.tracer,
+	}
 }
 
 type postValue struct {
 	values   []*mackerel.CreatingMetricsValue
 	retryCnt int
+	trace    *pipelineTrace
 }
 
 func newPostValue(values []*mackerel.CreatingMetricsValue) *postValue {
-	return &postValue{values, 0}
+	return &postValue{values: values}
 }
 
 type loopState uint8
@@ -180,49 +374,121 @@ const (
 	loopStateDefault
 	loopStateQueued
 	loopStateHadError
+	loopStateRateLimited
 	loopStateTerminating
 )
 
+func (s loopState) String() string {
+	switch s {
+	case loopStateFirst:
+		return "first"
+	case loopStateDefault:
+		return "default"
+	case loopStateQueued:
+		return "queued"
+	case loopStateHadError:
+		return "had_error"
+	case loopStateRateLimited:
+		return "rate_limited"
+	case loopStateTerminating:
+		return "terminating"
+	}
+	return "unknown"
+}
+
+// loop runs the agent until it terminates. ctx is canceled when loop returns to stop
+// the goroutines started by loop, and the termination requested through termCh is
+// tracked by termination.
 func loop(c *Context, termCh chan struct{}) error {
-	quit := make(chan struct{})
-	defer close(quit) // broadcast terminating
+	// the settings used here are not changed by Reload
+	conf := c.config()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // broadcast terminating
+
+	term := newTermination()
+	go term.watch(ctx, termCh)
+	c.stateMu.Lock()
+	c.term = term
+	c.stateMu.Unlock()
+	defer func() {
+		c.stateMu.Lock()
+		c.term = nil
+		c.stateMu.Unlock()
+	}()
 
-	// Periodically update host specs.
-	go updateHostSpecsLoop(c, quit)
+	// Periodically update host specs, and immediately after the host is resumed.
+	resumed := make(chan struct{}, 1)
+	c.Agent.OnResume = func() {
+		select {
+		case resumed <- struct{}{}:
+		default:
+		}
+	}
+	go updateHostSpecsLoop(ctx, c, resumed)
+	go fastPathLoop(ctx, c)
+
+	if c.shared != nil {
+		c.shared.update()
+		go c.shared.run(ctx)
+	}
+
+	if conf.Backup.Enabled {
+		go backupLoop(ctx, conf)
+	}
+	sharedCacheLoop(ctx, conf)
 
-	postQueue := make(chan *postValue, c.Config.Connection.PostMetricsBufferSize)
-	go enqueueLoop(c, postQueue, quit)
+	postQueue := make(chan *postValue, conf.Connection.PostMetricsBufferSize)
+	c.postStats.setQueue(postQueue)
+	enqueued := make(chan struct{})
+	go func() {
+		defer close(enqueued)
+		enqueueLoop(ctx, c, postQueue)
+	}()
+	if c.spool != nil {
+		// keep the values not posted yet across the restart
+		defer func() {
+			cancel()
+			<-enqueued // no more values are enqueued
+			spoolQueue(c, postQueue)
+		}()
+	}
 
-	postDelaySeconds := delayByHost(c.Host)
+	if conf.Ephemeral.WatchTermination {
+		if watcher := spec.SuggestTerminationWatcher(); watcher != nil {
+			go watchTermination(ctx, c, watcher, postQueue, term)
+		} else {
+			logger.Warningf("The termination notice is not available on this host. [ephemeral] watch_termination is ignored.")
+		}
+	}
+
+	interval := conf.CollectionInterval()
+	postDelaySeconds := delayByHost(c.Host, interval)
 	initialDelay := postDelaySeconds / 2
 	logger.Debugf("wait %d seconds before initial posting.", initialDelay)
 	select {
-	case <-termCh:
+	case <-term.graceful.Done():
 		return nil
 	case <-time.After(time.Duration(initialDelay) * time.Second):
 		c.Agent.InitPluginGenerators(c.API)
 	}
 
-	termCheckerCh := make(chan struct{})
-	termMetricsCh := make(chan struct{})
-
-	// fan-out termCh
-	go func() {
-		for range termCh {
-			termCheckerCh <- struct{}{}
-			termMetricsCh <- struct{}{}
-		}
-	}()
-
-	runCheckersLoop(c, termCheckerCh, quit)
+	runCheckersLoop(ctx, c, term)
 
 	lState := loopStateFirst
+	postFailures := 0 // consecutive failures of posting
+	flushing := false // post the queued values without the delays until the queue gets empty
+	backoffRand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	retryAfter := time.Duration(0)      // requested by the API rate-limiting the posts
+	terminating := term.graceful.Done() // nil after the graceful termination has started
 	for {
+		c.postStats.setState(lState)
 		select {
-		case <-termMetricsCh:
-			if lState == loopStateTerminating {
-				return fmt.Errorf("received terminate instruction again. force return")
-			}
+		case <-c.flushCh:
+			// nothing is queued
+		case <-term.force.Done():
+			return ErrForceTerminated
+		case <-terminating:
+			terminating = nil
 			lState = loopStateTerminating
 			if len(postQueue) <= 0 {
 				return nil
@@ -235,16 +501,20 @@ func loop(c *Context, termCh chan struct{}) error {
 				nextValues := <-postQueue
 				origPostValues = append(origPostValues, nextValues)
 			}
+			for _, v := range origPostValues {
+				v.trace.stage("batched", "%d values in the batch", len(origPostValues))
+			}
 
 			delaySeconds := 0
 			switch lState {
 			case loopStateFirst: // request immediately to create graph defs of host
 				// nop
 			case loopStateQueued:
-				delaySeconds = c.Config.Connection.PostMetricsDequeueDelaySeconds
+				delaySeconds = conf.Connection.PostMetricsDequeueDelaySeconds
 			case loopStateHadError:
-				// TODO: better interval calculation. exponential backoff or so.
-				delaySeconds = c.Config.Connection.PostMetricsRetryDelaySeconds
+				delaySeconds = retryDelaySeconds(conf.Connection, postFailures, backoffRand)
+			case loopStateRateLimited:
+				delaySeconds = rateLimitedDelaySeconds(conf.Connection, retryAfter, postFailures, backoffRand)
 			case loopStateTerminating:
 				// dequeue and post every one second when terminating.
 				delaySeconds = 1
@@ -252,12 +522,15 @@ func loop(c *Context, termCh chan struct{}) error {
 				// Sending data at every 0 second from all hosts causes request flooding.
 				// To prevent flooding, this loop sleeps for some seconds
 				// which is specific to the ID of the host running agent on.
-				// The sleep second is up to 60s (to be exact up to `config.Postmetricsinterval.Seconds()`.
-				elapsedSeconds := int(time.Now().Unix() % int64(config.PostMetricsInterval.Seconds()))
+				// The sleep second is up to the interval of the collection (60s by default).
+				elapsedSeconds := int(time.Now().Unix() % int64(interval.Seconds()))
 				if postDelaySeconds > elapsedSeconds {
 					delaySeconds = postDelaySeconds - elapsedSeconds
 				}
 			}
+			if flushing {
+				delaySeconds = 0
+			}
 
 			// determine next loopState before sleeping
 			if lState != loopStateTerminating {
@@ -268,14 +541,18 @@ func loop(c *Context, termCh chan struct{}) error {
 				}
 			}
 
+			c.postStats.setState(lState)
 			logger.Debugf("Sleep %d seconds before posting.", delaySeconds)
 			select {
 			case <-time.After(time.Duration(delaySeconds) * time.Second):
 				// nop
-			case <-termMetricsCh:
-				if lState == loopStateTerminating {
-					return fmt.Errorf("received terminate instruction again. force return")
-				}
+			case <-c.flushCh:
+				logger.Infof("Flushing the queued metrics")
+				flushing = true
+			case <-term.force.Done():
+				return ErrForceTerminated
+			case <-terminating:
+				terminating = nil
 				lState = loopStateTerminating
 			}
 
@@ -283,18 +560,51 @@ func loop(c *Context, termCh chan struct{}) error {
 			for _, v := range origPostValues {
 				postValues = append(postValues, v.values...)
 			}
+			for _, v := range origPostValues {
+				v.trace.stage("posted", "%d datapoints in the request, retry: %d", len(postValues), v.retryCnt)
+			}
 			err := c.API.PostMetricsValues(postValues)
+			for _, v := range origPostValues {
+				if err != nil {
+					v.trace.stage("failed", "%s", err)
+				} else {
+					v.trace.stage("acknowledged", "")
+				}
+			}
+			c.postStats.posted(err)
+			if err != nil || len(postQueue) <= 0 {
+				flushing = false
+			}
 			if err != nil {
-				logger.Errorf("Failed to post metrics value (will retry): %s", err.Error())
+				postFailures++
+				var limited bool
+				retryAfter, limited = rateLimited(err)
+				nextState := loopStateHadError
+				if limited {
+					logger.Warningf("Posting metrics value is rate-limited by the API (will retry): %s", err.Error())
+					nextState = loopStateRateLimited
+				} else {
+					logger.Errorf("Failed to post metrics value (will retry): %s", err.Error())
+				}
 				if lState != loopStateTerminating {
-					lState = loopStateHadError
+					lState = nextState
+				}
+				if c.spool != nil {
+					spoolPostValues(c, origPostValues, err, postQueue)
+					if lState == loopStateTerminating && len(postQueue) <= 0 {
+						return nil
+					}
+					continue
 				}
 				go func() {
 					for _, v := range origPostValues {
-						v.retryCnt++
+						if !limited {
+							// the values are not invalid but rate-limited
+							v.retryCnt++
+						}
 						// It is difficult to distinguish the error is server error or data error.
 						// So, if retryCnt exceeded the configured limit, postValue is considered invalid and abandoned.
-						if v.retryCnt > c.Config.Connection.PostMetricsRetryMax {
+						if v.retryCnt > conf.Connection.PostMetricsRetryMax {
 							json, err := json.Marshal(v.values)
 							if err != nil {
 								logger.Errorf("Something wrong with post values. marshaling failed.")
@@ -309,6 +619,10 @@ func loop(c *Context, termCh chan struct{}) error {
 				continue
 			}
 			logger.Debugf("Posting metrics succeeded.")
+			postFailures = 0
+			if c.spool != nil && lState != loopStateTerminating {
+				drainSpool(c)
+			}
 
 			if lState == loopStateTerminating && len(postQueue) <= 0 {
 				return nil
@@ -317,182 +631,387 @@ func loop(c *Context, termCh chan struct{}) error {
 	}
 }
 
-func updateHostSpecsLoop(c *Context, quit chan struct{}) {
+// retryDelaySeconds returns the delay before retrying the post after the consecutive failures.
+// The delay grows exponentially from PostMetricsRetryDelaySeconds up to PostMetricsRetryDelaySecondsCap,
+// and is randomized between its half and itself so that the hosts do not retry all at once
+// when the API recovers from a long outage. The delay is constant without the jitter if the cap is 0,
+// which is only the case when the config is not loaded by config.LoadConfig (it sets the default cap).
+func retryDelaySeconds(conn config.ConnectionConfig, failures int, rnd *rand.Rand) int {
+	delay := conn.PostMetricsRetryDelaySeconds
+	if conn.PostMetricsRetryDelaySecondsCap <= 0 {
+		return delay
+	}
+	for i := 1; i < failures && delay < conn.PostMetricsRetryDelaySecondsCap; i++ {
+		delay *= 2
+	}
+	if delay > conn.PostMetricsRetryDelaySecondsCap {
+		delay = conn.PostMetricsRetryDelaySecondsCap
+	}
+	return delay/2 + rnd.Intn(delay-delay/2+1)
+}
+
+// rateLimitBackoffCapSeconds is the cap of the backoff of the posts rate-limited by the API without
+// Retry-After, which is used when PostMetricsRetryDelaySecondsCap is not set.
+const rateLimitBackoffCapSeconds = 10 * 60
+
+// rateLimited reports whether err is the rate limit of the API (429 Too Many Requests),
+// with the delay requested by its Retry-After (0 if not given).
+func rateLimited(err error) (time.Duration, bool) {
+	var apiErr *mackerel.Error
+	if errors.As(err, &apiErr) && errors.Is(apiErr, mackerel.ErrRateLimited) {
+		return apiErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// rateLimitedDelaySeconds returns the delay before retrying the post rate-limited by the API.
+// It is retryAfter requested by the API if given, or grows exponentially like retryDelaySeconds,
+// up to rateLimitBackoffCapSeconds unless PostMetricsRetryDelaySecondsCap is set.
+func rateLimitedDelaySeconds(conn config.ConnectionConfig, retryAfter time.Duration, failures int, rnd *rand.Rand) int {
+	if retryAfter > 0 {
+		return int((retryAfter + time.Second - 1) / time.Second)
+	}
+	if conn.PostMetricsRetryDelaySecondsCap <= 0 {
+		conn.PostMetricsRetryDelaySecondsCap = rateLimitBackoffCapSeconds
+	}
+	return retryDelaySeconds(conn, failures, rnd)
+}
+
+// updateHostSpecsLoop updates the host specs when any of them has changed,
+// and at least every specsUpdateInterval. All the specs including the metadata of the cloud
+// are regenerated when the host is resumed, which may have been migrated to another hardware.
+func updateHostSpecsLoop(ctx context.Context, c *Context, resumed chan struct{}) {
+	collector := newSpecCollector(c.config())
+	var (
+		lastUpdated  time.Time
+		lastHostname string
+		pending      bool
+	)
 	for {
-		c.UpdateHostSpecs()
+		now := time.Now()
+		meta, interfaces, customIdentifier, changed := collector.collect(now)
+		hostname, err := resolveHostname(c.config())
+		if err != nil {
+			logger.Errorf("While collecting host specs: failed to obtain hostname: %s", err)
+		} else {
+			pending = pending || changed || hostname != lastHostname
+			if pending || now.Sub(lastUpdated) >= specsUpdateInterval {
+				logger.Debugf("Updating host specs...")
+				if c.updateHost(hostname, meta, interfaces, customIdentifier) {
+					lastUpdated, lastHostname, pending = now, hostname, false
+				}
+			}
+		}
 		select {
-		case <-quit:
+		case <-ctx.Done():
 			return
-		case <-time.After(specsUpdateInterval):
+		case <-resumed:
+			collector.expire()
+			pending = true
+		case <-time.After(collector.tick()):
 			// nop
 		}
 	}
 }
 
-func enqueueLoop(c *Context, postQueue chan *postValue, quit chan struct{}) {
-	metricsResult := c.Agent.Watch()
+func enqueueLoop(ctx context.Context, c *Context, postQueue chan *postValue) {
+	metricsResult := c.Agent.Watch(ctx)
 	for {
 		select {
-		case <-quit:
+		case <-ctx.Done():
 			return
 		case result := <-metricsResult:
-			created := float64(result.Created.Unix())
-			creatingValues := [](*mackerel.CreatingMetricsValue){}
-			for _, values := range result.Values {
-				hostID := c.Host.ID
-				if values.CustomIdentifier != nil {
-					if host, ok := c.CustomIdentifierHosts[*values.CustomIdentifier]; ok {
-						hostID = host.ID
-					} else {
-						continue
-					}
-				}
-				for name, value := range (map[string]float64)(values.Values) {
-					if math.IsNaN(value) || math.IsInf(value, 0) {
-						logger.Warningf("Invalid value: hostID = %s, name = %s, value = %f\n is not sent.", hostID, name, value)
-						continue
-					}
+			c.latest.update(result)
+			logger.Debugf("Enqueuing task to post metrics.")
+			v := metricsPostValue(c, result)
+			c.runMetricsHooks(v.values)
+			c.pipeline().expect.observe(v.values)
+			c.drops.enqueue(postQueue, v)
+			v.trace.stage("enqueued", "queue length: %d", len(postQueue))
+		}
+	}
+}
 
-					creatingValues = append(
-						creatingValues,
-						&mackerel.CreatingMetricsValue{
-							HostID: hostID,
-							Name:   name,
-							Time:   created,
-							Value:  value,
-						},
-					)
-				}
+// metricsPostValue converts the collected metrics into the values to be posted
+func metricsPostValue(c *Context, result *agent.MetricsResult) *postValue {
+	p := c.pipeline()
+	created := float64(result.Created.Unix())
+	creatingValues := [](*mackerel.CreatingMetricsValue){}
+	for _, values := range result.Values {
+		hostID := c.Host.ID
+		if values.CustomIdentifier != nil {
+			if host, ok := p.customIdentifierHosts[*values.CustomIdentifier]; ok {
+				hostID = host.ID
+			} else {
+				continue
 			}
-			logger.Debugf("Enqueuing task to post metrics.")
-			postQueue <- newPostValue(creatingValues)
+		}
+		valuesCreated := created
+		if !values.Time.IsZero() {
+			valuesCreated = float64(values.Time.Unix())
+		}
+		for name, value := range (map[string]float64)(values.Values) {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				logger.Warningf("Invalid value: hostID = %s, name = %s, value = %f\n is not sent.", hostID, name, value)
+				continue
+			}
+			if !p.conf.MetricFilter.Allows(name) {
+				continue
+			}
+			value, ok := p.guard.filter(hostID, name, value)
+			if !ok {
+				continue
+			}
+			if !p.budget.admit(hostID, name) {
+				continue
+			}
+
+			creatingValues = append(
+				creatingValues,
+				&mackerel.CreatingMetricsValue{
+					HostID: hostID,
+					Name:   name,
+					Time:   valuesCreated,
+					Value:  value,
+				},
+			)
 		}
 	}
+	v := newPostValue(creatingValues)
+	v.trace = p.tracer.sample(result.Created, len(creatingValues))
+	return v
 }
 
 // runCheckersLoop generates "checker" goroutines
 // which run for each checker commands and one for HTTP POSTing
 // the reports to Mackerel API.
-func runCheckersLoop(c *Context, termCheckerCh <-chan struct{}, quit <-chan struct{}) {
-	var (
-		checkReportCh          chan *checks.Report
-		reportCheckImmediateCh chan struct{}
-	)
-	for _, checker := range c.Agent.Checkers {
-		if checkReportCh == nil {
-			checkReportCh = make(chan *checks.Report)
-			reportCheckImmediateCh = make(chan struct{})
-		}
+// The checkers are replaced by Reload while the reports are kept.
+// The reports are posted once more when the graceful termination starts,
+// and the goroutines stop when ctx is done.
+func runCheckersLoop(ctx context.Context, c *Context, term *termination) {
+	r := &checkRunner{
+		reportCh:    make(chan *checks.Report),
+		immediateCh: make(chan struct{}),
+		jitterRand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		ctx:         ctx,
+		latest:      c.latest,
+		history:     c.history,
+		shared:      c.shared,
+		onReport:    c.runCheckReportHooks,
+	}
+	c.reloadMu.Lock()
+	r.run(c.Agent.Checkers)
+	c.checkRunner = r
+	c.reloadMu.Unlock()
 
-		go func(checker checks.Checker) {
-			var (
-				lastStatus  = checks.StatusUndefined
-				lastMessage = ""
-			)
+	go func() {
+		exit := false
+		for !exit {
+			select {
+			case <-time.After(1 * time.Minute):
+			case <-term.graceful.Done():
+				logger.Debugf("received 'term' chan")
+				exit = true
+			case <-ctx.Done():
+				return
+			case <-r.immediateCh:
+				logger.Debugf("received 'immediate' chan")
+			}
 
-			util.Periodically(
-				func() {
-					report, err := checker.Check()
-					if err != nil {
-						logger.Errorf("checker %v: %s", checker, err)
-						return
-					}
+			reports := []*checks.Report{}
+		DrainCheckReport:
+			for {
+				select {
+				case report := <-r.reportCh:
+					reports = append(reports, report)
+				default:
+					break DrainCheckReport
+				}
+			}
 
-					logger.Debugf("checker %q: report=%v", checker.Name, report)
+			for i, report := range reports {
+				logger.Debugf("reports[%d]: %#v", i, report)
+			}
 
-					if report.Status == checks.StatusOK && report.Status == lastStatus && report.Message == lastMessage {
-						// Do not report if nothing has changed
-						return
-					}
+			if c.checkSpool != nil && !drainCheckSpool(c) {
+				// keep the order of the reports while the spooled ones are left
+				if len(reports) > 0 {
+					spoolCheckReports(c, r, reports)
+				}
+				continue
+			}
 
-					checkReportCh <- report
+			if len(reports) == 0 {
+				continue
+			}
 
-					// If status has changed, send it immediately
-					// but if the status was OK and it's first invocation of a check, do not
-					if report.Status != lastStatus && !(report.Status == checks.StatusOK && lastStatus == checks.StatusUndefined) {
-						logger.Debugf("checker %q: status has changed %v -> %v: send it immediately", checker.Name, lastStatus, report.Status)
-						reportCheckImmediateCh <- struct{}{}
-					}
+			err := c.API.ReportCheckMonitors(c.Host.ID, reports)
+			if errors.Is(err, mackerel.ErrUnsupported) {
+				logger.Debugf("Discarded %d check reports: %s", len(reports), err)
+				continue
+			}
+			if err != nil {
+				logger.Errorf("ReportCheckMonitors: %s", err)
+				if c.checkSpool != nil {
+					spoolCheckReports(c, r, reports)
+					continue
+				}
+				r.queueBack(reports)
+			}
+		}
+	}()
+}
 
-					lastStatus = report.Status
-					lastMessage = report.Message
-				},
-				checker.Interval(),
-				quit,
-			)
-		}(checker)
+// spoolCheckReports stores the reports failed to be reported into the spool.
+// The reports which cannot be spooled are queued back to the memory instead.
+func spoolCheckReports(c *Context, r *checkRunner, reports []*checks.Report) {
+	if err := c.checkSpool.pushReports(reports); err != nil {
+		logger.Errorf("Failed to spool check reports (kept in memory): %s", err)
+		r.queueBack(reports)
 	}
-	if checkReportCh != nil {
-		go func() {
-			exit := false
-			for !exit {
-				select {
-				case <-time.After(1 * time.Minute):
-				case <-termCheckerCh:
-					logger.Debugf("received 'term' chan")
-					exit = true
-				case <-reportCheckImmediateCh:
-					logger.Debugf("received 'immediate' chan")
+}
+
+// checkRunner runs the checkers, sending their reports to reportCh.
+type checkRunner struct {
+	reportCh    chan *checks.Report
+	immediateCh chan struct{}
+	jitterRand  *rand.Rand
+	ctx         context.Context // canceled to stop all the checkers
+	latest      *latestValues   // referred by the message templates
+	history     *checkHistory
+	shared      *sharedCheckLease
+	onReport    func(*checks.Report)
+
+	mu   sync.Mutex
+	stop context.CancelFunc // stops the running checkers
+}
+
+// queueBack sends the reports failed to be reported to reportCh again
+func (r *checkRunner) queueBack(reports []*checks.Report) {
+	go func() {
+		for _, report := range reports {
+			logger.Debugf("queue back report: %#v", report)
+			r.reportCh <- report
+		}
+	}()
+}
+
+// run stops the running checkers, and starts the checkers given
+func (r *checkRunner) run(checkers []checks.Checker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		r.stop()
+	}
+	ctx, stop := context.WithCancel(r.ctx)
+	r.stop = stop
+
+	for _, checker := range checkers {
+		// spread the checks aligned to the wall clock among the hosts
+		var offset time.Duration
+		if jitter := checker.Jitter(); checker.Config.AlignToClock && jitter > 0 {
+			offset = time.Duration(r.jitterRand.Int63n(int64(jitter)))
+		}
+
+		go func(checker checks.Checker, offset time.Duration) {
+			var (
+				lastStatus  = checks.StatusUndefined
+				lastMessage = ""
+				state       = checks.NewState(checker)
+				compactor   = newMessageCompactor(checker)
+			)
+
+			check := func() {
+				if disabledPlugins.isDisabled(checker.Name) {
+					logger.Debugf("checker %q: skipped because it is disabled", checker.Name)
+					return
+				}
+				if checker.Config.Shared && !r.shared.isLeader() {
+					logger.Debugf("checker %q: skipped because it is reported by another agent", checker.Name)
+					return
+				}
+				report, err := checker.CheckContext(ctx)
+				if ctx.Err() != nil {
+					logger.Debugf("checker %q: canceled by the reload or the termination", checker.Name)
+					return
+				}
+				if err == checks.ErrConditionNotSatisfied {
+					logger.Debugf("checker %q: skipped because the condition is not satisfied", checker.Name)
+					return
+				}
+				if err != nil {
+					logger.Errorf("checker %v: %s", checker, err)
+					return
 				}
 
-				reports := []*checks.Report{}
-			DrainCheckReport:
-				for {
-					select {
-					case report := <-checkReportCh:
-						reports = append(reports, report)
-					default:
-						break DrainCheckReport
-					}
+				if hard, attempts := state.Update(report.Status); !hard {
+					logger.Debugf("checker %q: soft %s (attempt %d/%d)", checker.Name, report.Status, attempts, state.MaxCheckAttempts)
+					return
 				}
+				// the attempts are counted by the agent instead of the server
+				report.MaxCheckAttempts = nil
 
-				for i, report := range reports {
-					logger.Debugf("reports[%d]: %#v", i, report)
+				if checker.Config.MessageTemplate != "" && report.Status != checks.StatusOK {
+					report.Message = renderCheckMessage(checker.Config.MessageTemplate, report, r.latest)
 				}
+				logger.Debugf("checker %q: report=%v", checker.Name, report)
+				r.history.record(report)
 
-				if len(reports) == 0 {
-					continue
+				if report.Status == checks.StatusOK && report.Status == lastStatus && report.Message == lastMessage {
+					// Do not report if nothing has changed
+					return
 				}
 
-				err := c.API.ReportCheckMonitors(c.Host.ID, reports)
-				if err != nil {
-					logger.Errorf("ReportCheckMonitors: %s", err)
+				r.onReport(report)
+				message := report.Message
+				report.Message = compactor.compact(report, time.Now())
+				r.reportCh <- report
 
-					// queue back the reports
-					go func() {
-						for _, report := range reports {
-							logger.Debugf("queue back report: %#v", report)
-							checkReportCh <- report
-						}
-					}()
+				// If status has changed, send it immediately
+				// but if the status was OK and it's first invocation of a check, do not
+				if report.Status != lastStatus && !(report.Status == checks.StatusOK && lastStatus == checks.StatusUndefined) {
+					logger.Debugf("checker %q: status has changed %v -> %v: send it immediately", checker.Name, lastStatus, report.Status)
+					r.immediateCh <- struct{}{}
 				}
+
+				lastStatus = report.Status
+				lastMessage = message
 			}
-		}()
-	} else {
-		// consume termCheckerCh
-		go func() {
-			for range termCheckerCh {
+
+			if checker.Config.AlignToClock {
+				util.PeriodicallyAlignedToClock(ctx, check, checker.Interval(), offset)
+			} else {
+				util.Periodically(ctx, check, checker.Interval())
 			}
-		}()
+		}(checker, offset)
 	}
 }
 
+// resolveHostname returns the name of the host, which is the name of the node if the agent runs in a container
+// (see config.Container)
+func resolveHostname(conf *config.Config) (string, error) {
+	if conf.Container.NodeName != "" {
+		return conf.Container.NodeName, nil
+	}
+	return os.Hostname()
+}
+
 // collectHostSpecs collects host specs (correspond to "name", "meta", "interfaces" and "customIdentifier" fields in API v0)
-func collectHostSpecs() (string, map[string]interface{}, []spec.NetInterface, string, error) {
-	hostname, err := os.Hostname()
+func collectHostSpecs(conf *config.Config) (string, map[string]interface{}, []spec.NetInterface, string, error) {
+	hostname, err := resolveHostname(conf)
 	if err != nil {
 		return "", nil, nil, "", fmt.Errorf("failed to obtain hostname: %s", err.Error())
 	}
 
-	specGens := specGenerators()
+	specGens := specGenerators(conf)
 	cGen := spec.SuggestCloudGenerator()
 	if cGen != nil {
 		specGens = append(specGens, cGen)
 	}
 	meta := spec.Collect(specGens)
 
-	var customIdentifier string
-	if cGen != nil {
+	customIdentifier := conf.Container.CustomIdentifier()
+	if cGen != nil && customIdentifier == "" {
 		customIdentifier, err = cGen.SuggestCustomIdentifier()
 		if err != nil {
 			logger.Warningf("Error while suggesting custom identifier. err: %s", err.Error())
@@ -510,49 +1029,132 @@ func collectHostSpecs() (string, map[string]interface{}, []spec.NetInterface, st
 func (c *Context) UpdateHostSpecs() {
 	logger.Debugf("Updating host specs...")
 
-	hostname, meta, interfaces, customIdentifier, err := collectHostSpecs()
+	hostname, meta, interfaces, customIdentifier, err := collectHostSpecs(c.config())
 	if err != nil {
 		logger.Errorf("While collecting host specs: %s", err)
 		return
 	}
 
-	err = c.API.UpdateHost(c.Host.ID, mackerel.HostSpec{
+	c.updateHost(hostname, meta, interfaces, customIdentifier)
+}
+
+// updateHost sends the host specs, and reports whether it succeeded
+func (c *Context) updateHost(hostname string, meta map[string]interface{}, interfaces []spec.NetInterface, customIdentifier string) bool {
+	conf := c.config()
+	err := c.API.UpdateHost(c.Host.ID, mackerel.HostSpec{
 		Name:             hostname,
 		Meta:             meta,
 		Interfaces:       interfaces,
-		RoleFullnames:    c.Config.Roles,
-		Checks:           c.Config.CheckNames(),
-		DisplayName:      c.Config.DisplayName,
+		RoleFullnames:    conf.Roles,
+		Checks:           conf.CheckNames(),
+		DisplayName:      conf.DisplayName,
 		CustomIdentifier: customIdentifier,
 	})
 
 	if err != nil {
 		logger.Errorf("Error while updating host specs: %s", err)
-	} else {
-		logger.Debugf("Host specs sent.")
+		return false
 	}
+	logger.Debugf("Host specs sent.")
+	return true
 }
 
 // Prepare sets up API and registers the host data to the Mackerel server.
 // Use returned values to call Run().
 func Prepare(conf *config.Config) (*Context, error) {
-	api, err := mackerel.NewAPI(conf.Apibase, conf.Apikey, conf.Verbose)
+	return PrepareContext(context.Background(), conf)
+}
+
+// PrepareContext is Prepare whose retries of the registration are interrupted when ctx is done,
+// which lets the agent stop immediately while the API is down.
+func PrepareContext(ctx context.Context, conf *config.Config) (*Context, error) {
+	api, err := NewAPI(conf)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to prepare an api: %s", err.Error())
 	}
 
-	host, err := prepareHost(conf, api)
+	if err := verifyOrg(conf, api); err != nil {
+		return nil, err
+	}
+
+	util.SetHostRoot(conf.Container.HostRoot)
+	spec.SetEC2MetadataVersion(conf.HostSpec.EC2Metadata)
+	prepareSharedCaches(conf)
+	host, err := prepareHost(ctx, conf, api)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to prepare host: %s", err.Error())
 	}
 
-	return &Context{
-		Agent:  NewAgent(conf),
+	ag := NewAgent(conf)
+	prepareDNSCacheMetrics(api, ag)
+	statsd, err := prepareStatsd(conf, ag, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start the StatsD listener: %s", err.Error())
+	}
+	c := &Context{
+		Agent:  ag,
 		Config: conf,
 		Host:   host,
 		API:    api,
 		CustomIdentifierHosts: prepareCustomIdentiferHosts(conf, api),
-	}, nil
+		budget:                prepareMetricBudget(conf, ag),
+		guard:                 prepareMetricGuard(conf, ag),
+		expect:                prepareExpectedMetrics(conf, ag),
+		drops:                 preparePostQueueDrops(conf, ag),
+		spool:                 newSpool(conf),
+		checkSpool:            newCheckSpool(conf),
+		tracer:                newTracer(conf.Trace),
+		statsd:                statsd,
+		latest:                &latestValues{},
+		history:               newCheckHistory(conf),
+		shared:                prepareSharedCheckLease(conf, host),
+		flushCh:               make(chan struct{}, 1),
+	}
+	prepareTelemetry(c)
+	return c, nil
+}
+
+// NewAPI creates the API client with the settings of the connection in conf (the TLS, the proxy,
+// the transport and so on), shared by the agent and the subcommands talking to the API.
+func NewAPI(conf *config.Config) (*mackerel.API, error) {
+	api, err := mackerel.NewAPI(conf.Apibase, conf.Apikey, conf.Verbose)
+	if err != nil {
+		return nil, err
+	}
+	if err := api.SetPinnedKeys(conf.PinnedKeys); err != nil {
+		return nil, err
+	}
+	if err := api.SetTLSFiles(conf.TLSCAFile, conf.TLSCertFile, conf.TLSKeyFile); err != nil {
+		return nil, err
+	}
+	if err := api.SetProxy(conf.HTTPProxy); err != nil {
+		return nil, err
+	}
+	if conf.HTTPProxy == "" {
+		if err := api.SetProxyPAC(conf.ProxyPAC); err != nil {
+			// the environment variables are used instead
+			logger.Warningf("proxy_pac is ignored: %s", err)
+		}
+	}
+	if conf.Connection.Transport == config.TransportHTTP1 {
+		api.DisableHTTP2()
+	}
+	if conf.Connection.Gzip {
+		api.EnableGzip()
+	}
+	if dc := conf.Connection.DNSCache; dc.Enabled {
+		api.SetDNSCache(mackerel.NewDNSCache(
+			time.Duration(dc.TTL)*time.Second,
+			time.Duration(dc.MinTTL)*time.Second,
+			time.Duration(dc.StaleTTL)*time.Second,
+		))
+	}
+	if conf.Connection.Transport == config.TransportHTTP3 {
+		// applies the settings of the transport above to HTTP/3
+		api.EnableHTTP3()
+	}
+	api.SetUnsupportedFeatures(conf.Compatibility.Unsupported, conf.Compatibility.AutoDetect)
+	return api, nil
 }
 
 // RunOnce collects specs and metrics, then output them to stdout.
@@ -567,7 +1169,7 @@ func RunOnce(conf *config.Config) error {
 		"metrics": metrics,
 	})
 	if err != nil {
-		logger.Warningf("Error while marshaling graphdefs: err = %s, graphdefs = %s.", err.Error(), graphdefs)
+		logger.Warningf("Error while marshaling graphdefs: err = %s, graphdefs = %v.", err.Error(), graphdefs)
 		return err
 	}
 	fmt.Println(string(json))
@@ -575,7 +1177,11 @@ func RunOnce(conf *config.Config) error {
 }
 
 func runOncePayload(conf *config.Config) ([]mackerel.CreateGraphDefsPayload, *mackerel.HostSpec, *agent.MetricsResult, error) {
-	hostname, meta, interfaces, customIdentifier, err := collectHostSpecs()
+	util.SetHostRoot(conf.Container.HostRoot)
+	spec.SetEC2MetadataVersion(conf.HostSpec.EC2Metadata)
+	prepareSharedCaches(conf)
+	refreshSharedCaches(conf)
+	hostname, meta, interfaces, customIdentifier, err := collectHostSpecs(conf)
 	if err != nil {
 		logger.Errorf("While collecting host specs: %s", err)
 		return nil, nil, nil, err
@@ -588,7 +1194,7 @@ func runOncePayload(conf *config.Config) ([]mackerel.CreateGraphDefsPayload, *ma
 	}()
 	ag := NewAgent(conf)
 	graphdefs := ag.CollectGraphDefsOfPlugins()
-	metrics := ag.CollectMetrics(time.Now())
+	metrics := ag.CollectMetrics(context.Background(), time.Now())
 	return graphdefs, &mackerel.HostSpec{
 		Name:             hostname,
 		Meta:             meta,
@@ -602,26 +1208,254 @@ func runOncePayload(conf *config.Config) ([]mackerel.CreateGraphDefsPayload, *ma
 
 // NewAgent creates a new instance of agent.Agent from its configuration conf.
 func NewAgent(conf *config.Config) *agent.Agent {
-	return &agent.Agent{
-		MetricsGenerators: prepareGenerators(conf),
-		PluginGenerators:  pluginGenerators(conf),
-		Checkers:          createCheckers(conf),
+	ag := &agent.Agent{
+		MetricsGenerators:    metricsGenerators(conf),
+		PluginGenerators:     preparePluginGenerators(fastPathConfig(conf, false)),
+		FastPluginGenerators: pluginGenerators(fastPathConfig(conf, true)),
+		Checkers:             createCheckers(conf),
+		Timestamp:            conf.Timestamp,
+		ForceGraphDefs:       conf.ForceGraphDefs,
+		Interval:             conf.CollectionInterval(),
+	}
+	if conf.Control.Enabled {
+		// the plugins can be disabled only by the control endpoint
+		ag.MetricsGenerators = append(ag.MetricsGenerators, &pluginSwitchesGenerator{})
+	}
+	if pluginTimeoutConfigured(conf) {
+		ag.MetricsGenerators = append(ag.MetricsGenerators, &metrics.PluginTimeoutsGenerator{})
+	}
+	prepareKernelLog(conf, ag)
+	prepareCollectionHook(conf.CollectionHook, ag)
+	if conf.Root != "" {
+		ag.GraphDefsCacheFile = filepath.Join(conf.Root, graphDefsCacheFileName)
+	}
+	ag.SetDiagnostic(conf.Diagnostic)
+	return ag
+}
+
+// sampled returns the built-in generator named name built by newGenerator with the interval of its deltas,
+// which samples the generator by metrics.NewSamplingGenerator if it is selected by [sampling].
+// The generators are not sampled in the collections with the shorter interval (e.g. at the start).
+func sampled(conf *config.Config, name string, newGenerator func(interval time.Duration) metrics.Generator) metrics.Generator {
+	interval := conf.SamplingInterval()
+	if !conf.Sampling.Sampled(name) || metricsInterval <= interval {
+		return newGenerator(metricsInterval)
+	}
+	return metrics.NewSamplingGenerator(newGenerator(interval), interval, conf.Sampling.Aggregation)
+}
+
+// Flush makes the agent post the queued metrics without waiting for the delays,
+// e.g. right after the network is restored.
+func (c *Context) Flush() {
+	select {
+	case c.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// Stop requests the graceful termination of the running agent like the termination signals, and makes it
+// retire the host after it stopped if retire is true. It reports whether the agent is running.
+func (c *Context) Stop(retire bool) bool {
+	c.stateMu.RLock()
+	term := c.term
+	c.stateMu.RUnlock()
+	if term == nil {
+		return false
+	}
+	if retire {
+		c.retireOnStop()
+	}
+	term.request()
+	return true
+}
+
+// retireOnStop makes the agent retire the host after it stopped
+func (c *Context) retireOnStop() {
+	atomic.StoreInt32(&c.retire, 1)
+}
+
+func (c *Context) retiring() bool {
+	return atomic.LoadInt32(&c.retire) == 1
+}
+
+// ToggleDiagnostic toggles the diagnostic mode of the running agent.
+// While the diagnostic mode is enabled, the metrics of the agent itself are
+// posted and the debug logs are emitted.
+// It returns whether the diagnostic mode has been enabled.
+func (c *Context) ToggleDiagnostic() bool {
+	enabled := !c.Agent.Diagnostic()
+	c.Agent.SetDiagnostic(enabled)
+	c.setLogLevel()
+	if enabled {
+		logger.Infof("Diagnostic mode is enabled")
+	} else {
+		logger.Infof("Diagnostic mode is disabled")
+	}
+	return enabled
+}
+
+// Reload applies the configuration reloaded (e.g. on SIGHUP) to the running agent.
+// The metrics generators, the plugin generators and the checkers are rebuilt and the roles are
+// updated, while the metrics queued to be posted are kept.
+// The settings of the connection to the API, the state directory, the spool and the ephemeral instances
+// are not applied until restart.
+func (c *Context) Reload(conf *config.Config) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	keepRestartRequiredSettings(c.Config, conf)
+	ag := NewAgent(conf)
+	prepareDNSCacheMetrics(c.API, ag)
+	budget := prepareMetricBudget(conf, ag)
+	guard := prepareMetricGuard(conf, ag)
+	expect := prepareExpectedMetrics(conf, ag)
+	if c.drops != nil {
+		// the policy is kept with [connection] until restart
+		ag.MetricsGenerators = append(ag.MetricsGenerators, c.drops)
+	}
+	statsd, err := prepareStatsd(conf, ag, c.statsd)
+	if err != nil {
+		logger.Errorf("Failed to start the StatsD listener: %s", err)
+	}
+	customIdentifierHosts := prepareCustomIdentiferHosts(conf, c.API)
+	c.Agent.Reload(ag)
+	if conf.Diagnostic != c.Config.Diagnostic {
+		c.Agent.SetDiagnostic(conf.Diagnostic)
+	}
+	c.stateMu.Lock()
+	c.Config = conf
+	c.budget = budget
+	c.guard = guard
+	c.expect = expect
+	c.tracer = newTracer(conf.Trace)
+	c.CustomIdentifierHosts = customIdentifierHosts
+	c.stateMu.Unlock()
+	c.statsd = statsd
+	if c.checkRunner != nil {
+		c.checkRunner.run(ag.Checkers)
+	}
+	c.setLogLevel()
+	logging.SetLogFormat(conf.LogFormat)
+
+	c.Agent.InitPluginGenerators(c.API)
+	c.UpdateHostSpecs()
+	logger.Infof("Configuration reloaded: %d metrics generators, %d plugin generators, %d checkers",
+		len(ag.MetricsGenerators), len(ag.PluginGenerators), len(ag.Checkers))
+}
+
+// keepRestartRequiredSettings overwrites the settings which are not applied until restart
+// in conf with the current ones, warning if they are changed.
+func keepRestartRequiredSettings(current, conf *config.Config) {
+	settings := []struct {
+		name          string
+		current, conf interface{}
+	}{
+		{"apibase", &current.Apibase, &conf.Apibase},
+		{"apikey", &current.Apikey, &conf.Apikey},
+		{"root", &current.Root, &conf.Root},
+		{"pidfile", &current.Pidfile, &conf.Pidfile},
+		{"metrics_interval", &current.MetricsInterval, &conf.MetricsInterval},
+		{"pinned_keys", &current.PinnedKeys, &conf.PinnedKeys},
+		{"tls_ca_file", &current.TLSCAFile, &conf.TLSCAFile},
+		{"tls_cert_file", &current.TLSCertFile, &conf.TLSCertFile},
+		{"tls_key_file", &current.TLSKeyFile, &conf.TLSKeyFile},
+		{"http_proxy", &current.HTTPProxy, &conf.HTTPProxy},
+		{"proxy_pac", &current.ProxyPAC, &conf.ProxyPAC},
+		{"connection", &current.Connection, &conf.Connection},
+		{"spool", &current.Spool, &conf.Spool},
+		{"check_history", &current.CheckHistory, &conf.CheckHistory},
+		{"backup", &current.Backup, &conf.Backup},
+		{"ephemeral", &current.Ephemeral, &conf.Ephemeral},
+		{"control", &current.Control, &conf.Control},
+		{"fast_path", &current.FastPath, &conf.FastPath},
+		{"compatibility", &current.Compatibility, &conf.Compatibility},
+		{"container", &current.Container, &conf.Container},
+		{"shared_checks", &current.SharedChecks, &conf.SharedChecks},
+		{"shared_cache", &current.SharedCaches, &conf.SharedCaches},
+	}
+	for _, s := range settings {
+		cur, v := reflect.ValueOf(s.current).Elem(), reflect.ValueOf(s.conf).Elem()
+		if !reflect.DeepEqual(cur.Interface(), v.Interface()) {
+			logger.Warningf("'%s' is changed but not applied until restart", s.name)
+			v.Set(cur)
+		}
+	}
+}
+
+// setLogLevel sets the log level by the configuration, unless the diagnostic mode is enabled
+func (c *Context) setLogLevel() {
+	conf := c.config()
+	switch {
+	case c.Agent.Diagnostic():
+		logging.SetLogLevel(logging.DEBUG)
+	case conf.Verbose:
+		logging.SetLogLevel(logging.DEBUG)
+	case conf.Silent:
+		logging.SetLogLevel(logging.ERROR)
+	default:
+		logging.SetLogLevel(logging.INFO)
 	}
 }
 
 // Run starts the main metric collecting logic and this function will never return.
 func Run(c *Context, termCh chan struct{}) error {
-	logger.Infof("Start: apibase = %s, hostName = %s, hostID = %s", c.Config.Apibase, c.Host.Name, c.Host.ID)
+	logger.Infof("Start: apibase = %s, hostName = %s, hostID = %s", c.config().Apibase, c.Host.Name, c.Host.ID)
+	reportStarted(c)
 
 	err := loop(c, termCh)
-	if err == nil && c.Config.HostStatus.OnStop != "" {
-		// TODO error handling. support retire(?)
-		e := c.API.UpdateHostStatus(c.Host.ID, c.Config.HostStatus.OnStop)
+	if err == nil {
+		// the termination requested again interrupts the retries of stopping the host
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-termCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		stopHost(ctx, c)
+		cancel()
+	}
+	return err
+}
+
+// retireRetryNum is the number of the attempts to retire the host on stop, which is smaller than retryNum
+// not to exceed the timeout of stopping the service
+var retireRetryNum uint = 5
+
+// stopHost retires the host or sets its status to HostStatus.OnStop after the agent stopped cleanly,
+// i.e. the queued metrics and check reports have been posted. The retries are interrupted when ctx is done.
+// The host is retired only when it is requested explicitly, i.e. by Stop or by the termination notice with
+// RetireOnStop (see watchTermination), not on the other stops like the restarts.
+func stopHost(ctx context.Context, c *Context) {
+	conf := c.config()
+	if c.retiring() {
+		logger.Infof("Retiring this host (hostID: %s). It is registered as a new host if the agent starts again.", c.Host.ID)
+		var err error
+		retryHonoringBackoff(ctx, retireRetryNum, retryInterval, func() error {
+			err = c.API.RetireHost(c.Host.ID)
+			var apiErr *mackerel.Error
+			if errors.As(err, &apiErr) && apiErr.IsClientError() {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			logger.Errorf("Failed to retire the host on stop: %s", err)
+			return
+		}
+		logger.Infof("This host (hostID: %s) has been retired.", c.Host.ID)
+		if err := conf.DeleteSavedHostID(); err != nil {
+			logger.Warningf("Failed to remove HostID file: %s", err)
+		}
+		return
+	}
+	if conf.HostStatus.OnStop != "" {
+		e := c.API.UpdateHostStatus(c.Host.ID, conf.HostStatus.OnStop)
 		if e != nil {
 			logger.Errorf("Failed update host status on stop: %s", e)
 		}
 	}
-	return err
 }
 
 func createCheckers(conf *config.Config) []checks.Checker {
@@ -636,14 +1470,181 @@ func createCheckers(conf *config.Config) []checks.Checker {
 		checkers = append(checkers, checker)
 	}
 
+	for name, pluginConfig := range conf.Plugin["checkfile"] {
+		checker := checks.Checker{
+			Name:   name,
+			Config: pluginConfig,
+			Func:   checks.NewFileFunc(pluginConfig),
+		}
+		logger.Debugf("Checker created: %v", checker)
+		checkers = append(checkers, checker)
+	}
+
+	for name, pluginConfig := range conf.Plugin["checklog"] {
+		f, err := checks.NewLogFunc(pluginConfig, checkLogStateFile(conf, name))
+		if err != nil {
+			logger.Errorf("Failed to prepare [plugin.checklog.%s]: %s", name, err)
+			continue
+		}
+		checker := checks.Checker{
+			Name:   name,
+			Config: pluginConfig,
+			Func:   f,
+		}
+		logger.Debugf("Checker created: %v", checker)
+		checkers = append(checkers, checker)
+	}
+
+	for name, pluginConfig := range conf.Plugin["checkcert"] {
+		f, err := checks.NewCertFunc(pluginConfig)
+		if err != nil {
+			logger.Errorf("Failed to prepare [plugin.checkcert.%s]: %s", name, err)
+			continue
+		}
+		checker := checks.Checker{
+			Name:   name,
+			Config: pluginConfig,
+			Func:   f,
+		}
+		logger.Debugf("Checker created: %v", checker)
+		checkers = append(checkers, checker)
+	}
+
+	for name, pluginConfig := range conf.Plugin["checktcp"] {
+		f, err := checks.NewTCPFunc(pluginConfig)
+		if err != nil {
+			logger.Errorf("Failed to prepare [plugin.checktcp.%s]: %s", name, err)
+			continue
+		}
+		checker := checks.Checker{
+			Name:   name,
+			Config: pluginConfig,
+			Func:   f,
+		}
+		logger.Debugf("Checker created: %v", checker)
+		checkers = append(checkers, checker)
+	}
+
+	for name, pluginConfig := range conf.Plugin["checkhttp"] {
+		f, err := checks.NewHTTPFunc(pluginConfig)
+		if err != nil {
+			logger.Errorf("Failed to prepare [plugin.checkhttp.%s]: %s", name, err)
+			continue
+		}
+		checker := checks.Checker{
+			Name:   name,
+			Config: pluginConfig,
+			Func:   f,
+		}
+		logger.Debugf("Checker created: %v", checker)
+		checkers = append(checkers, checker)
+	}
+
+	for name, pluginConfig := range conf.Plugin["checktraffic"] {
+		f, err := checks.NewTrafficFunc(pluginConfig)
+		if err != nil {
+			logger.Errorf("Failed to prepare [plugin.checktraffic.%s]: %s", name, err)
+			continue
+		}
+		checker := checks.Checker{
+			Name:   name,
+			Config: pluginConfig,
+			Func:   f,
+		}
+		logger.Debugf("Checker created: %v", checker)
+		checkers = append(checkers, checker)
+	}
+
+	if conf.Connectivity.Check {
+		checkers = append(checkers, checks.Checker{
+			Name: config.ConnectivityCheckName,
+			Config: config.PluginConfig{
+				NotificationInterval: conf.Connectivity.NotificationInterval,
+				CheckInterval:        conf.Connectivity.CheckInterval,
+			},
+			Func: checks.NewConnectivityFunc(connectivityTargets(conf)),
+		})
+	}
+
+	for _, checker := range builtinCheckers(conf) {
+		logger.Debugf("Checker created: %v", checker)
+		checkers = append(checkers, checker)
+	}
+
 	return checkers
 }
 
-func prepareGenerators(conf *config.Config) []metrics.Generator {
-	diagnostic := conf.Diagnostic
-	generators := metricsGenerators(conf)
-	if diagnostic {
-		generators = append(generators, &metrics.AgentGenerator{})
+var checkLogNameSanitizer = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// checkLogStateFile returns the path of the file keeping the position of the log file checked by [plugin.checklog.<name>]
+func checkLogStateFile(conf *config.Config, name string) string {
+	return filepath.Join(conf.Root, "checklog", checkLogNameSanitizer.ReplaceAllString(name, "_")+".json")
+}
+
+// connectivityTargets returns the destinations checked by the connectivity check.
+// The proxy is checked instead of the API endpoint when it is used.
+func connectivityTargets(conf *config.Config) []checks.ConnectivityTarget {
+	var targets []checks.ConnectivityTarget
+	if u, err := url.Parse(conf.Apibase); err == nil {
+		target := checks.ConnectivityTarget{Name: "apibase", Network: "tcp", Address: hostPort(u)}
+		req := &http.Request{Method: "GET", URL: u, Header: http.Header{}}
+		proxy, err := http.ProxyFromEnvironment(req)
+		if conf.HTTPProxy != "" {
+			proxy, err = url.Parse(conf.HTTPProxy)
+		}
+		if err == nil && proxy != nil {
+			target = checks.ConnectivityTarget{Name: "proxy", Network: "tcp", Address: hostPort(proxy)}
+		}
+		targets = append(targets, target)
+	} else {
+		logger.Warningf("Invalid apibase %q is not checked: %s", conf.Apibase, err)
+	}
+	for _, server := range conf.Connectivity.NTPServers {
+		targets = append(targets, checks.ConnectivityTarget{Name: "ntp", Network: "ntp", Address: server})
+	}
+	for _, address := range conf.Connectivity.Targets {
+		targets = append(targets, checks.ConnectivityTarget{Name: "target", Network: "tcp", Address: address})
+	}
+	return targets
+}
+
+// hostPort returns "host:port" of u, complementing the default port of the scheme
+func hostPort(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Host, "443")
+	}
+	return net.JoinHostPort(u.Host, "80")
+}
+
+// pluginTimeoutConfigured reports whether the timeouts of the metrics plugins are configured,
+// whose occurrences are posted as custom.agent.plugin.timeouts.
+func pluginTimeoutConfigured(conf *config.Config) bool {
+	if conf.PluginTimeout > 0 {
+		return true
+	}
+	for _, pluginConfig := range conf.Plugin["metrics"] {
+		if pluginConfig.Timeout != nil && *pluginConfig.Timeout > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func preparePluginGenerators(conf *config.Config) []metrics.PluginGenerator {
+	generators := pluginGenerators(conf)
+	if len(conf.Plugin["checkfile"]) > 0 {
+		generators = append(generators, metrics.NewCheckFileGenerator(conf.Plugin["checkfile"]))
+	}
+	for name, pluginConfig := range conf.Plugin["prometheus"] {
+		g, err := metrics.NewPrometheusGenerator(name, pluginConfig)
+		if err != nil {
+			logger.Errorf("Failed to prepare [plugin.prometheus.%s]: %s", name, err)
+			continue
+		}
+		generators = append(generators, switchablePlugin(name, g))
 	}
 	return generators
 }
@@ -1,6 +1,9 @@
 package command
 
 import (
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
 	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	metricsLinux "github.com/mackerelio/mackerel-agent/metrics/linux"
@@ -8,14 +11,22 @@ import (
 	specLinux "github.com/mackerelio/mackerel-agent/spec/linux"
 )
 
-func specGenerators() []spec.Generator {
-	return []spec.Generator{
+func specGenerators(conf *config.Config) []spec.Generator {
+	generators := []spec.Generator{
 		&specLinux.KernelGenerator{},
 		&specLinux.CPUGenerator{},
 		&specLinux.MemoryGenerator{},
 		&specLinux.BlockDeviceGenerator{},
 		&spec.FilesystemGenerator{},
+		&specLinux.CapacityGenerator{},
+	}
+	if conf.ListeningPorts.Spec {
+		generators = append(generators, &specLinux.ListeningPortsGenerator{})
+	}
+	if conf.HostSpec.Attestation {
+		generators = append(generators, &specLinux.AttestationGenerator{AKHandle: conf.HostSpec.AKHandle()})
 	}
+	return generators
 }
 
 func interfaceGenerator() spec.InterfaceGenerator {
@@ -24,12 +35,34 @@ func interfaceGenerator() spec.InterfaceGenerator {
 
 func metricsGenerators(conf *config.Config) []metrics.Generator {
 	generators := []metrics.Generator{
-		&metricsLinux.Loadavg5Generator{},
-		&metricsLinux.CPUUsageGenerator{Interval: metricsInterval},
-		&metricsLinux.MemoryGenerator{},
-		&metricsLinux.InterfaceGenerator{Interval: metricsInterval},
-		&metricsLinux.DiskGenerator{Interval: metricsInterval},
+		sampled(conf, "loadavg5", func(time.Duration) metrics.Generator { return &metricsLinux.Loadavg5Generator{} }),
+		sampled(conf, "cpu", func(interval time.Duration) metrics.Generator {
+			return &metricsLinux.CPUUsageGenerator{Interval: interval}
+		}),
+		sampled(conf, "memory", func(time.Duration) metrics.Generator { return &metricsLinux.MemoryGenerator{} }),
+		sampled(conf, "interface", func(interval time.Duration) metrics.Generator {
+			return &metricsLinux.InterfaceGenerator{Interval: interval}
+		}),
+		sampled(conf, "disk", func(interval time.Duration) metrics.Generator {
+			return &metricsLinux.DiskGenerator{Interval: interval}
+		}),
 		&metrics.FilesystemGenerator{IgnoreRegexp: conf.Filesystems.Ignore.Regexp},
+		sampled(conf, "tcp", func(time.Duration) metrics.Generator { return &metricsLinux.TCPGenerator{} }),
+		&metricsLinux.FileDescriptorGenerator{Agent: conf.FileDescriptor.Agent},
+	}
+	if metricsLinux.GPUAvailable() {
+		generators = append(generators, &metricsLinux.GPUGenerator{})
+	}
+	// the cgroup is of the agent itself, not of the host
+	if metricsLinux.CgroupV2Available() && conf.Container.HostRoot == "" {
+		generators = append(generators, sampled(conf, "cgroup", func(interval time.Duration) metrics.Generator {
+			return &metricsLinux.CgroupGenerator{Interval: interval}
+		}))
+	}
+	if metricsLinux.PSIAvailable() {
+		generators = append(generators, sampled(conf, "psi", func(interval time.Duration) metrics.Generator {
+			return &metricsLinux.PSIGenerator{Interval: interval}
+		}))
 	}
 
 	return generators
@@ -38,9 +71,36 @@ func metricsGenerators(conf *config.Config) []metrics.Generator {
 func pluginGenerators(conf *config.Config) []metrics.PluginGenerator {
 	generators := []metrics.PluginGenerator{}
 
-	for _, pluginConfig := range conf.Plugin["metrics"] {
-		generators = append(generators, metrics.NewPluginGenerator(pluginConfig))
+	for name, pluginConfig := range conf.Plugin["metrics"] {
+		generators = append(generators, switchablePlugin(name, metrics.NewPluginGenerator(pluginConfig)))
 	}
 
 	return generators
 }
+
+func builtinCheckers(conf *config.Config) []checks.Checker {
+	checkers := []checks.Checker{}
+
+	if conf.ListeningPorts.Check {
+		checkers = append(checkers, checks.Checker{
+			Name: config.ListeningPortsCheckName,
+			Config: config.PluginConfig{
+				NotificationInterval: conf.ListeningPorts.NotificationInterval,
+				CheckInterval:        conf.ListeningPorts.CheckInterval,
+			},
+			Func: checks.NewDeltaFunc("listening ports", func() ([]string, error) {
+				ports, err := specLinux.CollectListeningPorts()
+				if err != nil {
+					return nil, err
+				}
+				items := make([]string, len(ports))
+				for i, p := range ports {
+					items[i] = p.String()
+				}
+				return items, nil
+			}),
+		})
+	}
+
+	return checkers
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"github.com/mackerelio/mackerel-agent/checks"
 	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	metricsNetbsd "github.com/mackerelio/mackerel-agent/metrics/netbsd"
@@ -8,7 +9,7 @@ import (
 	specNetbsd "github.com/mackerelio/mackerel-agent/spec/netbsd"
 )
 
-func specGenerators() []spec.Generator {
+func specGenerators(conf *config.Config) []spec.Generator {
 	return []spec.Generator{
 		&specNetbsd.KernelGenerator{},
 		&specNetbsd.MemoryGenerator{},
@@ -35,9 +36,13 @@ func metricsGenerators(conf *config.Config) []metrics.Generator {
 func pluginGenerators(conf *config.Config) []metrics.PluginGenerator {
 	generators := []metrics.PluginGenerator{}
 
-	for _, pluginConfig := range conf.Plugin["metrics"] {
-		generators = append(generators, metrics.NewPluginGenerator(pluginConfig))
+	for name, pluginConfig := range conf.Plugin["metrics"] {
+		generators = append(generators, switchablePlugin(name, metrics.NewPluginGenerator(pluginConfig)))
 	}
 
 	return generators
 }
+
+func builtinCheckers(conf *config.Config) []checks.Checker {
+	return []checks.Checker{}
+}
@@ -1,16 +1,24 @@
 package command
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
 	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/logging"
 	"github.com/mackerelio/mackerel-agent/mackerel"
@@ -23,14 +31,14 @@ func TestDelayByHost(t *testing.T) {
 		Name:   "hogehoge2.host.h",
 		Type:   "unknown",
 		Status: "working",
-	})) * time.Second
+	}, config.PostMetricsInterval)) * time.Second
 
 	delay2 := time.Duration(delayByHost(&mackerel.Host{
 		ID:     "21GZjCE5Etb",
 		Name:   "hogehoge2.host.h",
 		Type:   "unknown",
 		Status: "working",
-	})) * time.Second
+	}, config.PostMetricsInterval)) * time.Second
 
 	if !(0 <= delay1.Seconds() && delay1.Seconds() < 60) {
 		t.Errorf("delay shoud be between 0 and 60 but %v", delay1)
@@ -39,6 +47,11 @@ func TestDelayByHost(t *testing.T) {
 	if delay1 == delay2 {
 		t.Error("delays shoud be different")
 	}
+
+	delay3 := delayByHost(&mackerel.Host{ID: "21GZjCE5Etb"}, 5*time.Minute)
+	if !(0 <= delay3 && delay3 < 300) {
+		t.Errorf("delay shoud be between 0 and 300 but %v", delay3)
+	}
 }
 
 type jsonObject map[string]interface{}
@@ -47,7 +60,11 @@ type jsonObject map[string]interface{}
 // and returns the Config, mock handlers map and the server.
 // The mock handlers map is "<method> <path>"-to-jsonObject-generator map.
 func newMockAPIServer(t *testing.T) (config.Config, map[string]func(*http.Request) (int, jsonObject), *httptest.Server) {
-	mockHandlers := map[string]func(*http.Request) (int, jsonObject){}
+	mockHandlers := map[string]func(*http.Request) (int, jsonObject){
+		"GET /api/v0/org": func(req *http.Request) (int, jsonObject) {
+			return 200, jsonObject{"name": "example-org"}
+		},
+	}
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		key := req.Method + " " + req.URL.Path
@@ -146,6 +163,20 @@ func TestPrepareWithCreateWithFail(t *testing.T) {
 	}
 }
 
+func TestPrepareWithInvalidAPIKey(t *testing.T) {
+	conf, mockHandlers, ts := newMockAPIServer(t)
+	defer ts.Close()
+
+	mockHandlers["GET /api/v0/org"] = func(req *http.Request) (int, jsonObject) {
+		return 403, jsonObject{"error": jsonObject{"message": "Authentication failed"}}
+	}
+
+	_, err := Prepare(&conf)
+	if err == nil || !strings.Contains(err.Error(), "apibase") {
+		t.Errorf("the rejected API key should be reported before the registration: %v", err)
+	}
+}
+
 func TestPrepareWithUpdate(t *testing.T) {
 	conf, mockHandlers, ts := newMockAPIServer(t)
 	defer ts.Close()
@@ -187,8 +218,132 @@ func TestPrepareWithUpdate(t *testing.T) {
 	}
 }
 
+func TestPrepareWithProvisionedHostID(t *testing.T) {
+	conf, mockHandlers, ts := newMockAPIServer(t)
+	defer ts.Close()
+	hostIDFile := filepath.Join(conf.Root, "provisioned_id")
+	ioutil.WriteFile(hostIDFile, []byte("xxx12345678902\n"), 0644)
+	conf.Registration.HostIDFile = hostIDFile
+
+	mockHandlers["GET /api/v0/hosts/xxx12345678902"] = func(req *http.Request) (int, jsonObject) {
+		return 200, jsonObject{
+			"host": mackerel.Host{ID: "xxx12345678902", Name: "host.example.com", Status: "working"},
+		}
+	}
+
+	api, _ := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	host, err := prepareHost(context.Background(), &conf, api)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if host.ID != "xxx12345678902" {
+		t.Errorf("the provisioned host should be used but %s", host.ID)
+	}
+	if hostID, _ := conf.LoadHostID(); hostID != "xxx12345678902" {
+		t.Errorf("the provisioned host id should be saved but %q", hostID)
+	}
+}
+
+func TestRegistrationDelay(t *testing.T) {
+	conf := config.Registration{MaxJitter: 60}
+	delay1 := registrationDelay(conf, "ip-10-0-0-1", "i-0123456789abcdef0")
+	delay2 := registrationDelay(conf, "ip-10-0-0-1", "i-0123456789abcdef1")
+	if delay1 < 0 || delay1 >= time.Minute || delay2 < 0 || delay2 >= time.Minute {
+		t.Errorf("the delays should be less than max_jitter: %s, %s", delay1, delay2)
+	}
+	if delay1 == delay2 {
+		t.Error("the delays should be different by the instances")
+	}
+	if registrationDelay(conf, "ip-10-0-0-1", "i-0123456789abcdef0") != delay1 {
+		t.Error("the delay should be the same for the instance")
+	}
+	if delay := registrationDelay(config.Registration{}, "ip-10-0-0-1", ""); delay != 0 {
+		t.Errorf("the registration should not be delayed without max_jitter: %s", delay)
+	}
+}
+
+func TestRetryHonoringBackoff(t *testing.T) {
+	calls := 0
+	start := time.Now()
+	err := retryHonoringBackoff(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		if calls == 1 {
+			return &mackerel.Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 100 * time.Millisecond}
+		}
+		if calls == 2 {
+			return errors.New("temporary error")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("f should be called 3 times but %d", calls)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Retry-After should be honored: %s", elapsed)
+	}
+
+	calls = 0
+	err = retryHonoringBackoff(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		return fmt.Errorf("error %d", calls)
+	})
+	if err == nil || err.Error() != "error 3" {
+		t.Errorf("the error of the last call should be returned but %v", err)
+	}
+}
+
+func TestRetryHonoringBackoffCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := retryHonoringBackoff(ctx, 20, time.Minute, func() error {
+		calls++
+		return errors.New("temporary error")
+	})
+	if err != context.Canceled {
+		t.Errorf("the cancellation should be returned but %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("f should not be called after the cancellation but %d times", calls)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the retries should be interrupted immediately: %s", elapsed)
+	}
+}
+
+func TestPrepareHostCanceled(t *testing.T) {
+	conf, mockHandlers, ts := newMockAPIServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(conf.Root)
+
+	mockHandlers["POST /api/v0/hosts"] = func(req *http.Request) (int, jsonObject) {
+		return 503, jsonObject{"error": "unavailable"}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	api, _ := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	done := make(chan error, 1)
+	go func() {
+		_, err := prepareHost(ctx, &conf, api)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "context canceled") {
+			t.Errorf("the registration should be interrupted: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("the registration should be interrupted immediately")
+	}
+}
+
 func TestCollectHostSpecs(t *testing.T) {
-	hostname, meta, _ /*interfaces*/, _ /*customIdentifier*/, err := collectHostSpecs()
+	hostname, meta, _ /*interfaces*/, _ /*customIdentifier*/, err := collectHostSpecs(&config.Config{})
 
 	if err != nil {
 		t.Errorf("collectHostSpecs should not fail: %s", err)
@@ -203,6 +358,20 @@ func TestCollectHostSpecs(t *testing.T) {
 	}
 }
 
+func TestCollectHostSpecsContainer(t *testing.T) {
+	conf := &config.Config{Container: config.Container{NodeName: "node-1", ClusterName: "prod"}}
+	hostname, _, _, customIdentifier, err := collectHostSpecs(conf)
+	if err != nil {
+		t.Errorf("collectHostSpecs should not fail: %s", err)
+	}
+	if hostname != "node-1" {
+		t.Errorf("hostname should be the node name but %q", hostname)
+	}
+	if customIdentifier != "node-1.prod.node.kubernetes" {
+		t.Errorf("customIdentifier should be of the node but %q", customIdentifier)
+	}
+}
+
 type counterGenerator struct {
 	counter int
 }
@@ -225,6 +394,8 @@ func TestLoop(t *testing.T) {
 
 	conf, mockHandlers, ts := newMockAPIServer(t)
 	defer ts.Close()
+	// Retry at the constant delay, which the timeline below expects, without the backoff growing past the interval
+	conf.Connection.PostMetricsRetryDelaySecondsCap = 0
 
 	if testing.Short() {
 		// Shrink time scale
@@ -343,3 +514,201 @@ func TestLoop(t *testing.T) {
 		t.Errorf("exitErr should be nil, got: %s", exitErr)
 	}
 }
+
+func TestToggleDiagnostic(t *testing.T) {
+	conf := &config.Config{}
+	ag := NewAgent(conf)
+	ag.MetricsGenerators = nil // skip the generators which take the interval to collect metrics
+	c := &Context{Agent: ag, Config: conf}
+
+	hasAgentMetrics := func() bool {
+		for _, v := range ag.CollectMetrics(context.Background(), time.Now()).Values {
+			if _, ok := v.Values["custom.agent.memory.alloc"]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if hasAgentMetrics() {
+		t.Errorf("metrics of the agent should not be collected without diagnostic mode")
+	}
+	if !c.ToggleDiagnostic() {
+		t.Errorf("diagnostic mode should be enabled")
+	}
+	if !hasAgentMetrics() {
+		t.Errorf("metrics of the agent should be collected in diagnostic mode")
+	}
+	if c.ToggleDiagnostic() {
+		t.Errorf("diagnostic mode should be disabled")
+	}
+	if hasAgentMetrics() {
+		t.Errorf("metrics of the agent should not be collected after diagnostic mode is disabled")
+	}
+}
+
+func TestConnectivityTargets(t *testing.T) {
+	// the proxy is never used for localhost
+	conf := &config.Config{
+		Apibase: "http://localhost",
+		Connectivity: config.Connectivity{
+			NTPServers: []string{"ntp.example.com"},
+			Targets:    []string{"repo.example.com:8080"},
+		},
+	}
+	expected := []checks.ConnectivityTarget{
+		{Name: "apibase", Network: "tcp", Address: "localhost:80"},
+		{Name: "ntp", Network: "ntp", Address: "ntp.example.com"},
+		{Name: "target", Network: "tcp", Address: "repo.example.com:8080"},
+	}
+	if targets := connectivityTargets(conf); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("targets should be %+v but %+v", expected, targets)
+	}
+}
+
+func TestRetryDelaySeconds(t *testing.T) {
+	conn := config.ConnectionConfig{PostMetricsRetryDelaySeconds: 60, PostMetricsRetryDelaySecondsCap: 600}
+	rnd := rand.New(rand.NewSource(1))
+	for failures, max := range []int{60, 60, 120, 240, 480, 600, 600} {
+		if failures == 0 {
+			continue
+		}
+		for i := 0; i < 100; i++ {
+			delay := retryDelaySeconds(conn, failures, rnd)
+			if delay < max/2 || delay > max {
+				t.Errorf("delay after %d failures should be between %d and %d but %d", failures, max/2, max, delay)
+			}
+		}
+	}
+
+	conn.PostMetricsRetryDelaySecondsCap = 0
+	if delay := retryDelaySeconds(conn, 5, rnd); delay != 60 {
+		t.Errorf("delay should be constant without the cap but %d", delay)
+	}
+}
+
+func TestRateLimitedDelaySeconds(t *testing.T) {
+	conn := config.ConnectionConfig{PostMetricsRetryDelaySeconds: 60}
+	rnd := rand.New(rand.NewSource(1))
+	if delay := rateLimitedDelaySeconds(conn, 1500*time.Millisecond, 3, rnd); delay != 2 {
+		t.Errorf("delay should be Retry-After rounded up but %d", delay)
+	}
+	for i := 0; i < 100; i++ {
+		delay := rateLimitedDelaySeconds(conn, 0, 10, rnd)
+		if delay < rateLimitBackoffCapSeconds/2 || delay > rateLimitBackoffCapSeconds {
+			t.Errorf("delay without Retry-After should back off up to %d but %d", rateLimitBackoffCapSeconds, delay)
+		}
+	}
+
+	if _, limited := rateLimited(errors.New("connection refused")); limited {
+		t.Error("the errors other than 429 should not be rate-limited")
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Retry-After", "30")
+		res.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+	api, _ := mackerel.NewAPI(ts.URL, "dummy-key", false)
+	retryAfter, limited := rateLimited(api.PostMetricsValues(nil))
+	if !limited || retryAfter != 30*time.Second {
+		t.Errorf("429 should be rate-limited with Retry-After: %t, %s", limited, retryAfter)
+	}
+}
+
+func TestReload(t *testing.T) {
+	conf, mockHandlers, ts := newMockAPIServer(t)
+	defer ts.Close()
+
+	var updatedRoles []interface{}
+	mockHandlers["PUT /api/v0/hosts/xyzabc12345"] = func(req *http.Request) (int, jsonObject) {
+		var payload map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&payload)
+		updatedRoles, _ = payload["roleFullnames"].([]interface{})
+		return 200, jsonObject{"result": "OK"}
+	}
+
+	api, _ := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	c := &Context{
+		Agent:  &agent.Agent{},
+		Config: &conf,
+		Host:   &mackerel.Host{ID: "xyzabc12345"},
+		API:    api,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runCheckersLoop(ctx, c, newTermination())
+
+	newConf := conf
+	newConf.Apibase = "http://example.com"
+	newConf.Roles = []string{"My-Service:app"}
+	newConf.Plugin = map[string]config.PluginConfigs{
+		"checks": {"heartbeat": config.PluginConfig{Command: "true"}},
+	}
+
+	// the metrics are converted while reloading (detected by -race)
+	converted := make(chan struct{})
+	go func() {
+		defer close(converted)
+		result := &agent.MetricsResult{Created: time.Now(), Values: []metrics.ValuesCustomIdentifier{
+			{Values: metrics.Values{"custom.foo.bar": 1}},
+		}}
+		for i := 0; i < 100; i++ {
+			metricsPostValue(c, result)
+		}
+	}()
+	c.Reload(&newConf)
+	<-converted
+
+	if c.Config.Apibase != conf.Apibase {
+		t.Errorf("apibase should not be changed until restart but %s", c.Config.Apibase)
+	}
+	if len(c.Agent.Checkers) != 1 || c.Agent.Checkers[0].Name != "heartbeat" {
+		t.Errorf("checkers should be rebuilt: %v", c.Agent.Checkers)
+	}
+	if !reflect.DeepEqual(updatedRoles, []interface{}{"My-Service:app"}) {
+		t.Errorf("roles should be updated but %v", updatedRoles)
+	}
+}
+
+func TestStopHost(t *testing.T) {
+	conf, mockHandlers, ts := newMockAPIServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(conf.Root)
+
+	conf.HostStatus.OnStop = "poweroff"
+	conf.SaveHostID("xyzabc12345")
+	var requests []string
+	mockHandlers["POST /api/v0/hosts/xyzabc12345/status"] = func(req *http.Request) (int, jsonObject) {
+		requests = append(requests, "status")
+		return 200, jsonObject{"success": true}
+	}
+	mockHandlers["POST /api/v0/hosts/xyzabc12345/retire"] = func(req *http.Request) (int, jsonObject) {
+		requests = append(requests, "retire")
+		return 200, jsonObject{"success": true}
+	}
+
+	api, _ := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	c := &Context{Config: &conf, Host: &mackerel.Host{ID: "xyzabc12345"}, API: api}
+	stopHost(context.Background(), c)
+	if !reflect.DeepEqual(requests, []string{"status"}) {
+		t.Errorf("the host status should be updated on stop: %v", requests)
+	}
+
+	// retire_on_stop alone does not retire the host on the stops like the restarts
+	requests = nil
+	conf.HostStatus.RetireOnStop = true
+	stopHost(context.Background(), c)
+	if !reflect.DeepEqual(requests, []string{"status"}) {
+		t.Errorf("the host should not be retired without the request: %v", requests)
+	}
+
+	requests = nil
+	c.retireOnStop()
+	stopHost(context.Background(), c)
+	if !reflect.DeepEqual(requests, []string{"retire"}) {
+		t.Errorf("the host should be retired instead of updating its status: %v", requests)
+	}
+	if _, err := conf.LoadHostID(); err == nil {
+		t.Error("the saved host id should be removed after the retirement")
+	}
+}
@@ -3,13 +3,18 @@
 package command
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/mackerelio/mackerel-agent/agent"
 	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/metrics"
 )
 
 var diceCommand = "../example/metrics-plugins/dice-with-meta.rb"
@@ -110,3 +115,47 @@ func TestRunOncePayload(t *testing.T) {
 	}
 
 }
+
+type hookCheckGenerator struct {
+	file string
+}
+
+func (g *hookCheckGenerator) Generate() (metrics.Values, error) {
+	// the pre hook should have created the file
+	_, err := os.Stat(g.file)
+	return metrics.Values{"hook.pre": boolValue(err == nil)}, nil
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestCollectionHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-collection-hook")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pre, post := filepath.Join(dir, "pre"), filepath.Join(dir, "post")
+
+	ag := &agent.Agent{MetricsGenerators: []metrics.Generator{&hookCheckGenerator{file: pre}}}
+	prepareCollectionHook(config.CollectionHook{Pre: "touch " + pre, Post: "touch " + post, Timeout: 1}, ag)
+	result := ag.CollectMetrics(context.Background(), time.Now())
+	if len(result.Values) != 1 || result.Values[0].Values["hook.pre"] != 1 {
+		t.Errorf("the pre hook should be run before the collection: %v", result.Values)
+	}
+	if _, err := os.Stat(post); err != nil {
+		t.Errorf("the post hook should be run after the collection: %v", err)
+	}
+
+	ag = &agent.Agent{}
+	prepareCollectionHook(config.CollectionHook{Pre: "sleep 10", Timeout: 1}, ag)
+	start := time.Now()
+	ag.CollectMetrics(context.Background(), time.Now())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the hook should be killed by the timeout but took %s", elapsed)
+	}
+}
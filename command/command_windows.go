@@ -1,6 +1,7 @@
 package command
 
 import (
+	"github.com/mackerelio/mackerel-agent/checks"
 	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	metricsWindows "github.com/mackerelio/mackerel-agent/metrics/windows"
@@ -8,7 +9,7 @@ import (
 	specWindows "github.com/mackerelio/mackerel-agent/spec/windows"
 )
 
-func specGenerators() []spec.Generator {
+func specGenerators(conf *config.Config) []spec.Generator {
 	return []spec.Generator{
 		&specWindows.KernelGenerator{},
 		&specWindows.CPUGenerator{},
@@ -30,7 +31,7 @@ func metricsGenerators(conf *config.Config) []metrics.Generator {
 	if g, err = metricsWindows.NewProcessorQueueLengthGenerator(); err == nil {
 		generators = append(generators, g)
 	}
-	if g, err = metricsWindows.NewCPUUsageGenerator(); err == nil {
+	if g, err = metricsWindows.NewCPUUsageGenerator(metricsInterval); err == nil {
 		generators = append(generators, g)
 	}
 	if g, err = metricsWindows.NewMemoryGenerator(); err == nil {
@@ -58,3 +59,7 @@ func pluginGenerators(conf *config.Config) []metrics.PluginGenerator {
 	// XXX to be implemented
 	return []metrics.PluginGenerator{}
 }
+
+func builtinCheckers(conf *config.Config) []checks.Checker {
+	return []checks.Checker{}
+}
@@ -0,0 +1,148 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// configOutput is what the agent posts under a config by a collection: the values of the metrics keyed by
+// the names (prefixed by the custom identifier if any), and the names of the checks.
+type configOutput struct {
+	metrics map[string]float64
+	checks  []string
+}
+
+// DiffConfigs runs a collection under each of the configs, and writes the metrics and the checks which
+// appear or disappear by changing oldConf to newConf. A disappearing metric is reported as renamed to
+// an appearing one if it is the only one with the same value, which catches the plugins renamed by
+// the refactoring of the config files. The differences of the values are not reported.
+func DiffConfigs(oldConf, newConf *config.Config, w io.Writer) error {
+	origInterval := metricsInterval
+	metricsInterval = 1 * time.Second
+	defer func() {
+		metricsInterval = origInterval
+	}()
+
+	before := collectConfigOutput(oldConf)
+	after := collectConfigOutput(newConf)
+	lines := diffConfigOutputs(before, after)
+	if len(lines) == 0 {
+		_, err := fmt.Fprintln(w, "no differences")
+		return err
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func collectConfigOutput(conf *config.Config) *configOutput {
+	out := &configOutput{metrics: make(map[string]float64), checks: conf.CheckNames()}
+	result := NewAgent(conf).CollectMetrics(context.Background(), time.Now())
+	for _, values := range result.Values {
+		prefix := ""
+		if values.CustomIdentifier != nil {
+			prefix = "[" + *values.CustomIdentifier + "] "
+		}
+		for name, value := range values.Values {
+			out.metrics[prefix+name] = value
+		}
+	}
+	return out
+}
+
+// diffConfigOutputs returns the lines of the differences, like "+ metric custom.foo.bar",
+// "- check disk" and "~ metric custom.old -> custom.new", sorted by the names.
+func diffConfigOutputs(before, after *configOutput) []string {
+	var appeared, disappeared []string
+	for name := range after.metrics {
+		if _, ok := before.metrics[name]; !ok {
+			appeared = append(appeared, name)
+		}
+	}
+	for name := range before.metrics {
+		if _, ok := after.metrics[name]; !ok {
+			disappeared = append(disappeared, name)
+		}
+	}
+	sort.Strings(appeared)
+	sort.Strings(disappeared)
+
+	renamed := make(map[string]string) // disappeared -> appeared
+	for _, from := range disappeared {
+		if to, ok := uniqueByValue(before.metrics[from], appeared, after.metrics); ok {
+			if back, ok := uniqueByValue(after.metrics[to], disappeared, before.metrics); ok && back == from {
+				renamed[from] = to
+			}
+		}
+	}
+	renamedTo := make(map[string]bool)
+	for _, to := range renamed {
+		renamedTo[to] = true
+	}
+
+	var lines []string
+	for _, name := range disappeared {
+		if to, ok := renamed[name]; ok {
+			lines = append(lines, fmt.Sprintf("~ metric %s -> %s", name, to))
+		} else {
+			lines = append(lines, "- metric "+name)
+		}
+	}
+	for _, name := range appeared {
+		if !renamedTo[name] {
+			lines = append(lines, "+ metric "+name)
+		}
+	}
+
+	beforeChecks := make(map[string]bool)
+	for _, name := range before.checks {
+		beforeChecks[name] = true
+	}
+	afterChecks := make(map[string]bool)
+	for _, name := range after.checks {
+		afterChecks[name] = true
+	}
+	for _, name := range sortedNames(beforeChecks) {
+		if !afterChecks[name] {
+			lines = append(lines, "- check "+name)
+		}
+	}
+	for _, name := range sortedNames(afterChecks) {
+		if !beforeChecks[name] {
+			lines = append(lines, "+ check "+name)
+		}
+	}
+	return lines
+}
+
+// uniqueByValue returns the only name in names whose value is v
+func uniqueByValue(v float64, names []string, values map[string]float64) (string, bool) {
+	found := ""
+	for _, name := range names {
+		if values[name] != v {
+			continue
+		}
+		if found != "" {
+			return "", false
+		}
+		found = name
+	}
+	return found, found != ""
+}
+
+func sortedNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,47 @@
+package command
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfigOutputs(t *testing.T) {
+	before := &configOutput{
+		metrics: map[string]float64{
+			"loadavg5":          1.5,
+			"custom.foo.a":      10,
+			"custom.bar.a":      0,
+			"custom.bar.b":      0,
+			"[host1] custom.hx": 3,
+		},
+		checks: []string{"disk", "http"},
+	}
+	after := &configOutput{
+		metrics: map[string]float64{
+			"loadavg5":          1.2,
+			"custom.baz.a":      10,
+			"custom.qux.a":      0,
+			"[host1] custom.hx": 3,
+			"custom.new":        42,
+		},
+		checks: []string{"http", "process"},
+	}
+
+	expected := []string{
+		"- metric custom.bar.a",
+		"- metric custom.bar.b",
+		"~ metric custom.foo.a -> custom.baz.a",
+		"+ metric custom.new",
+		"+ metric custom.qux.a",
+		"- check disk",
+		"+ check process",
+	}
+	lines := diffConfigOutputs(before, after)
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("the differences should be %v but got %v", expected, lines)
+	}
+
+	if lines := diffConfigOutputs(before, before); len(lines) != 0 {
+		t.Errorf("no differences should be found: %v", lines)
+	}
+}
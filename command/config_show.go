@@ -0,0 +1,76 @@
+package command
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// redactedValue replaces the credentials in the configuration shown
+const redactedValue = "xxxxx"
+
+// ShowConfig writes the config files merged into conf in the order of the precedence (the latter overriding
+// the former), or the effective configuration in TOML if effective is true. The credentials (the API key,
+// the password of the proxy, the environment variables and the headers of the plugins, and the secrets
+// expanded into the commands) are masked if redact is true.
+func ShowConfig(conf *config.Config, effective, redact bool, w io.Writer) error {
+	if !effective {
+		for _, file := range conf.MergedFiles {
+			if _, err := fmt.Fprintln(w, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if redact {
+		conf = redactConfig(conf)
+	}
+	return conf.Encode(w)
+}
+
+// redactConfig returns the copy of conf with the credentials masked. The headers of the plugins
+// (e.g. Authorization of checkhttp) are masked, and the commands are shown before the environment variables
+// were expanded into them (see config.Config.Unexpanded).
+func redactConfig(conf *config.Config) *config.Config {
+	c := *conf
+	if c.Apikey != "" {
+		c.Apikey = redactedValue
+	}
+	c.HTTPProxy = redactURL(c.HTTPProxy)
+	c.ProxyPAC = redactURL(c.ProxyPAC)
+	c.Spool.EncryptionKeyCommand = conf.Unexpanded(c.Spool.EncryptionKeyCommand)
+	c.CollectionHook.Pre = conf.Unexpanded(c.CollectionHook.Pre)
+	c.CollectionHook.Post = conf.Unexpanded(c.CollectionHook.Post)
+	if conf.SharedCaches != nil {
+		c.SharedCaches = make(map[string]config.SharedCache, len(conf.SharedCaches))
+		for name, cache := range conf.SharedCaches {
+			cache.Command = conf.Unexpanded(cache.Command)
+			c.SharedCaches[name] = cache
+		}
+	}
+	c.Plugin = make(map[string]config.PluginConfigs, len(conf.Plugin))
+	for kind, plugins := range conf.Plugin {
+		c.Plugin[kind] = make(config.PluginConfigs, len(plugins))
+		for name, pc := range plugins {
+			pc.Command = conf.Unexpanded(pc.Command)
+			pc.URL = redactURL(pc.URL)
+			pc.Env = redactValues(pc.Env)
+			pc.Headers = redactValues(pc.Headers)
+			c.Plugin[kind][name] = pc
+		}
+	}
+	return &c
+}
+
+// redactValues returns the copy of m with all the values masked
+func redactValues(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return m
+	}
+	redacted := make(map[string]string, len(m))
+	for key := range m {
+		redacted[key] = redactedValue
+	}
+	return redacted
+}
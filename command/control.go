@@ -0,0 +1,350 @@
+package command
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/version"
+)
+
+// controlStatus is the response of GET /status of the control endpoint
+type controlStatus struct {
+	Version    string     `json:"version"`
+	Revision   string     `json:"revision"`
+	HostID     string     `json:"hostId"`
+	Diagnostic bool       `json:"diagnostic"`
+	Post       postStatus `json:"post"`
+
+	DisabledPlugins []disabledPlugin `json:"disabledPlugins"`
+}
+
+// ServeControl starts serving the control endpoint configured by [control], and returns the listener
+// to be closed on the termination. The endpoint accepts the following requests:
+//
+//	GET  /status               the status of the agent (the queue of the metrics, the last post and so on)
+//	POST /flush                post the queued metrics without waiting for the delays
+//	POST /reload               reload the configuration by reload
+//	POST /dump                 write the diagnostics dump (see DumpDiagnostics)
+//	POST /stop?retire=         stop the agent gracefully, retiring the host after it stopped if retire is "true"
+//	GET  /check-history?name=  the history of the transitions of the check (see [check_history])
+//	POST /plugin/disable?name=&duration=
+//	                           disable the metrics plugin or the check for the duration (e.g. "1h"),
+//	                           or until it is enabled if the duration is omitted
+//	POST /plugin/enable?name=  enable the plugin disabled
+//	GET  /debug/pprof/         the profiles of the agent by net/http/pprof (only with pprof of [control])
+//
+// The requests from the browsers (with Origin) are rejected, which any web page could send cross-origin.
+// On a TCP address, which any local user can connect to unlike the unix domain socket, the requests
+// should also carry the token written to control.token under Root readable only by the owner
+// (see writeControlToken), by "Authorization: Bearer <token>".
+func ServeControl(c *Context, reload func() error) (io.Closer, error) {
+	network, address := c.config().ControlAddress()
+	if network == "unix" {
+		// the socket left by the agent killed
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(address), 0755); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		// only the owner (root in general) can control the agent
+		if err := os.Chmod(address, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	var token string
+	if network == "tcp" {
+		if token, err = writeControlToken(controlTokenFile(c.config())); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	logger.Infof("Serving the control endpoint on %s", address)
+	go http.Serve(l, controlGuard(token, c.controlHandler(reload)))
+	return l, nil
+}
+
+const controlTokenFileName = "control.token"
+
+func controlTokenFile(conf *config.Config) string {
+	return filepath.Join(conf.Root, controlTokenFileName)
+}
+
+// writeControlToken generates the random token of the control endpoint, and writes it to file
+// readable only by the owner (and the administrators on Windows, see restrictControlToken).
+// The token is regenerated every time the agent starts.
+func writeControlToken(file string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", err
+	}
+	// the permission is applied only to the new file
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file, []byte(token), 0600); err != nil {
+		return "", err
+	}
+	if err := restrictControlToken(file); err != nil {
+		os.Remove(file)
+		return "", fmt.Errorf("failed to restrict the access to %s: %s", file, err)
+	}
+	return token, nil
+}
+
+// controlGuard rejects the requests with Origin, and the requests without token if it is not empty
+func controlGuard(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			http.Error(w, "the requests from the browsers are not allowed", http.StatusForbidden)
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (c *Context) controlHandler(reload func() error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", controlMethod("GET", func(w http.ResponseWriter, r *http.Request) {
+		st := controlStatus{
+			Version:    version.VERSION,
+			Revision:   version.GITCOMMIT,
+			Diagnostic: c.Agent.Diagnostic(),
+			Post:       c.postStats.status(),
+
+			DisabledPlugins: disabledPlugins.list(),
+		}
+		if c.Host != nil {
+			st.HostID = c.Host.ID
+		}
+		writeControlJSON(w, st)
+	}))
+	mux.HandleFunc("/flush", controlMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		c.Flush()
+		fmt.Fprintln(w, "flushing the queued metrics")
+	}))
+	mux.HandleFunc("/reload", controlMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		if err := reload(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload the configuration: %s", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "reloaded the configuration")
+	}))
+	mux.HandleFunc("/dump", controlMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		file, err := c.DumpDiagnostics()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to write the diagnostics: %s", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, file)
+	}))
+	mux.HandleFunc("/stop", controlMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		retire := r.URL.Query().Get("retire") == "true"
+		if !c.Stop(retire) {
+			http.Error(w, "the agent is not running", http.StatusServiceUnavailable)
+			return
+		}
+		if retire {
+			fmt.Fprintln(w, "stopping the agent, and retiring the host after it stopped")
+		} else {
+			fmt.Fprintln(w, "stopping the agent")
+		}
+	}))
+	mux.HandleFunc("/check-history", controlMethod("GET", func(w http.ResponseWriter, r *http.Request) {
+		if c.history == nil {
+			http.Error(w, "check_history is not enabled", http.StatusNotFound)
+			return
+		}
+		transitions := c.history.get(r.URL.Query().Get("name"))
+		if transitions == nil {
+			transitions = []checkTransition{}
+		}
+		writeControlJSON(w, transitions)
+	}))
+	mux.HandleFunc("/plugin/disable", controlMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if !pluginDefined(c.config(), name) {
+			http.Error(w, fmt.Sprintf("plugin %q is not defined", name), http.StatusNotFound)
+			return
+		}
+		var duration time.Duration
+		if d := r.URL.Query().Get("duration"); d != "" {
+			var err error
+			if duration, err = time.ParseDuration(d); err != nil || duration <= 0 {
+				http.Error(w, fmt.Sprintf("invalid duration: %q", d), http.StatusBadRequest)
+				return
+			}
+		}
+		disabledPlugins.disable(name, duration)
+		if duration > 0 {
+			fmt.Fprintf(w, "disabled plugin %q for %s\n", name, duration)
+		} else {
+			fmt.Fprintf(w, "disabled plugin %q\n", name)
+		}
+	}))
+	mux.HandleFunc("/plugin/enable", controlMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if !disabledPlugins.enable(name) {
+			http.Error(w, fmt.Sprintf("plugin %q is not disabled", name), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "enabled plugin %q\n", name)
+	}))
+	if c.config().Control.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// controlMethod responds 405 to the requests of the methods other than method
+func controlMethod(method string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f(w, r)
+	}
+}
+
+func writeControlJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warningf("Failed to write the response of the control endpoint: %s", err)
+	}
+}
+
+// the methods of the requests of the control commands
+var controlCommands = map[string]string{
+	"status": "GET",
+	"flush":  "POST",
+	"reload": "POST",
+	"dump":   "POST",
+}
+
+// RequestControl sends the command ("status", "flush", "reload" or "dump") to the control endpoint
+// of the running agent, and writes the response to w.
+func RequestControl(conf *config.Config, command string, w io.Writer) error {
+	method, ok := controlCommands[command]
+	if !ok {
+		return fmt.Errorf("unknown control command: %q", command)
+	}
+	return requestControl(conf, method, "/"+command, w)
+}
+
+// RequestStop stops the running agent gracefully, and makes it retire the host after it stopped if retire is true,
+// e.g. on the scale-in of the autoscaling groups.
+func RequestStop(conf *config.Config, retire bool, w io.Writer) error {
+	query := url.Values{}
+	if retire {
+		query.Set("retire", "true")
+	}
+	return requestControl(conf, "POST", "/stop?"+query.Encode(), w)
+}
+
+// RequestPluginControl disables ("disable") or enables ("enable") the metrics plugin or the check named name
+// of the running agent. The plugin is disabled for duration, or until it is enabled if duration is 0.
+func RequestPluginControl(conf *config.Config, action, name string, duration time.Duration, w io.Writer) error {
+	if action != "disable" && action != "enable" {
+		return fmt.Errorf("unknown plugin control command: %q", action)
+	}
+	if name == "" {
+		return fmt.Errorf("the name of the plugin should be specified")
+	}
+	query := url.Values{"name": {name}}
+	if action == "disable" && duration > 0 {
+		query.Set("duration", duration.String())
+	}
+	return requestControl(conf, "POST", "/plugin/"+action+"?"+query.Encode(), w)
+}
+
+// RequestProfile writes the profile named name (e.g. "heap", "goroutine", "profile" for the CPU profile
+// and "trace" for the execution trace) of the running agent to w, which requires pprof of [control].
+// The CPU profile and the execution trace are taken for seconds if it is positive.
+func RequestProfile(conf *config.Config, name string, seconds int, w io.Writer) error {
+	if name == "" {
+		return fmt.Errorf("the name of the profile should be specified")
+	}
+	path := "/debug/pprof/" + url.PathEscape(name)
+	timeout := controlRequestTimeout
+	if seconds > 0 {
+		path += "?seconds=" + strconv.Itoa(seconds)
+		timeout += time.Duration(seconds) * time.Second
+	}
+	return requestControlWithTimeout(conf, "GET", path, timeout, w)
+}
+
+const controlRequestTimeout = time.Minute
+
+func requestControl(conf *config.Config, method, path string, w io.Writer) error {
+	return requestControlWithTimeout(conf, method, path, controlRequestTimeout, w)
+}
+
+func requestControlWithTimeout(conf *config.Config, method, path string, timeout time.Duration, w io.Writer) error {
+	network, address := conf.ControlAddress()
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial(network, address)
+			},
+		},
+		Timeout: timeout,
+	}
+	req, err := http.NewRequest(method, "http://mackerel-agent"+path, nil)
+	if err != nil {
+		return err
+	}
+	if network == "tcp" {
+		token, err := ioutil.ReadFile(controlTokenFile(conf))
+		if err != nil {
+			return fmt.Errorf("failed to read the token of the control endpoint (run as the user of the agent): %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the control endpoint (is [control] enabled?): %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
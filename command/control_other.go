@@ -0,0 +1,8 @@
+// +build !windows
+
+package command
+
+// restrictControlToken does nothing, since the token file is created with the mode 0600
+func restrictControlToken(file string) error {
+	return nil
+}
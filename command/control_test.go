@@ -0,0 +1,276 @@
+// +build !windows
+
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+func TestServeControl(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-control")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	conf := &config.Config{Root: root, Control: config.Control{Enabled: true}}
+	c := &Context{
+		Agent:   &agent.Agent{},
+		Config:  conf,
+		Host:    &mackerel.Host{ID: "xyzabc12345"},
+		flushCh: make(chan struct{}, 1),
+	}
+	c.postStats.setQueue(make(chan *postValue, 10))
+	c.postStats.setState(loopStateHadError)
+	c.postStats.posted(errors.New("connection refused"))
+
+	reloaded := false
+	l, err := ServeControl(c, func() error {
+		reloaded = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(root + "/control.sock")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("the socket should be accessible only by the owner: %v", fi.Mode())
+	}
+
+	var buf bytes.Buffer
+	if err := RequestControl(conf, "status", &buf); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	var st controlStatus
+	if err := json.Unmarshal(buf.Bytes(), &st); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if st.HostID != "xyzabc12345" || st.Post.QueueCapacity != 10 || st.Post.LoopState != "had_error" ||
+		st.Post.ConsecutiveFailures != 1 || st.Post.LastError != "connection refused" || st.Post.LastSucceededAt != nil {
+		t.Errorf("the status is not reported correctly: %+v", st)
+	}
+
+	if err := RequestControl(conf, "flush", ioutil.Discard); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	select {
+	case <-c.flushCh:
+	default:
+		t.Errorf("flush should be requested")
+	}
+
+	if err := RequestControl(conf, "reload", ioutil.Discard); err != nil || !reloaded {
+		t.Errorf("the configuration should be reloaded: %v", err)
+	}
+
+	buf.Reset()
+	if err := RequestControl(conf, "dump", &buf); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), root) {
+		t.Errorf("the path of the diagnostics should be responded: %s", buf.String())
+	}
+
+	if err := RequestControl(conf, "unknown", ioutil.Discard); err == nil {
+		t.Errorf("should raise error for the unknown command")
+	}
+}
+
+func TestServeControl_tcp(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-control")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	conf := &config.Config{Root: root, Control: config.Control{Enabled: true, Listen: "127.0.0.1:0"}}
+	c := &Context{Agent: &agent.Agent{}, Config: conf}
+	l, err := ServeControl(c, func() error { return nil })
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer l.Close()
+	conf.Control.Listen = l.(net.Listener).Addr().String()
+
+	fi, err := os.Stat(root + "/control.token")
+	if err != nil {
+		t.Fatalf("the token should be written: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("the token should be readable only by the owner: %v", fi.Mode())
+	}
+	if err := RequestControl(conf, "status", ioutil.Discard); err != nil {
+		t.Errorf("should be authorized by the token: %v", err)
+	}
+
+	for name, header := range map[string]http.Header{
+		"without the token":    {},
+		"with the wrong token": {"Authorization": {"Bearer wrong"}},
+		"from the browser":     {"Origin": {"http://example.com"}},
+	} {
+		req, _ := http.NewRequest("POST", "http://"+conf.Control.Listen+"/flush", nil)
+		token, _ := ioutil.ReadFile(root + "/control.token")
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if name == "without the token" {
+			req.Header.Del("Authorization")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("the request %s should be rejected: %s", name, resp.Status)
+		}
+	}
+}
+
+func TestServeControl_stop(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-control")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	conf := &config.Config{Root: root, Control: config.Control{Enabled: true}}
+	c := &Context{Agent: &agent.Agent{}, Config: conf}
+	l, err := ServeControl(c, func() error { return nil })
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer l.Close()
+
+	if err := RequestStop(conf, true, ioutil.Discard); err == nil {
+		t.Error("should raise error when the agent is not running")
+	}
+	if c.retiring() {
+		t.Error("the host should not be retired when the agent is not running")
+	}
+
+	term := newTermination()
+	c.term = term
+	if err := RequestStop(conf, true, ioutil.Discard); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	select {
+	case <-term.graceful.Done():
+	default:
+		t.Error("the graceful termination should be requested")
+	}
+	if !c.retiring() {
+		t.Error("the host should be retired after the agent stopped")
+	}
+}
+
+func TestServeControl_plugin(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-control")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+	defer func() {
+		disabledPlugins = &pluginSwitches{disabled: make(map[string]time.Time)}
+	}()
+
+	conf := &config.Config{
+		Root:    root,
+		Control: config.Control{Enabled: true},
+		Plugin: map[string]config.PluginConfigs{
+			"metrics": {"mysql": config.PluginConfig{Command: "mackerel-plugin-mysql"}},
+			"checks":  {"heartbeat": config.PluginConfig{Command: "check-heartbeat"}},
+		},
+	}
+	c := &Context{Agent: &agent.Agent{}, Config: conf}
+	l, err := ServeControl(c, func() error { return nil })
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer l.Close()
+
+	if err := RequestPluginControl(conf, "disable", "mysql", time.Hour, ioutil.Discard); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if err := RequestPluginControl(conf, "disable", "heartbeat", 0, ioutil.Discard); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if err := RequestPluginControl(conf, "disable", "unknown", 0, ioutil.Discard); err == nil {
+		t.Errorf("should raise error for the undefined plugin")
+	}
+
+	var buf bytes.Buffer
+	if err := RequestControl(conf, "status", &buf); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	var st controlStatus
+	if err := json.Unmarshal(buf.Bytes(), &st); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if len(st.DisabledPlugins) != 2 || st.DisabledPlugins[0].Name != "heartbeat" || st.DisabledPlugins[0].Until != nil ||
+		st.DisabledPlugins[1].Name != "mysql" || st.DisabledPlugins[1].Until == nil {
+		t.Errorf("the disabled plugins are not reported correctly: %+v", st.DisabledPlugins)
+	}
+
+	if err := RequestPluginControl(conf, "enable", "mysql", 0, ioutil.Discard); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if err := RequestPluginControl(conf, "enable", "mysql", 0, ioutil.Discard); err == nil {
+		t.Errorf("should raise error for the plugin not disabled")
+	}
+	if disabledPlugins.isDisabled("mysql") || !disabledPlugins.isDisabled("heartbeat") {
+		t.Errorf("only heartbeat should be disabled: %+v", disabledPlugins.list())
+	}
+}
+
+func TestServeControl_pprof(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-control")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	conf := &config.Config{Root: root, Control: config.Control{Enabled: true}}
+	c := &Context{Agent: &agent.Agent{}, Config: conf}
+	l, err := ServeControl(c, func() error { return nil })
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if err := RequestProfile(conf, "heap", 0, ioutil.Discard); err == nil {
+		t.Errorf("the profiles should not be served without pprof")
+	}
+	l.Close()
+
+	conf.Control.Pprof = true
+	l, err = ServeControl(c, func() error { return nil })
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer l.Close()
+	var buf bytes.Buffer
+	if err := RequestProfile(conf, "heap", 0, &buf); err != nil || buf.Len() == 0 {
+		t.Errorf("the heap profile should be served: %v", err)
+	}
+	if err := RequestProfile(conf, "unknown", 0, ioutil.Discard); err == nil {
+		t.Errorf("should raise error for the unknown profile")
+	}
+}
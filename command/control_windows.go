@@ -0,0 +1,12 @@
+package command
+
+import (
+	"os/exec"
+)
+
+// restrictControlToken allows only SYSTEM and the administrators to access file, since the mode of
+// the file is not applied on Windows, and the files under Root (the directory of the agent by default)
+// are readable by the users.
+func restrictControlToken(file string) error {
+	return exec.Command("icacls", file, "/inheritance:r", "/grant:r", "*S-1-5-18:F", "*S-1-5-32-544:F").Run()
+}
@@ -0,0 +1,205 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/version"
+)
+
+// postStats is the state of posting the metrics for the diagnostics and the control endpoint
+type postStats struct {
+	mu              sync.Mutex
+	queue           chan *postValue
+	state           loopState
+	failures        int // consecutive
+	lastError       error
+	lastErrorAt     time.Time
+	lastSucceededAt time.Time
+}
+
+// postStatus is a snapshot of postStats
+type postStatus struct {
+	QueueLength         int        `json:"queueLength"`
+	QueueCapacity       int        `json:"queueCapacity"`
+	LoopState           string     `json:"loopState"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastErrorAt         *time.Time `json:"lastErrorAt,omitempty"`
+	LastSucceededAt     *time.Time `json:"lastSucceededAt,omitempty"`
+}
+
+func (s *postStats) setQueue(queue chan *postValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = queue
+}
+
+func (s *postStats) setState(state loopState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+// posted records the result of posting the metrics
+func (s *postStats) posted(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failures++
+		s.lastError = err
+		s.lastErrorAt = time.Now()
+		return
+	}
+	s.failures = 0
+	s.lastSucceededAt = time.Now()
+}
+
+func (s *postStats) status() postStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := postStatus{
+		QueueLength:         len(s.queue),
+		QueueCapacity:       cap(s.queue),
+		LoopState:           s.state.String(),
+		ConsecutiveFailures: s.failures,
+	}
+	if s.lastError != nil {
+		lastErrorAt := s.lastErrorAt
+		st.LastError, st.LastErrorAt = s.lastError.Error(), &lastErrorAt
+	}
+	if !s.lastSucceededAt.IsZero() {
+		lastSucceededAt := s.lastSucceededAt
+		st.LastSucceededAt = &lastSucceededAt
+	}
+	return st
+}
+
+func (s *postStats) write(buf *bytes.Buffer) {
+	st := s.status()
+	fmt.Fprintf(buf, "queue: %d/%d\n", st.QueueLength, st.QueueCapacity)
+	fmt.Fprintf(buf, "loop state: %s\n", st.LoopState)
+	fmt.Fprintf(buf, "consecutive failures: %d\n", st.ConsecutiveFailures)
+	if st.LastSucceededAt != nil {
+		fmt.Fprintf(buf, "last succeeded: %s\n", st.LastSucceededAt.Format(time.RFC3339))
+	}
+	if st.LastErrorAt != nil {
+		fmt.Fprintf(buf, "last error: %s %s\n", st.LastErrorAt.Format(time.RFC3339), st.LastError)
+	}
+}
+
+const diagnosticsFileNameFormat = "diagnostics-20060102-150405.txt"
+
+// DumpDiagnostics writes the diagnostics of the running agent (the state of posting the metrics,
+// the recent errors, the time taken by the generators, the summary of the configuration without
+// the credentials and the stack traces of the goroutines) to a file under Root, which is helpful
+// for reporting the problems like hangs. It returns the path of the file.
+func (c *Context) DumpDiagnostics() (string, error) {
+	now := time.Now()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "time: %s\n", now.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "version: %s (rev %s) [%s %s %s]\n", version.VERSION, version.GITCOMMIT, runtime.GOOS, runtime.GOARCH, runtime.Version())
+	fmt.Fprintf(&buf, "args: %s\n", strings.Join(os.Args, " "))
+	fmt.Fprintf(&buf, "goroutines: %d\n", runtime.NumGoroutine())
+	if c.Host != nil {
+		fmt.Fprintf(&buf, "host: %s (%s)\n", c.Host.ID, c.Host.Name)
+	}
+
+	conf := c.config()
+
+	buf.WriteString("\n== config\n")
+	writeConfigSummary(&buf, conf)
+
+	buf.WriteString("\n== posting metrics\n")
+	c.postStats.write(&buf)
+
+	buf.WriteString("\n== generators in the last collection\n")
+	if c.Agent != nil {
+		for _, t := range c.Agent.GeneratorTimings() {
+			fmt.Fprintf(&buf, "%s: started at %s, took %s", t.Name, t.Started.Format(time.RFC3339), t.Duration)
+			if t.Err != nil {
+				fmt.Fprintf(&buf, ", error: %s", t.Err)
+			}
+			buf.WriteString("\n")
+		}
+	}
+
+	buf.WriteString("\n== recent errors\n")
+	for _, e := range logging.RecentErrors() {
+		buf.WriteString(e + "\n")
+	}
+
+	buf.WriteString("\n== goroutines\n")
+	stack := make([]byte, 1024*1024)
+	stack = stack[:runtime.Stack(stack, true)]
+	buf.Write(stack)
+
+	file := filepath.Join(conf.Root, now.Format(diagnosticsFileNameFormat))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// writeConfigSummary writes the settings of the agent without the credentials
+// (the API key, the password of the proxy and the commands of the plugins).
+func writeConfigSummary(buf *bytes.Buffer, conf *config.Config) {
+	fmt.Fprintf(buf, "file: %s\n", conf.Conffile)
+	fmt.Fprintf(buf, "apibase: %s\n", conf.Apibase)
+	apikey := "(not set)"
+	if conf.Apikey != "" {
+		apikey = "(set)"
+	}
+	fmt.Fprintf(buf, "apikey: %s\n", apikey)
+	fmt.Fprintf(buf, "http_proxy: %s\n", redactURL(conf.HTTPProxy))
+	fmt.Fprintf(buf, "proxy_pac: %s\n", redactURL(conf.ProxyPAC))
+	fmt.Fprintf(buf, "tls_ca_file: %s, tls_cert_file: %s, tls_key_file: %s\n", conf.TLSCAFile, conf.TLSCertFile, conf.TLSKeyFile)
+	fmt.Fprintf(buf, "profile: %s\n", conf.Profile)
+	fmt.Fprintf(buf, "root: %s\n", conf.Root)
+	fmt.Fprintf(buf, "metrics interval: %s\n", conf.CollectionInterval())
+	fmt.Fprintf(buf, "verbose: %t, diagnostic: %t, log_format: %s\n", conf.Verbose, conf.Diagnostic, conf.LogFormat)
+	fmt.Fprintf(buf, "connection: %+v\n", conf.Connection)
+	fmt.Fprintf(buf, "spool: %+v\n", conf.Spool)
+	fmt.Fprintf(buf, "container: %+v\n", conf.Container)
+	fmt.Fprintf(buf, "roles: %s\n", strings.Join(conf.Roles, ", "))
+	kinds := make([]string, 0, len(conf.Plugin))
+	for kind := range conf.Plugin {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		names := make([]string, 0, len(conf.Plugin[kind]))
+		for name := range conf.Plugin[kind] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(buf, "plugin.%s: %s\n", kind, strings.Join(names, ", "))
+	}
+}
+
+// redactURL replaces the password in rawurl
+func redactURL(rawurl string) string {
+	i := strings.Index(rawurl, "://")
+	at := strings.LastIndex(rawurl, "@")
+	if i < 0 || at < i {
+		return rawurl
+	}
+	userinfo := rawurl[i+3 : at]
+	if colon := strings.Index(userinfo, ":"); colon >= 0 {
+		userinfo = userinfo[:colon] + ":xxxxx"
+	}
+	return rawurl[:i+3] + userinfo + rawurl[at:]
+}
@@ -0,0 +1,209 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// discoveredPort is a TCP port listening on the host and the name of the process ("" if unknown)
+type discoveredPort struct {
+	port    int
+	process string
+}
+
+// discoveryRule suggests the plugins for the service listening on the host,
+// which is found by the names of its processes or its well-known port
+type discoveryRule struct {
+	name      string
+	processes []string
+	port      int
+	instances bool // whether the instances of the service on the ports are configured respectively
+	snippet   func(name string, port int) string
+}
+
+var discoveryRules = []discoveryRule{
+	{
+		name:      "nginx",
+		processes: []string{"nginx"},
+		port:      80,
+		snippet: func(name string, port int) string {
+			return fmt.Sprintf(`# requires the stub_status at /nginx_status
+[plugin.metrics.%[1]s]
+command = "mackerel-plugin-nginx -host=127.0.0.1 -port=%[2]d -path=/nginx_status"
+
+[plugin.checktcp.%[1]s]
+targets = ["127.0.0.1:%[2]d"]
+`, name, port)
+		},
+	},
+	{
+		name:      "mysql",
+		processes: []string{"mysqld", "mariadbd"},
+		port:      3306,
+		instances: true,
+		snippet: func(name string, port int) string {
+			return fmt.Sprintf(`[plugin.metrics.%[1]s]
+command = "mackerel-plugin-mysql -host=127.0.0.1 -port=%[2]d -username=mackerel -password=${MYSQL_PASSWORD}"
+# set the password of the user
+env = { MYSQL_PASSWORD = "" }
+
+[plugin.checktcp.%[1]s]
+targets = ["127.0.0.1:%[2]d"]
+`, name, port)
+		},
+	},
+	{
+		name:      "redis",
+		processes: []string{"redis-server"},
+		port:      6379,
+		instances: true,
+		snippet: func(name string, port int) string {
+			return fmt.Sprintf(`[plugin.metrics.%[1]s]
+command = "mackerel-plugin-redis -host=127.0.0.1 -port=%[2]d"
+
+[plugin.checktcp.%[1]s]
+targets = ["127.0.0.1:%[2]d"]
+send = "PING\r\n"
+expect = "+PONG"
+`, name, port)
+		},
+	},
+	{
+		name:      "postgres",
+		processes: []string{"postgres", "postmaster"},
+		port:      5432,
+		instances: true,
+		snippet: func(name string, port int) string {
+			return fmt.Sprintf(`[plugin.metrics.%[1]s]
+command = "mackerel-plugin-postgres -hostname=127.0.0.1 -port=%[2]d -user=mackerel -password=${PGPASSWORD}"
+# set the password of the user
+env = { PGPASSWORD = "" }
+
+[plugin.checktcp.%[1]s]
+targets = ["127.0.0.1:%[2]d"]
+`, name, port)
+		},
+	},
+}
+
+// discoveredService is the service found by a discoveryRule
+type discoveredService struct {
+	name    string // the name of the plugins, e.g. "redis" or "redis_6380"
+	port    int
+	snippet string
+}
+
+// discoverServices matches the ports with the rules. A service is found by the names of the processes
+// if known, or by the well-known port otherwise. The instances of the service listening on the ports other than
+// the well-known one are suffixed with the ports, or only the first port is used for the services without instances.
+func discoverServices(ports []discoveredPort) []discoveredService {
+	var services []discoveredService
+	seen := make(map[string]bool)
+	for _, p := range ports {
+		for _, rule := range discoveryRules {
+			if !rule.match(p) {
+				continue
+			}
+			name := rule.name
+			if rule.instances && p.port != rule.port {
+				name += "_" + strconv.Itoa(p.port)
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			services = append(services, discoveredService{name: name, port: p.port, snippet: rule.snippet(name, p.port)})
+		}
+	}
+	sort.Sort(discoveredServices(services))
+	return services
+}
+
+type discoveredServices []discoveredService
+
+func (ss discoveredServices) Len() int           { return len(ss) }
+func (ss discoveredServices) Less(i, j int) bool { return ss[i].name < ss[j].name }
+func (ss discoveredServices) Swap(i, j int)      { ss[i], ss[j] = ss[j], ss[i] }
+
+func (rule discoveryRule) match(p discoveredPort) bool {
+	if p.process == "" {
+		return p.port == rule.port
+	}
+	for _, process := range rule.processes {
+		if p.process == process {
+			return true
+		}
+	}
+	return false
+}
+
+// probeWellKnownPorts returns the well-known ports of the rules accepting the connections on the loopback,
+// which is used where the listening ports cannot be listed
+func probeWellKnownPorts() []discoveredPort {
+	var ports []discoveredPort
+	for _, rule := range discoveryRules {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(rule.port)), time.Second)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		ports = append(ports, discoveredPort{port: rule.port})
+	}
+	return ports
+}
+
+// Discover finds the services (nginx, mysql, redis and postgres) listening on the host, and writes the snippets
+// of the config of the plugins for them to w. The services whose metrics plugins are already configured are skipped.
+// If write is true, the snippets are written to the files <name>.conf in the directory of Include of conf instead,
+// skipping the files which exist.
+func Discover(conf *config.Config, write bool, w io.Writer) error {
+	ports, err := listeningTCPPorts()
+	if err != nil {
+		logger.Warningf("Failed to list the listening ports (the well-known ports are probed instead): %s", err)
+		ports = probeWellKnownPorts()
+	}
+	var dir string
+	if write {
+		if conf.Include == "" {
+			return fmt.Errorf("include should be configured in the config file to write the plugins")
+		}
+		dir = filepath.Dir(conf.Include)
+	}
+
+	found := false
+	for _, service := range discoverServices(ports) {
+		if _, ok := conf.Plugin["metrics"][service.name]; ok {
+			continue
+		}
+		found = true
+		if !write {
+			fmt.Fprintf(w, "# %s (port %d)\n%s\n", service.name, service.port, service.snippet)
+			continue
+		}
+		file := filepath.Join(dir, service.name+".conf")
+		if _, err := os.Stat(file); err == nil {
+			fmt.Fprintf(w, "%s exists (skipped)\n", file)
+			continue
+		}
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "# discovered by mackerel-agent discover: %s (port %d)\n%s", service.name, service.port, service.snippet)
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s written\n", file)
+	}
+	if !found {
+		fmt.Fprintln(w, "# no services to be configured are found")
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package command
+
+import (
+	specLinux "github.com/mackerelio/mackerel-agent/spec/linux"
+)
+
+// listeningTCPPorts returns the TCP ports listening on the host with the names of the processes
+func listeningTCPPorts() ([]discoveredPort, error) {
+	ports, err := specLinux.CollectListeningPorts()
+	if err != nil {
+		return nil, err
+	}
+	var tcpPorts []discoveredPort
+	for _, p := range ports {
+		if p.Protocol == "tcp" {
+			tcpPorts = append(tcpPorts, discoveredPort{port: p.Port, process: p.Process})
+		}
+	}
+	return tcpPorts, nil
+}
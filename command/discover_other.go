@@ -0,0 +1,9 @@
+// +build !linux
+
+package command
+
+import "errors"
+
+func listeningTCPPorts() ([]discoveredPort, error) {
+	return nil, errors.New("listing the listening ports is not supported on this platform")
+}
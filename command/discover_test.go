@@ -0,0 +1,75 @@
+package command
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestDiscoverServices(t *testing.T) {
+	ports := []discoveredPort{
+		{port: 22, process: "sshd"},
+		{port: 80, process: "nginx"},
+		{port: 443, process: "nginx"},
+		{port: 3306, process: "mysqld"},
+		{port: 3306, process: "mysqld"}, // tcp6
+		{port: 5432},                    // the process is unknown
+		{port: 6379, process: "redis-server"},
+		{port: 6380, process: "redis-server"},
+		{port: 8080, process: "java"},
+	}
+	var names []string
+	for _, service := range discoverServices(ports) {
+		names = append(names, service.name)
+	}
+	expected := []string{"mysql", "nginx", "postgres", "redis", "redis_6380"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("the services should be %v but %v", expected, names)
+	}
+
+	dir, err := ioutil.TempDir("", "mackerel-agent-discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, service := range discoverServices(ports) {
+		file := filepath.Join(dir, service.name+".conf")
+		ioutil.WriteFile(file, []byte(service.snippet), 0644)
+		conf, err := config.LoadConfig(file)
+		if err != nil {
+			t.Errorf("the snippet of %s should be a valid config: %s", service.name, err)
+			continue
+		}
+		if _, ok := conf.Plugin["metrics"][service.name]; !ok {
+			t.Errorf("the snippet of %s should configure the metrics plugin: %+v", service.name, conf.Plugin)
+		}
+	}
+}
+
+func TestDiscover_write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := Discover(&config.Config{}, true, ioutil.Discard); err == nil {
+		t.Error("should raise error without include")
+	}
+
+	conf := &config.Config{Include: filepath.Join(dir, "*.conf")}
+	var buf bytes.Buffer
+	if err := Discover(conf, true, &buf); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	files, _ := filepath.Glob(conf.Include)
+	if len(files) != strings.Count(buf.String(), " written\n") {
+		t.Errorf("the written files should be reported: %v %q", files, buf.String())
+	}
+}
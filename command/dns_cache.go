@@ -0,0 +1,29 @@
+package command
+
+import (
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// dnsCacheGenerator generates the numbers of the failed lookups of the DNS cache of the API client,
+// and the requests served by the stale addresses.
+type dnsCacheGenerator struct {
+	cache *mackerel.DNSCache
+}
+
+// prepareDNSCacheMetrics registers the metrics generator of the DNS cache to the agent if the API client uses it.
+func prepareDNSCacheMetrics(api *mackerel.API, ag *agent.Agent) {
+	if cache := api.DNSCache(); cache != nil {
+		ag.MetricsGenerators = append(ag.MetricsGenerators, &dnsCacheGenerator{cache: cache})
+	}
+}
+
+// Generate generates the numbers since the previous invocation
+func (g *dnsCacheGenerator) Generate() (metrics.Values, error) {
+	failures, stale := g.cache.Stats()
+	return metrics.Values{
+		"custom.agent.dns.failures": float64(failures),
+		"custom.agent.dns.stale":    float64(stale),
+	}, nil
+}
@@ -0,0 +1,108 @@
+package command
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// expectedMetrics counts the consecutive collections missing the metrics of config.ExpectedMetrics.
+type expectedMetrics struct {
+	names    []string
+	warning  int
+	critical int
+
+	mu      sync.Mutex
+	missing map[string]int // name (or pattern) -> consecutive collections missing it
+}
+
+func newExpectedMetrics(conf config.ExpectedMetrics) *expectedMetrics {
+	return &expectedMetrics{
+		names:    conf.Names,
+		warning:  conf.WarningCycles,
+		critical: conf.CriticalCycles,
+		missing:  make(map[string]int),
+	}
+}
+
+// prepareExpectedMetrics creates the expected metrics if any are declared, and registers its checker
+// to the agent.
+func prepareExpectedMetrics(conf *config.Config, ag *agent.Agent) *expectedMetrics {
+	if len(conf.ExpectedMetrics.Names) == 0 {
+		return nil
+	}
+	e := newExpectedMetrics(conf.ExpectedMetrics)
+	ag.Checkers = append(ag.Checkers, checks.Checker{
+		Name: config.ExpectedMetricsCheckName,
+		Config: config.PluginConfig{
+			NotificationInterval: conf.ExpectedMetrics.NotificationInterval,
+			CheckInterval:        conf.ExpectedMetrics.CheckInterval,
+		},
+		Func: e.check,
+	})
+	return e
+}
+
+// observe records the values posted at a collection.
+// The expected metrics are nil-safe, observing nothing.
+func (e *expectedMetrics) observe(values []*mackerel.CreatingMetricsValue) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, name := range e.names {
+		if matchesAnyMetric(name, values) {
+			e.missing[name] = 0
+		} else {
+			e.missing[name]++
+		}
+	}
+}
+
+func matchesAnyMetric(pattern string, values []*mackerel.CreatingMetricsValue) bool {
+	wildcard := strings.Contains(pattern, "*")
+	for _, v := range values {
+		if !wildcard {
+			if v.Name == pattern {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, v.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *expectedMetrics) check() (checks.Status, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status := checks.StatusOK
+	var missing []string
+	for _, name := range e.names {
+		n := e.missing[name]
+		if n < e.warning {
+			continue
+		}
+		if n >= e.critical {
+			status = checks.StatusCritical
+		} else if status != checks.StatusCritical {
+			status = checks.StatusWarning
+		}
+		missing = append(missing, fmt.Sprintf("%s (%d collections)", name, n))
+	}
+	if len(missing) == 0 {
+		return checks.StatusOK, fmt.Sprintf("%d expected metrics are posted", len(e.names))
+	}
+	sort.Strings(missing)
+	return status, "missing metrics: " + strings.Join(missing, ", ")
+}
@@ -0,0 +1,67 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+func testCreatingValues(names ...string) []*mackerel.CreatingMetricsValue {
+	values := []*mackerel.CreatingMetricsValue{}
+	for _, name := range names {
+		values = append(values, &mackerel.CreatingMetricsValue{HostID: "xyzabc12345", Name: name, Time: 1474186920, Value: 1.0})
+	}
+	return values
+}
+
+func TestExpectedMetrics(t *testing.T) {
+	e := newExpectedMetrics(config.ExpectedMetrics{
+		Names:          []string{"custom.app.requests", "custom.queue.*.depth"},
+		WarningCycles:  2,
+		CriticalCycles: 3,
+	})
+
+	e.observe(testCreatingValues("custom.app.requests", "custom.queue.orders.depth", "loadavg5"))
+	if status, msg := e.check(); status != checks.StatusOK {
+		t.Errorf("status should be OK but %s: %s", status, msg)
+	}
+
+	e.observe(testCreatingValues("custom.queue.orders.depth"))
+	if status, msg := e.check(); status != checks.StatusOK {
+		t.Errorf("status should be OK before warning_cycles but %s: %s", status, msg)
+	}
+	e.observe(testCreatingValues("custom.queue.orders.depth"))
+	if status, msg := e.check(); status != checks.StatusWarning || msg != "missing metrics: custom.app.requests (2 collections)" {
+		t.Errorf("status should be WARNING at warning_cycles but %s: %s", status, msg)
+	}
+	e.observe(testCreatingValues("loadavg5"))
+	if status, msg := e.check(); status != checks.StatusCritical {
+		t.Errorf("status should be CRITICAL at critical_cycles but %s: %s", status, msg)
+	}
+
+	e.observe(testCreatingValues("custom.app.requests", "custom.queue.payments.depth"))
+	if status, msg := e.check(); status != checks.StatusOK {
+		t.Errorf("status should be OK after the metrics are posted again but %s: %s", status, msg)
+	}
+}
+
+func TestPrepareExpectedMetrics(t *testing.T) {
+	conf := &config.Config{}
+	e := prepareExpectedMetrics(conf, &agent.Agent{})
+	if e != nil {
+		t.Errorf("expected metrics should not be created without names")
+	}
+	e.observe(testCreatingValues("loadavg5")) // nil-safe
+
+	conf.ExpectedMetrics = config.ExpectedMetrics{Names: []string{"custom.app.requests"}, WarningCycles: 3, CriticalCycles: 5}
+	ag := &agent.Agent{}
+	if e := prepareExpectedMetrics(conf, ag); e == nil {
+		t.Errorf("expected metrics should be created with names")
+	}
+	if len(ag.Checkers) != 1 || ag.Checkers[0].Name != config.ExpectedMetricsCheckName {
+		t.Errorf("the checker of the expected metrics should be registered: %+v", ag)
+	}
+}
@@ -0,0 +1,76 @@
+package command
+
+import (
+	"context"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// the number of the collections on the fast path kept while the posts fail
+const fastPathQueueSize = 6
+
+// fastPathConfig returns the copy of conf whose metrics plugins are only the ones on the fast path if fast is true,
+// or only the others if false.
+func fastPathConfig(conf *config.Config, fast bool) *config.Config {
+	c := *conf
+	c.Plugin = make(map[string]config.PluginConfigs, len(conf.Plugin))
+	for kind, plugins := range conf.Plugin {
+		if kind != "metrics" {
+			if !fast {
+				c.Plugin[kind] = plugins
+			}
+			continue
+		}
+		filtered := config.PluginConfigs{}
+		for name, plugin := range plugins {
+			if plugin.FastPath == fast {
+				filtered[name] = plugin
+			}
+		}
+		c.Plugin[kind] = filtered
+	}
+	return &c
+}
+
+// fastPathLoop collects the metrics of the plugins on the fast path at the interval of [fast_path],
+// and posts them right away in a request separately from the other metrics.
+// The values failed to be posted are retried with the next ones, and the oldest are abandoned
+// when more than fastPathQueueSize collections are pending.
+func fastPathLoop(ctx context.Context, c *Context) {
+	ticker := time.NewTicker(c.config().FastPathInterval())
+	defer ticker.Stop()
+	var pending []*postValue
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			result := c.Agent.CollectFastMetrics(ctx, t)
+			if len(result.Values) == 0 && len(pending) == 0 {
+				continue
+			}
+			v := metricsPostValue(c, result)
+			c.runMetricsHooks(v.values)
+			pending = append(pending, v)
+			if len(pending) > fastPathQueueSize {
+				logger.Warningf("The metrics on the fast path collected at %d times are not posted and abandoned.", len(pending)-fastPathQueueSize)
+				pending = pending[len(pending)-fastPathQueueSize:]
+			}
+			values := []*mackerel.CreatingMetricsValue{}
+			for _, v := range pending {
+				values = append(values, v.values...)
+			}
+			if len(values) == 0 {
+				pending = nil
+				continue
+			}
+			if err := c.API.PostMetricsValues(values); err != nil {
+				logger.Warningf("Failed to post the metrics on the fast path (will retry): %s", err)
+				continue
+			}
+			pending = nil
+		}
+	}
+}
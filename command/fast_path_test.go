@@ -0,0 +1,38 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestFastPathConfig(t *testing.T) {
+	conf := &config.Config{
+		Plugin: map[string]config.PluginConfigs{
+			"metrics": {
+				"queue": config.PluginConfig{Command: "queue-depth", FastPath: true},
+				"mysql": config.PluginConfig{Command: "mackerel-plugin-mysql"},
+			},
+			"checks": {
+				"ssh": config.PluginConfig{Command: "check-ssh"},
+			},
+		},
+	}
+
+	fast := fastPathConfig(conf, true)
+	if len(fast.Plugin["metrics"]) != 1 || fast.Plugin["metrics"]["queue"].Command != "queue-depth" || len(fast.Plugin["checks"]) != 0 {
+		t.Errorf("only the metrics plugins on the fast path should be kept: %v", fast.Plugin)
+	}
+	regular := fastPathConfig(conf, false)
+	if len(regular.Plugin["metrics"]) != 1 || regular.Plugin["metrics"]["mysql"].Command != "mackerel-plugin-mysql" || len(regular.Plugin["checks"]) != 1 {
+		t.Errorf("the plugins on the fast path should be removed: %v", regular.Plugin)
+	}
+	if len(conf.Plugin["metrics"]) != 2 {
+		t.Errorf("the original config should not be changed: %v", conf.Plugin)
+	}
+
+	ag := NewAgent(conf)
+	if len(ag.FastPluginGenerators) != 1 || len(ag.PluginGenerators) != 1 {
+		t.Errorf("the plugins on the fast path should be separated: %d, %d", len(ag.FastPluginGenerators), len(ag.PluginGenerators))
+	}
+}
@@ -0,0 +1,123 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/version"
+)
+
+const crashReportFileName = "crash_report.txt"
+
+// fatalReportedFileName is the marker of the fatal error reported, whose alert is closed by the next start
+const fatalReportedFileName = "fatal_reported"
+
+// Max length of the message of the check report
+const fatalMessageMax = 1024
+
+// ReportFatal reports the fatal error which stops the agent. The error is reported as CRITICAL
+// of the check named config.FatalCheckName when the API is reachable, and written to the
+// crash report file when conf.CrashReport is true.
+// c may be nil when the agent fails before it is prepared.
+func ReportFatal(conf *config.Config, c *Context, fatal error) {
+	if conf.CrashReport {
+		file := filepath.Join(conf.Root, crashReportFileName)
+		if err := writeCrashReport(file, conf, c, fatal); err != nil {
+			logger.Errorf("Failed to write the crash report: %s", err)
+		} else {
+			logger.Infof("The crash report is written to %s", file)
+		}
+	}
+
+	var hostID string
+	var api *mackerel.API
+	if c != nil {
+		hostID, api = c.Host.ID, c.API
+	} else {
+		var err error
+		if hostID, err = conf.LoadHostID(); err != nil {
+			logger.Debugf("The fatal error is not reported because the host is not registered yet: %s", err)
+			return
+		}
+		if api, err = NewAPI(conf); err != nil {
+			logger.Errorf("Failed to report the fatal error: %s", err)
+			return
+		}
+	}
+	report := &checks.Report{
+		Name:       config.FatalCheckName,
+		Status:     checks.StatusCritical,
+		Message:    fatalMessage(fatal),
+		OccurredAt: time.Now(),
+	}
+	if err := api.ReportCheckMonitors(hostID, []*checks.Report{report}); err != nil {
+		logger.Errorf("Failed to report the fatal error: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(conf.Root, fatalReportedFileName), nil, 0600); err != nil {
+		logger.Warningf("Failed to record the fatal error reported: %s", err)
+	}
+}
+
+// reportStarted reports OK of the check named config.FatalCheckName, which closes the alert
+// of the last fatal error. It is reported only when the fatal error has been reported by ReportFatal.
+func reportStarted(c *Context) {
+	marker := filepath.Join(c.config().Root, fatalReportedFileName)
+	if _, err := os.Stat(marker); err != nil {
+		return
+	}
+	report := &checks.Report{
+		Name:       config.FatalCheckName,
+		Status:     checks.StatusOK,
+		Message:    fmt.Sprintf("mackerel-agent %s started", version.VERSION),
+		OccurredAt: time.Now(),
+	}
+	if err := c.API.ReportCheckMonitors(c.Host.ID, []*checks.Report{report}); err != nil {
+		logger.Warningf("Failed to report the start of the agent: %s", err)
+		return
+	}
+	if err := os.Remove(marker); err != nil {
+		logger.Warningf("Failed to remove %s: %s", marker, err)
+	}
+}
+
+func fatalMessage(fatal error) string {
+	msg := fmt.Sprintf("mackerel-agent %s (rev %s) stopped by the fatal error: %s", version.VERSION, version.GITCOMMIT, fatal)
+	if len(msg) > fatalMessageMax {
+		msg = msg[:fatalMessageMax-3] + "..."
+	}
+	return msg
+}
+
+// writeCrashReport writes the environment of the agent, the error and the stack traces of
+// the goroutines to file.
+func writeCrashReport(file string, conf *config.Config, c *Context, fatal error) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "time: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&buf, "version: %s (rev %s) [%s %s %s]\n", version.VERSION, version.GITCOMMIT, runtime.GOOS, runtime.GOARCH, runtime.Version())
+	fmt.Fprintf(&buf, "args: %s\n", strings.Join(os.Args, " "))
+	fmt.Fprintf(&buf, "config: %s\n", conf.Conffile)
+	fmt.Fprintf(&buf, "apibase: %s\n", conf.Apibase)
+	if c != nil {
+		fmt.Fprintf(&buf, "host: %s (%s)\n", c.Host.ID, c.Host.Name)
+	}
+	fmt.Fprintf(&buf, "error: %s\n\n", fatal)
+
+	stack := make([]byte, 1024*1024)
+	stack = stack[:runtime.Stack(stack, true)]
+	buf.Write(stack)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0600)
+}
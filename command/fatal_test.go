@@ -0,0 +1,81 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+func TestReportFatal(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-fatal")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	var reports []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v0/monitoring/checks/report" {
+			t.Errorf("check report should be posted but %s", req.URL.Path)
+		}
+		var payload struct {
+			Reports []map[string]interface{} `json:"reports"`
+		}
+		json.NewDecoder(req.Body).Decode(&payload)
+		reports = append(reports, payload.Reports...)
+		res.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	conf := &config.Config{Apibase: ts.URL, Apikey: "dummy-key", Root: root, CrashReport: true}
+	ReportFatal(conf, nil, errors.New("failed to prepare"))
+	if len(reports) != 0 {
+		t.Errorf("the fatal error should not be reported before the host is registered")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, crashReportFileName))
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if !strings.Contains(string(content), "error: failed to prepare\n") || !strings.Contains(string(content), "goroutine ") {
+		t.Errorf("crash report should contain the error and the stack traces: %s", string(content))
+	}
+
+	conf.SaveHostID("xyzabc12345")
+	ReportFatal(conf, nil, errors.New("failed to prepare"))
+	if len(reports) != 1 {
+		t.Fatalf("the fatal error should be reported: %v", reports)
+	}
+	if reports[0]["name"] != config.FatalCheckName || reports[0]["status"] != "CRITICAL" {
+		t.Errorf("the fatal error should be reported as CRITICAL: %v", reports[0])
+	}
+	if !strings.HasSuffix(reports[0]["message"].(string), "failed to prepare") {
+		t.Errorf("the message should contain the error: %v", reports[0]["message"])
+	}
+
+	api, _ := mackerel.NewAPI(ts.URL, "dummy-key", false)
+	c := &Context{Config: conf, Host: &mackerel.Host{ID: "xyzabc12345"}, API: api}
+	reportStarted(c)
+	if len(reports) != 2 || reports[1]["status"] != "OK" {
+		t.Fatalf("the start should be reported as OK after the fatal error: %v", reports)
+	}
+	reportStarted(c)
+	if len(reports) != 2 {
+		t.Errorf("the start should not be reported without the fatal error reported: %v", reports)
+	}
+}
+
+func TestFatalMessage(t *testing.T) {
+	msg := fatalMessage(errors.New(strings.Repeat("x", 2000)))
+	if len(msg) != fatalMessageMax || !strings.HasSuffix(msg, "x...") {
+		t.Errorf("long message should be truncated: %s", msg)
+	}
+}
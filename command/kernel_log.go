@@ -0,0 +1,219 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+const kernelLogCursorFileName = "kernel_log.cursor"
+
+// The patterns of the kernel log checked by default
+var defaultKernelLogPatterns = []string{
+	`I/O error`,
+	`task \S+ blocked for more than \d+ seconds`, // hung tasks
+	`NETDEV WATCHDOG|[Rr]eset adapter`,           // NIC resets
+}
+
+const defaultKernelLogMaxMessages = 5
+
+// kernelLog scans the kernel log for the patterns configured by config.KernelLog.
+// The sequence number of the last scanned record is persisted with the boot ID,
+// so that the records are not scanned again after the restart of the agent.
+type kernelLog struct {
+	patterns    []*regexp.Regexp
+	maxMessages int
+	cursorFile  string
+	bootID      string
+
+	mu      sync.Mutex
+	cursor  *kernelLogCursor
+	matches int // since the last Generate
+}
+
+type kernelLogCursor struct {
+	BootID string `json:"bootId"`
+	Seq    uint64 `json:"seq"`
+}
+
+type kmsgRecord struct {
+	seq     uint64
+	message string
+}
+
+// prepareKernelLog registers the checker and the metrics generator of the kernel log to the agent if configured.
+func prepareKernelLog(conf *config.Config, ag *agent.Agent) {
+	if !conf.KernelLog.Check {
+		return
+	}
+	if !kmsgSupported {
+		logger.Warningf("The kernel log check is not available on this platform. [kernel_log] check is ignored.")
+		return
+	}
+	k := newKernelLog(conf)
+	ag.MetricsGenerators = append(ag.MetricsGenerators, k)
+	ag.Checkers = append(ag.Checkers, checks.Checker{
+		Name: config.KernelLogCheckName,
+		Config: config.PluginConfig{
+			NotificationInterval: conf.KernelLog.NotificationInterval,
+			CheckInterval:        conf.KernelLog.CheckInterval,
+		},
+		Func: k.check,
+	})
+}
+
+func newKernelLog(conf *config.Config) *kernelLog {
+	sources := conf.KernelLog.Patterns
+	if len(sources) == 0 {
+		sources = defaultKernelLogPatterns
+	}
+	var patterns []*regexp.Regexp
+	for _, source := range sources {
+		re, err := regexp.Compile(source)
+		if err != nil {
+			logger.Warningf("Ignoring the invalid pattern of [kernel_log] %q: %s", source, err)
+			continue
+		}
+		patterns = append(patterns, re)
+	}
+	maxMessages := conf.KernelLog.MaxMessages
+	if maxMessages <= 0 {
+		maxMessages = defaultKernelLogMaxMessages
+	}
+	bootID, err := ioutil.ReadFile(util.HostPath("/proc/sys/kernel/random/boot_id"))
+	if err != nil {
+		logger.Debugf("Failed to read the boot ID: %s", err)
+	}
+	return &kernelLog{
+		patterns:    patterns,
+		maxMessages: maxMessages,
+		cursorFile:  filepath.Join(conf.Root, kernelLogCursorFileName),
+		bootID:      strings.TrimSpace(string(bootID)),
+	}
+}
+
+// loadCursor loads the cursor of the current boot, or returns nil if not found
+func (k *kernelLog) loadCursor() *kernelLogCursor {
+	content, err := ioutil.ReadFile(k.cursorFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read the cursor of the kernel log: %s", err)
+		}
+		return nil
+	}
+	var cursor kernelLogCursor
+	if err := json.Unmarshal(content, &cursor); err != nil || cursor.BootID != k.bootID {
+		return nil
+	}
+	return &cursor
+}
+
+func (k *kernelLog) saveCursor() error {
+	content, err := json.Marshal(k.cursor)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(k.cursorFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(k.cursorFile, content, 0644)
+}
+
+func (k *kernelLog) check() (checks.Status, string) {
+	lines, err := readKmsg()
+	if err != nil {
+		return checks.StatusUnknown, fmt.Sprintf("failed to read the kernel log: %s", err)
+	}
+	return k.report(lines)
+}
+
+// report scans the records of the kernel log, and reports the matches
+func (k *kernelLog) report(lines []string) (checks.Status, string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cursor == nil {
+		// scan all the records of the current boot at first
+		k.cursor = k.loadCursor()
+	}
+	matched := k.scan(lines)
+	if k.cursor != nil {
+		if err := k.saveCursor(); err != nil {
+			logger.Warningf("Failed to save the cursor of the kernel log: %s", err)
+		}
+	}
+
+	if len(matched) == 0 {
+		return checks.StatusOK, "no matches in the kernel log"
+	}
+	k.matches += len(matched)
+	message := fmt.Sprintf("%d matches in the kernel log:", len(matched))
+	for i, m := range matched {
+		if i >= k.maxMessages {
+			message += fmt.Sprintf("\n... and %d more", len(matched)-k.maxMessages)
+			break
+		}
+		message += "\n" + m
+	}
+	return checks.StatusWarning, message
+}
+
+// scan returns the messages of the records after the cursor matching the patterns, and advances the cursor
+func (k *kernelLog) scan(lines []string) []string {
+	var matched []string
+	for _, line := range lines {
+		record, ok := parseKmsgRecord(line)
+		if !ok {
+			continue
+		}
+		if k.cursor != nil && record.seq <= k.cursor.Seq {
+			continue
+		}
+		k.cursor = &kernelLogCursor{BootID: k.bootID, Seq: record.seq}
+		for _, re := range k.patterns {
+			if re.MatchString(record.message) {
+				matched = append(matched, record.message)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// parseKmsgRecord parses the record of /dev/kmsg: "<priority>,<sequence>,<timestamp>,<flags>[,...];<message>".
+// The continuation lines (beginning with a space) are not records.
+func parseKmsgRecord(line string) (kmsgRecord, bool) {
+	i := strings.Index(line, ";")
+	if i < 0 || strings.HasPrefix(line, " ") {
+		return kmsgRecord{}, false
+	}
+	fields := strings.Split(line[:i], ",")
+	if len(fields) < 3 {
+		return kmsgRecord{}, false
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return kmsgRecord{}, false
+	}
+	return kmsgRecord{seq: seq, message: strings.TrimRight(line[i+1:], "\n")}, true
+}
+
+// Generate generates the number of the matches since the previous invocation
+func (k *kernelLog) Generate() (metrics.Values, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	matches := k.matches
+	k.matches = 0
+	return metrics.Values{"custom.kernel_log.matches": float64(matches)}, nil
+}
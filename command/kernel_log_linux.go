@@ -0,0 +1,42 @@
+package command
+
+import (
+	"os"
+	"syscall"
+)
+
+const kmsgSupported = true
+
+var kmsgFile = "/dev/kmsg"
+
+// readKmsg reads all the records in the kernel ring buffer from /dev/kmsg
+func readKmsg() ([]string, error) {
+	fd, err := syscall.Open(kmsgFile, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: kmsgFile, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	var lines []string
+	buf := make([]byte, 8192)
+	for {
+		// each read returns a record
+		n, err := syscall.Read(fd, buf)
+		switch err {
+		case nil:
+		case syscall.EAGAIN:
+			return lines, nil
+		case syscall.EPIPE, syscall.EINVAL:
+			// the record has been overwritten, or is too large
+			continue
+		case syscall.EINTR:
+			continue
+		default:
+			return nil, &os.PathError{Op: "read", Path: kmsgFile, Err: err}
+		}
+		if n <= 0 {
+			return lines, nil
+		}
+		lines = append(lines, string(buf[:n]))
+	}
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package command
+
+import "errors"
+
+const kmsgSupported = false
+
+func readKmsg() ([]string, error) {
+	return nil, errors.New("the kernel log is not supported on this platform")
+}
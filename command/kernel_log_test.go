@@ -0,0 +1,74 @@
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestParseKmsgRecord(t *testing.T) {
+	record, ok := parseKmsgRecord("3,1234,5678901,-;end_request: I/O error, dev sda, sector 0\n")
+	if !ok || record.seq != 1234 || record.message != "end_request: I/O error, dev sda, sector 0" {
+		t.Errorf("record should be parsed: %+v", record)
+	}
+	for _, line := range []string{" SUBSYSTEM=block", "no separator", "3,x,0,-;message", "3;message"} {
+		if _, ok := parseKmsgRecord(line); ok {
+			t.Errorf("%q should not be parsed as a record", line)
+		}
+	}
+}
+
+func TestKernelLog(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-kernel-log")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	conf := &config.Config{Root: root, KernelLog: config.KernelLog{Check: true, MaxMessages: 2}}
+	k := newKernelLog(conf)
+	k.bootID = "boot-1"
+
+	lines := []string{
+		"6,1,100,-;eth0: link up",
+		"3,2,200,-;end_request: I/O error, dev sda, sector 0",
+		"3,3,300,-;INFO: task jbd2/sda1-8:123 blocked for more than 120 seconds.",
+		"4,4,400,-;NETDEV WATCHDOG: eth0 (e1000): transmit queue 0 timed out",
+	}
+	status, message := k.report(lines)
+	if status != checks.StatusWarning {
+		t.Errorf("status should be WARNING but %s", status)
+	}
+	expected := "3 matches in the kernel log:\nend_request: I/O error, dev sda, sector 0\nINFO: task jbd2/sda1-8:123 blocked for more than 120 seconds.\n... and 1 more"
+	if message != expected {
+		t.Errorf("message should be %q but %q", expected, message)
+	}
+	values, _ := k.Generate()
+	if values["custom.kernel_log.matches"] != 3 {
+		t.Errorf("the number of the matches should be generated: %v", values)
+	}
+
+	if status, _ := k.report(lines); status != checks.StatusOK {
+		t.Errorf("the records already scanned should not be reported again")
+	}
+
+	// restarted
+	k = newKernelLog(conf)
+	k.bootID = "boot-1"
+	lines = append(lines, "3,5,500,-;Buffer I/O error on dev sdb1")
+	status, message = k.report(lines)
+	if status != checks.StatusWarning || !strings.HasSuffix(message, "Buffer I/O error on dev sdb1") || strings.Contains(message, "sector 0") {
+		t.Errorf("only the records after the persisted cursor should be reported: %s", message)
+	}
+
+	// rebooted
+	k = newKernelLog(conf)
+	k.bootID = "boot-2"
+	if status, message := k.report(lines[:2]); status != checks.StatusWarning {
+		t.Errorf("all the records should be scanned after reboot: %s", message)
+	}
+}
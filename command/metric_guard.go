@@ -0,0 +1,113 @@
+package command
+
+import (
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// metricGuard drops or clamps the metric values violating the rules of config.MetricGuard.
+type metricGuard struct {
+	rules []config.MetricGuard
+
+	mu         sync.Mutex
+	previous   map[string]float64 // host ID + "\x00" + metric name -> the previous value
+	suppressed int                // since the last Generate
+}
+
+// prepareMetricGuard creates the guard if any rules are configured, and registers its metrics generator
+// to the agent.
+func prepareMetricGuard(conf *config.Config, ag *agent.Agent) *metricGuard {
+	if len(conf.MetricGuards) == 0 {
+		return nil
+	}
+	g := &metricGuard{
+		rules:    conf.MetricGuards,
+		previous: make(map[string]float64),
+	}
+	ag.MetricsGenerators = append(ag.MetricsGenerators, g)
+	return g
+}
+
+// rule returns the rule of the longest prefix matching the name
+func (g *metricGuard) rule(name string) *config.MetricGuard {
+	var matched *config.MetricGuard
+	for i, r := range g.rules {
+		if strings.HasPrefix(name, r.Prefix) && (matched == nil || len(r.Prefix) > len(matched.Prefix)) {
+			matched = &g.rules[i]
+		}
+	}
+	return matched
+}
+
+// filter returns the value to be posted, and reports whether it should be posted.
+// The values out of the bounds do not become the previous values of the delta, while the ones
+// dropped by the delta do, so that a persistent change of the level is accepted at the next interval.
+// The guard is nil-safe, passing every value.
+func (g *metricGuard) filter(hostID, name string, value float64) (float64, bool) {
+	if g == nil {
+		return value, true
+	}
+	r := g.rule(name)
+	if r == nil {
+		return value, true
+	}
+	clamp := r.Action == config.MetricGuardClamp
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if (r.Min != nil && value < *r.Min) || (r.Max != nil && value > *r.Max) {
+		g.suppressed++
+		if !clamp {
+			logger.Warningf("The value of %q (%v) is out of the bounds of [[metric_guard]] %q and not posted.", name, value, r.Prefix)
+			return 0, false
+		}
+		clamped := value
+		if r.Min != nil {
+			clamped = math.Max(clamped, *r.Min)
+		}
+		if r.Max != nil {
+			clamped = math.Min(clamped, *r.Max)
+		}
+		logger.Warningf("The value of %q (%v) is out of the bounds of [[metric_guard]] %q and clamped to %v.", name, value, r.Prefix, clamped)
+		value = clamped
+	}
+	if r.MaxDelta == nil {
+		return value, true
+	}
+	key := hostID + "\x00" + name
+	prev, ok := g.previous[key]
+	g.previous[key] = value
+	if !ok || math.Abs(value-prev) <= *r.MaxDelta {
+		return value, true
+	}
+	g.suppressed++
+	if !clamp {
+		logger.Warningf("The value of %q changed by %v from %v, more than max_delta of [[metric_guard]] %q, and is not posted.", name, value-prev, prev, r.Prefix)
+		return 0, false
+	}
+	clamped := prev + math.Copysign(*r.MaxDelta, value-prev)
+	logger.Warningf("The value of %q changed by %v from %v, more than max_delta of [[metric_guard]] %q, and is clamped to %v.", name, value-prev, prev, r.Prefix, clamped)
+	g.previous[key] = clamped
+	return clamped, true
+}
+
+// Generate generates the number of the values dropped or clamped since the previous call
+func (g *metricGuard) Generate() (metrics.Values, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	suppressed := g.suppressed
+	g.suppressed = 0
+	return metrics.Values{"custom.agent.metric_guard.suppressed": float64(suppressed)}, nil
+}
+
+// Reset discards the previous values of max_delta
+func (g *metricGuard) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.previous = make(map[string]float64)
+}
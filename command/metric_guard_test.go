@@ -0,0 +1,64 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func TestMetricGuard(t *testing.T) {
+	conf := &config.Config{MetricGuards: []config.MetricGuard{
+		{Prefix: "custom.", Min: float64Ptr(0), Max: float64Ptr(100), Action: config.MetricGuardDrop},
+		{Prefix: "custom.clamped.", Min: float64Ptr(0), Max: float64Ptr(100), MaxDelta: float64Ptr(10), Action: config.MetricGuardClamp},
+		{Prefix: "custom.delta.", MaxDelta: float64Ptr(10), Action: config.MetricGuardDrop},
+	}}
+	ag := &agent.Agent{}
+	g := prepareMetricGuard(conf, ag)
+	if len(ag.MetricsGenerators) != 1 {
+		t.Errorf("the generator of the guard should be registered")
+	}
+
+	testCases := []struct {
+		name     string
+		value    float64
+		expected float64
+		posted   bool
+	}{
+		{"loadavg5", -1, -1, true},
+		{"custom.foo", 50, 50, true},
+		{"custom.foo", -1, 0, false},
+		{"custom.foo", 1e308, 0, false},
+		{"custom.clamped.foo", 1e308, 100, true},
+		{"custom.clamped.foo", 50, 90, true},
+		{"custom.clamped.foo", 85, 85, true},
+		{"custom.delta.foo", 1000, 1000, true},
+		{"custom.delta.foo", 1005, 1005, true},
+		{"custom.delta.foo", 5000, 0, false},
+		{"custom.delta.foo", 5001, 5001, true},
+	}
+	for _, tc := range testCases {
+		value, posted := g.filter("xyzabc12345", tc.name, tc.value)
+		if value != tc.expected || posted != tc.posted {
+			t.Errorf("%s = %v should be (%v, %v) but (%v, %v)", tc.name, tc.value, tc.expected, tc.posted, value, posted)
+		}
+	}
+
+	values, _ := g.Generate()
+	if values["custom.agent.metric_guard.suppressed"] != 5 {
+		t.Errorf("the suppressed values should be counted: %v", values)
+	}
+	values, _ = g.Generate()
+	if values["custom.agent.metric_guard.suppressed"] != 0 {
+		t.Errorf("the counter should be reset: %v", values)
+	}
+
+	var nilGuard *metricGuard
+	if value, posted := nilGuard.filter("xyzabc12345", "custom.foo", -1); value != -1 || !posted {
+		t.Errorf("the nil guard should pass the values")
+	}
+}
@@ -0,0 +1,73 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// RunPluginOnce runs the metrics plugin configured by [plugin.metrics.<name>] once, and writes
+// the values parsed from the output, the graph definitions which would be registered and the warnings
+// about the output to w, without posting them.
+func RunPluginOnce(conf *config.Config, name string, w io.Writer) error {
+	pluginConfig, ok := conf.Plugin["metrics"][name]
+	if !ok {
+		return fmt.Errorf("plugin.metrics.%s is not configured", name)
+	}
+	// the plugin reads the shared caches refreshed by the running agent
+	prepareSharedCaches(conf)
+	trial, err := metrics.TryPlugin(pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for key := range trial.Values {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "values (%d):\n", len(names))
+	for _, key := range names {
+		fmt.Fprintf(w, "\t%s\t%g\n", key, trial.Values[key])
+		if !conf.MetricFilter.Allows(key) {
+			trial.Warnings = append(trial.Warnings, fmt.Sprintf("%s is dropped by the metric filter", key))
+		}
+	}
+
+	sort.Sort(graphDefsByName(trial.GraphDefs))
+	fmt.Fprintf(w, "graph definitions (%d):\n", len(trial.GraphDefs))
+	for _, graph := range trial.GraphDefs {
+		fmt.Fprintf(w, "\t%s (label: %q, unit: %s)\n", graph.Name, graph.DisplayName, graph.Unit)
+		for _, metric := range graph.Metrics {
+			stacked := ""
+			if metric.IsStacked {
+				stacked = ", stacked"
+			}
+			fmt.Fprintf(w, "\t\t%s (label: %q%s)\n", metric.Name, metric.DisplayName, stacked)
+		}
+	}
+
+	if trial.Stderr != "" {
+		fmt.Fprintf(w, "stderr:\n")
+		for _, line := range strings.Split(strings.TrimRight(trial.Stderr, "\n"), "\n") {
+			fmt.Fprintf(w, "\t%s\n", line)
+		}
+	}
+
+	fmt.Fprintf(w, "warnings (%d):\n", len(trial.Warnings))
+	for _, warning := range trial.Warnings {
+		fmt.Fprintf(w, "\t%s\n", warning)
+	}
+	return nil
+}
+
+type graphDefsByName []mackerel.CreateGraphDefsPayload
+
+func (p graphDefsByName) Len() int           { return len(p) }
+func (p graphDefsByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p graphDefsByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
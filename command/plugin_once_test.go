@@ -0,0 +1,41 @@
+// +build linux darwin freebsd netbsd
+
+package command
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestRunPluginOnce(t *testing.T) {
+	conf := &config.Config{
+		Plugin: map[string]config.PluginConfigs{
+			"metrics": {
+				"app": config.PluginConfig{Command: "printf 'app.requests\t10\t1397822016\napp.debug\t1\t1397822016\n'"},
+			},
+		},
+		MetricFilter: config.MetricFilter{Exclude: config.Regexpwrapper{Regexp: regexp.MustCompile(`^custom\.app\.debug$`)}},
+	}
+
+	var out bytes.Buffer
+	if err := RunPluginOnce(conf, "app", &out); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	for _, s := range []string{
+		"values (2):\n\tcustom.app.debug\t1\n\tcustom.app.requests\t10\n",
+		"graph definitions (0):\n",
+		"custom.app.debug is dropped by the metric filter",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("the output should contain %q but:\n%s", s, out.String())
+		}
+	}
+
+	if err := RunPluginOnce(conf, "unknown", &out); err == nil {
+		t.Error("should raise error for the plugin not configured")
+	}
+}
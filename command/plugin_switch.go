@@ -0,0 +1,206 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// pluginSwitches holds the plugins (metrics plugins and checks) disabled at runtime by the control endpoint,
+// which are skipped until they are enabled again or the durations expire. They are kept over the reloads
+// of the configuration, but not over the restarts.
+type pluginSwitches struct {
+	mu       sync.Mutex
+	disabled map[string]time.Time // the name -> the time to be enabled again (zero if not)
+}
+
+var disabledPlugins = &pluginSwitches{disabled: make(map[string]time.Time)}
+
+// disabledPlugin is an entry of the disabled plugins reported by GET /status of the control endpoint
+type disabledPlugin struct {
+	Name  string     `json:"name"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// disable disables the plugin for duration, or until it is enabled if duration is 0
+func (s *pluginSwitches) disable(name string, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration)
+		logger.Infof("Plugin %q is disabled for %s", name, duration)
+	} else {
+		logger.Infof("Plugin %q is disabled", name)
+	}
+	s.disabled[name] = until
+}
+
+// enable enables the plugin, and reports whether it has been disabled
+func (s *pluginSwitches) enable(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.disabled[name]; !ok {
+		return false
+	}
+	delete(s.disabled, name)
+	logger.Infof("Plugin %q is enabled", name)
+	return true
+}
+
+// isDisabled reports whether the plugin is disabled, enabling it again if the duration has expired
+func (s *pluginSwitches) isDisabled(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.disabled[name]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && !time.Now().Before(until) {
+		delete(s.disabled, name)
+		logger.Infof("Plugin %q is enabled again after the duration", name)
+		return false
+	}
+	return true
+}
+
+// list returns the disabled plugins sorted by the names
+func (s *pluginSwitches) list() []disabledPlugin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	names := make([]string, 0, len(s.disabled))
+	for name, until := range s.disabled {
+		if until.IsZero() || now.Before(until) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	plugins := make([]disabledPlugin, len(names))
+	for i, name := range names {
+		plugins[i].Name = name
+		if until := s.disabled[name]; !until.IsZero() {
+			plugins[i].Until = &until
+		}
+	}
+	return plugins
+}
+
+// pluginDefined reports whether the metrics plugin or the check named name is defined in conf
+func pluginDefined(conf *config.Config, name string) bool {
+	for _, kind := range []string{"metrics", "checks", "checkfile", "checklog", "checkcert", "checktcp", "checkhttp", "checktraffic", "prometheus"} {
+		if _, ok := conf.Plugin[kind][name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// switchedPluginGenerator skips the metrics plugin while it is disabled, and records its runs (see telemetryGenerator).
+// The plugin running in the background (e.g. the stream plugin) is stopped while it is disabled.
+type switchedPluginGenerator struct {
+	metrics.PluginGenerator
+	name string
+
+	mu      sync.Mutex
+	started bool // started by Start
+	paused  bool // stopped while the plugin is disabled
+}
+
+func switchablePlugin(name string, g metrics.PluginGenerator) metrics.PluginGenerator {
+	return &switchedPluginGenerator{PluginGenerator: g, name: name}
+}
+
+func (g *switchedPluginGenerator) Generate() (metrics.Values, error) {
+	return g.GenerateContext(context.Background())
+}
+
+func (g *switchedPluginGenerator) GenerateContext(ctx context.Context) (metrics.Values, error) {
+	disabled := disabledPlugins.isDisabled(g.name)
+	g.pause(disabled)
+	if disabled {
+		logger.Debugf("Skipped plugin %q because it is disabled", g.name)
+		return metrics.Values{}, nil
+	}
+	start := time.Now()
+	values, err := metrics.GenerateContext(ctx, g.PluginGenerator)
+	metricsPluginRuns.record(g.name, time.Since(start), err)
+	return values, err
+}
+
+func (g *switchedPluginGenerator) String() string {
+	if s, ok := g.PluginGenerator.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", g.PluginGenerator)
+}
+
+// Reset implements metrics.Resetter
+func (g *switchedPluginGenerator) Reset() {
+	if r, ok := g.PluginGenerator.(metrics.Resetter); ok {
+		r.Reset()
+	}
+}
+
+// Start implements metrics.Background, starting the plugin running in the background unless it is disabled
+func (g *switchedPluginGenerator) Start() {
+	b, ok := g.PluginGenerator.(metrics.Background)
+	if !ok {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.started = true
+	g.paused = disabledPlugins.isDisabled(g.name)
+	if !g.paused {
+		b.Start()
+	}
+}
+
+// Stop implements metrics.Background
+func (g *switchedPluginGenerator) Stop() {
+	b, ok := g.PluginGenerator.(metrics.Background)
+	if !ok {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.started = false
+	b.Stop()
+}
+
+// pause stops the plugin running in the background when it is disabled, and starts it again when enabled
+func (g *switchedPluginGenerator) pause(disabled bool) {
+	b, ok := g.PluginGenerator.(metrics.Background)
+	if !ok {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.started || g.paused == disabled {
+		return
+	}
+	g.paused = disabled
+	if disabled {
+		logger.Infof("Stopping plugin %q because it is disabled", g.name)
+		b.Stop()
+	} else {
+		b.Start()
+	}
+}
+
+// pluginSwitchesGenerator generates the number of the plugins disabled by the control endpoint.
+//
+// `custom.agent.plugin.disabled`: the number of the disabled plugins
+type pluginSwitchesGenerator struct{}
+
+func (g *pluginSwitchesGenerator) Generate() (metrics.Values, error) {
+	return metrics.Values{
+		"custom.agent.plugin.disabled": float64(len(disabledPlugins.list())),
+	}, nil
+}
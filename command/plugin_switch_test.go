@@ -0,0 +1,83 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+type countingPluginGenerator struct {
+	metrics.PluginGenerator
+	count int
+}
+
+func (g *countingPluginGenerator) Generate() (metrics.Values, error) {
+	g.count++
+	return metrics.Values{"custom.foo.bar": 1}, nil
+}
+
+func TestSwitchedPluginGenerator(t *testing.T) {
+	defer func() {
+		disabledPlugins = &pluginSwitches{disabled: make(map[string]time.Time)}
+	}()
+	inner := &countingPluginGenerator{}
+	g := switchablePlugin("foo", inner)
+
+	disabledPlugins.disable("foo", 50*time.Millisecond)
+	values, err := g.Generate()
+	if err != nil || len(values) != 0 || inner.count != 0 {
+		t.Errorf("the disabled plugin should not run: values=%v err=%v", values, err)
+	}
+	gen := &pluginSwitchesGenerator{}
+	if values, _ := gen.Generate(); values["custom.agent.plugin.disabled"] != 1 {
+		t.Errorf("the disabled plugin should be counted: %v", values)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	values, err = g.Generate()
+	if err != nil || values["custom.foo.bar"] != 1 || inner.count != 1 {
+		t.Errorf("the plugin should be enabled again after the duration: values=%v err=%v", values, err)
+	}
+	if values, _ := gen.Generate(); values["custom.agent.plugin.disabled"] != 0 {
+		t.Errorf("the enabled plugin should not be counted: %v", values)
+	}
+}
+
+type backgroundPluginGenerator struct {
+	countingPluginGenerator
+	running bool
+}
+
+func (g *backgroundPluginGenerator) Start() { g.running = true }
+func (g *backgroundPluginGenerator) Stop()  { g.running = false }
+
+func TestSwitchedPluginGenerator_background(t *testing.T) {
+	defer func() {
+		disabledPlugins = &pluginSwitches{disabled: make(map[string]time.Time)}
+	}()
+	inner := &backgroundPluginGenerator{}
+	g := switchablePlugin("foo", inner)
+	g.(metrics.Background).Start()
+	if !inner.running {
+		t.Fatal("the plugin should be started")
+	}
+
+	disabledPlugins.disable("foo", 0)
+	g.Generate()
+	if inner.running {
+		t.Error("the plugin should be stopped while it is disabled")
+	}
+
+	disabledPlugins.enable("foo")
+	g.Generate()
+	if !inner.running {
+		t.Error("the plugin should be started again when it is enabled")
+	}
+
+	g.(metrics.Background).Stop()
+	g.Generate()
+	if inner.running {
+		t.Error("the plugin stopped should not be started by Generate")
+	}
+}
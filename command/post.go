@@ -0,0 +1,155 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// postStatuses are the statuses of the check reports posted by PostCheckReport, by the names or the exit codes
+var postStatuses = map[string]checks.Status{
+	"OK":       checks.StatusOK,
+	"WARNING":  checks.StatusWarning,
+	"CRITICAL": checks.StatusCritical,
+	"UNKNOWN":  checks.StatusUnknown,
+	"0":        checks.StatusOK,
+	"1":        checks.StatusWarning,
+	"2":        checks.StatusCritical,
+	"3":        checks.StatusUnknown,
+}
+
+// prepareStandalonePost returns the API client and the id of the host registered by the agent,
+// which are used by the commands posting without the running agent.
+func prepareStandalonePost(conf *config.Config) (*mackerel.API, string, error) {
+	hostID, err := conf.LoadHostID()
+	if err != nil {
+		return nil, "", fmt.Errorf("the host is not registered yet (start the agent first): %s", err)
+	}
+	api, err := NewAPI(conf)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to prepare an api: %s", err)
+	}
+	return api, hostID, nil
+}
+
+// retryPost calls post until it succeeds like the preparation of the host, without retrying the client errors
+func retryPost(post func() error) error {
+	var lastErr error
+	retryHonoringBackoff(context.Background(), retryNum, retryInterval, func() error {
+		lastErr = post()
+		var apiErr *mackerel.Error
+		if (errors.As(lastErr, &apiErr) && apiErr.IsClientError()) || errors.Is(lastErr, mackerel.ErrUnsupported) {
+			return nil
+		}
+		if lastErr != nil {
+			logger.Warningf("Failed to post (will retry): %s", lastErr)
+		}
+		return lastErr
+	})
+	return lastErr
+}
+
+// PostMetricLines posts the metric values of the host read from r, which are the lines of the output of
+// the metrics plugins ("<name>\t<value>\t<epoch seconds>", the names are prefixed with "custom.").
+// The timestamp can be omitted to post the values at now. The metrics filtered by MetricFilter are not posted.
+func PostMetricLines(conf *config.Config, r io.Reader, w io.Writer) error {
+	now := time.Now()
+	var values []*mackerel.CreatingMetricsValue
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		v, err := parseMetricLine(line, now)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineno, err)
+		}
+		if !conf.MetricFilter.Allows(v.Name) {
+			continue
+		}
+		values = append(values, v)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		fmt.Fprintln(w, "no metrics to be posted")
+		return nil
+	}
+
+	api, hostID, err := prepareStandalonePost(conf)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		v.HostID = hostID
+	}
+	if err := retryPost(func() error { return api.PostMetricsValues(values) }); err != nil {
+		return fmt.Errorf("failed to post the metrics: %s", err)
+	}
+	fmt.Fprintf(w, "%d metrics posted\n", len(values))
+	return nil
+}
+
+// parseMetricLine parses the line "<name> <value> [<epoch seconds>]" separated by the tabs or the spaces
+func parseMetricLine(line string, now time.Time) (*mackerel.CreatingMetricsValue, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("invalid metric line: %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("invalid value: %q", fields[1])
+	}
+	t := float64(now.Unix())
+	if len(fields) == 3 {
+		if t, err = strconv.ParseFloat(fields[2], 64); err != nil {
+			return nil, fmt.Errorf("invalid timestamp: %q", fields[2])
+		}
+	}
+	return &mackerel.CreatingMetricsValue{Name: "custom." + fields[0], Time: t, Value: value}, nil
+}
+
+// PostCheckReport posts the report of the check named name with the status (OK, WARNING, CRITICAL or UNKNOWN,
+// or the exit code of the check plugins), whose message is read from r.
+func PostCheckReport(conf *config.Config, name, status string, r io.Reader, w io.Writer) error {
+	if name == "" {
+		return fmt.Errorf("the name of the check should be specified")
+	}
+	s, ok := postStatuses[strings.ToUpper(status)]
+	if !ok {
+		return fmt.Errorf("invalid status: %q", status)
+	}
+	message, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	report := &checks.Report{
+		Name:       name,
+		Status:     s,
+		Message:    strings.TrimRight(string(message), "\r\n"),
+		OccurredAt: time.Now(),
+	}
+
+	api, hostID, err := prepareStandalonePost(conf)
+	if err != nil {
+		return err
+	}
+	if err := retryPost(func() error { return api.ReportCheckMonitors(hostID, []*checks.Report{report}) }); err != nil {
+		return fmt.Errorf("failed to report the check: %s", err)
+	}
+	fmt.Fprintf(w, "%s reported as %s\n", name, s)
+	return nil
+}
@@ -0,0 +1,88 @@
+package command
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// postQueueWarningInterval is the minimum interval of the warnings of the values dropped from the full queue
+var postQueueWarningInterval = 10 * time.Minute
+
+// postQueueDrops enqueues the collected values to the queue to be posted without blocking the collections.
+// When the queue is full (e.g. the posts keep failing without the spool), the oldest value in the queue
+// or the new one is dropped by the policy (see config.Connection.PostMetricsDropPolicy).
+// The dropper is nil-safe, dropping the oldest ones without counting.
+type postQueueDrops struct {
+	policy string
+
+	mu           sync.Mutex
+	dropped      int  // since the previous collection of the metrics
+	droppedEver  bool // the metric is posted once any value has been dropped
+	unwarned     int  // since the previous warning
+	lastWarnedAt time.Time
+}
+
+// preparePostQueueDrops creates the dropper by the policy, and registers its metrics generator to the agent
+func preparePostQueueDrops(conf *config.Config, ag *agent.Agent) *postQueueDrops {
+	d := &postQueueDrops{policy: conf.Connection.PostMetricsDropPolicy}
+	ag.MetricsGenerators = append(ag.MetricsGenerators, d)
+	return d
+}
+
+// enqueue sends v to postQueue, dropping a value by the policy if the queue is full
+func (d *postQueueDrops) enqueue(postQueue chan *postValue, v *postValue) {
+	for {
+		select {
+		case postQueue <- v:
+			return
+		default:
+		}
+		if d != nil && d.policy == config.PostMetricsDropNewest {
+			d.drop(v, cap(postQueue))
+			return
+		}
+		select {
+		case old := <-postQueue:
+			d.drop(old, cap(postQueue))
+		default:
+			// the queue has been consumed by the post loop
+		}
+	}
+}
+
+func (d *postQueueDrops) drop(v *postValue, capacity int) {
+	v.trace.stage("dropped", "the queue is full")
+	if d == nil {
+		logger.Warningf("The queue of the metrics to be posted is full (%d). The oldest values are dropped.", capacity)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dropped++
+	d.droppedEver = true
+	d.unwarned++
+	if now := time.Now(); now.Sub(d.lastWarnedAt) >= postQueueWarningInterval {
+		logger.Warningf("The queue of the metrics to be posted is full (%d). %d values have been dropped by %s.", capacity, d.unwarned, d.policy)
+		d.unwarned = 0
+		d.lastWarnedAt = now
+	}
+}
+
+// Generate generates the number of the values dropped since the previous collection, which is named
+// custom.agent.post_queue.dropped.<policy>. It is not generated until any value is dropped.
+func (d *postQueueDrops) Generate() (metrics.Values, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.droppedEver {
+		return metrics.Values{}, nil
+	}
+	dropped := d.dropped
+	d.dropped = 0
+	return metrics.Values{
+		"custom.agent.post_queue.dropped." + d.policy: float64(dropped),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+func TestPostQueueDrops(t *testing.T) {
+	value := func(name string) *postValue {
+		return newPostValue([]*mackerel.CreatingMetricsValue{{Name: name}})
+	}
+	tests := []struct {
+		policy   string
+		expected []string
+	}{
+		{config.PostMetricsDropOldest, []string{"b", "c"}},
+		{config.PostMetricsDropNewest, []string{"a", "b"}},
+	}
+	for _, tc := range tests {
+		d := &postQueueDrops{policy: tc.policy}
+		if values, _ := d.Generate(); len(values) != 0 {
+			t.Errorf("%s: the drops should not be generated before any drop: %v", tc.policy, values)
+		}
+
+		postQueue := make(chan *postValue, 2)
+		done := make(chan struct{})
+		go func() {
+			for _, name := range []string{"a", "b", "c"} {
+				d.enqueue(postQueue, value(name))
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: enqueue should not block", tc.policy)
+		}
+
+		var names []string
+		for len(postQueue) > 0 {
+			names = append(names, (<-postQueue).values[0].Name)
+		}
+		if len(names) != 2 || names[0] != tc.expected[0] || names[1] != tc.expected[1] {
+			t.Errorf("%s: the queue should be %v but %v", tc.policy, tc.expected, names)
+		}
+
+		values, _ := d.Generate()
+		if v := values["custom.agent.post_queue.dropped."+tc.policy]; v != 1 {
+			t.Errorf("%s: 1 value should be dropped but %v", tc.policy, values)
+		}
+		values, _ = d.Generate()
+		if v, ok := values["custom.agent.post_queue.dropped."+tc.policy]; !ok || v != 0 {
+			t.Errorf("%s: the drops should be reset but %v", tc.policy, values)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPostMetricLines(t *testing.T) {
+	conf, mockHandlers, ts := newMockAPIServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(conf.Root)
+	conf.SaveHostID("xxx12345678901")
+
+	var posted []map[string]interface{}
+	mockHandlers["POST /api/v0/tsdb"] = func(req *http.Request) (int, jsonObject) {
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &posted)
+		return 200, jsonObject{"success": true}
+	}
+
+	var out bytes.Buffer
+	input := "backup.duration\t12.5\t1397822016\n\nbackup.size 1024\n"
+	if err := PostMetricLines(&conf, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if len(posted) != 2 {
+		t.Fatalf("2 metrics should be posted but %v", posted)
+	}
+	if posted[0]["name"] != "custom.backup.duration" || posted[0]["value"] != 12.5 || posted[0]["time"] != 1397822016.0 || posted[0]["hostId"] != "xxx12345678901" {
+		t.Errorf("unexpected metric: %v", posted[0])
+	}
+	if out.String() != "2 metrics posted\n" {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+
+	if err := PostMetricLines(&conf, strings.NewReader("backup.size large\n"), &out); err == nil {
+		t.Error("should raise error for the invalid value")
+	}
+}
+
+func TestPostCheckReport(t *testing.T) {
+	conf, mockHandlers, ts := newMockAPIServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(conf.Root)
+
+	if err := PostCheckReport(&conf, "backup", "OK", strings.NewReader(""), ioutil.Discard); err == nil {
+		t.Error("should raise error before the host is registered")
+	}
+	conf.SaveHostID("xxx12345678901")
+
+	var payload struct {
+		Reports []map[string]interface{} `json:"reports"`
+	}
+	mockHandlers["POST /api/v0/monitoring/checks/report"] = func(req *http.Request) (int, jsonObject) {
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &payload)
+		return 200, jsonObject{"success": true}
+	}
+
+	if err := PostCheckReport(&conf, "backup", "2", strings.NewReader("backup failed\n"), ioutil.Discard); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if len(payload.Reports) != 1 {
+		t.Fatalf("a report should be posted but %v", payload.Reports)
+	}
+	report := payload.Reports[0]
+	if report["name"] != "backup" || report["status"] != "CRITICAL" || report["message"] != "backup failed" {
+		t.Errorf("unexpected report: %v", report)
+	}
+
+	if err := PostCheckReport(&conf, "backup", "fine", strings.NewReader(""), ioutil.Discard); err == nil {
+		t.Error("should raise error for the invalid status")
+	}
+}
@@ -0,0 +1,156 @@
+// Package command runs the mackerel-agent. Besides the mackerel-agent command itself,
+// the agent can be embedded into other programs by Runner:
+//
+//	conf, err := config.LoadConfig("/etc/mackerel-agent/mackerel-agent.conf")
+//	...
+//	r, err := command.NewRunner(conf)
+//	...
+//	r.OnMetrics(func(values []*mackerel.CreatingMetricsValue) {
+//		// also send the values to somewhere else
+//	})
+//	if err := r.Start(); err != nil {
+//		...
+//	}
+//	defer r.Stop(30 * time.Second)
+//
+// The API of Runner (NewRunner, Start, Stop, Reload, OnMetrics and OnCheckReport) is kept compatible
+// within the major version of the agent.
+package command
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// ErrRunnerStarted is returned by Runner.Start when the runner has already been started.
+var ErrRunnerStarted = errors.New("the runner has already been started")
+
+// ErrRunnerNotStarted is returned by Runner.Stop when the runner is not running.
+var ErrRunnerNotStarted = errors.New("the runner is not running")
+
+// ErrRunnerStopped is returned by Runner.Start when the runner has been stopped.
+// The agent cannot be started again by the runner, since the host may have been retired
+// on the stop (see config.HostStatus); create another one by NewRunner instead.
+var ErrRunnerStopped = errors.New("the runner has been stopped")
+
+// Runner runs the agent in the background, for embedding the agent into other programs.
+type Runner struct {
+	c *Context
+
+	mu      sync.Mutex
+	termCh  chan struct{}
+	done    chan error
+	stopped bool
+}
+
+// NewRunner prepares the host and the API client like the mackerel-agent command.
+// The agent does not start until Start is called.
+func NewRunner(conf *config.Config) (*Runner, error) {
+	c, err := Prepare(conf)
+	if err != nil {
+		return nil, err
+	}
+	return newRunner(c), nil
+}
+
+func newRunner(c *Context) *Runner {
+	return &Runner{c: c}
+}
+
+// Context returns the context of the agent, which holds the host and the API client.
+func (r *Runner) Context() *Context {
+	return r.c
+}
+
+// Start starts collecting and posting the metrics, and running the checks in the background.
+// The runner can be started only once.
+func (r *Runner) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.termCh != nil {
+		return ErrRunnerStarted
+	}
+	if r.stopped {
+		return ErrRunnerStopped
+	}
+	r.termCh = make(chan struct{})
+	r.done = make(chan error, 1)
+	go func(termCh chan struct{}, done chan error) {
+		done <- Run(r.c, termCh)
+	}(r.termCh, r.done)
+	return nil
+}
+
+// Stop stops the agent after posting the remaining metrics, or forcibly after timeout.
+// It returns the error of the agent, which is ErrForceTerminated if it is stopped forcibly.
+// The runner cannot be started again after it is stopped.
+func (r *Runner) Stop(timeout time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.termCh == nil {
+		return ErrRunnerNotStarted
+	}
+	termCh, done := r.termCh, r.done
+	r.termCh, r.done = nil, nil
+	r.stopped = true
+
+	var err error
+	select {
+	case termCh <- struct{}{}:
+	case err = <-done:
+		// the agent has already exited by an error
+		return err
+	}
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		select {
+		case termCh <- struct{}{}:
+			err = <-done
+		case err = <-done:
+		}
+	}
+	return err
+}
+
+// Reload replaces the configuration while the agent is running, like SIGHUP to the mackerel-agent command.
+func (r *Runner) Reload(conf *config.Config) {
+	r.c.Reload(conf)
+}
+
+// OnMetrics registers the hook called with the metric values every time before they are posted.
+// The hooks are called synchronously in the collection loop, and should not modify the values.
+func (r *Runner) OnMetrics(hook func(values []*mackerel.CreatingMetricsValue)) {
+	r.c.hooksMu.Lock()
+	defer r.c.hooksMu.Unlock()
+	r.c.metricsHooks = append(r.c.metricsHooks, hook)
+}
+
+// OnCheckReport registers the hook called with the reports of the checks every time before they are posted.
+// The hooks are called synchronously in the goroutines of the checks, and should not modify the reports.
+func (r *Runner) OnCheckReport(hook func(report *checks.Report)) {
+	r.c.hooksMu.Lock()
+	defer r.c.hooksMu.Unlock()
+	r.c.checkReportHooks = append(r.c.checkReportHooks, hook)
+}
+
+func (c *Context) runMetricsHooks(values []*mackerel.CreatingMetricsValue) {
+	c.hooksMu.RLock()
+	defer c.hooksMu.RUnlock()
+	for _, hook := range c.metricsHooks {
+		hook(values)
+	}
+}
+
+func (c *Context) runCheckReportHooks(report *checks.Report) {
+	c.hooksMu.RLock()
+	defer c.hooksMu.RUnlock()
+	for _, hook := range c.checkReportHooks {
+		hook(report)
+	}
+}
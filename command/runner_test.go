@@ -0,0 +1,70 @@
+package command
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+func TestRunner(t *testing.T) {
+	conf, mockHandlers, ts := newMockAPIServer(t)
+	defer ts.Close()
+
+	mockHandlers["POST /api/v0/monitoring/checks/report"] = func(req *http.Request) (int, jsonObject) {
+		return 200, jsonObject{"success": true}
+	}
+
+	api, _ := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	r := newRunner(&Context{
+		Agent:  &agent.Agent{},
+		Config: &conf,
+		Host:   &mackerel.Host{ID: "xyzabc12345"},
+		API:    api,
+	})
+
+	if err := r.Stop(time.Second); err != ErrRunnerNotStarted {
+		t.Errorf("should raise ErrRunnerNotStarted before started: %v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if err := r.Start(); err != ErrRunnerStarted {
+		t.Errorf("should raise ErrRunnerStarted while running: %v", err)
+	}
+	if err := r.Stop(time.Second); err != nil {
+		t.Errorf("should stop gracefully: %v", err)
+	}
+	if err := r.Start(); err != ErrRunnerStopped {
+		t.Errorf("should raise ErrRunnerStopped after stopped: %v", err)
+	}
+	if err := r.Stop(time.Second); err != ErrRunnerNotStarted {
+		t.Errorf("should raise ErrRunnerNotStarted after stopped: %v", err)
+	}
+}
+
+func TestRunner_hooks(t *testing.T) {
+	c := &Context{}
+	r := newRunner(c)
+
+	var received []*mackerel.CreatingMetricsValue
+	r.OnMetrics(func(values []*mackerel.CreatingMetricsValue) {
+		received = append(received, values...)
+	})
+	var reports []*checks.Report
+	r.OnCheckReport(func(report *checks.Report) {
+		reports = append(reports, report)
+	})
+
+	c.runMetricsHooks([]*mackerel.CreatingMetricsValue{{HostID: "xyzabc12345", Name: "loadavg5", Value: 1.0}})
+	if len(received) != 1 || received[0].Name != "loadavg5" {
+		t.Errorf("the metrics hook should be called: %v", received)
+	}
+	c.runCheckReportHooks(&checks.Report{Name: "ssh", Status: checks.StatusCritical})
+	if len(reports) != 1 || reports[0].Name != "ssh" {
+		t.Errorf("the check report hook should be called: %v", reports)
+	}
+}
@@ -0,0 +1,97 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// sharedCacheEnv is the environment variable of the directory of the shared caches given to the plugins
+const sharedCacheEnv = "MACKEREL_AGENT_CACHE_DIR"
+
+func sharedCacheDir(conf *config.Config) string {
+	return filepath.Join(conf.Root, "cache")
+}
+
+// prepareSharedCaches makes the directory of the shared caches, and gives it to the plugins by sharedCacheEnv.
+// The directory and the files are readable by the plugins run as the other users.
+func prepareSharedCaches(conf *config.Config) {
+	if len(conf.SharedCaches) == 0 {
+		return
+	}
+	dir := sharedCacheDir(conf)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Warningf("Failed to make the directory of the shared caches: %s", err)
+		return
+	}
+	os.Setenv(sharedCacheEnv, dir)
+}
+
+// sharedCacheLoop refreshes each shared cache every its TTL until ctx is done.
+// The caches are refreshed at the start, which may be after the first collection.
+func sharedCacheLoop(ctx context.Context, conf *config.Config) {
+	dir := sharedCacheDir(conf)
+	for name, cache := range conf.SharedCaches {
+		go func(name string, cache config.SharedCache) {
+			for {
+				if err := refreshSharedCache(dir, name, cache); err != nil {
+					logger.Warningf("Failed to refresh shared_cache.%s (the last one is kept): %s", name, err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(cache.TTL) * time.Second):
+				}
+			}
+		}(name, cache)
+	}
+}
+
+// refreshSharedCaches refreshes all the shared caches once, e.g. before collecting the metrics in the once mode
+func refreshSharedCaches(conf *config.Config) {
+	dir := sharedCacheDir(conf)
+	for name, cache := range conf.SharedCaches {
+		if err := refreshSharedCache(dir, name, cache); err != nil {
+			logger.Warningf("Failed to refresh shared_cache.%s: %s", name, err)
+		}
+	}
+}
+
+// refreshSharedCache runs the command of the cache and replaces the file of the cache with its output,
+// which is not replaced if the command fails.
+func refreshSharedCache(dir, name string, cache config.SharedCache) error {
+	stdout, stderr, exitCode, err := util.RunCommandWithEnv(cache.Command, cache.User, config.CommandEnv(cache.Command), time.Duration(cache.Timeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("the command exited with %d: %q", exitCode, stderr)
+	}
+
+	f, err := ioutil.TempFile(dir, "."+name+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(stdout)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	logger.Debugf("Refreshed shared_cache.%s (%d bytes)", name, len(stdout))
+	return nil
+}
@@ -0,0 +1,47 @@
+// +build linux darwin freebsd netbsd
+
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestRefreshSharedCaches(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-shared-cache")
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	defer os.RemoveAll(root)
+	defer os.Unsetenv(sharedCacheEnv)
+
+	conf := &config.Config{
+		Root: root,
+		SharedCaches: map[string]config.SharedCache{
+			"stats": {Command: "echo expensive", TTL: 60, Timeout: 60},
+		},
+	}
+	prepareSharedCaches(conf)
+	dir := os.Getenv(sharedCacheEnv)
+	if dir != filepath.Join(root, "cache") {
+		t.Fatalf("the directory of the shared caches should be given to the plugins but %q", dir)
+	}
+	refreshSharedCaches(conf)
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "stats")); err != nil || string(b) != "expensive\n" {
+		t.Errorf("the output of the command should be cached: %q, %v", string(b), err)
+	}
+
+	if err := refreshSharedCache(dir, "stats", config.SharedCache{Command: "echo broken; exit 1", Timeout: 60}); err == nil {
+		t.Error("should raise error when the command fails")
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "stats")); string(b) != "expensive\n" {
+		t.Errorf("the last cache should be kept when the command fails: %q", string(b))
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("the temporary files should be removed: %d files", len(files))
+	}
+}
@@ -0,0 +1,195 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// sharedCheckLease elects the agent reporting the shared checks among the agents at the site by the lease file
+// on the shared storage (see config.SharedChecks). The agent holding the unexpired lease is the reporter.
+// The file is created exclusively by the hard link, so only one of the agents racing for it wins.
+// The lease is nil-safe, reporting the shared checks by every agent if the coordination is not configured.
+type sharedCheckLease struct {
+	path     string
+	owner    string // the ID of the host
+	hostname string
+	duration time.Duration
+
+	mu     sync.Mutex
+	leader bool
+}
+
+// sharedCheckLeaseContent is the content of the lease file
+type sharedCheckLeaseContent struct {
+	Owner    string    `json:"owner"`
+	Hostname string    `json:"hostname"`
+	Expires  time.Time `json:"expires"`
+
+	raw     []byte // the content of the file as is
+	corrupt bool   // the file is not parsable, which is treated as expired
+}
+
+// prepareSharedCheckLease creates the lease of the group configured in conf, or returns nil if not configured
+func prepareSharedCheckLease(conf *config.Config, host *mackerel.Host) *sharedCheckLease {
+	if conf.SharedChecks.LockDir == "" {
+		return nil
+	}
+	return &sharedCheckLease{
+		path:     filepath.Join(conf.SharedChecks.LockDir, conf.SharedChecks.Group+".lease"),
+		owner:    host.ID,
+		hostname: host.Name,
+		duration: time.Duration(conf.SharedChecks.LeaseSeconds) * time.Second,
+	}
+}
+
+// isLeader reports whether the agent reports the shared checks
+func (l *sharedCheckLease) isLeader() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+// run renews or acquires the lease every third of its duration, and releases it when ctx is done
+func (l *sharedCheckLease) run(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.release()
+			return
+		case <-ticker.C:
+			l.update()
+		}
+	}
+}
+
+// update renews or acquires the lease, and logs the change of the leadership. If the lease file is not
+// available (e.g. the shared storage is down), the agent reports the shared checks not to miss them.
+func (l *sharedCheckLease) update() {
+	leader, err := l.acquire(time.Now())
+	if err != nil {
+		logger.Warningf("Failed to acquire the lease of the shared checks %q: %s. They are reported by this agent.", l.path, err)
+		leader = true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if leader != l.leader {
+		if leader {
+			logger.Infof("This agent reports the shared checks by the lease %q", l.path)
+		} else {
+			logger.Infof("The shared checks are reported by another agent holding the lease %q", l.path)
+		}
+	}
+	l.leader = leader
+}
+
+// acquire renews the lease if the agent holds it, or takes it if it does not exist or has expired at now
+// (or is corrupt, which would keep every agent failing to read it otherwise). It reports whether the agent
+// holds the lease.
+func (l *sharedCheckLease) acquire(now time.Time) (bool, error) {
+	cur, err := l.read(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if cur != nil {
+		if cur.Owner == l.owner {
+			return true, l.write(now, func(tmp string) error { return os.Rename(tmp, l.path) })
+		}
+		if now.Before(cur.Expires) {
+			return false, nil
+		}
+		if !l.removeExpired(cur) {
+			return false, nil
+		}
+		if cur.corrupt {
+			logger.Warningf("The lease %q is corrupt and replaced", l.path)
+		} else {
+			logger.Debugf("The lease %q of %s (%s) expired at %s", l.path, cur.Hostname, cur.Owner, cur.Expires)
+		}
+	}
+	err = l.write(now, func(tmp string) error { return os.Link(tmp, l.path) })
+	if os.IsExist(err) {
+		// another agent has won the race
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// removeExpired moves the expired lease aside and removes it, and reports whether it has been removed.
+// The lease taken by another agent in the meantime is restored.
+func (l *sharedCheckLease) removeExpired(expired *sharedCheckLeaseContent) bool {
+	aside := l.path + ".expired." + l.owner
+	if err := os.Rename(l.path, aside); err != nil {
+		return false
+	}
+	defer os.Remove(aside)
+	if moved, err := l.read(aside); err != nil || !bytes.Equal(moved.raw, expired.raw) {
+		os.Link(aside, l.path)
+		return false
+	}
+	return true
+}
+
+// write writes the lease expiring after the duration from now to the temporary file, and puts it by put
+func (l *sharedCheckLease) write(now time.Time, put func(tmp string) error) error {
+	b, err := json.Marshal(sharedCheckLeaseContent{
+		Owner:    l.owner,
+		Hostname: l.hostname,
+		Expires:  now.Add(l.duration),
+	})
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp." + l.owner
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return put(tmp)
+}
+
+func (l *sharedCheckLease) read(file string) (*sharedCheckLeaseContent, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var content sharedCheckLeaseContent
+	if err := json.Unmarshal(b, &content); err != nil {
+		content = sharedCheckLeaseContent{corrupt: true}
+	}
+	content.raw = b
+	return &content, nil
+}
+
+// release removes the lease if the agent holds it, so that another agent takes over without waiting for it to expire
+func (l *sharedCheckLease) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.leader {
+		return
+	}
+	l.leader = false
+	if cur, err := l.read(l.path); err == nil && cur.Owner == l.owner {
+		if err := os.Remove(l.path); err != nil {
+			logger.Warningf("Failed to release the lease of the shared checks %q: %s", l.path, err)
+			return
+		}
+		logger.Infof("Released the lease of the shared checks %q", l.path)
+	}
+}
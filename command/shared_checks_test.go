@@ -0,0 +1,100 @@
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+func TestSharedCheckLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-shared-checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.Config{SharedChecks: config.SharedChecks{LockDir: dir, Group: "office", LeaseSeconds: 60}}
+	a := prepareSharedCheckLease(conf, &mackerel.Host{ID: "host-a", Name: "a"})
+	b := prepareSharedCheckLease(conf, &mackerel.Host{ID: "host-b", Name: "b"})
+	if a.path != filepath.Join(dir, "office.lease") {
+		t.Errorf("unexpected path: %s", a.path)
+	}
+
+	now := time.Now()
+	if ok, err := a.acquire(now); !ok || err != nil {
+		t.Errorf("a should acquire the lease: %v, %v", ok, err)
+	}
+	if ok, err := b.acquire(now); ok || err != nil {
+		t.Errorf("b should not acquire the lease held by a: %v, %v", ok, err)
+	}
+	if ok, err := a.acquire(now.Add(50 * time.Second)); !ok || err != nil {
+		t.Errorf("a should renew the lease: %v, %v", ok, err)
+	}
+	if ok, err := b.acquire(now.Add(100 * time.Second)); ok || err != nil {
+		t.Errorf("b should not acquire the renewed lease: %v, %v", ok, err)
+	}
+
+	// a has stopped renewing the lease
+	if ok, err := b.acquire(now.Add(111 * time.Second)); !ok || err != nil {
+		t.Errorf("b should take over the expired lease: %v, %v", ok, err)
+	}
+	if ok, err := a.acquire(now.Add(112 * time.Second)); ok || err != nil {
+		t.Errorf("a should not acquire the lease taken over by b: %v, %v", ok, err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("the temporary files should be removed: %d files", len(files))
+	}
+
+	b.update()
+	if !b.isLeader() {
+		t.Errorf("b should be the leader")
+	}
+	b.release()
+	if b.isLeader() {
+		t.Errorf("b should not be the leader after the release")
+	}
+	if _, err := os.Stat(a.path); !os.IsNotExist(err) {
+		t.Errorf("the lease should be removed by the release: %v", err)
+	}
+	a.update()
+	if !a.isLeader() {
+		t.Errorf("a should be the leader after the release of b")
+	}
+}
+
+func TestSharedCheckLease_corrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-shared-checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.Config{SharedChecks: config.SharedChecks{LockDir: dir, Group: "office", LeaseSeconds: 60}}
+	a := prepareSharedCheckLease(conf, &mackerel.Host{ID: "host-a", Name: "a"})
+	b := prepareSharedCheckLease(conf, &mackerel.Host{ID: "host-b", Name: "b"})
+	ioutil.WriteFile(a.path, []byte(`{"owner":"host-`), 0644)
+
+	now := time.Now()
+	if ok, err := a.acquire(now); !ok || err != nil {
+		t.Errorf("a should replace the corrupt lease: %v, %v", ok, err)
+	}
+	if ok, err := b.acquire(now); ok || err != nil {
+		t.Errorf("b should not acquire the lease replaced by a: %v, %v", ok, err)
+	}
+}
+
+func TestSharedCheckLease_nil(t *testing.T) {
+	l := prepareSharedCheckLease(&config.Config{}, &mackerel.Host{ID: "host-a"})
+	if l != nil {
+		t.Fatalf("the lease should be nil without lock_dir")
+	}
+	if !l.isLeader() {
+		t.Errorf("the shared checks should be reported without the coordination")
+	}
+}
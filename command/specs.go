@@ -0,0 +1,143 @@
+package command
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+// The key of the interfaces in config.HostSpec.Intervals
+const interfacesSpecKey = "interfaces"
+
+// The update intervals of the specs which are not configured.
+// The other specs are updated at specsUpdateInterval.
+var defaultSpecIntervals = map[string]time.Duration{
+	interfacesSpecKey: 5 * time.Minute,
+	"cpu":             24 * time.Hour,
+	"memory":          24 * time.Hour,
+	"kernel":          24 * time.Hour,
+}
+
+// specCollector collects the host specs, regenerating each of them at its own interval
+// and reusing the last values in the meantime.
+type specCollector struct {
+	generators         []spec.Generator
+	interfaceGenerator spec.InterfaceGenerator
+	cloudGenerator     *spec.CloudGenerator
+	intervals          map[string]time.Duration
+	fixedIdentifier    string // the custom identifier of the node, preferred to the one of the cloud
+
+	specs            map[string]interface{}
+	interfaces       []spec.NetInterface
+	customIdentifier string
+	collectedAt      map[string]time.Time
+}
+
+func newSpecCollector(conf *config.Config) *specCollector {
+	generators := specGenerators(conf)
+	cGen := spec.SuggestCloudGenerator()
+	if cGen != nil {
+		generators = append(generators, cGen)
+	}
+	return &specCollector{
+		generators:         generators,
+		interfaceGenerator: interfaceGenerator(),
+		cloudGenerator:     cGen,
+		intervals:          specIntervals(conf.HostSpec),
+		fixedIdentifier:    conf.Container.CustomIdentifier(),
+		specs:              make(map[string]interface{}),
+		collectedAt:        make(map[string]time.Time),
+	}
+}
+
+func specIntervals(conf config.HostSpec) map[string]time.Duration {
+	intervals := make(map[string]time.Duration)
+	for key, interval := range defaultSpecIntervals {
+		intervals[key] = interval
+	}
+	for key, minutes := range conf.Intervals {
+		intervals[key] = time.Duration(minutes) * time.Minute
+	}
+	return intervals
+}
+
+func (sc *specCollector) interval(key string) time.Duration {
+	if interval, ok := sc.intervals[key]; ok && interval > 0 {
+		return interval
+	}
+	return specsUpdateInterval
+}
+
+// tick returns the shortest interval, at which collect should be called
+func (sc *specCollector) tick() time.Duration {
+	tick := sc.interval(interfacesSpecKey)
+	for _, g := range sc.generators {
+		if interval := sc.interval(g.Key()); interval < tick {
+			tick = interval
+		}
+	}
+	return tick
+}
+
+func (sc *specCollector) due(key string, now time.Time) bool {
+	collectedAt, ok := sc.collectedAt[key]
+	return !ok || now.Sub(collectedAt) >= sc.interval(key)
+}
+
+// expire makes all the specs regenerated at the next collect
+func (sc *specCollector) expire() {
+	sc.collectedAt = make(map[string]time.Time)
+}
+
+// collect regenerates the specs whose intervals have elapsed, and reports whether any of them has changed.
+func (sc *specCollector) collect(now time.Time) (map[string]interface{}, []spec.NetInterface, string, bool) {
+	changed := false
+	for _, g := range sc.generators {
+		key := g.Key()
+		if !sc.due(key, now) {
+			continue
+		}
+		sc.collectedAt[key] = now
+		value, err := g.Generate()
+		if err != nil {
+			logger.Warningf("Failed to collect meta in %T (the last one is used): %s", g, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(sc.specs[key], value) {
+			logger.Debugf("The spec %q has changed", key)
+			sc.specs[key] = value
+			changed = true
+		}
+		if sc.cloudGenerator != nil && g == spec.Generator(sc.cloudGenerator) {
+			customIdentifier, err := sc.cloudGenerator.SuggestCustomIdentifier()
+			if err != nil {
+				logger.Warningf("Error while suggesting custom identifier. err: %s", err.Error())
+			} else if customIdentifier != sc.customIdentifier {
+				sc.customIdentifier = customIdentifier
+				changed = true
+			}
+		}
+	}
+	if sc.due(interfacesSpecKey, now) {
+		sc.collectedAt[interfacesSpecKey] = now
+		interfaces, err := sc.interfaceGenerator.Generate()
+		if err != nil {
+			logger.Warningf("Failed to collect interfaces (the last ones are used): %s", err.Error())
+		} else if !reflect.DeepEqual(sc.interfaces, interfaces) {
+			logger.Debugf("The interfaces have changed")
+			sc.interfaces = interfaces
+			changed = true
+		}
+	}
+
+	meta := spec.Collect(nil) // the versions of the agent
+	for key, value := range sc.specs {
+		meta[key] = value
+	}
+	if sc.fixedIdentifier != "" {
+		return meta, sc.interfaces, sc.fixedIdentifier, changed
+	}
+	return meta, sc.interfaces, sc.customIdentifier, changed
+}
@@ -0,0 +1,80 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+type testSpecGenerator struct {
+	key   string
+	value interface{}
+	count int
+}
+
+func (g *testSpecGenerator) Key() string {
+	return g.key
+}
+
+func (g *testSpecGenerator) Generate() (interface{}, error) {
+	g.count++
+	return g.value, nil
+}
+
+type testInterfaceGenerator struct {
+	interfaces []spec.NetInterface
+	count      int
+}
+
+func (g *testInterfaceGenerator) Key() string {
+	return interfacesSpecKey
+}
+
+func (g *testInterfaceGenerator) Generate() ([]spec.NetInterface, error) {
+	g.count++
+	return g.interfaces, nil
+}
+
+func TestSpecCollector(t *testing.T) {
+	cpu := &testSpecGenerator{key: "cpu", value: "4 cores"}
+	fs := &testSpecGenerator{key: "filesystem", value: "sda1"}
+	ifs := &testInterfaceGenerator{interfaces: []spec.NetInterface{{Name: "eth0", Address: "10.0.0.1"}}}
+	sc := &specCollector{
+		generators:         []spec.Generator{cpu, fs},
+		interfaceGenerator: ifs,
+		intervals:          specIntervals(config.HostSpec{Intervals: map[string]int{"filesystem": 30}}),
+		specs:              make(map[string]interface{}),
+		collectedAt:        make(map[string]time.Time),
+	}
+	if tick := sc.tick(); tick != 5*time.Minute {
+		t.Errorf("tick should be the interval of the interfaces but %s", tick)
+	}
+
+	now := time.Now()
+	meta, interfaces, _, changed := sc.collect(now)
+	if !changed || meta["cpu"] != "4 cores" || meta["filesystem"] != "sda1" || meta["agent-version"] == nil || len(interfaces) != 1 {
+		t.Errorf("all the specs should be collected at first: %v, %v", meta, interfaces)
+	}
+
+	ifs.interfaces = []spec.NetInterface{{Name: "eth0", Address: "10.0.0.2"}}
+	cpu.value = "8 cores"
+	meta, interfaces, _, changed = sc.collect(now.Add(5 * time.Minute))
+	if !changed || interfaces[0].Address != "10.0.0.2" {
+		t.Errorf("the interfaces should be updated every 5 minutes: %v", interfaces)
+	}
+	if meta["cpu"] != "4 cores" || cpu.count != 1 || fs.count != 1 {
+		t.Errorf("the other specs should not be collected before their intervals")
+	}
+
+	_, _, _, changed = sc.collect(now.Add(30 * time.Minute))
+	if changed || fs.count != 2 {
+		t.Errorf("the filesystem should be collected at the configured interval, but not changed")
+	}
+
+	meta, _, _, changed = sc.collect(now.Add(24 * time.Hour))
+	if !changed || meta["cpu"] != "8 cores" {
+		t.Errorf("the cpu should be updated daily: %v", meta)
+	}
+}
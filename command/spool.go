@@ -0,0 +1,311 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+const (
+	spoolDirName      = "spool"
+	checkSpoolDirName = "checks" // under spoolDirName
+)
+
+// Max number of the spooled values posted after each successful posting
+var spoolDrainMax = 10
+
+// spool is a file-backed queue of the values which failed to be posted,
+// which survives the restarts of the agent and the reboots of the host.
+// Each postValue (or each batch of the check reports) is stored as a JSON file named by the time it is spooled,
+// which is compressed and encrypted by the codec if configured.
+type spool struct {
+	dir       string
+	maxSize   int64
+	retention time.Duration
+	codec     *spoolCodec
+
+	mu  sync.Mutex
+	seq int
+}
+
+type spooledValue struct {
+	Values   []*mackerel.CreatingMetricsValue `json:"values"`
+	RetryCnt int                              `json:"retryCnt"`
+}
+
+type spooledReports struct {
+	Reports []*checks.Report `json:"reports"`
+}
+
+func newSpool(conf *config.Config) *spool {
+	if !conf.Spool.Enabled {
+		return nil
+	}
+	codec, err := newSpoolCodec(conf.Spool)
+	if err != nil {
+		// not to write the values in plain against the configuration
+		logger.Errorf("The spool is disabled: %s", err)
+		return nil
+	}
+	return &spool{
+		dir:       filepath.Join(conf.Root, spoolDirName),
+		maxSize:   int64(conf.Spool.MaxSizeMB) * 1024 * 1024,
+		retention: time.Duration(conf.Spool.RetentionHours) * time.Hour,
+		codec:     codec,
+	}
+}
+
+// newCheckSpool returns the spool of the check reports failed to be reported,
+// which shares the configuration with the spool of the metrics.
+func newCheckSpool(conf *config.Config) *spool {
+	s := newSpool(conf)
+	if s != nil {
+		s.dir = filepath.Join(s.dir, checkSpoolDirName)
+	}
+	return s
+}
+
+// push stores v into the spool
+func (s *spool) push(v *postValue) error {
+	return s.write(spooledValue{Values: v.values, RetryCnt: v.retryCnt})
+}
+
+// pushReports stores the check reports into the spool
+func (s *spool) pushReports(reports []*checks.Report) error {
+	return s.write(spooledReports{Reports: reports})
+}
+
+func (s *spool) write(v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if content, err = s.codec.encode(content); err != nil {
+		return err
+	}
+	s.seq++
+	// zero-padded so that the names are sorted by the time
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), s.seq%1000000)
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	s.prune()
+	return nil
+}
+
+// pop returns the oldest value in the spool with its file, which should be removed by remove
+// after the value has been posted. It returns nil if the spool is empty.
+func (s *spool) pop() (*postValue, string, error) {
+	var v spooledValue
+	path, err := s.read(&v)
+	if err != nil || path == "" {
+		return nil, "", err
+	}
+	return &postValue{values: v.Values, retryCnt: v.RetryCnt}, path, nil
+}
+
+// popReports returns the oldest check reports in the spool with its file like pop.
+func (s *spool) popReports() ([]*checks.Report, string, error) {
+	var v spooledReports
+	path, err := s.read(&v)
+	if err != nil || path == "" {
+		return nil, "", err
+	}
+	return v.Reports, path, nil
+}
+
+// read decodes the oldest file in the spool into v, and returns its path.
+// It returns the empty path if the spool is empty.
+func (s *spool) read(v interface{}) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	files := s.files()
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			return "", err
+		}
+		if content, err = s.codec.decode(content); err == nil {
+			err = json.Unmarshal(content, v)
+		}
+		if err != nil {
+			logger.Warningf("Removing the broken spooled values %s: %s", file.path, err)
+			os.Remove(file.path)
+			continue
+		}
+		return file.path, nil
+	}
+	return "", nil
+}
+
+// remove removes the file of the spooled value
+func (s *spool) remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Warningf("Failed to remove the spooled values %s: %s", path, err)
+	}
+}
+
+type spoolFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// files returns the spooled files in the order of the time they are spooled
+func (s *spool) files() []spoolFile {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	var files []spoolFile
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		files = append(files, spoolFile{filepath.Join(s.dir, info.Name()), info.Size(), info.ModTime()})
+	}
+	sort.Sort(spoolFiles(files))
+	return files
+}
+
+type spoolFiles []spoolFile
+
+func (fs spoolFiles) Len() int           { return len(fs) }
+func (fs spoolFiles) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
+func (fs spoolFiles) Less(i, j int) bool { return fs[i].path < fs[j].path }
+
+// prune removes the files older than the retention, and the oldest files exceeding the max size
+func (s *spool) prune() {
+	files := s.files()
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+	for _, file := range files {
+		expired := s.retention > 0 && time.Since(file.modTime) > s.retention
+		if !expired && (s.maxSize <= 0 || total <= s.maxSize) {
+			break
+		}
+		logger.Warningf("Abandoning the spooled values %s (expired: %t, spool size: %d bytes)", file.path, expired, total)
+		os.Remove(file.path)
+		total -= file.size
+	}
+}
+
+// drainSpool posts the spooled values, at most spoolDrainMax of them.
+// It stops at the first failure, leaving the rest in the spool.
+func drainSpool(c *Context) {
+	for i := 0; i < spoolDrainMax; i++ {
+		v, path, err := c.spool.pop()
+		if err != nil {
+			logger.Errorf("Failed to read the spool: %s", err)
+			return
+		}
+		if v == nil {
+			return
+		}
+		if err := c.API.PostMetricsValues(v.values); err != nil {
+			logger.Errorf("Failed to post spooled metrics value (will retry): %s", err)
+			c.spool.remove(path)
+			if _, limited := rateLimited(err); !limited {
+				v.retryCnt++
+			}
+			if v.retryCnt > c.config().Connection.PostMetricsRetryMax {
+				logger.Errorf("Spooled post values may be invalid and abandoned")
+			} else if err := c.spool.push(v); err != nil {
+				logger.Errorf("Failed to spool metrics value: %s", err)
+			}
+			return
+		}
+		c.spool.remove(path)
+		logger.Debugf("Posting spooled metrics succeeded.")
+	}
+}
+
+// spoolPostValues stores the values failed to be posted into the spool, abandoning the ones
+// retried too many times. The retries rate-limited by the API are not counted.
+// The values which cannot be spooled are requeued to the memory instead.
+func spoolPostValues(c *Context, values []*postValue, err error, postQueue chan<- *postValue) {
+	_, limited := rateLimited(err)
+	for _, v := range values {
+		if !limited {
+			v.retryCnt++
+		}
+		if v.retryCnt > c.config().Connection.PostMetricsRetryMax {
+			logger.Errorf("Post values may be invalid and abandoned")
+			continue
+		}
+		if err := c.spool.push(v); err != nil {
+			logger.Errorf("Failed to spool metrics value (kept in memory): %s", err)
+			go func(v *postValue) {
+				postQueue <- v
+			}(v)
+		}
+	}
+}
+
+// spoolQueue moves the values left in postQueue into the spool
+func spoolQueue(c *Context, postQueue <-chan *postValue) {
+	for {
+		select {
+		case v := <-postQueue:
+			if err := c.spool.push(v); err != nil {
+				logger.Errorf("Failed to spool metrics value: %s", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// drainCheckSpool reports the spooled check reports in the order they are spooled, at most spoolDrainMax batches
+// of them. It stops at the first failure, leaving the rest in the spool, and returns whether the spool gets empty.
+// The reports rejected by the API are abandoned not to block the others.
+func drainCheckSpool(c *Context) bool {
+	for i := 0; i < spoolDrainMax; i++ {
+		reports, path, err := c.checkSpool.popReports()
+		if err != nil {
+			logger.Errorf("Failed to read the spool of the check reports: %s", err)
+			return false
+		}
+		if path == "" {
+			return true
+		}
+		if err := c.API.ReportCheckMonitors(c.Host.ID, reports); err != nil {
+			var apiErr *mackerel.Error
+			if (errors.As(err, &apiErr) && apiErr.IsClientError()) || errors.Is(err, mackerel.ErrUnsupported) {
+				logger.Errorf("Spooled check reports are rejected and abandoned: %s", err)
+				c.checkSpool.remove(path)
+				continue
+			}
+			logger.Errorf("Failed to report spooled check reports (will retry): %s", err)
+			return false
+		}
+		c.checkSpool.remove(path)
+		logger.Debugf("Reporting spooled check reports succeeded.")
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package command
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// The spooled files are encoded as
+//
+//	magic (4 bytes) | compression (1 byte) | encrypted (1 byte) | body
+//
+// where the body is the nonce and the JSON compressed and sealed by AES-GCM (with the header as
+// the additional data) if encrypted, or the SHA-256 of the compressed JSON and itself otherwise.
+// The files are checked for the integrity on reading, and the plain JSON files spooled by the older
+// agents are still read. With the encryption, the files not encrypted (which could be written by anyone
+// who can write to the spool) are rejected unless they are accepted explicitly for the migration.
+var spoolMagic = []byte("MKS1")
+
+const spoolHeaderSize = 6
+
+var spoolCompressions = map[string]byte{
+	config.SpoolCompressionNone: 0,
+	config.SpoolCompressionGzip: 1,
+	config.SpoolCompressionZstd: 2,
+}
+
+var errSpoolIntegrity = errors.New("the integrity check failed")
+
+var errSpoolNotEncrypted = errors.New("the file is not encrypted (accept_unencrypted accepts it for the migration)")
+
+// spoolCodec compresses and encrypts the spooled files.
+// The codec is nil-safe, writing and reading the plain files with the checksums.
+type spoolCodec struct {
+	compression       string
+	aead              cipher.AEAD // nil if not encrypted
+	acceptUnencrypted bool        // reads the files not encrypted even with aead
+}
+
+// newSpoolCodec creates the codec by the configuration, which fails if the encryption key is not available
+// not to write the values in plain.
+func newSpoolCodec(conf config.Spool) (*spoolCodec, error) {
+	c := &spoolCodec{compression: conf.Compression, acceptUnencrypted: conf.AcceptUnencrypted}
+	if conf.EncryptionKeyFile == "" && conf.EncryptionKeyCommand == "" {
+		return c, nil
+	}
+	key, err := loadSpoolKey(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the encryption key of the spool: %s", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if c.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadSpoolKey reads the key (base64 of 16, 24 or 32 bytes) from the file, or the output of the command,
+// e.g. decrypting the data key by KMS or reading it from the keyring.
+func loadSpoolKey(conf config.Spool) ([]byte, error) {
+	var encoded string
+	if conf.EncryptionKeyFile != "" {
+		content, err := ioutil.ReadFile(conf.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(content)
+	} else {
+		stdout, stderr, exitCode, err := util.RunCommand(conf.EncryptionKeyCommand, "")
+		if err != nil {
+			return nil, err
+		}
+		if exitCode != 0 {
+			return nil, fmt.Errorf("the command exited with %d: %s", exitCode, strings.TrimSpace(stderr))
+		}
+		encoded = stdout
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("the key should be encoded by base64: %s", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("the key should be 16, 24 or 32 bytes but %d bytes", len(key))
+}
+
+func (c *spoolCodec) encode(content []byte) ([]byte, error) {
+	if c == nil {
+		c = &spoolCodec{}
+	}
+	compression := spoolCompressions[c.compression]
+	compressed, err := compressSpool(compression, content)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append([]byte{}, spoolMagic...), compression, 0)
+	if c.aead == nil {
+		sum := sha256.Sum256(compressed)
+		return append(append(header, sum[:]...), compressed...), nil
+	}
+	header[5] = 1
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(append(header, nonce...), nonce, compressed, header), nil
+}
+
+func (c *spoolCodec) decode(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, spoolMagic) {
+		// the plain JSON spooled by the older agents
+		if !c.readsUnencrypted() {
+			return nil, errSpoolNotEncrypted
+		}
+		return data, nil
+	}
+	if len(data) < spoolHeaderSize {
+		return nil, errSpoolIntegrity
+	}
+	header, body := data[:spoolHeaderSize], data[spoolHeaderSize:]
+	if header[5] != 1 && !c.readsUnencrypted() {
+		return nil, errSpoolNotEncrypted
+	}
+	var compressed []byte
+	if header[5] == 1 {
+		if c == nil || c.aead == nil {
+			return nil, errors.New("the encryption key is not configured")
+		}
+		size := c.aead.NonceSize()
+		if len(body) < size {
+			return nil, errSpoolIntegrity
+		}
+		var err error
+		compressed, err = c.aead.Open(nil, body[:size], body[size:], header)
+		if err != nil {
+			return nil, errSpoolIntegrity
+		}
+	} else {
+		if len(body) < sha256.Size {
+			return nil, errSpoolIntegrity
+		}
+		sum := sha256.Sum256(body[sha256.Size:])
+		if !bytes.Equal(sum[:], body[:sha256.Size]) {
+			return nil, errSpoolIntegrity
+		}
+		compressed = body[sha256.Size:]
+	}
+	return decompressSpool(header[4], compressed)
+}
+
+// readsUnencrypted reports whether the files not encrypted are read, i.e. without the encryption or accepted
+// explicitly
+func (c *spoolCodec) readsUnencrypted() bool {
+	return c == nil || c.aead == nil || c.acceptUnencrypted
+}
+
+func compressSpool(compression byte, content []byte) ([]byte, error) {
+	switch compression {
+	case spoolCompressions[config.SpoolCompressionGzip]:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case spoolCompressions[config.SpoolCompressionZstd]:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(content, nil), nil
+	}
+	return content, nil
+}
+
+func decompressSpool(compression byte, compressed []byte) ([]byte, error) {
+	switch compression {
+	case spoolCompressions[config.SpoolCompressionNone]:
+		return compressed, nil
+	case spoolCompressions[config.SpoolCompressionGzip]:
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case spoolCompressions[config.SpoolCompressionZstd]:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(compressed, nil)
+	}
+	return nil, fmt.Errorf("unknown compression %d", compression)
+}
@@ -0,0 +1,91 @@
+package command
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestSpoolCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-spool-codec")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "spool.key")
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))+"\n"), 0600)
+	otherKeyFile := filepath.Join(dir, "other.key")
+	ioutil.WriteFile(otherKeyFile, []byte(base64.StdEncoding.EncodeToString([]byte("fedcba9876543210"))), 0600)
+
+	content := []byte(`{"values":[{"hostId":"xyzabc12345","name":"custom.secret","time":1474186920,"value":1}],"retryCnt":0}`)
+	testCases := []config.Spool{
+		{},
+		{Compression: config.SpoolCompressionGzip},
+		{Compression: config.SpoolCompressionZstd},
+		{EncryptionKeyFile: keyFile},
+		{Compression: config.SpoolCompressionZstd, EncryptionKeyFile: keyFile},
+	}
+	for _, conf := range testCases {
+		c, err := newSpoolCodec(conf)
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		encoded, err := c.encode(content)
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		if conf.EncryptionKeyFile != "" && bytes.Contains(encoded, []byte("custom.secret")) {
+			t.Errorf("the values should be encrypted (%+v)", conf)
+		}
+		decoded, err := c.decode(encoded)
+		if err != nil || string(decoded) != string(content) {
+			t.Errorf("the content should be decoded (%+v): %q, %v", conf, decoded, err)
+		}
+
+		// tampered
+		encoded[len(encoded)-1] ^= 1
+		if _, err := c.decode(encoded); err == nil {
+			t.Errorf("the tampered content should not be decoded (%+v)", conf)
+		}
+	}
+
+	c, _ := newSpoolCodec(config.Spool{EncryptionKeyFile: keyFile})
+	encoded, _ := c.encode(content)
+	other, _ := newSpoolCodec(config.Spool{EncryptionKeyFile: otherKeyFile})
+	if _, err := other.decode(encoded); err == nil {
+		t.Errorf("the content encrypted by another key should not be decoded")
+	}
+	var plain *spoolCodec
+	if _, err := plain.decode(encoded); err == nil {
+		t.Errorf("the encrypted content should not be decoded without the key")
+	}
+	if decoded, err := plain.decode(content); err != nil || string(decoded) != string(content) {
+		t.Errorf("the plain JSON of the older agents should be read: %q, %v", decoded, err)
+	}
+
+	// the files not encrypted are rejected with the key unless accepted for the migration
+	unencrypted, _ := plain.encode(content)
+	for _, data := range [][]byte{content, unencrypted} {
+		if _, err := c.decode(data); err == nil {
+			t.Errorf("the content not encrypted should not be decoded with the key: %q", data)
+		}
+	}
+	migrating, _ := newSpoolCodec(config.Spool{EncryptionKeyFile: keyFile, AcceptUnencrypted: true})
+	for _, data := range [][]byte{content, unencrypted} {
+		if decoded, err := migrating.decode(data); err != nil || string(decoded) != string(content) {
+			t.Errorf("the content not encrypted should be decoded by accept_unencrypted: %q, %v", decoded, err)
+		}
+	}
+
+	if _, err := newSpoolCodec(config.Spool{EncryptionKeyFile: filepath.Join(dir, "none.key")}); err == nil {
+		t.Errorf("the codec should not be created without the key")
+	}
+	if _, err := newSpoolCodec(config.Spool{EncryptionKeyCommand: "echo c2hvcnQ="}); err == nil {
+		t.Errorf("the codec should not be created with the short key")
+	}
+}
@@ -0,0 +1,239 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+func newTestSpool(t *testing.T) (*spool, func()) {
+	root, err := ioutil.TempDir("", "mackerel-agent-spool")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	conf := &config.Config{Root: root, Spool: config.Spool{Enabled: true, MaxSizeMB: 1, RetentionHours: 1}}
+	return newSpool(conf), func() { os.RemoveAll(root) }
+}
+
+func testPostValue(name string, retryCnt int) *postValue {
+	return &postValue{
+		values:   []*mackerel.CreatingMetricsValue{{HostID: "xyzabc12345", Name: name, Value: 1.0, Time: 1474186920}},
+		retryCnt: retryCnt,
+	}
+}
+
+func TestNewSpool(t *testing.T) {
+	if s := newSpool(&config.Config{Root: "/tmp"}); s != nil {
+		t.Errorf("spool should be nil when disabled")
+	}
+	s := newSpool(&config.Config{Root: "/tmp", Spool: config.Spool{Enabled: true, MaxSizeMB: 2, RetentionHours: 3}})
+	if s.dir != "/tmp/spool" || s.maxSize != 2*1024*1024 || s.retention != 3*time.Hour {
+		t.Errorf("spool is not configured properly: %+v", s)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	s, cleanup := newTestSpool(t)
+	defer cleanup()
+
+	for i, name := range []string{"first", "second"} {
+		if err := s.push(testPostValue(name, i)); err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+	}
+
+	for i, name := range []string{"first", "second"} {
+		v, path, err := s.pop()
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		if v == nil || v.values[0].Name != name || v.retryCnt != i {
+			t.Fatalf("the oldest values should be popped: %+v", v)
+		}
+		// not removed until posted
+		if again, _, _ := s.pop(); again.values[0].Name != name {
+			t.Errorf("values should be kept until removed")
+		}
+		s.remove(path)
+	}
+	if v, _, _ := s.pop(); v != nil {
+		t.Errorf("spool should be empty but %+v", v)
+	}
+}
+
+func TestSpool_prune(t *testing.T) {
+	s, cleanup := newTestSpool(t)
+	defer cleanup()
+
+	s.push(testPostValue("expired", 0))
+	s.push(testPostValue("large", 0))
+	s.push(testPostValue("kept", 0))
+	files := s.files()
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(files[0].path, old, old)
+	s.maxSize = files[2].size
+
+	s.prune()
+	files = s.files()
+	if len(files) != 1 {
+		t.Fatalf("the expired values and the values exceeding the max size should be removed: %+v", files)
+	}
+	if v, _, _ := s.pop(); v.values[0].Name != "kept" {
+		t.Errorf("the newest values should be kept but %+v", v)
+	}
+}
+
+func TestSpool_broken(t *testing.T) {
+	s, cleanup := newTestSpool(t)
+	defer cleanup()
+
+	os.MkdirAll(s.dir, 0755)
+	ioutil.WriteFile(filepath.Join(s.dir, "00000000000000000000-000000.json"), []byte("{broken"), 0600)
+	s.push(testPostValue("valid", 0))
+
+	v, _, err := s.pop()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if v == nil || v.values[0].Name != "valid" {
+		t.Errorf("broken values should be skipped: %+v", v)
+	}
+	if len(s.files()) != 1 {
+		t.Errorf("broken values should be removed")
+	}
+}
+
+func TestDrainSpool(t *testing.T) {
+	s, cleanup := newTestSpool(t)
+	defer cleanup()
+
+	status := http.StatusOK
+	posted := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if status == http.StatusOK {
+			posted++
+		}
+		res.WriteHeader(status)
+		res.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	api, _ := mackerel.NewAPI(ts.URL, "dummy-key", false)
+	c := &Context{
+		Config: &config.Config{Connection: config.ConnectionConfig{PostMetricsRetryMax: 1}},
+		API:    api,
+		spool:  s,
+	}
+
+	s.push(testPostValue("retried", 0))
+	status = http.StatusInternalServerError
+	drainSpool(c)
+	v, _, _ := s.pop()
+	if v == nil || v.retryCnt != 1 {
+		t.Fatalf("values should be kept in the spool with retry count on failure: %+v", v)
+	}
+	drainSpool(c)
+	if v, _, _ := s.pop(); v != nil {
+		t.Errorf("values retried too many times should be abandoned: %+v", v)
+	}
+
+	original := spoolDrainMax
+	spoolDrainMax = 2
+	defer func() { spoolDrainMax = original }()
+	for _, name := range []string{"a", "b", "c"} {
+		s.push(testPostValue(name, 0))
+	}
+	status = http.StatusOK
+	drainSpool(c)
+	if posted != 2 {
+		t.Errorf("at most spoolDrainMax values should be posted but %d", posted)
+	}
+	if v, _, _ := s.pop(); v == nil || v.values[0].Name != "c" {
+		t.Errorf("the rest should be left in the spool: %+v", v)
+	}
+}
+
+func TestSpoolQueue(t *testing.T) {
+	s, cleanup := newTestSpool(t)
+	defer cleanup()
+
+	postQueue := make(chan *postValue, 3)
+	postQueue <- testPostValue("a", 0)
+	postQueue <- testPostValue("b", 0)
+	spoolQueue(&Context{spool: s}, postQueue)
+
+	if len(postQueue) != 0 || len(s.files()) != 2 {
+		t.Errorf("queued values should be moved into the spool")
+	}
+}
+
+func TestDrainCheckSpool(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-spool")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(root)
+	s := newCheckSpool(&config.Config{Root: root, Spool: config.Spool{Enabled: true, MaxSizeMB: 1, RetentionHours: 1}})
+	if s.dir != filepath.Join(root, "spool", "checks") {
+		t.Errorf("check reports should be spooled under the spool directory: %s", s.dir)
+	}
+
+	status := http.StatusOK
+	var reported []string
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if status == http.StatusOK {
+			var payload struct {
+				Reports []struct {
+					Name       string `json:"name"`
+					OccurredAt int64  `json:"occurredAt"`
+				} `json:"reports"`
+			}
+			json.NewDecoder(req.Body).Decode(&payload)
+			for _, r := range payload.Reports {
+				reported = append(reported, fmt.Sprintf("%s@%d", r.Name, r.OccurredAt))
+			}
+		}
+		res.WriteHeader(status)
+		res.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	api, _ := mackerel.NewAPI(ts.URL, "dummy-key", false)
+	c := &Context{
+		Host:       &mackerel.Host{ID: "xyzabc12345"},
+		API:        api,
+		checkSpool: s,
+	}
+
+	occurredAt := time.Unix(1474186920, 0)
+	s.pushReports([]*checks.Report{{Name: "first", Status: checks.StatusCritical, OccurredAt: occurredAt}})
+	s.pushReports([]*checks.Report{{Name: "second", Status: checks.StatusOK, OccurredAt: occurredAt.Add(time.Minute)}})
+
+	status = http.StatusServiceUnavailable
+	if drainCheckSpool(c) || len(s.files()) != 2 {
+		t.Errorf("reports should be kept in the spool on failure")
+	}
+
+	status = http.StatusOK
+	if !drainCheckSpool(c) || len(s.files()) != 0 {
+		t.Errorf("spooled reports should be reported")
+	}
+	if !reflect.DeepEqual(reported, []string{"first@1474186920", "second@1474186980"}) {
+		t.Errorf("reports should be reported in order with the original timestamps: %v", reported)
+	}
+
+	s.pushReports([]*checks.Report{{Name: "invalid", OccurredAt: occurredAt}})
+	status = http.StatusBadRequest
+	if !drainCheckSpool(c) {
+		t.Errorf("reports rejected by the API should be abandoned")
+	}
+}
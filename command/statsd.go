@@ -0,0 +1,32 @@
+package command
+
+import (
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// prepareStatsd starts the StatsD listener if configured, and registers its generator to the agent.
+// The running listener is reused if its configuration is not changed, and closed otherwise.
+func prepareStatsd(conf *config.Config, ag *agent.Agent, running *metrics.StatsdGenerator) (*metrics.StatsdGenerator, error) {
+	prefix := conf.Statsd.Prefix
+	if prefix == "" {
+		prefix = metrics.DefaultStatsdPrefix
+	}
+	if running != nil {
+		if running.Address() == conf.Statsd.Listen && running.Prefix == prefix {
+			ag.MetricsGenerators = append(ag.MetricsGenerators, running)
+			return running, nil
+		}
+		running.Close()
+	}
+	if conf.Statsd.Listen == "" {
+		return nil, nil
+	}
+	g, err := metrics.NewStatsdGenerator(conf.Statsd.Listen, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ag.MetricsGenerators = append(ag.MetricsGenerators, g)
+	return g, nil
+}
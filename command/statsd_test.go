@@ -0,0 +1,42 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestPrepareStatsd(t *testing.T) {
+	conf := &config.Config{}
+	ag := &agent.Agent{}
+	if g, err := prepareStatsd(conf, ag, nil); g != nil || err != nil {
+		t.Errorf("StatsD listener should not be started without listen: %v, %v", g, err)
+	}
+
+	conf.Statsd.Listen = "127.0.0.1:0"
+	g, err := prepareStatsd(conf, ag, nil)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer g.Close()
+	if len(ag.MetricsGenerators) != 1 || ag.MetricsGenerators[0] != g {
+		t.Errorf("the generator should be registered to the agent")
+	}
+
+	ag = &agent.Agent{}
+	if reused, _ := prepareStatsd(conf, ag, g); reused != g || len(ag.MetricsGenerators) != 1 {
+		t.Errorf("the running listener should be reused when the configuration is not changed")
+	}
+
+	conf.Statsd.Prefix = "custom.app"
+	ag = &agent.Agent{}
+	restarted, err := prepareStatsd(conf, ag, g)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer restarted.Close()
+	if restarted == g || restarted.Prefix != "custom.app" {
+		t.Errorf("the listener should be restarted when the configuration is changed")
+	}
+}
@@ -0,0 +1,102 @@
+package command
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// pluginRuns records the time taken by the last run of each metrics plugin and the failed runs,
+// which are posted by telemetryGenerator.
+type pluginRuns struct {
+	mu        sync.Mutex
+	durations map[string]time.Duration // of the last runs
+	failures  map[string]int           // since the previous collection
+}
+
+var metricsPluginRuns = &pluginRuns{}
+
+func (r *pluginRuns) record(name string, duration time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.durations == nil {
+		r.durations = make(map[string]time.Duration)
+		r.failures = make(map[string]int)
+	}
+	r.durations[name] = duration
+	if err != nil {
+		r.failures[name]++
+	} else if _, ok := r.failures[name]; !ok {
+		r.failures[name] = 0
+	}
+}
+
+// flush returns the records and resets them, so that the removed plugins are not reported any more
+func (r *pluginRuns) flush() (map[string]time.Duration, map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	durations, failures := r.durations, r.failures
+	r.durations, r.failures = nil, nil
+	return durations, failures
+}
+
+var telemetryNameSanitizer = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// telemetryGenerator generates the metrics of the agent itself in the diagnostic mode in addition to
+// metrics.AgentGenerator, so that the agent can be monitored by the metrics (the values dropped from
+// the full queue are posted as custom.agent.post_queue.dropped.<policy> regardless of the mode).
+//
+// `custom.agent.post_queue.length`: the number of the values waiting to be posted
+// `custom.agent.api.{requests,errors}.<endpoint>`: the numbers of the requests and the failed ones since the previous collection
+// `custom.agent.api.latency.<endpoint>`: the average latency (seconds) of the requests since the previous collection
+// `custom.agent.api.http_version`: the version of HTTP of the last response from the API (e.g. 1.1, 2 or 3)
+// `custom.agent.api.http3_fallbacks`: the number of the requests fallen back from HTTP/3 since the previous collection
+// `custom.agent.plugin.duration.<name>`: the time (seconds) taken by the last run of the metrics plugin
+// `custom.agent.plugin.failures.<name>`: the number of the failed runs of the metrics plugin since the previous collection
+type telemetryGenerator struct {
+	api   *mackerel.API
+	stats *postStats
+}
+
+// prepareTelemetry registers the telemetry generator of c to its agent
+func prepareTelemetry(c *Context) {
+	c.Agent.DiagnosticGenerators = append(c.Agent.DiagnosticGenerators, &telemetryGenerator{api: c.API, stats: &c.postStats})
+}
+
+// Generate generates the telemetry since the previous collection
+func (g *telemetryGenerator) Generate() (metrics.Values, error) {
+	values := metrics.Values{
+		"custom.agent.post_queue.length": float64(g.stats.status().QueueLength),
+	}
+	if g.api != nil {
+		for endpoint, s := range g.api.RequestStats() {
+			endpoint = telemetryNameSanitizer.ReplaceAllString(endpoint, "_")
+			values["custom.agent.api.requests."+endpoint] = float64(s.Requests)
+			values["custom.agent.api.errors."+endpoint] = float64(s.Errors)
+			if s.Requests > 0 {
+				values["custom.agent.api.latency."+endpoint] = s.Latency.Seconds() / float64(s.Requests)
+			}
+		}
+		if v, err := strconv.ParseFloat(strings.TrimPrefix(g.api.Proto(), "HTTP/"), 64); err == nil {
+			values["custom.agent.api.http_version"] = v
+		}
+		if n, ok := g.api.HTTP3Fallbacks(); ok {
+			values["custom.agent.api.http3_fallbacks"] = float64(n)
+		}
+	}
+	durations, failures := metricsPluginRuns.flush()
+	for name, d := range durations {
+		name = telemetryNameSanitizer.ReplaceAllString(name, "_")
+		values["custom.agent.plugin.duration."+name] = d.Seconds()
+	}
+	for name, n := range failures {
+		name = telemetryNameSanitizer.ReplaceAllString(name, "_")
+		values["custom.agent.plugin.failures."+name] = float64(n)
+	}
+	return values, nil
+}
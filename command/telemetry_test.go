@@ -0,0 +1,59 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+func TestTelemetryGenerator(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(res, `{"host":{"id":"9rxGOHfVF8F","name":"mydb001"}}`)
+	}))
+	defer ts.Close()
+	api, _ := mackerel.NewAPI(ts.URL, "dummy-key", false)
+	api.FindHost("9rxGOHfVF8F")
+
+	var stats postStats
+	queue := make(chan *postValue, 3)
+	queue <- newPostValue(nil)
+	stats.setQueue(queue)
+
+	metricsPluginRuns.record("my.plugin", 2*time.Second, nil)
+	metricsPluginRuns.record("failing", time.Second, errors.New("exit status 1"))
+	metricsPluginRuns.record("failing", time.Second, errors.New("exit status 1"))
+
+	g := &telemetryGenerator{api: api, stats: &stats}
+	values, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{
+		"custom.agent.post_queue.length":         1,
+		"custom.agent.api.requests.hosts":        1,
+		"custom.agent.api.errors.hosts":          0,
+		"custom.agent.api.http_version":          1.1,
+		"custom.agent.plugin.duration.my_plugin": 2,
+		"custom.agent.plugin.failures.my_plugin": 0,
+		"custom.agent.plugin.duration.failing":   1,
+		"custom.agent.plugin.failures.failing":   2,
+	}
+	for name, v := range expected {
+		if values[name] != v {
+			t.Errorf("%s should be %f but %f", name, v, values[name])
+		}
+	}
+	if _, ok := values["custom.agent.api.latency.hosts"]; !ok {
+		t.Errorf("the latency of the API should be generated: %v", values)
+	}
+
+	values, _ = g.Generate()
+	if _, ok := values["custom.agent.plugin.duration.my_plugin"]; ok {
+		t.Errorf("the runs of the plugins should be reset: %v", values)
+	}
+}
@@ -0,0 +1,171 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+// Interval to poll the termination notice. Spot instances of EC2 get the notice two minutes before the termination,
+// and preemptible instances of GCE get only 30 seconds.
+var terminationWatchInterval = 5 * time.Second
+
+// termination is the termination of the agent requested by the signals (sent to termCh of Run) or
+// the termination notice of the ephemeral instance. The first request starts the graceful termination
+// (graceful is done), which flushes the queued metrics and the check reports, and the second one
+// forces it (force is done).
+type termination struct {
+	mu             sync.Mutex
+	graceful       context.Context
+	force          context.Context
+	cancelGraceful context.CancelFunc
+	cancelForce    context.CancelFunc
+}
+
+func newTermination() *termination {
+	t := &termination{}
+	t.graceful, t.cancelGraceful = context.WithCancel(context.Background())
+	t.force, t.cancelForce = context.WithCancel(context.Background())
+	return t
+}
+
+// request requests the graceful termination, or forces it if it has already been requested
+func (t *termination) request() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.graceful.Done():
+		t.cancelForce()
+	default:
+		t.cancelGraceful()
+	}
+}
+
+// watch requests the termination on every receive from termCh until ctx is done
+func (t *termination) watch(ctx context.Context, termCh <-chan struct{}) {
+	for {
+		select {
+		case <-termCh:
+			t.request()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchTermination polls the termination notice of the ephemeral instance.
+// On notice, it enqueues the metrics collected at that moment, flushes the queued metrics, sets the host status
+// to HostStatus.OnStop and posts the graph annotations. The agent keeps running when the instance is going to be
+// stopped or hibernated, and the status is set back to HostStatus.OnStart when the notice is withdrawn (e.g. the
+// hibernated instance has resumed). When the instance is going to be terminated, it requests the termination to
+// flush the check reports and then stop the agent, and the host is retired (with HostStatus.RetireOnStop)
+// or its status is set by Run after the agent stopped.
+func watchTermination(ctx context.Context, c *Context, watcher spec.TerminationWatcher, postQueue chan *postValue, term *termination) {
+	var noticed *spec.Interruption // the interruption handled
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(terminationWatchInterval):
+		}
+
+		notice, err := watcher.TerminationNotice()
+		if err != nil {
+			logger.Debugf("Failed to get the termination notice: %s", err)
+			continue
+		}
+		if notice == nil {
+			if noticed != nil {
+				logger.Infof("The termination notice has been withdrawn: %s", noticed.Description)
+				noticed = nil
+				updateHostStatus(c, c.config().HostStatus.OnStart)
+			}
+			continue
+		}
+		if noticed != nil && *notice == *noticed {
+			continue
+		}
+		noticed = notice
+
+		if notice.Terminates() {
+			logger.Warningf("Received the termination notice: %s. Flushing metrics and check reports and stopping.", notice.Description)
+		} else {
+			logger.Warningf("Received the termination notice: %s. Flushing metrics and keep running.", notice.Description)
+		}
+		select {
+		case postQueue <- metricsPostValue(c, c.Agent.CollectMetrics(ctx, time.Now())):
+		case <-ctx.Done():
+			return
+		}
+		c.Flush()
+		postTerminationAnnotations(c, notice)
+		if notice.Terminates() {
+			if c.config().HostStatus.RetireOnStop {
+				c.retireOnStop()
+			}
+			term.request()
+			return
+		}
+		updateHostStatus(c, c.config().HostStatus.OnStop)
+	}
+}
+
+// updateHostStatus sets the status of the host to status unless it is empty
+func updateHostStatus(c *Context, status string) {
+	if status == "" {
+		return
+	}
+	if err := c.API.UpdateHostStatus(c.Host.ID, status); err != nil {
+		logger.Errorf("Failed to update the host status to %s: %s", status, err)
+	}
+}
+
+// postTerminationAnnotations posts a graph annotation for each service of the host's roles.
+func postTerminationAnnotations(c *Context, notice *spec.Interruption) {
+	now := time.Now().Unix()
+	for _, annotation := range terminationAnnotations(c.config().Roles, c.Host.Name, notice, now) {
+		if err := c.API.CreateGraphAnnotation(annotation); errors.Is(err, mackerel.ErrUnsupported) {
+			logger.Debugf("Skip posting the graph annotations: %s", err)
+			return
+		} else if err != nil {
+			logger.Errorf("Failed to post the graph annotation to %s: %s", annotation.Service, err)
+		}
+	}
+}
+
+// terminationAnnotations groups the role fullnames ("<service>:<role>") by the services
+// and returns the annotations for each service.
+func terminationAnnotations(roleFullnames []string, hostName string, notice *spec.Interruption, now int64) []*mackerel.GraphAnnotation {
+	title := fmt.Sprintf("%s is being terminated", hostName)
+	if !notice.Terminates() {
+		title = fmt.Sprintf("%s is being interrupted (%s)", hostName, notice.Action)
+	}
+	var annotations []*mackerel.GraphAnnotation
+	byService := make(map[string]*mackerel.GraphAnnotation)
+	for _, fullname := range roleFullnames {
+		parts := strings.SplitN(fullname, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		annotation, ok := byService[parts[0]]
+		if !ok {
+			annotation = &mackerel.GraphAnnotation{
+				Title:       title,
+				Description: notice.Description,
+				From:        now,
+				To:          now,
+				Service:     parts[0],
+			}
+			byService[parts[0]] = annotation
+			annotations = append(annotations, annotation)
+		}
+		annotation.Roles = append(annotation.Roles, parts[1])
+	}
+	return annotations
+}
@@ -0,0 +1,190 @@
+package command
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+func TestTerminationAnnotations(t *testing.T) {
+	notice := &spec.Interruption{Action: spec.InterruptionTerminate, Description: "preempted"}
+	annotations := terminationAnnotations([]string{"My-Service:app", "My-Service:db", "Other:web", "invalid"}, "myhost", notice, 1474186920)
+	expected := []*mackerel.GraphAnnotation{
+		{Title: "myhost is being terminated", Description: "preempted", From: 1474186920, To: 1474186920, Service: "My-Service", Roles: []string{"app", "db"}},
+		{Title: "myhost is being terminated", Description: "preempted", From: 1474186920, To: 1474186920, Service: "Other", Roles: []string{"web"}},
+	}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("annotations should be %+v but %+v", expected, annotations)
+	}
+
+	notice.Action = spec.InterruptionHibernate
+	annotations = terminationAnnotations([]string{"My-Service:app"}, "myhost", notice, 1474186920)
+	if len(annotations) != 1 || annotations[0].Title != "myhost is being interrupted (hibernate)" {
+		t.Errorf("the annotation should tell the interruption: %+v", annotations)
+	}
+}
+
+type testTerminationWatcher struct {
+	mu     sync.Mutex
+	notice *spec.Interruption
+}
+
+func (w *testTerminationWatcher) TerminationNotice() (*spec.Interruption, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.notice, nil
+}
+
+func (w *testTerminationWatcher) set(notice *spec.Interruption) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.notice = notice
+}
+
+func TestWatchTermination(t *testing.T) {
+	annotated := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		annotated <- req.URL.Path
+	}))
+	defer ts.Close()
+	api, _ := mackerel.NewAPI(ts.URL, "dummy-key", false)
+
+	conf := &config.Config{Roles: []string{"My-Service:app"}}
+	c := &Context{
+		Agent:  &agent.Agent{},
+		Config: conf,
+		Host:   &mackerel.Host{ID: "xyzabc12345", Name: "myhost"},
+		API:    api,
+	}
+
+	original := terminationWatchInterval
+	terminationWatchInterval = 10 * time.Millisecond
+	defer func() { terminationWatchInterval = original }()
+
+	postQueue := make(chan *postValue, 1)
+	term := newTermination()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watcher := &testTerminationWatcher{notice: &spec.Interruption{Action: spec.InterruptionTerminate, Description: "preempted"}}
+	go watchTermination(ctx, c, watcher, postQueue, term)
+
+	select {
+	case <-postQueue:
+	case <-time.After(time.Second):
+		t.Fatal("metrics should be enqueued on the termination notice")
+	}
+	select {
+	case path := <-annotated:
+		if path != "/api/v0/graph-annotations" {
+			t.Errorf("graph annotation should be posted but %s", path)
+		}
+	case <-time.After(time.Second):
+		t.Error("graph annotation should be posted on the termination notice")
+	}
+	select {
+	case <-term.graceful.Done():
+	case <-time.After(time.Second):
+		t.Error("the agent should be terminated on the termination notice")
+	}
+}
+
+func TestWatchTermination_stop(t *testing.T) {
+	requests := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- req.URL.Path + " " + string(body)
+		res.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	api, _ := mackerel.NewAPI(ts.URL, "dummy-key", false)
+
+	conf := &config.Config{HostStatus: config.HostStatus{OnStart: "working", OnStop: "standby"}}
+	c := &Context{
+		Agent:  &agent.Agent{},
+		Config: conf,
+		Host:   &mackerel.Host{ID: "xyzabc12345", Name: "myhost"},
+		API:    api,
+	}
+
+	original := terminationWatchInterval
+	terminationWatchInterval = 10 * time.Millisecond
+	defer func() { terminationWatchInterval = original }()
+
+	postQueue := make(chan *postValue, 1)
+	term := newTermination()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watcher := &testTerminationWatcher{notice: &spec.Interruption{Action: spec.InterruptionHibernate, Description: "hibernate"}}
+	go watchTermination(ctx, c, watcher, postQueue, term)
+
+	select {
+	case <-postQueue:
+	case <-time.After(time.Second):
+		t.Fatal("metrics should be enqueued on the notice of the hibernation")
+	}
+	select {
+	case req := <-requests:
+		if !strings.HasPrefix(req, "/api/v0/hosts/xyzabc12345/status ") || !strings.Contains(req, `"standby"`) {
+			t.Errorf("the host status should be set to on_stop but %s", req)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the host status should be set on the notice of the hibernation")
+	}
+
+	watcher.set(nil)
+	select {
+	case req := <-requests:
+		if !strings.HasPrefix(req, "/api/v0/hosts/xyzabc12345/status ") || !strings.Contains(req, `"working"`) {
+			t.Errorf("the host status should be set back to on_start but %s", req)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the host status should be set back after the notice is withdrawn")
+	}
+	select {
+	case <-term.graceful.Done():
+		t.Error("the agent should keep running on the notice of the hibernation")
+	default:
+	}
+}
+
+func TestTermination(t *testing.T) {
+	term := newTermination()
+	termCh := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go term.watch(ctx, termCh)
+
+	termCh <- struct{}{}
+	select {
+	case <-term.graceful.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the graceful termination should be requested at first")
+	}
+	select {
+	case <-term.force.Done():
+		t.Fatal("the termination should not be forced at first")
+	default:
+	}
+
+	termCh <- struct{}{}
+	select {
+	case <-term.force.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the termination should be forced at the second request")
+	}
+
+	// the requests after the forced termination should not block
+	term.request()
+	termCh <- struct{}{}
+}
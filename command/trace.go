@@ -0,0 +1,81 @@
+package command
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logging"
+)
+
+var traceLogger = logging.GetLogger("command.trace")
+
+// tracer samples the values to be traced through the posting pipeline, configured by config.Trace.
+type tracer struct {
+	rate float64
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+	seq uint64
+}
+
+func newTracer(conf config.Trace) *tracer {
+	if conf.SampleRate <= 0 {
+		return nil
+	}
+	return &tracer{
+		rate: conf.SampleRate,
+		rnd:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// sample returns the trace of the values generated at the time if they are sampled, and nil otherwise.
+// The tracer is nil-safe, sampling nothing.
+func (t *tracer) sample(generated time.Time, datapoints int) *pipelineTrace {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	sampled := t.rnd.Float64() < t.rate
+	if sampled {
+		t.seq++
+	}
+	id := t.seq
+	t.mu.Unlock()
+	if !sampled {
+		return nil
+	}
+	tr := &pipelineTrace{id: id, generated: generated, last: generated}
+	tr.stage("generated", "%d datapoints", datapoints)
+	return tr
+}
+
+// pipelineTrace logs the stages of the sampled values with the elapsed times
+// since they are generated and since the previous stage.
+type pipelineTrace struct {
+	id        uint64
+	generated time.Time
+
+	mu     sync.Mutex
+	last   time.Time
+	stages []string
+}
+
+// stage logs that the values reach the stage. The trace is nil-safe, logging nothing.
+func (tr *pipelineTrace) stage(name, format string, args ...interface{}) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	now := time.Now()
+	if name == "generated" {
+		now = tr.generated
+	}
+	traceLogger.Infof("trace=%d stage=%s at=%s total=%s delta=%s %s", tr.id, name,
+		now.Format(time.RFC3339Nano), now.Sub(tr.generated), now.Sub(tr.last), fmt.Sprintf(format, args...))
+	tr.last = now
+	tr.stages = append(tr.stages, name)
+}
@@ -0,0 +1,49 @@
+package command
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestTracer(t *testing.T) {
+	if tr := newTracer(config.Trace{}); tr != nil {
+		t.Errorf("tracer should be nil when disabled")
+	}
+	var disabled *tracer
+	trace := disabled.sample(time.Now(), 1)
+	if trace != nil {
+		t.Errorf("disabled tracer should not sample")
+	}
+	trace.stage("enqueued", "") // should not panic
+
+	tracer := newTracer(config.Trace{SampleRate: 1})
+	generated := time.Now().Add(-time.Second)
+	trace = tracer.sample(generated, 3)
+	if trace == nil || trace.id != 1 {
+		t.Fatalf("all values should be sampled at the rate 1: %+v", trace)
+	}
+	trace.stage("enqueued", "queue length: %d", 1)
+	if !reflect.DeepEqual(trace.stages, []string{"generated", "enqueued"}) {
+		t.Errorf("stages should be recorded: %v", trace.stages)
+	}
+	if !trace.last.After(generated) {
+		t.Errorf("the time of the last stage should be recorded")
+	}
+	if next := tracer.sample(time.Now(), 1); next.id != 2 {
+		t.Errorf("traces should be numbered: %d", next.id)
+	}
+
+	tracer = newTracer(config.Trace{SampleRate: 0.5})
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if tracer.sample(time.Now(), 1) != nil {
+			sampled++
+		}
+	}
+	if sampled < 400 || sampled > 600 {
+		t.Errorf("about half of the values should be sampled but %d", sampled)
+	}
+}
@@ -6,14 +6,15 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/Songmu/prompter"
 	"github.com/Songmu/retry"
 	"github.com/mackerelio/mackerel-agent/command"
 	"github.com/mackerelio/mackerel-agent/config"
-	"github.com/mackerelio/mackerel-agent/mackerel"
 	"github.com/mackerelio/mackerel-agent/version"
 )
 
@@ -28,7 +29,10 @@ func doMain(fs *flag.FlagSet, argv []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to load config: %s", err)
 	}
-	return start(conf, make(chan struct{}))
+	reloadConfig := func() (*config.Config, error) {
+		return resolveConfig(flag.NewFlagSet("mackerel-agent", flag.ContinueOnError), argv)
+	}
+	return start(conf, make(chan struct{}), reloadConfig)
 }
 
 /* +command init - initialize mackerel-agent.conf with apikey
@@ -78,10 +82,37 @@ func doConfigtest(fs *flag.FlagSet, argv []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to test config: %s", err)
 	}
-	fmt.Fprintf(os.Stderr, "%s Syntax OK\n", conf.Conffile)
+	fmt.Fprintf(os.Stderr, "%s Syntax OK\n", strings.Join(conf.Conffiles, ", "))
 	return nil
 }
 
+/* +command config - display the configuration
+
+	config show [-conf=mackerel-agent.conf]... [-effective] [-redact]
+
+display the config files merged (including the included ones) in the order of
+the precedence, the latter overriding the former. The config files given by
+the repeated -conf options are merged in the order.
+
+	-effective  display the effective configuration merged from the config files
+	            and the command line options in TOML instead
+	-redact     mask the credentials (the API key, the password of the proxy,
+	            the environment variables and the headers of the plugins), and show
+	            the commands before the environment variables are expanded
+*/
+func doConfig(fs *flag.FlagSet, argv []string) error {
+	if len(argv) == 0 || argv[0] != "show" {
+		return fmt.Errorf("usage: config show [-conf=mackerel-agent.conf]... [-effective] [-redact]")
+	}
+	effective := fs.Bool("effective", false, "display the effective configuration in TOML")
+	redact := fs.Bool("redact", false, "mask the credentials")
+	conf, err := resolveConfig(fs, argv[1:])
+	if err != nil {
+		return fmt.Errorf("failed to load config: %s", err)
+	}
+	return command.ShowConfig(conf, *effective, *redact, os.Stdout)
+}
+
 /* +command retire - retire the host
 
 	retire [-force]
@@ -99,7 +130,7 @@ func doRetire(fs *flag.FlagSet, argv []string) error {
 		return fmt.Errorf("HostID file is not found")
 	}
 
-	api, err := mackerel.NewAPI(conf.Apibase, conf.Apikey, conf.Verbose)
+	api, err := command.NewAPI(conf)
 	if err != nil {
 		return fmt.Errorf("faild to create api client: %s", err)
 	}
@@ -139,3 +170,189 @@ func doOnce(fs *flag.FlagSet, argv []string) error {
 	command.RunOnce(conf)
 	return nil
 }
+
+/* +command check-history - display the history of the checks
+
+	check-history [-conf=mackerel-agent.conf] [<check>]
+
+display the transitions of the statuses of the check in JSON,
+or of all the checks if <check> is omitted.
+check_history should be enabled in the config file.
+*/
+func doCheckHistory(fs *flag.FlagSet, argv []string) error {
+	conf, err := resolveConfig(fs, argv)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %s", err)
+	}
+	return command.DumpCheckHistory(conf, fs.Arg(0), os.Stdout)
+}
+
+/* +command restore - restore the backup
+
+	restore [-dest=/] <tarball>
+
+restore the config files and the state files in the backup made by [backup]
+to the original paths (or under -dest). The agent should be stopped in advance.
+*/
+func doRestore(fs *flag.FlagSet, argv []string) error {
+	dest := fs.String("dest", string(filepath.Separator), "the directory to restore the files under")
+	fs.Parse(argv)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("the backup tarball should be specified")
+	}
+	return command.RestoreBackup(fs.Arg(0), *dest, os.Stdout)
+}
+
+/* +command control - control the running agent
+
+	control [-conf=mackerel-agent.conf] status|flush|reload|dump
+	control [-conf=mackerel-agent.conf] stop [-retire]
+	control [-conf=mackerel-agent.conf] plugin disable <name> [-duration=1h]
+	control [-conf=mackerel-agent.conf] plugin enable <name>
+	control [-conf=mackerel-agent.conf] pprof <profile> [-seconds=30] > <profile>.pprof
+
+send the command to the control endpoint of the running agent.
+control should be enabled in the config file.
+
+	status          display the status of the agent in JSON
+	flush           post the queued metrics without waiting for the delays
+	reload          reload the config file
+	dump            write the diagnostics dump and display its path
+	stop            stop the agent gracefully, retiring the host after it stopped
+	                with -retire (e.g. on the scale-in of the autoscaling groups)
+	plugin disable  stop running the metrics plugin or the check (e.g. misbehaving)
+	                for the duration, or until it is enabled
+	plugin enable   run the plugin disabled again
+	pprof           write the profile (e.g. heap, goroutine, profile for the CPU and trace)
+	                of the agent, which requires pprof of [control]
+*/
+func doControl(fs *flag.FlagSet, argv []string) error {
+	conf, err := resolveConfig(fs, argv)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %s", err)
+	}
+	if fs.Arg(0) == "pprof" {
+		pfs := flag.NewFlagSet("control pprof", flag.ContinueOnError)
+		seconds := pfs.Int("seconds", 0, "the duration of the CPU profile and the execution trace (30 seconds if 0)")
+		if fs.NArg() > 2 {
+			if err := pfs.Parse(fs.Args()[2:]); err != nil {
+				return err
+			}
+		}
+		return command.RequestProfile(conf, fs.Arg(1), *seconds, os.Stdout)
+	}
+	if fs.Arg(0) == "stop" {
+		sfs := flag.NewFlagSet("control stop", flag.ContinueOnError)
+		retire := sfs.Bool("retire", false, "retire the host after the agent stopped")
+		if err := sfs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+		return command.RequestStop(conf, *retire, os.Stdout)
+	}
+	if fs.Arg(0) != "plugin" {
+		return command.RequestControl(conf, fs.Arg(0), os.Stdout)
+	}
+	pfs := flag.NewFlagSet("control plugin", flag.ContinueOnError)
+	duration := pfs.Duration("duration", 0, "the duration to disable the plugin for (until enabled if 0)")
+	if fs.NArg() > 3 {
+		if err := pfs.Parse(fs.Args()[3:]); err != nil {
+			return err
+		}
+	}
+	return command.RequestPluginControl(conf, fs.Arg(1), fs.Arg(2), *duration, os.Stdout)
+}
+
+/* +command diff - compare the outputs of the agent between two config files
+
+	diff -c=old.conf -c2=new.conf
+
+run a collection under each of the config files and display the metrics and
+the checks which appear (+), disappear (-) or are renamed (~) by the change.
+Nothing is posted to Mackerel.
+*/
+func doDiff(fs *flag.FlagSet, argv []string) error {
+	oldFile := fs.String("c", config.DefaultConfig.Conffile, "the config file before the change")
+	newFile := fs.String("c2", "", "the config file after the change")
+	fs.Parse(argv)
+	if *newFile == "" {
+		return fmt.Errorf("the config file after the change should be specified by -c2")
+	}
+	oldConf, err := config.LoadConfig(*oldFile)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %s", *oldFile, err)
+	}
+	newConf, err := config.LoadConfig(*newFile)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %s", *newFile, err)
+	}
+	return command.DiffConfigs(oldConf, newConf, os.Stdout)
+}
+
+/* +command discover - suggest the plugins for the services listening on the host
+
+	discover [-conf=mackerel-agent.conf] [-write]
+
+display the config snippets of the metrics plugins and the checks for the services
+(nginx, mysql, redis and postgres) listening on the host, which are found by the
+names of the processes (on Linux) or the well-known ports. The services whose
+metrics plugins are configured are skipped. With -write, they are written to the
+files <name>.conf in the directory of include in the config file instead.
+*/
+func doDiscover(fs *flag.FlagSet, argv []string) error {
+	write := fs.Bool("write", false, "write the snippets to the directory of include")
+	conf, err := resolveConfig(fs, argv)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %s", err)
+	}
+	return command.Discover(conf, *write, os.Stdout)
+}
+
+/* +command plugin - test-run a metrics plugin
+
+	plugin once [-conf=mackerel-agent.conf] <name>
+
+run the metrics plugin configured by [plugin.metrics.<name>] once, and display the values parsed
+from the output, the graph definitions which would be registered (from the meta output) and the
+warnings about the output, e.g. the lines which cannot be parsed, without posting them.
+*/
+func doPlugin(fs *flag.FlagSet, argv []string) error {
+	if len(argv) == 0 || argv[0] != "once" {
+		return fmt.Errorf("usage: plugin once [-conf=mackerel-agent.conf] <name>")
+	}
+	conf, err := resolveConfig(fs, argv[1:])
+	if err != nil {
+		return fmt.Errorf("failed to load config: %s", err)
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: plugin once [-conf=mackerel-agent.conf] <name>")
+	}
+	return command.RunPluginOnce(conf, fs.Arg(0), os.Stdout)
+}
+
+/* +command post - post the metrics or the check report read from stdin
+
+	post [-conf=mackerel-agent.conf] -type=metric < values.tsv
+	post [-conf=mackerel-agent.conf] -type=check -name=<check> -status=<status> < message.txt
+
+post the metric values read from stdin (the lines "<name>\t<value>[\t<epoch seconds>]" like
+the output of the metrics plugins, whose names are prefixed with "custom."), or the report of
+the check (the status is OK, WARNING, CRITICAL, UNKNOWN or the exit code of the check plugins)
+whose message is read from stdin, as the host registered by the agent, retrying the failures.
+e.g. some_job | mackerel-agent post -type=metric
+*/
+func doPost(fs *flag.FlagSet, argv []string) error {
+	typ := fs.String("type", "metric", "the type of the input (metric or check)")
+	name := fs.String("name", "", "the name of the check")
+	status := fs.String("status", "", "the status of the check")
+	conf, err := resolveConfig(fs, argv)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %s", err)
+	}
+	switch *typ {
+	case "metric":
+		return command.PostMetricLines(conf, os.Stdin, os.Stdout)
+	case "check":
+		return command.PostCheckReport(conf, *name, *status, os.Stdin, os.Stdout)
+	}
+	return fmt.Errorf("the type should be metric or check: %q", *typ)
+}
@@ -17,9 +17,10 @@ var DefaultConfig = &Config{
 	Verbose:    false,
 	Diagnostic: false,
 	Connection: ConnectionConfig{
-		PostMetricsDequeueDelaySeconds: 30,     // Check the metric values queue for every half minute
-		PostMetricsRetryDelaySeconds:   60,     // Wait a minute before retrying metric value posts
-		PostMetricsRetryMax:            60,     // Retry up to 60 times (30s * 60 = 30min)
-		PostMetricsBufferSize:          6 * 60, // Keep metric values of 6 hours span in the queue
+		PostMetricsDequeueDelaySeconds:  30,      // Check the metric values queue for every half minute
+		PostMetricsRetryDelaySeconds:    60,      // Wait a minute before retrying metric value posts
+		PostMetricsRetryDelaySecondsCap: 10 * 60, // Back off up to 10 minutes while the errors continue
+		PostMetricsRetryMax:             60,      // Retry up to 60 times (30s * 60 = 30min)
+		PostMetricsBufferSize:           6 * 60,  // Keep metric values of 6 hours span in the queue
 	},
 }
@@ -5,8 +5,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
 )
 
 var sampleConfig = `
@@ -21,6 +26,10 @@ ignore = "/dev/ram.*"
 post_metrics_retry_delay_seconds = 600
 post_metrics_retry_max = 5
 
+[connection.dns_cache]
+enabled = true
+ttl = 60
+
 [plugin.metrics.mysql]
 command = "ruby /path/to/your/plugin/mysql.rb"
 user = "mysql"
@@ -68,6 +77,14 @@ func TestLoadConfig(t *testing.T) {
 		t.Error("should be 180 (max retry delay seconds is 180)")
 	}
 
+	if config.Connection.PostMetricsRetryDelaySecondsCap != 600 {
+		t.Error("should be 600 (default value should be used)")
+	}
+
+	if dc := config.Connection.DNSCache; !dc.Enabled || dc.TTL != 60 || dc.MinTTL != 10 || dc.StaleTTL != 86400 {
+		t.Errorf("dns_cache should be enabled with the default min_ttl and stale_ttl: %+v", dc)
+	}
+
 	if config.Connection.PostMetricsRetryMax != 5 {
 		t.Error("should be 5 (config value should be used)")
 	}
@@ -132,6 +149,44 @@ func TestLoadConfigWithInvalidIgnoreRegexp(t *testing.T) {
 	}
 }
 
+func TestMetricFilter(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[metric_filter]
+include = '^(loadavg5|interface|custom\.)'
+exclude = '^interface\.docker'
+`)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	testCases := []struct {
+		name    string
+		allowed bool
+	}{
+		{"loadavg5", true},
+		{"interface.eth0.rxBytes.delta", true},
+		{"interface.docker0.rxBytes.delta", false},
+		{"custom.myapp.requests", true},
+		{"memory.used", false},
+	}
+	for _, tc := range testCases {
+		if config.MetricFilter.Allows(tc.name) != tc.allowed {
+			t.Errorf("Allows(%q) should be %t", tc.name, tc.allowed)
+		}
+	}
+
+	if !(MetricFilter{}).Allows("memory.used") {
+		t.Error("every metric should be allowed without the filter")
+	}
+}
+
 func TestLoadConfigFile(t *testing.T) {
 	tmpFile, err := newTempFileWithContent(sampleConfig)
 	if err != nil {
@@ -259,6 +314,128 @@ command = "bar"
 	assert(t, config.Plugin["metrics"]["bar"].Command == "bar", "plugin.metrics.bar should be overwritten")
 }
 
+func TestLoadConfigWithProfile(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "mackerel-config-test")
+	assertNoError(t, err)
+	defer os.RemoveAll(configDir)
+	assertNoError(t, os.Mkdir(filepath.Join(configDir, "common"), 0755))
+	assertNoError(t, os.Mkdir(filepath.Join(configDir, "prod"), 0755))
+
+	configContent := fmt.Sprintf(`
+apikey = "abcde"
+roles = [ "Service:main" ]
+include = "%s/common/*.conf"
+
+[profile.prod]
+include = "%s/prod/*.conf"
+
+[profile.stg]
+`, tomlQuotedReplacer.Replace(configDir), tomlQuotedReplacer.Replace(configDir))
+	configFile, err := newTempFileWithContent(configContent)
+	assertNoError(t, err)
+	defer os.Remove(configFile.Name())
+
+	files := map[string]string{
+		"common/sub.conf": `
+roles = [ "Service:common" ]
+[plugin.metrics.foo]
+command = "common"
+`,
+		"prod/1.conf": `
+[plugin.metrics.foo]
+command = "prod1"
+`,
+		"prod/2.conf": `
+roles = [ "Service:prod" ]
+[plugin.metrics.foo]
+command = "prod2"
+`,
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(configDir, name), []byte(content), 0644)
+		assertNoError(t, err)
+	}
+
+	config, err := LoadConfigWithProfile(configFile.Name(), "prod")
+	assertNoError(t, err)
+	assert(t, config.Profile == "prod", "profile should be prod")
+	assert(t, len(config.Roles) == 1 && config.Roles[0] == "Service:prod", "roles should be overwritten by the profile")
+	assert(t, config.Plugin["metrics"]["foo"].Command == "prod2", "the files of the profile should be merged in the order of the paths")
+
+	config, err = LoadConfigWithProfile(configFile.Name(), "stg")
+	assertNoError(t, err)
+	assert(t, len(config.Roles) == 1 && config.Roles[0] == "Service:common", "roles should not be overwritten without the files of the profile")
+	assert(t, config.Plugin["metrics"]["foo"].Command == "common", "the included file should be merged")
+
+	config, err = LoadConfig(configFile.Name())
+	assertNoError(t, err)
+	assert(t, config.Profile == "", "no profile should be selected")
+	assert(t, config.Plugin["metrics"]["foo"].Command == "common", "the files of the profiles should not be merged")
+
+	_, err = LoadConfigWithProfile(configFile.Name(), "dev")
+	assert(t, err != nil, "undefined profile should be an error")
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "mackerel-config-test")
+	assertNoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	files := map[string]string{
+		"base.conf": fmt.Sprintf(`
+apikey = "abcde"
+roles = [ "Service:base" ]
+include = "%s/base.d/*.conf"
+[plugin.metrics.foo]
+command = "base"
+[plugin.metrics.bar]
+command = "base"
+`, tomlQuotedReplacer.Replace(configDir)),
+		"base.d/sub.conf": `
+[plugin.metrics.baz]
+command = "base.d"
+`,
+		"site.conf": `
+http_proxy = "http://proxy.example.com:8080"
+[plugin.metrics.foo]
+command = "site"
+`,
+		"host.conf": `
+roles = [ "Service:host" ]
+[plugin.metrics.bar]
+command = "host"
+`,
+	}
+	assertNoError(t, os.Mkdir(filepath.Join(configDir, "base.d"), 0755))
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(configDir, name), []byte(content), 0644)
+		assertNoError(t, err)
+	}
+	conffiles := []string{
+		filepath.Join(configDir, "base.conf"),
+		filepath.Join(configDir, "site.conf"),
+		filepath.Join(configDir, "host.conf"),
+	}
+
+	config, err := LoadConfigFiles(conffiles, "")
+	assertNoError(t, err)
+	assert(t, config.Conffile == conffiles[0], "Conffile should be the first file")
+	assert(t, config.Apikey == "abcde", "apikey should be kept from the base")
+	assert(t, config.HTTPProxy == "http://proxy.example.com:8080", "http_proxy should be merged from the site")
+	assert(t, len(config.Roles) == 1 && config.Roles[0] == "Service:host", "roles should be overwritten by the latter file")
+	assert(t, config.Plugin["metrics"]["foo"].Command == "site", "the plugin should be overwritten by the site")
+	assert(t, config.Plugin["metrics"]["bar"].Command == "host", "the plugin should be overwritten by the host")
+	assert(t, config.Plugin["metrics"]["baz"].Command == "base.d", "the plugin of the included file should be kept")
+	assert(t, config.Include == filepath.Join(configDir, "base.d/*.conf"), "include should be kept without the include of the latter files")
+	expected := []string{conffiles[0], filepath.Join(configDir, "base.d/sub.conf"), conffiles[1], conffiles[2]}
+	if !reflect.DeepEqual(config.MergedFiles, expected) {
+		t.Errorf("MergedFiles should be %v but %v", expected, config.MergedFiles)
+	}
+
+	_, err = LoadConfigFiles([]string{conffiles[0], filepath.Join(configDir, "not-found.conf")}, "")
+	assert(t, err != nil, "the missing file should be an error")
+}
+
 func TestFileSystemHostIDStorage(t *testing.T) {
 	root, err := ioutil.TempDir("", "mackerel-agent-test")
 	if err != nil {
@@ -308,6 +485,194 @@ silent = true
 	}
 }
 
+var sampleConfigWithTimestamp = `
+apikey = "abcde"
+timestamp = "plugin_end"
+
+[plugin.metrics.slow]
+command = "slow-plugin"
+timestamp = "plugin_start"
+
+[plugin.metrics.invalid]
+command = "invalid-plugin"
+timestamp = "plugin_middle"
+`
+
+func TestLoadConfigWithTimestamp(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(sampleConfigWithTimestamp)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+
+	if config.Timestamp != TimestampPluginEnd {
+		t.Errorf("timestamp should be %q but %q", TimestampPluginEnd, config.Timestamp)
+	}
+
+	if ts := config.Plugin["metrics"]["slow"].Timestamp; ts != TimestampPluginStart {
+		t.Errorf("timestamp of the plugin should be %q but %q", TimestampPluginStart, ts)
+	}
+
+	if ts := config.Plugin["metrics"]["invalid"].Timestamp; ts != "" {
+		t.Errorf("invalid timestamp of the plugin should be reset but %q", ts)
+	}
+}
+
+var sampleConfigWithPluginArray = `
+apikey = "abcde"
+
+[plugin.metrics.mysql]
+command = "mackerel-plugin-mysql"
+
+[[plugin.metrics.port]]
+instance = "http"
+port = 80
+command = "mackerel-plugin-port -port={{port}} -name={{instance}}"
+
+[[plugin.metrics.port]]
+instance = "https"
+port = 443
+command = "mackerel-plugin-port -port={{port}} -name={{instance}}"
+
+[[plugin.checks.heartbeat]]
+command = "check-heartbeat {{instance}}"
+max_check_attempts = 3
+
+[[plugin.checks.heartbeat]]
+command = "check-heartbeat {{instance}}"
+`
+
+func TestLoadConfigWithPluginArray(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(sampleConfigWithPluginArray)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	metrics := config.Plugin["metrics"]
+	if len(metrics) != 3 {
+		t.Errorf("3 metrics plugins should be defined but %d", len(metrics))
+	}
+	if metrics["mysql"].Command != "mackerel-plugin-mysql" {
+		t.Errorf("plain plugin section should be loaded: %+v", metrics["mysql"])
+	}
+	if c := metrics["port_http"].Command; c != "mackerel-plugin-port -port=80 -name=http" {
+		t.Errorf("command should be expanded but %q", c)
+	}
+	if c := metrics["port_https"].Command; c != "mackerel-plugin-port -port=443 -name=https" {
+		t.Errorf("command should be expanded but %q", c)
+	}
+
+	checks := config.Plugin["checks"]
+	if c := checks["heartbeat_0"].Command; c != "check-heartbeat 0" {
+		t.Errorf("instance should default to the index but %q", c)
+	}
+	if m := checks["heartbeat_0"].MaxCheckAttempts; m == nil || *m != 3 {
+		t.Errorf("max_check_attempts should be 3 but %v", m)
+	}
+	if c := checks["heartbeat_1"].Command; c != "check-heartbeat 1" {
+		t.Errorf("instance should default to the index but %q", c)
+	}
+}
+
+func TestPluginConfigs_collision(t *testing.T) {
+	for _, content := range []string{
+		`
+[plugin.metrics.port_http]
+command = "mackerel-plugin-port -port=8080"
+
+[[plugin.metrics.port]]
+instance = "http"
+command = "mackerel-plugin-port -port=80"
+`,
+		`
+[[plugin.metrics.port]]
+instance = "a_b"
+command = "mackerel-plugin-port -port=80"
+
+[[plugin.metrics.port_a]]
+instance = "b"
+command = "mackerel-plugin-port -port=81"
+`,
+	} {
+		// the order of the sections in the map is random, so it is decoded several times
+		for i := 0; i < 20; i++ {
+			var conf Config
+			if _, err := toml.Decode(content, &conf); err == nil {
+				t.Fatalf("the collision of the plugin names should be reported: %s", content)
+			}
+		}
+	}
+}
+
+var sampleConfigWithPluginEnv = `
+apikey = "abcde"
+
+[plugin.metrics.api]
+command = "mackerel-plugin-api"
+env = { API_TOKEN = "secret", "INVALID-NAME" = "x" }
+
+[[plugin.checks.endpoint]]
+instance = "v1"
+command = "check-endpoint"
+env = { ENDPOINT = "https://example.com/{{instance}}" }
+`
+
+func TestLoadConfigWithPluginEnv(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(sampleConfigWithPluginEnv)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	env := config.Plugin["metrics"]["api"].EnvList()
+	if !reflect.DeepEqual(env, []string{"API_TOKEN=secret"}) {
+		t.Errorf("the invalid name should be ignored but %v", env)
+	}
+	env = config.Plugin["checks"]["endpoint_v1"].EnvList()
+	if !reflect.DeepEqual(env, []string{"ENDPOINT=https://example.com/v1"}) {
+		t.Errorf("the placeholders in env should be expanded but %v", env)
+	}
+}
+
+func TestLoadConfigWithTransport(t *testing.T) {
+	for transport, expected := range map[string]string{
+		"":        TransportAuto,
+		"http1":   TransportHTTP1,
+		"http3":   TransportHTTP3,
+		"unknown": TransportAuto,
+	} {
+		tmpFile, err := newTempFileWithContent(fmt.Sprintf("[connection]\ntransport = %q\n", transport))
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		config, err := LoadConfig(tmpFile.Name())
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		if config.Connection.Transport != expected {
+			t.Errorf("transport %q should be %q but %q", transport, expected, config.Connection.Transport)
+		}
+	}
+}
+
 func newTempFileWithContent(content string) (*os.File, error) {
 	tmpf, err := ioutil.TempFile("", "mackerel-config-test")
 	if err != nil {
@@ -321,3 +686,236 @@ func newTempFileWithContent(content string) (*os.File, error) {
 	tmpf.Close()
 	return tmpf, nil
 }
+
+func TestLoadConfigExpandEnv(t *testing.T) {
+	os.Setenv("MACKEREL_AGENT_TEST_APIKEY", "secret")
+	os.Setenv("MACKEREL_AGENT_TEST_ROLE", "app")
+	defer os.Unsetenv("MACKEREL_AGENT_TEST_APIKEY")
+	defer os.Unsetenv("MACKEREL_AGENT_TEST_ROLE")
+
+	tmpFile, err := newTempFileWithContent(`
+apikey = "${MACKEREL_AGENT_TEST_APIKEY}"
+roles = ["service:${MACKEREL_AGENT_TEST_ROLE}", "service:$MACKEREL_AGENT_TEST_ROLE-db", "service:$MACKEREL_AGENT_TEST_UNDEFINED"]
+
+[plugin.metrics.foo]
+command = "foo --role=${MACKEREL_AGENT_TEST_ROLE} | awk '{print $1, $MACKEREL_AGENT_TEST_ROLE, ${MACKEREL_AGENT_TEST_UNDEFINED}}'"
+`)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if config.Apikey != "secret" {
+		t.Errorf("apikey should be expanded but %q", config.Apikey)
+	}
+	if !reflect.DeepEqual(config.Roles, []string{"service:app", "service:app-db", "service:$MACKEREL_AGENT_TEST_UNDEFINED"}) {
+		t.Errorf("roles should be expanded but %v", config.Roles)
+	}
+
+	// the variables are left to the shell, and passed to the command by env
+	expected := "foo --role=${MACKEREL_AGENT_TEST_ROLE} | awk '{print $1, $MACKEREL_AGENT_TEST_ROLE, ${MACKEREL_AGENT_TEST_UNDEFINED}}'"
+	if runtime.GOOS == "windows" {
+		expected = "foo --role=%MACKEREL_AGENT_TEST_ROLE% | awk '{print $1, $MACKEREL_AGENT_TEST_ROLE, ${MACKEREL_AGENT_TEST_UNDEFINED}}'"
+	}
+	pc := config.Plugin["metrics"]["foo"]
+	if pc.Command != expected {
+		t.Errorf("command should be %q but %q", expected, pc.Command)
+	}
+	if !reflect.DeepEqual(pc.Env, map[string]string{"MACKEREL_AGENT_TEST_ROLE": "app"}) {
+		t.Errorf("the variables referred by the command should be passed by env but %v", pc.Env)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	os.Setenv("MACKEREL_AGENT_TEST_TOKEN", "secret")
+	defer os.Unsetenv("MACKEREL_AGENT_TEST_TOKEN")
+
+	env := CommandEnv("refresh --token ${MACKEREL_AGENT_TEST_TOKEN} ${MACKEREL_AGENT_TEST_UNDEFINED} $HOME")
+	if !reflect.DeepEqual(env, []string{"MACKEREL_AGENT_TEST_TOKEN=secret"}) {
+		t.Errorf("only the defined variables referred by ${VAR} should be passed but %v", env)
+	}
+}
+
+func TestLoadConfigCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-credentials")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "apikey"), []byte("secret-apikey\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "mysql.cnf"), []byte("[client]\npassword = secret\n"), 0600)
+	os.Setenv("CREDENTIALS_DIRECTORY", dir)
+	defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+
+	tmpFile, err := newTempFileWithContent(`
+[plugin.metrics.mysql]
+command = "mackerel-plugin-mysql -config '${credential:mysql.cnf}' ${credential:undefined}"
+env = { MYSQL_PASSWORD = "${credential:mysql.cnf}" }
+`)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if config.Apikey != "secret-apikey" {
+		t.Errorf("apikey should be read from the credential but %q", config.Apikey)
+	}
+	expected := "mackerel-plugin-mysql -config '" + filepath.Join(dir, "mysql.cnf") + "' ${credential:undefined}"
+	if command := config.Plugin["metrics"]["mysql"].Command; command != expected {
+		t.Errorf("command should be %q but %q", expected, command)
+	}
+	if env := config.Plugin["metrics"]["mysql"].Env["MYSQL_PASSWORD"]; env != "[client]\npassword = secret" {
+		t.Errorf("env should be the content of the credential but %q", env)
+	}
+
+	if _, err := readCredential("../apikey"); err == nil {
+		t.Errorf("should raise error for the name out of the directory")
+	}
+}
+
+func TestLoadConfigMetricsInterval(t *testing.T) {
+	testCases := []struct {
+		content          string
+		interval         time.Duration
+		dequeueDelay     int
+		metricsIntervals int
+	}{
+		{"", 1 * time.Minute, 30, 0},
+		{"metrics_interval = 300\n[connection]\npost_metrics_dequeue_delay_seconds = 120\n", 5 * time.Minute, 120, 300},
+		{"metrics_interval = 10\n[connection]\npost_metrics_dequeue_delay_seconds = 120\n", 1 * time.Minute, 59, 60},
+		{"metrics_interval = 150\n", 2 * time.Minute, 30, 120},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent(tc.content)
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		config, err := LoadConfig(tmpFile.Name())
+		os.Remove(tmpFile.Name())
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		if config.MetricsInterval != tc.metricsIntervals || config.CollectionInterval() != tc.interval {
+			t.Errorf("%q: the interval should be %s but %s", tc.content, tc.interval, config.CollectionInterval())
+		}
+		if config.Connection.PostMetricsDequeueDelaySeconds != tc.dequeueDelay {
+			t.Errorf("%q: post_metrics_dequeue_delay_seconds should be %d but %d", tc.content, tc.dequeueDelay, config.Connection.PostMetricsDequeueDelaySeconds)
+		}
+	}
+}
+
+func TestLoadConfigSampling(t *testing.T) {
+	testCases := []struct {
+		content     string
+		interval    time.Duration
+		aggregation string
+	}{
+		{"", 10 * time.Second, "avg"},
+		{"[sampling]\ninterval = 15\ngenerators = [\"cpu\"]\naggregation = \"max\"\n", 15 * time.Second, "max"},
+		{"[sampling]\ninterval = 1\naggregation = \"p99\"\n", 5 * time.Second, "avg"},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent(tc.content)
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		config, err := LoadConfig(tmpFile.Name())
+		os.Remove(tmpFile.Name())
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		if config.SamplingInterval() != tc.interval || config.Sampling.Aggregation != tc.aggregation {
+			t.Errorf("%q: the sampling should be %s by %s but %s by %s", tc.content, tc.interval, tc.aggregation, config.SamplingInterval(), config.Sampling.Aggregation)
+		}
+	}
+}
+
+func TestLoadConfigSharedCache(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+[shared_cache.docker-stats]
+command = "docker stats --no-stream --format '{{json .}}'"
+
+[shared_cache.cloud]
+command = "fetch-cloud-metrics"
+ttl = 5
+timeout = 30
+
+[shared_cache."../escape"]
+command = "true"
+
+[shared_cache.empty]
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	expected := map[string]SharedCache{
+		"docker-stats": {Command: "docker stats --no-stream --format '{{json .}}'", TTL: 60, Timeout: 60},
+		"cloud":        {Command: "fetch-cloud-metrics", TTL: 10, Timeout: 10},
+	}
+	if !reflect.DeepEqual(config.SharedCaches, expected) {
+		t.Errorf("the shared caches should be %+v but %+v", expected, config.SharedCaches)
+	}
+}
+
+func TestLoadConfigControl(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the default control endpoint is a TCP address on Windows")
+	}
+	testCases := []struct {
+		content string
+		network string
+		address string
+	}{
+		{"root = \"/var/lib/mackerel-agent\"\n[control]\nenabled = true\n", "unix", "/var/lib/mackerel-agent/control.sock"},
+		{"[control]\nlisten = \"/run/mackerel-agent.sock\"\n", "unix", "/run/mackerel-agent.sock"},
+		{"[control]\nlisten = \"127.0.0.1:9000\"\n", "tcp", "127.0.0.1:9000"},
+		{"[control]\nlisten = \"localhost:9000\"\n", "tcp", "localhost:9000"},
+		{"root = \"/var/lib/mackerel-agent\"\n[control]\nlisten = \"0.0.0.0:9000\"\n", "unix", "/var/lib/mackerel-agent/control.sock"},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent(tc.content)
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		config, err := LoadConfig(tmpFile.Name())
+		os.Remove(tmpFile.Name())
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		if network, address := config.ControlAddress(); network != tc.network || address != tc.address {
+			t.Errorf("%q: the control address should be %s %s but %s %s", tc.content, tc.network, tc.address, network, address)
+		}
+	}
+}
+
+func TestHostSpecAKHandle(t *testing.T) {
+	testCases := []struct {
+		handle   string
+		expected uint32
+	}{
+		{"0x81000002", 0x81000002},
+		{"2164260866", 0x81000002},
+		{"", 0},
+		{"ak", 0},
+		{"0x100000000", 0},
+	}
+	for _, tc := range testCases {
+		hs := HostSpec{AttestationKeyHandle: tc.handle}
+		if h := hs.AKHandle(); h != tc.expected {
+			t.Errorf("the handle of %q should be 0x%x but 0x%x", tc.handle, tc.expected, h)
+		}
+	}
+}
@@ -27,9 +27,10 @@ var DefaultConfig = &Config{
 	Verbose:    false,
 	Diagnostic: false,
 	Connection: ConnectionConfig{
-		PostMetricsDequeueDelaySeconds: 30,
-		PostMetricsRetryDelaySeconds:   60,
-		PostMetricsRetryMax:            10,
-		PostMetricsBufferSize:          30,
+		PostMetricsDequeueDelaySeconds:  30,
+		PostMetricsRetryDelaySeconds:    60,
+		PostMetricsRetryDelaySecondsCap: 10 * 60,
+		PostMetricsRetryMax:             10,
+		PostMetricsBufferSize:           30,
 	},
 }
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var envVarPattern = regexp.MustCompile(`\$\{(?:credential:([-\w.@]+)|(\w+))\}|\$([A-Za-z_]\w*)`)
+
+// expandEnv replaces ${VAR} and $VAR in s with the values of the environment variables, and ${credential:NAME}
+// with the credential passed by systemd (see readCredential). The references to the undefined variables are kept
+// as they are.
+// The variables are not expanded into the commands, which would show the secrets to ps and in the logs. They are
+// left to the shell, which expands them from the environment passed to the commands (see CommandEnv),
+// and ${VAR} is rewritten to %VAR% for cmd.exe on Windows. ${credential:NAME} is replaced with the path of
+// the credential instead of the secret in the commands.
+func expandEnv(s string, command bool) string {
+	return envVarPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envVarPattern.FindStringSubmatch(ref)
+		if m[1] != "" {
+			read := readCredential
+			if command {
+				read = credentialPath
+			}
+			value, err := read(m[1])
+			if err != nil {
+				configLogger.Warningf("Failed to read the credential %q: %s", m[1], err)
+				return ref
+			}
+			return value
+		}
+		if command {
+			if _, ok := os.LookupEnv(m[2]); ok && runtime.GOOS == "windows" {
+				return "%" + m[2] + "%"
+			}
+			return ref
+		}
+		name := m[2] + m[3]
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// commandEnvPattern matches the references to the environment variables left in the commands by expandEnv
+var commandEnvPattern = regexp.MustCompile(`\$\{(\w+)\}|%(\w+)%`)
+
+// CommandEnv returns the environment variables referred by ${VAR} (%VAR% on Windows) in the command
+// in the form of "KEY=value", which are passed to the command run as another user, since it does not
+// inherit the environment of the agent. The undefined variables are not included.
+func CommandEnv(command string) []string {
+	var env []string
+	for _, m := range commandEnvPattern.FindAllStringSubmatch(command, -1) {
+		name := m[1]
+		if m[2] != "" && runtime.GOOS == "windows" {
+			name = m[2]
+		}
+		if name == "" {
+			continue
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// passCommandEnv adds the environment variables referred by the command of pc (see CommandEnv) to its env.
+// The variables set in env are kept.
+func passCommandEnv(pc *PluginConfig) {
+	for _, kv := range CommandEnv(pc.Command) {
+		kv := strings.SplitN(kv, "=", 2)
+		if _, ok := pc.Env[kv[0]]; ok {
+			continue
+		}
+		if pc.Env == nil {
+			pc.Env = make(map[string]string)
+		}
+		pc.Env[kv[0]] = kv[1]
+	}
+}
+
+// apikeyCredentialName is the name of the credential used as the apikey when it is not configured,
+// e.g. by LoadCredential=apikey:/etc/mackerel-agent/apikey in the unit file.
+const apikeyCredentialName = "apikey"
+
+// readCredential reads the credential named name from the directory of the credentials passed
+// by systemd (LoadCredential= or SetCredentialEncrypted=), which is set to $CREDENTIALS_DIRECTORY
+// when the agent runs under systemd. The secrets of multiple lines are kept except the last newline.
+func readCredential(name string) (string, error) {
+	file, err := credentialPath(name)
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(content), "\n"), "\r"), nil
+}
+
+// credentialPath returns the path of the credential named name in $CREDENTIALS_DIRECTORY
+func credentialPath(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", fmt.Errorf("CREDENTIALS_DIRECTORY is not set (not running under systemd with the credentials)")
+	}
+	if strings.Contains(name, "/") || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid credential name: %q", name)
+	}
+	file := filepath.Join(dir, name)
+	if _, err := os.Stat(file); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// isCommandField reports whether the field f of the struct t is a command run by the shell
+func isCommandField(t reflect.Type, f reflect.StructField) bool {
+	if strings.HasSuffix(f.Name, "Command") {
+		return true
+	}
+	return t == reflect.TypeOf(CollectionHook{}) && (f.Name == "Pre" || f.Name == "Post")
+}
+
+// expandEnvInConfig expands the environment variables in all the string values of the config,
+// e.g. apikey = "${MACKEREL_APIKEY}". The values before the expansion are kept for Unexpanded.
+func expandEnvInConfig(conf *Config) {
+	conf.unexpanded = make(map[string]string)
+	expandEnvValue(reflect.ValueOf(conf).Elem(), false, conf.unexpanded)
+}
+
+// Unexpanded returns the value s of the config before the environment variables and the credentials
+// were expanded, e.g. to show the commands without the secrets expanded into them.
+func (conf *Config) Unexpanded(s string) string {
+	if raw, ok := conf.unexpanded[s]; ok {
+		return raw
+	}
+	return s
+}
+
+func expandEnvValue(v reflect.Value, command bool, unexpanded map[string]string) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() {
+			raw := v.String()
+			if expanded := expandEnv(raw, command); expanded != raw {
+				v.SetString(expanded)
+				unexpanded[expanded] = raw
+			}
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandEnvValue(v.Elem(), command, unexpanded)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath == "" { // exported
+				expandEnvValue(v.Field(i), isCommandField(v.Type(), f), unexpanded)
+			}
+		}
+		// the variables are passed after the expansion, which would expand the values of them again
+		if v.CanAddr() {
+			if pc, ok := v.Addr().Interface().(*PluginConfig); ok {
+				passCommandEnv(pc)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			expandEnvValue(v.Index(i), command, unexpanded)
+		}
+	case reflect.Map:
+		// the values of the maps are not addressable
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			expandEnvValue(elem, command, unexpanded)
+			v.SetMapIndex(key, elem)
+		}
+	}
+}
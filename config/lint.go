@@ -0,0 +1,302 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// LintProblem is a problem of the configuration found by LintConfigFile,
+// such as an unknown key or a plugin defined in multiple files.
+type LintProblem struct {
+	File    string
+	Line    int // 0 if unknown
+	Message string
+}
+
+func (p LintProblem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+// The kinds of plugins. The options of each kind are the fields of PluginConfig whose `kinds` tags match it.
+var pluginKinds = []string{"metrics", "checks", "checkfile", "checklog", "checkcert", "checktcp", "checkhttp", "checktraffic", "prometheus"}
+
+// LintConfigFile checks the configuration file and the included files for
+// unknown keys, the plugins defined in multiple files and the conflicting plugin options.
+func LintConfigFile(file string) ([]LintProblem, error) {
+	return LintConfigFileWithProfile(file, "")
+}
+
+// LintConfigFileWithProfile checks the config files like LintConfigFile, including the files of the profile.
+// The plugins defined in the files of the profile are not reported as overridden, which is intended.
+func LintConfigFileWithProfile(file, profile string) ([]LintProblem, error) {
+	return LintConfigFiles([]string{file}, profile)
+}
+
+// LintConfigFiles checks the config files given by the -conf options like LintConfigFileWithProfile.
+// The plugins defined in the following config files (and their included files) are not reported
+// as overridden either, since they are layered on the former ones intentionally.
+func LintConfigFiles(conffiles []string, profile string) ([]LintProblem, error) {
+	var files []string
+	overriding := make(map[string]bool) // the files overriding the plugins intentionally
+	profiles := make(map[string]Profile)
+	for i, file := range conffiles {
+		var conf Config
+		if _, err := toml.DecodeFile(file, &conf); err != nil {
+			return nil, err
+		}
+		layer := []string{file}
+		if conf.Include != "" {
+			included, err := filepath.Glob(conf.Include)
+			if err != nil {
+				return nil, err
+			}
+			layer = append(layer, included...)
+		}
+		for _, f := range layer {
+			files = append(files, f)
+			overriding[f] = i > 0
+		}
+		for name, p := range conf.Profiles {
+			profiles[name] = p
+		}
+	}
+	if p := profiles[profile]; profile != "" && p.Include != "" {
+		included, err := filepath.Glob(p.Include)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range included {
+			files = append(files, f)
+			overriding[f] = true
+		}
+	}
+
+	var problems []LintProblem
+	definedIn := make(map[string]string) // plugin section -> where it is defined first
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		lines := tomlKeyLines(string(content))
+		problemAt := func(key, format string, args ...interface{}) LintProblem {
+			return LintProblem{File: file, Line: lines[key], Message: fmt.Sprintf(format, args...)}
+		}
+
+		meta, err := toml.Decode(string(content), &Config{})
+		if err != nil {
+			return nil, fmt.Errorf("while linting config file %s: %s", file, err)
+		}
+		undecoded := make(map[string]bool)
+		for _, key := range meta.Undecoded() {
+			undecoded[key.String()] = true
+		}
+		for _, key := range meta.Undecoded() {
+			// the plugin sections are checked below, and report only the outermost unknown keys
+			if key[0] == "plugin" || undecoded[key[:len(key)-1].String()] {
+				continue
+			}
+			problems = append(problems, problemAt(key.String(), "unknown key %q", key.String()))
+		}
+
+		var raw struct {
+			Plugin map[string]map[string]interface{}
+		}
+		if _, err := toml.Decode(string(content), &raw); err != nil {
+			return nil, fmt.Errorf("while linting config file %s: %s", file, err)
+		}
+		for _, kind := range sortedKeys(raw.Plugin) {
+			if !containsString(pluginKinds, kind) {
+				problems = append(problems, problemAt("plugin."+kind, "unknown plugin kind %q", kind))
+				continue
+			}
+			for _, name := range sortedKeys(raw.Plugin[kind]) {
+				section := "plugin." + kind + "." + name
+				if first, ok := definedIn[section]; !ok {
+					definedIn[section] = fmt.Sprintf("%s:%d", file, lines[section])
+				} else if !overriding[file] {
+					problems = append(problems, problemAt(section, "[%s] is already defined at %s and overridden", section, first))
+				}
+
+				switch tables := raw.Plugin[kind][name].(type) {
+				case map[string]interface{}:
+					for _, msg := range lintPluginOptions(kind, tables, false) {
+						problems = append(problems, problemAt(section, "[%s] %s", section, msg))
+					}
+				case []map[string]interface{}:
+					for _, table := range tables {
+						for _, msg := range lintPluginOptions(kind, table, true) {
+							problems = append(problems, problemAt(section, "[[%s]] %s", section, msg))
+						}
+					}
+				}
+			}
+		}
+	}
+	return problems, nil
+}
+
+// lintPluginOptions checks the options of a plugin section of the kind
+func lintPluginOptions(kind string, table map[string]interface{}, isArray bool) []string {
+	var msgs []string
+	known := knownPluginOptions()
+	options := pluginOptions(kind)
+	for _, key := range sortedKeys(table) {
+		option := strings.ToLower(key)
+		if isArray && option == "instance" {
+			continue
+		}
+		if !known[option] {
+			msgs = append(msgs, fmt.Sprintf("unknown option %q", key))
+		} else if !options[option] {
+			msgs = append(msgs, fmt.Sprintf("option %q is ignored by %s plugins", key, kind))
+		}
+	}
+
+	has := func(option string) bool {
+		for key := range table {
+			if strings.ToLower(key) == option {
+				return true
+			}
+		}
+		return false
+	}
+	if kind == "checkfile" {
+		if !has("path") {
+			msgs = append(msgs, `option "path" is required`)
+		}
+	} else if kind == "checklog" {
+		if !has("path") {
+			msgs = append(msgs, `option "path" is required`)
+		}
+		if !has("pattern") && !has("critical_pattern") {
+			msgs = append(msgs, `option "pattern" or "critical_pattern" is required`)
+		}
+	} else if kind == "checkcert" {
+		if has("address") == has("path") {
+			msgs = append(msgs, `either option "address" or "path" is required`)
+		}
+	} else if kind == "checktcp" {
+		if !has("targets") {
+			msgs = append(msgs, `option "targets" is required`)
+		}
+	} else if kind == "checkhttp" {
+		if !has("url") {
+			msgs = append(msgs, `option "url" is required`)
+		}
+	} else if kind == "checktraffic" {
+		// all the interfaces are checked without any options
+	} else if kind == "prometheus" {
+		if !has("url") {
+			msgs = append(msgs, `option "url" is required`)
+		}
+	} else if !has("command") {
+		msgs = append(msgs, `option "command" is required`)
+	}
+	if kind == "metrics" && has("aggregation") && table["stream"] != true {
+		msgs = append(msgs, `option "aggregation" requires "stream = true"`)
+	}
+	if kind == "metrics" && has("timeout") && table["stream"] == true {
+		msgs = append(msgs, `option "timeout" is ignored with "stream = true"`)
+	}
+	if kind != "metrics" && has("jitter") && table["align_to_clock"] != true {
+		msgs = append(msgs, `option "jitter" requires "align_to_clock = true"`)
+	}
+	if has("full_message_interval") && table["compact_message"] != true {
+		msgs = append(msgs, `option "full_message_interval" requires "compact_message = true"`)
+	}
+	return msgs
+}
+
+// knownPluginOptions returns the set of the keys of PluginConfig
+func knownPluginOptions() map[string]bool {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(PluginConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		known[pluginOptionKey(t.Field(i))] = true
+	}
+	return known
+}
+
+// pluginOptions returns the set of the keys of PluginConfig used by the kind of plugins,
+// whose `kinds` tags match the kind
+func pluginOptions(kind string) map[string]bool {
+	options := make(map[string]bool)
+	t := reflect.TypeOf(PluginConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		for _, pattern := range strings.Split(t.Field(i).Tag.Get("kinds"), ",") {
+			if ok, _ := path.Match(pattern, kind); ok {
+				options[pluginOptionKey(t.Field(i))] = true
+				break
+			}
+		}
+	}
+	return options
+}
+
+func pluginOptionKey(f reflect.StructField) string {
+	key := f.Tag.Get("toml")
+	if key == "" {
+		key = f.Name
+	}
+	return strings.ToLower(key)
+}
+
+var (
+	tomlTableLine = regexp.MustCompile(`^\s*\[\[?\s*([^\[\]]+?)\s*\]\]?\s*(#.*)?$`)
+	tomlKeyLine   = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+)\s*=`)
+)
+
+// tomlKeyLines returns the map from the keys (e.g. "plugin.metrics.mysql.command") to the line numbers
+// where they are defined first. The tables are mapped to the lines of their headers.
+func tomlKeyLines(content string) map[string]int {
+	lines := make(map[string]int)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	table := ""
+	for n := 1; scanner.Scan(); n++ {
+		key := ""
+		if m := tomlTableLine.FindStringSubmatch(scanner.Text()); m != nil {
+			table = strings.Replace(m[1], " ", "", -1)
+			key = table
+		} else if m := tomlKeyLine.FindStringSubmatch(scanner.Text()); m != nil {
+			key = m[1]
+			if table != "" {
+				key = table + "." + key
+			}
+		}
+		if _, ok := lines[key]; key != "" && !ok {
+			lines[key] = n
+		}
+	}
+	return lines
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLintConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainFile := filepath.Join(dir, "mackerel-agent.conf")
+	ioutil.WriteFile(mainFile, []byte(fmt.Sprintf(`apikey = "abcde"
+include = "%s"
+pidfil = "/var/run/mackerel-agent.pid"
+
+[host_status]
+on_start = "working"
+on_stpo = "poweroff"
+
+[plugin.metrics.mysql]
+command = "mackerel-plugin-mysql"
+aggregation = "avg"
+`, filepath.Join(dir, "conf.d", "*.conf"))), 0644)
+
+	os.MkdirAll(filepath.Join(dir, "conf.d"), 0755)
+	includedFile := filepath.Join(dir, "conf.d", "mysql.conf")
+	ioutil.WriteFile(includedFile, []byte(`
+[plugin.metrics.mysql]
+command = "mackerel-plugin-mysql -port 3307"
+
+[plugin.checks.ssh]
+command = "check-tcp -p 22"
+jitter = 10
+max_age = 60
+
+[plugin.checkfile.heartbeat]
+paht = "/var/run/heartbeat"
+
+[plugin.prometheus.node]
+command = "node_exporter"
+relabel = [{ regex = "^node_", replacement = "" }]
+
+[plugin.checklog.app]
+path = "/var/log/app.log"
+exclude = "debug"
+`), 0644)
+
+	problems, err := LintConfigFile(mainFile)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	expected := []string{
+		mainFile + `:3: unknown key "pidfil"`,
+		mainFile + `:7: unknown key "host_status.on_stpo"`,
+		mainFile + `:9: [plugin.metrics.mysql] option "aggregation" requires "stream = true"`,
+		includedFile + `:10: [plugin.checkfile.heartbeat] unknown option "paht"`,
+		includedFile + `:10: [plugin.checkfile.heartbeat] option "path" is required`,
+		includedFile + `:17: [plugin.checklog.app] option "pattern" or "critical_pattern" is required`,
+		includedFile + `:5: [plugin.checks.ssh] option "max_age" is ignored by checks plugins`,
+		includedFile + `:5: [plugin.checks.ssh] option "jitter" requires "align_to_clock = true"`,
+		includedFile + `:2: [plugin.metrics.mysql] is already defined at ` + mainFile + `:9 and overridden`,
+		includedFile + `:13: [plugin.prometheus.node] option "command" is ignored by prometheus plugins`,
+		includedFile + `:13: [plugin.prometheus.node] option "url" is required`,
+	}
+	var actual []string
+	for _, p := range problems {
+		actual = append(actual, p.String())
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("problems should be\n%s\nbut\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestLoadConfigWithStrictConfig(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+strict_config = true
+verbos = true
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = LoadConfig(tmpFile.Name())
+	if err == nil || !strings.Contains(err.Error(), `unknown key "verbos"`) {
+		t.Errorf("should raise error for the unknown key with strict_config: %v", err)
+	}
+}
+
+func TestPluginOptions(t *testing.T) {
+	// every option should be used by some kind of plugins, or it would be reported as ignored by all of them
+	used := make(map[string]bool)
+	for _, kind := range pluginKinds {
+		for option := range pluginOptions(kind) {
+			used[option] = true
+		}
+	}
+	for option := range knownPluginOptions() {
+		if !used[option] {
+			t.Errorf("option %q should be used by some kind of plugins (see the kinds tag)", option)
+		}
+	}
+
+	options := pluginOptions("checkhttp")
+	for _, option := range []string{"url", "notification_interval", "condition"} {
+		if !options[option] {
+			t.Errorf("option %q should be used by checkhttp plugins", option)
+		}
+	}
+	if options["command"] || options["stream"] {
+		t.Errorf("the options of the other kinds should not be used by checkhttp plugins: %v", options)
+	}
+}
@@ -1,14 +1,22 @@
 package logging
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Logger struct for logging
 type Logger struct {
-	tag string
+	tag    string
+	fields map[string]interface{}
 }
 
 // GetLogger get the logger
@@ -16,12 +24,57 @@ func GetLogger(tag string) *Logger {
 	return &Logger{tag: tag}
 }
 
-// global log level
-var logLv = INFO
+// WithFields returns the logger which adds the fields to the records, which are written as "key=value"
+// after the messages in the text format, and as "fields" in the JSON format.
+func (logger *Logger) WithFields(fields map[string]interface{}) *Logger {
+	merged := make(map[string]interface{}, len(logger.fields)+len(fields))
+	for k, v := range logger.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{tag: logger.tag, fields: merged}
+}
+
+// The formats of the log records
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// global log level, which is changed at runtime (e.g. by SIGUSR1) while the goroutines are logging
+var (
+	logLvMu sync.RWMutex
+	logLv   = INFO
+)
 var lgr = log.New(os.Stderr, "", log.LstdFlags)
 
+// global log format, which is changed by Reload while the goroutines are logging,
+// and the logger of the JSON format writing the records as they are
+var (
+	logFormatMu sync.RWMutex
+	logFormat   = FormatText
+)
+var jsonLgr = log.New(os.Stderr, "", 0)
+
+// SetLogFormat configures the format of the log records, FormatText or FormatJSON.
+// The JSON records have "level", "component" (the tag of the logger), "ts" (RFC 3339), "msg"
+// and "fields" (with "caller" at the DEBUG level).
+func SetLogFormat(format string) {
+	logFormatMu.Lock()
+	defer logFormatMu.Unlock()
+	if format == FormatJSON {
+		logFormat = FormatJSON
+	} else {
+		logFormat = FormatText
+	}
+}
+
 // SetLogLevel congigure log settings
 func SetLogLevel(lv level) {
+	logLvMu.Lock()
+	defer logLvMu.Unlock()
 	if logLv != lv {
 		logLv = lv
 		if logLv <= DEBUG {
@@ -32,18 +85,120 @@ func SetLogLevel(lv level) {
 	}
 }
 
+func currentLogLevel() level {
+	logLvMu.RLock()
+	defer logLvMu.RUnlock()
+	return logLv
+}
+
+func currentLogFormat() string {
+	logFormatMu.RLock()
+	defer logFormatMu.RUnlock()
+	return logFormat
+}
+
 func (logger *Logger) message(lv level, message string) string {
-	return lv.String() + " <" + logger.tag + "> " + message
+	return lv.String() + " <" + logger.tag + "> " + message + logger.fieldsText()
+}
+
+// fieldsText returns the fields in the text format, sorted by the keys
+func (logger *Logger) fieldsText() string {
+	if len(logger.fields) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(logger.fields))
+	for k := range logger.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, logger.fields[k])
+	}
+	return b.String()
 }
 
 func (logger *Logger) log(lv level, message string, args ...interface{}) {
+	logLv := currentLogLevel()
+	if lv < WARNING && lv < logLv {
+		return
+	}
+	msg := fmt.Sprintf(message, args...)
+	formatted := logger.message(lv, msg)
+	if lv >= WARNING {
+		recordRecentError(formatted)
+	}
 	if lv >= logLv {
 		// caller -> Infof() -> log()
 		const depth = 3
-		lgr.Output(depth, fmt.Sprintf(logger.message(lv, message), args...))
+		if currentLogFormat() == FormatJSON {
+			jsonLgr.Output(depth, logger.jsonRecord(lv, msg, depth))
+		} else {
+			lgr.Output(depth, formatted)
+		}
+	}
+}
+
+type jsonRecord struct {
+	Level     string                 `json:"level"`
+	Component string                 `json:"component"`
+	Ts        string                 `json:"ts"`
+	Msg       string                 `json:"msg"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// jsonRecord returns the record in the JSON format, with the caller at depth like log.Lshortfile at DEBUG
+func (logger *Logger) jsonRecord(lv level, msg string, depth int) string {
+	r := jsonRecord{
+		Level:     lv.String(),
+		Component: logger.tag,
+		Ts:        time.Now().Format(time.RFC3339Nano),
+		Msg:       msg,
+		Fields:    logger.fields,
+	}
+	if currentLogLevel() <= DEBUG {
+		if _, file, line, ok := runtime.Caller(depth); ok {
+			r.Fields = make(map[string]interface{}, len(logger.fields)+1)
+			for k, v := range logger.fields {
+				r.Fields[k] = v
+			}
+			r.Fields["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+		}
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		// the fields cannot be marshaled
+		r.Fields = map[string]interface{}{"error": err.Error()}
+		b, _ = json.Marshal(r)
+	}
+	return string(b)
+}
+
+// the number of the recent warnings and errors kept for RecentErrors
+const recentErrorsMax = 50
+
+var (
+	recentErrorsMu sync.Mutex
+	recentErrors   []string
+)
+
+func recordRecentError(message string) {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	recentErrors = append(recentErrors, time.Now().Format(time.RFC3339)+" "+message)
+	if len(recentErrors) > recentErrorsMax {
+		recentErrors = recentErrors[len(recentErrors)-recentErrorsMax:]
 	}
 }
 
+// RecentErrors returns the recent messages logged at WARNING or higher levels with the times,
+// the oldest first, regardless of the log level.
+func RecentErrors() []string {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	return append([]string(nil), recentErrors...)
+}
+
 // Criticalf critical log
 func (logger *Logger) Criticalf(m string, args ...interface{}) {
 	logger.log(CRITICAL, m, args...)
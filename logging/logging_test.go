@@ -1,6 +1,10 @@
 package logging
 
 import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
 	"testing"
 	"time"
 )
@@ -14,8 +18,8 @@ func TestGetLogger(t *testing.T) {
 
 func TestSetLogLevel(t *testing.T) {
 	SetLogLevel(INFO)
-	if logLv != INFO {
-		t.Errorf("tag should be tag but %v", logLv.String())
+	if lv := currentLogLevel(); lv != INFO {
+		t.Errorf("tag should be tag but %v", lv.String())
 	}
 }
 
@@ -56,3 +60,68 @@ func TestCriticalLogf(t *testing.T) {
 	logger.Debugf("This is debug log: %v", time.Now())
 	logger.Tracef("This is trace log: %v", time.Now())
 }
+
+func TestRecentErrors(t *testing.T) {
+	SetLogLevel(CRITICAL)
+	defer SetLogLevel(INFO)
+
+	var logger = GetLogger("tag")
+	logger.Infof("This is info log")
+	logger.Errorf("This is error log: %d", 1)
+	for i := 0; i < recentErrorsMax; i++ {
+		logger.Warningf("This is warning log: %d", i)
+	}
+	errors := RecentErrors()
+	if len(errors) != recentErrorsMax {
+		t.Fatalf("the recent %d errors should be kept but %d", recentErrorsMax, len(errors))
+	}
+	if !strings.HasSuffix(errors[len(errors)-1], "WARNING <tag> This is warning log: 49") {
+		t.Errorf("the warnings should be kept regardless of the log level: %q", errors[len(errors)-1])
+	}
+	for _, e := range errors {
+		if strings.Contains(e, "info") {
+			t.Errorf("the info logs should not be kept: %q", e)
+		}
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	origLgr := jsonLgr
+	jsonLgr = log.New(&buf, "", 0)
+	SetLogFormat(FormatJSON)
+	SetLogLevel(DEBUG)
+	defer func() {
+		jsonLgr = origLgr
+		SetLogFormat(FormatText)
+		SetLogLevel(INFO)
+	}()
+
+	var logger = GetLogger("tag").WithFields(map[string]interface{}{"plugin": "mysql"})
+	logger.Warningf("This is warning log: %d", 1)
+	logger.Tracef("This is trace log") // not shown
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("a record should be written in a line: %q", buf.String())
+	}
+	var record struct {
+		Level     string
+		Component string
+		Ts        string
+		Msg       string
+		Fields    map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("the record should be JSON: %s", err)
+	}
+	if record.Level != "WARNING" || record.Component != "tag" || record.Msg != "This is warning log: 1" || record.Ts == "" {
+		t.Errorf("unexpected record: %+v", record)
+	}
+	if record.Fields["plugin"] != "mysql" || !strings.HasPrefix(record.Fields["caller"].(string), "logging_test.go:") {
+		t.Errorf("the fields and the caller should be written: %+v", record.Fields)
+	}
+	if errors := RecentErrors(); !strings.HasSuffix(errors[len(errors)-1], "WARNING <tag> This is warning log: 1 plugin=mysql") {
+		t.Errorf("the fields should be written in the text format: %q", errors[len(errors)-1])
+	}
+}
@@ -1,13 +1,17 @@
 package mackerel
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mackerelio/mackerel-agent/version"
 )
@@ -448,6 +452,20 @@ func TestFindHostByCustomIdentifier(t *testing.T) {
 	}
 }
 
+func TestFindHostByCustomIdentifier_notFound(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header()["Content-Type"] = []string{"application/json"}
+		fmt.Fprint(res, `{"hosts":[]}`)
+	}))
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	_, err := api.FindHostByCustomIdentifier("foo-bar")
+	if !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("err should be ErrHostNotFound but: %v", err)
+	}
+}
+
 func TestPostHostMetricValues(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		if req.URL.Path != "/api/v0/tsdb" {
@@ -509,6 +527,52 @@ func TestPostHostMetricValues(t *testing.T) {
 	}
 }
 
+func TestPostMetricsValuesGzip(t *testing.T) {
+	var encodings []string
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		encodings = append(encodings, req.Header.Get("Content-Encoding"))
+		body := req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			r, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Fatal("request body should be compressed by gzip: ", err)
+			}
+			body = r
+		}
+
+		var values []CreatingMetricsValue
+		if err := json.NewDecoder(body).Decode(&values); err != nil {
+			t.Fatal("request body should be decoded as json: ", err)
+		}
+		if values[0].Name != "custom.metric.0" {
+			t.Error("request sends json including name but: ", values[0].Name)
+		}
+
+		res.Header()["Content-Type"] = []string{"application/json"}
+		fmt.Fprint(res, `{"success":true}`)
+	}))
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	api.EnableGzip()
+
+	var values []*CreatingMetricsValue
+	for i := 0; i < 100; i++ {
+		values = append(values, &CreatingMetricsValue{HostID: "9rxGOHfVF8F", Name: fmt.Sprintf("custom.metric.%d", i), Time: 123456789, Value: i})
+	}
+	if err := api.PostMetricsValues(values); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	// the small body is not compressed
+	if err := api.PostMetricsValues(values[:1]); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+
+	if !reflect.DeepEqual(encodings, []string{"gzip", ""}) {
+		t.Errorf("only the large body should be compressed: %v", encodings)
+	}
+}
+
 func TestCreateGraphDefs(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		if req.URL.Path != "/api/v0/graph-defs/create" {
@@ -607,6 +671,174 @@ func TestRetireHost(t *testing.T) {
 	}
 }
 
+func TestCreateGraphAnnotation(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v0/graph-annotations" {
+			t.Error("request URL should be /api/v0/graph-annotations but :", req.URL.Path)
+		}
+		if req.Method != "POST" {
+			t.Error("request method should be POST but: ", req.Method)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		var data GraphAnnotation
+		if err := json.Unmarshal(body, &data); err != nil {
+			t.Fatal("request body should be decoded as json", string(body))
+		}
+		if !reflect.DeepEqual(data, GraphAnnotation{Title: "terminated", From: 1474186920, To: 1474186920, Service: "My-Service", Roles: []string{"app"}}) {
+			t.Errorf("request sends unexpected json: %s", string(body))
+		}
+		res.Header()["Content-Type"] = []string{"application/json"}
+		fmt.Fprint(res, string(body))
+	}))
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	err := api.CreateGraphAnnotation(&GraphAnnotation{
+		Title:   "terminated",
+		From:    1474186920,
+		To:      1474186920,
+		Service: "My-Service",
+		Roles:   []string{"app"},
+	})
+
+	if err != nil {
+		t.Error("err shoud be nil but: ", err)
+	}
+}
+
+func TestProto(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(res, `{"success":true}`)
+	}))
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	if api.Proto() != "" {
+		t.Errorf("proto should be empty before any request but %q", api.Proto())
+	}
+	api.RetireHost("9rxGOHfVF8F")
+	if api.Proto() != "HTTP/1.1" {
+		t.Errorf("proto should be HTTP/1.1 but %q", api.Proto())
+	}
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	api, _ := NewAPI("https://example.com", "dummy-key", false)
+	api.DisableHTTP2()
+	transport, ok := api.transport.(*http.Transport)
+	if !ok || transport.TLSNextProto == nil || transport.ForceAttemptHTTP2 {
+		t.Errorf("transport should disable HTTP/2: %#v", api.transport)
+	}
+
+	api, _ = NewAPI("https://example.com", "dummy-key", false)
+	api.SetPinnedKeys([]string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="})
+	pinning := api.transport
+	api.DisableHTTP2()
+	if api.transport != pinning {
+		t.Errorf("transport for pinning should be kept")
+	}
+	if transport := httpTransport(api.transport); transport.TLSNextProto == nil || transport.ForceAttemptHTTP2 {
+		t.Errorf("transport for pinning should disable HTTP/2: %#v", transport)
+	}
+
+	api, _ = NewAPI("https://example.com", "dummy-key", false)
+	api.DisableHTTP2()
+	api.SetPinnedKeys([]string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="})
+	if transport := httpTransport(api.transport); transport.TLSNextProto == nil || transport.ForceAttemptHTTP2 {
+		t.Errorf("transport set up after DisableHTTP2 should disable HTTP/2: %#v", transport)
+	}
+}
+
+func TestHTTP2WithCustomTransport(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(res, `{"success":true}`)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	rootCAs = ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	defer func() { rootCAs = nil }()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	api.SetDNSCache(NewDNSCache(time.Minute, time.Second, time.Hour))
+	if err := api.RetireHost("9rxGOHfVF8F"); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if api.Proto() != "HTTP/2.0" {
+		t.Errorf("HTTP/2 should be used with the custom transport but %q", api.Proto())
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	var proxied *http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		proxied = req
+		fmt.Fprint(res, `{"success":true}`)
+	}))
+	defer proxy.Close()
+
+	api, _ := NewAPI("http://api.example.com", "dummy-key", false)
+	if err := api.SetProxy(strings.Replace(proxy.URL, "http://", "http://user:secret@", 1)); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if err := api.RetireHost("9rxGOHfVF8F"); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if proxied == nil || proxied.URL.String() != "http://api.example.com/api/v0/hosts/9rxGOHfVF8F/retire" {
+		t.Fatalf("the request should be sent through the proxy: %v", proxied)
+	}
+	if auth := proxied.Header.Get("Proxy-Authorization"); auth != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("the credentials should be sent to the proxy but %q", auth)
+	}
+
+	for _, invalid := range []string{"proxy.example.com:8080", "socks5://proxy.example.com:1080", "http://"} {
+		if err := api.SetProxy(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2016, 9, 18, 8, 22, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Sun, 18 Sep 2016 08:23:30 GMT", 90 * time.Second},
+		{"Sun, 18 Sep 2016 08:21:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, tc := range tests {
+		if d := parseRetryAfter(tc.value, now); d != tc.expected {
+			t.Errorf("Retry-After %q should be %s but %s", tc.value, tc.expected, d)
+		}
+	}
+}
+
+func TestApiError_rateLimited(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Retry-After", "30")
+		res.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	err := api.PostMetricsValues([]*CreatingMetricsValue{{Name: "custom.metric.0", Value: 1}})
+	aperr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("should raise API error: %v", err)
+	}
+	if !aperr.IsRateLimited() || aperr.IsClientError() {
+		t.Errorf("429 should be rate-limited but not the client error: %+v", aperr)
+	}
+	if aperr.RetryAfter != 30*time.Second {
+		t.Errorf("RetryAfter should be 30s but %s", aperr.RetryAfter)
+	}
+}
+
 func TestApiError(t *testing.T) {
 	aperr := apiError(400, "bad request")
 
@@ -618,3 +850,71 @@ func TestApiError(t *testing.T) {
 		t.Error("something went wrong")
 	}
 }
+
+func TestApiError_Is(t *testing.T) {
+	testCases := []struct {
+		statusCode int
+		target     error
+	}{
+		{http.StatusNotFound, ErrHostNotFound},
+		{http.StatusUnauthorized, ErrInvalidAPIKey},
+		{http.StatusForbidden, ErrInvalidAPIKey},
+		{http.StatusTooManyRequests, ErrRateLimited},
+	}
+	targets := []error{ErrHostNotFound, ErrInvalidAPIKey, ErrRateLimited}
+	for _, tc := range testCases {
+		err := fmt.Errorf("wrapped: %w", apiError(tc.statusCode, "error"))
+		for _, target := range targets {
+			if errors.Is(err, target) != (target == tc.target) {
+				t.Errorf("errors.Is(%d, %v) should be %t", tc.statusCode, target, target == tc.target)
+			}
+		}
+	}
+	if errors.Is(apiError(http.StatusInternalServerError, "error"), ErrHostNotFound) {
+		t.Error("500 should not be ErrHostNotFound")
+	}
+}
+
+func TestUnsupportedFeatures(t *testing.T) {
+	requests := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests[req.URL.Path]++
+		switch req.URL.Path {
+		case "/api/v0/monitoring/checks/report":
+			res.WriteHeader(http.StatusNotImplemented)
+		case "/api/v0/hosts":
+			http.NotFound(res, req)
+		default:
+			fmt.Fprint(res, `{"success":true}`)
+		}
+	}))
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	api.SetUnsupportedFeatures([]string{FeatureGraphDefs, "unknown"}, false)
+	if err := api.CreateGraphDefs(nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("the unsupported feature should not be requested: %v", err)
+	}
+	if err := api.ReportCheckMonitors("xyzabc12345", nil); err == nil || errors.Is(err, ErrUnsupported) {
+		t.Errorf("the error should be returned as is without the auto-detection: %v", err)
+	}
+
+	api.SetUnsupportedFeatures(nil, true)
+	for i := 0; i < 2; i++ {
+		if err := api.ReportCheckMonitors("xyzabc12345", nil); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("the feature responding 501 should be unsupported: %v", err)
+		}
+		if _, err := api.FindHostByCustomIdentifier("app.example.com"); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("the feature responding 404 should be unsupported: %v", err)
+		}
+	}
+	if requests["/api/v0/monitoring/checks/report"] != 2 || requests["/api/v0/hosts"] != 1 {
+		t.Errorf("the unsupported features should not be requested again: %v", requests)
+	}
+	if err := api.CreateGraphDefs(nil); err != nil {
+		t.Errorf("the supported feature should be requested: %v", err)
+	}
+	if features := api.UnsupportedFeatures(); !reflect.DeepEqual(features, []string{FeatureChecks, FeatureCustomIdentifier}) {
+		t.Errorf("unexpected unsupported features: %v", features)
+	}
+}
@@ -34,6 +34,9 @@ func (h monitorTargetHost) MarshalJSON() ([]byte, error) {
 
 // ReportCheckMonitors sends reports of checks.Checker() to Mackrel API server.
 func (api *API) ReportCheckMonitors(hostID string, reports []*checks.Report) error {
+	if !api.Supports(FeatureChecks) {
+		return unsupportedError(FeatureChecks)
+	}
 	payload := &monitoringChecksPayload{
 		Reports: make([]*checkReport, len(reports)),
 	}
@@ -48,7 +51,10 @@ func (api *API) ReportCheckMonitors(hostID string, reports []*checks.Report) err
 			MaxCheckAttempts:     report.MaxCheckAttempts,
 		}
 	}
-	resp, err := api.postJSON("/api/v0/monitoring/checks/report", payload)
+	resp, err := api.requestJSONWithCompression("POST", "/api/v0/monitoring/checks/report", payload, true)
 	defer closeResp(resp)
-	return err
+	if err != nil {
+		return api.detectUnsupportedFeature(FeatureChecks, err)
+	}
+	return nil
 }
@@ -0,0 +1,154 @@
+package mackerel
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newFixtureServer returns the server which responds with the recorded API response in testdata/<fixture>
+func newFixtureServer(t *testing.T, fixture string) *httptest.Server {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if v := req.Header.Get("X-Payload-Version"); v != PayloadVersion {
+			t.Errorf("X-Payload-Version should be %s but %s", PayloadVersion, v)
+		}
+		if v := req.Header.Get("X-Accept-Payload-Versions"); v != PayloadVersion {
+			t.Errorf("X-Accept-Payload-Versions should be %s but %s", PayloadVersion, v)
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("X-Payload-Version", "2")
+		res.Write(body)
+	}))
+}
+
+func TestContractFindHost(t *testing.T) {
+	ts := newFixtureServer(t, "find_host.json")
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	host, err := api.FindHost("2eQGEaLxibb")
+	if err != nil {
+		t.Errorf("err should be nil but: %s", err)
+	}
+
+	expected := &Host{
+		ID:     "2eQGEaLxibb",
+		Name:   "app01.example.com",
+		Type:   "unknown",
+		Status: "working",
+	}
+	if !reflect.DeepEqual(host, expected) {
+		t.Errorf("host should be %+v but %+v", expected, host)
+	}
+}
+
+func TestContractFindHostEvolved(t *testing.T) {
+	ts := newFixtureServer(t, "find_host_evolved.json")
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	host, err := api.FindHost("2eQGEaLxibb")
+	if err != nil {
+		t.Errorf("err should be nil even if the type of a field has been changed but: %s", err)
+	}
+
+	// the field of the incompatible type is left zero, and the fields after it are still decoded
+	if host == nil || host.ID != "2eQGEaLxibb" || host.Type != "" || host.Status != "working" || host.Name != "app01.example.com" {
+		t.Errorf("the known fields should be decoded but %+v", host)
+	}
+}
+
+func TestContractFindHostByCustomIdentifier(t *testing.T) {
+	ts := newFixtureServer(t, "find_hosts.json")
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	host, err := api.FindHostByCustomIdentifier("i-0123456789abcdef0.ec2.amazonaws.com")
+	if err != nil {
+		t.Errorf("err should be nil but: %s", err)
+	}
+
+	if host == nil || host.ID != "2eQGEaLxibb" || host.Status != "standby" {
+		t.Errorf("the host should be decoded but %+v", host)
+	}
+}
+
+func TestContractCreateHost(t *testing.T) {
+	ts := newFixtureServer(t, "create_host.json")
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	id, err := api.CreateHost(HostSpec{Name: "app01.example.com"})
+	if err != nil {
+		t.Errorf("err should be nil but: %s", err)
+	}
+	if id != "2eQGEaLxibb" {
+		t.Errorf("id should be 2eQGEaLxibb but %q", id)
+	}
+}
+
+func TestContractGetOrg(t *testing.T) {
+	ts := newFixtureServer(t, "org.json")
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	org, err := api.GetOrg()
+	if err != nil {
+		t.Errorf("err should be nil but: %s", err)
+	}
+	if org == nil || org.Name != "example-org" {
+		t.Errorf("the name of the organization should be example-org but %+v", org)
+	}
+}
+
+func TestContractCreateHostWithoutID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"id":{"value":"2eQGEaLxibb"}}`))
+	}))
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	id, err := api.CreateHost(HostSpec{Name: "app01.example.com"})
+	if err == nil {
+		t.Errorf("err should be returned when the id of the incompatible type is left zero but the id %q", id)
+	}
+}
+
+func TestContractPayloadVersion(t *testing.T) {
+	var chosen string
+	var sent []string
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		sent = append(sent, req.Header.Get("X-Payload-Version"))
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("X-Payload-Version", chosen)
+		res.Write([]byte(`{"name":"example-org"}`))
+	}))
+	defer ts.Close()
+
+	orig := supportedPayloadVersions
+	supportedPayloadVersions = []string{"1", "2"}
+	defer func() { supportedPayloadVersions = orig }()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	for _, chosen = range []string{"2", "3", "1"} {
+		if _, err := api.GetOrg(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api.GetOrg()
+
+	// the version chosen by the server is spoken in the following requests,
+	// and the agent falls back to PayloadVersion when the server chooses an unsupported one
+	expected := []string{"1", "2", "1", "1"}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("the payload versions sent should be %v but %v", expected, sent)
+	}
+}
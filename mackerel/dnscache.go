@@ -0,0 +1,122 @@
+package mackerel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var defaultDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// DNSCache caches the addresses of the hosts the API client connects to (the API endpoint or the proxy),
+// so that the intermittent failures of the resolver do not fail the requests.
+//
+// The addresses are reused for TTL without lookups. The host is looked up at most once in MinTTL,
+// so the failures are also cached for MinTTL. When the lookup fails, the expired addresses are served
+// for StaleTTL after they expired.
+type DNSCache struct {
+	TTL      time.Duration
+	MinTTL   time.Duration
+	StaleTTL time.Duration
+
+	lookup func(host string) ([]string, error)
+	now    func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*dnsCacheEntry
+	failures int // since the last Stats
+	stale    int // since the last Stats
+}
+
+type dnsCacheEntry struct {
+	addrs      []string
+	resolvedAt time.Time
+	triedAt    time.Time
+	err        error // of the last lookup
+}
+
+// NewDNSCache returns the cache resolving the hosts by the system resolver.
+func NewDNSCache(ttl, minTTL, staleTTL time.Duration) *DNSCache {
+	return &DNSCache{
+		TTL:      ttl,
+		MinTTL:   minTTL,
+		StaleTTL: staleTTL,
+		lookup:   net.LookupHost,
+		now:      time.Now,
+		entries:  make(map[string]*dnsCacheEntry),
+	}
+}
+
+// Stats returns the numbers of the failed lookups and the requests served by the stale addresses
+// since the previous call.
+func (c *DNSCache) Stats() (failures, stale int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failures, stale = c.failures, c.stale
+	c.failures, c.stale = 0, 0
+	return
+}
+
+func (c *DNSCache) resolve(host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	e, ok := c.entries[host]
+	if !ok {
+		e = &dnsCacheEntry{}
+		c.entries[host] = e
+	}
+	if e.addrs != nil && now.Sub(e.resolvedAt) < c.TTL {
+		return e.addrs, nil
+	}
+	if e.triedAt.IsZero() || now.Sub(e.triedAt) >= c.MinTTL {
+		e.triedAt = now
+		// the lookup is serialized, which is rare and keeps the resolver from being flooded
+		addrs, err := c.lookup(host)
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses found for %s", host)
+		}
+		e.err = err
+		if err == nil {
+			e.addrs = addrs
+			e.resolvedAt = now
+			return addrs, nil
+		}
+		c.failures++
+		logger.Warningf("Failed to resolve %s: %s", host, err)
+	}
+	if e.addrs != nil && now.Sub(e.resolvedAt) < c.TTL+c.StaleTTL {
+		c.stale++
+		logger.Debugf("Using the stale addresses of %s resolved at %s", host, e.resolvedAt)
+		return e.addrs, nil
+	}
+	if e.err == nil {
+		return nil, fmt.Errorf("failed to resolve %s", host)
+	}
+	return nil, e.err
+}
+
+// Dial connects to addr by the cached addresses, trying them in order.
+func (c *DNSCache) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := c.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var conn net.Conn
+		conn, err = defaultDialer.Dial(network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,89 @@
+package mackerel
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSCache_resolve(t *testing.T) {
+	c := NewDNSCache(5*time.Minute, 10*time.Second, time.Hour)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	lookups := 0
+	var lookupErr error
+	c.lookup = func(host string) ([]string, error) {
+		lookups++
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return []string{"192.0.2.1", "192.0.2.2"}, nil
+	}
+	expected := []string{"192.0.2.1", "192.0.2.2"}
+
+	if addrs, err := c.resolve("192.0.2.10"); err != nil || !reflect.DeepEqual(addrs, []string{"192.0.2.10"}) || lookups != 0 {
+		t.Errorf("IP addresses should not be looked up: %v, %v", addrs, err)
+	}
+
+	addrs, err := c.resolve("api.example.com")
+	if err != nil || !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("addresses should be %v but %v, %v", expected, addrs, err)
+	}
+	now = now.Add(4 * time.Minute)
+	c.resolve("api.example.com")
+	if lookups != 1 {
+		t.Errorf("addresses should be cached for the ttl but looked up %d times", lookups)
+	}
+
+	// the resolver fails after the ttl
+	lookupErr = errors.New("i/o timeout")
+	now = now.Add(2 * time.Minute)
+	addrs, err = c.resolve("api.example.com")
+	if err != nil || !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("stale addresses should be served: %v, %v", addrs, err)
+	}
+	now = now.Add(5 * time.Second)
+	c.resolve("api.example.com")
+	if lookups != 2 {
+		t.Errorf("the failure should be cached for the min_ttl but looked up %d times", lookups)
+	}
+	if failures, stale := c.Stats(); failures != 1 || stale != 2 {
+		t.Errorf("stats should be 1 failure and 2 stale but %d, %d", failures, stale)
+	}
+	if failures, stale := c.Stats(); failures != 0 || stale != 0 {
+		t.Errorf("stats should be reset but %d, %d", failures, stale)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := c.resolve("api.example.com"); err != lookupErr {
+		t.Errorf("should raise the error of the lookup after the stale_ttl: %v", err)
+	}
+
+	lookupErr = nil
+	now = now.Add(10 * time.Second)
+	if addrs, err := c.resolve("api.example.com"); err != nil || !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("addresses should be resolved again after the min_ttl: %v, %v", addrs, err)
+	}
+}
+
+func TestDNSCache_Dial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	c := NewDNSCache(time.Minute, time.Second, time.Hour)
+	c.lookup = func(host string) ([]string, error) {
+		// the first address refuses the connection
+		return []string{"127.0.0.2", "127.0.0.1"}, nil
+	}
+	conn, err := c.Dial("tcp", net.JoinHostPort("api.example.com", port))
+	if err != nil {
+		t.Fatalf("should connect to the second address: %v", err)
+	}
+	conn.Close()
+}
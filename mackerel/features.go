@@ -0,0 +1,102 @@
+package mackerel
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// The features of the API which the Mackerel-compatible backends (e.g. self-hosted) may lack.
+// The API client does not request the features known to be unsupported (see SetUnsupportedFeatures).
+const (
+	FeatureCustomIdentifier = "custom_identifier" // finding the hosts by the custom identifiers
+	FeatureChecks           = "checks"            // reporting the check monitoring
+	FeatureGraphDefs        = "graph_defs"        // creating the graph definitions of the plugins
+	FeatureGraphAnnotations = "graph_annotations" // posting the graph annotations
+	FeatureOrg              = "org"               // the organization of the API key
+)
+
+// Features are the features of the API which can be unsupported
+var Features = []string{FeatureCustomIdentifier, FeatureChecks, FeatureGraphDefs, FeatureGraphAnnotations, FeatureOrg}
+
+// ErrUnsupported is the feature not supported by the API, which is matched by errors.Is
+// with the errors returned instead of requesting the feature.
+var ErrUnsupported = errors.New("not supported by the API")
+
+// SetUnsupportedFeatures makes the API client skip requesting the features (the unknown ones are warned and ignored).
+// With autoDetect, the features whose endpoints respond 404 Not Found, 405 Method Not Allowed or 501 Not Implemented
+// are regarded as unsupported. The real Mackerel supports all the features, where the auto-detection should be disabled.
+func (api *API) SetUnsupportedFeatures(features []string, autoDetect bool) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.unsupported = make(map[string]bool, len(features))
+	for _, f := range features {
+		if !knownFeature(f) {
+			logger.Warningf("Unknown feature of the API %q, which should be one of %v", f, Features)
+			continue
+		}
+		api.unsupported[f] = true
+	}
+	api.detectUnsupported = autoDetect
+}
+
+// Supports reports whether the feature is not known to be unsupported
+func (api *API) Supports(feature string) bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return !api.unsupported[feature]
+}
+
+// UnsupportedFeatures returns the features known to be unsupported, sorted by the names
+func (api *API) UnsupportedFeatures() []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	features := make([]string, 0, len(api.unsupported))
+	for f := range api.unsupported {
+		features = append(features, f)
+	}
+	sort.Strings(features)
+	return features
+}
+
+func knownFeature(feature string) bool {
+	for _, f := range Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func unsupportedError(feature string) error {
+	return fmt.Errorf("%s is %w", feature, ErrUnsupported)
+}
+
+// detectUnsupportedFeature returns ErrUnsupported instead of err if the feature turns out to be unsupported
+// by the status code of err, which is regarded as unsupported afterwards.
+func (api *API) detectUnsupportedFeature(feature string, err error) error {
+	var aperr *Error
+	if !errors.As(err, &aperr) {
+		return err
+	}
+	switch aperr.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+	default:
+		return err
+	}
+	api.mu.Lock()
+	detect := api.detectUnsupported
+	if detect {
+		if api.unsupported == nil {
+			api.unsupported = make(map[string]bool)
+		}
+		api.unsupported[feature] = true
+	}
+	api.mu.Unlock()
+	if !detect {
+		return err
+	}
+	logger.Warningf("The API does not support %s (%s), which is not requested any more", feature, err)
+	return unsupportedError(feature)
+}
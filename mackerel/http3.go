@@ -0,0 +1,147 @@
+// +build http3
+
+package mackerel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3FallbackInterval is how long the API client uses HTTP/2 or HTTP/1.1 instead of HTTP/3 after HTTP/3 failed,
+// e.g. when UDP is blocked on the way to the API.
+var http3FallbackInterval = 10 * time.Minute
+
+// EnableHTTP3 makes the API client try the experimental HTTP/3 (QUIC) first, which does not stall all the requests
+// on a lost packet like TCP does. The request falls back to HTTP/2 or HTTP/1.1 when HTTP/3 fails, and HTTP/3 is not
+// tried again for http3FallbackInterval. The requests through a proxy always use HTTP/2 or HTTP/1.1, since the proxies
+// do not tunnel QUIC. The keys pinned by SetPinnedKeys, the TLS files and the DNS cache are applied to HTTP/3 too,
+// so it should be called after the other settings of the transport. HTTP/3 is built only with the http3 tag,
+// since quic-go requires the newer Go than the rest of the agent.
+func (api *API) EnableHTTP3() {
+	fallback := api.transport
+	if fallback == nil {
+		fallback = api.newTransport()
+	}
+	api.transport = &http3Transport{
+		h3: &http3.Transport{
+			TLSClientConfig: api.tlsConfig(""),
+			Dial:            api.dialQUIC,
+		},
+		fallback: fallback,
+		proxy:    api.proxy,
+	}
+}
+
+// HTTP3Fallbacks returns the number of the requests fallen back from HTTP/3 since the previous call,
+// and whether HTTP/3 is enabled by EnableHTTP3.
+func (api *API) HTTP3Fallbacks() (int, bool) {
+	t, ok := api.transport.(*http3Transport)
+	if !ok {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.fallbacks
+	t.fallbacks = 0
+	return n, true
+}
+
+// dialQUIC connects to addr by QUIC, resolving the host by the DNS cache if set
+func (api *API) dialQUIC(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+	if api.dnsCache == nil {
+		return quic.DialAddrEarly(ctx, addr, tlsConfig, config)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := api.dnsCache.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var conn *quic.Conn
+		conn, err = quic.DialAddrEarly(ctx, net.JoinHostPort(a, port), tlsConfig, config)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// http3Fallback returns the transport which rt falls back to if rt is the one of HTTP/3, or nil
+func http3Fallback(rt http.RoundTripper) http.RoundTripper {
+	if t, ok := rt.(*http3Transport); ok {
+		return t.fallback
+	}
+	return nil
+}
+
+// setHTTP3TLSConfig applies config to HTTP/3 if rt is the transport of HTTP/3
+func setHTTP3TLSConfig(rt http.RoundTripper, config *tls.Config) {
+	if t, ok := rt.(*http3Transport); ok {
+		t.h3.TLSClientConfig = config
+	}
+}
+
+// http3Transport sends the requests by HTTP/3, falling back to the transport of HTTP/2 and HTTP/1.1.
+type http3Transport struct {
+	h3       *http3.Transport
+	fallback http.RoundTripper
+	proxy    func(*http.Request) (*url.URL, error)
+
+	mu            sync.Mutex
+	fallbackUntil time.Time // HTTP/3 is not tried until then after it failed
+	fallbacks     int       // since the previous HTTP3Fallbacks
+}
+
+func (t *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.useHTTP3(req) {
+		return t.fallback.RoundTrip(req)
+	}
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil {
+		return resp, nil
+	}
+	if req.Context().Err() != nil || (req.Body != nil && req.GetBody == nil) {
+		return nil, err
+	}
+	logger.Warningf("HTTP/3 to %s failed (falling back to HTTP/2 or HTTP/1.1 for %s): %s", req.URL.Host, http3FallbackInterval, err)
+	t.mu.Lock()
+	t.fallbackUntil = time.Now().Add(http3FallbackInterval)
+	t.fallbacks++
+	t.mu.Unlock()
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.fallback.RoundTrip(retry)
+}
+
+// useHTTP3 reports whether req is sent by HTTP/3
+func (t *http3Transport) useHTTP3(req *http.Request) bool {
+	if req.URL.Scheme != "https" {
+		return false
+	}
+	if proxy, err := t.proxy(req); err != nil || proxy != nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Now().Before(t.fallbackUntil) {
+		t.fallbacks++
+		return false
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+// +build !http3
+
+package mackerel
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// EnableHTTP3 is not available without the http3 tag, and the API client keeps using HTTP/2 or HTTP/1.1
+func (api *API) EnableHTTP3() {
+	logger.Warningf("HTTP/3 is not available in this build (built without the http3 tag). HTTP/2 or HTTP/1.1 is used instead.")
+}
+
+// HTTP3Fallbacks always reports that HTTP/3 is not enabled without the http3 tag
+func (api *API) HTTP3Fallbacks() (int, bool) {
+	return 0, false
+}
+
+func http3Fallback(rt http.RoundTripper) http.RoundTripper {
+	return nil
+}
+
+func setHTTP3TLSConfig(rt http.RoundTripper, config *tls.Config) {
+}
@@ -0,0 +1,83 @@
+// +build http3
+
+package mackerel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestEnableHTTP3(t *testing.T) {
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(res, `{"success":true}`)
+	})
+	ts := httptest.NewTLSServer(handler)
+	defer ts.Close()
+	rootCAs = ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	defer func() { rootCAs = nil }()
+
+	// serve HTTP/3 on the same port as the TLS server
+	conn, err := net.ListenPacket("udp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Skipf("UDP is not available: %s", err)
+	}
+	server := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: ts.TLS.Certificates}),
+	}
+	go server.Serve(conn)
+	defer server.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	api.EnableHTTP3()
+	if err := api.RetireHost("9rxGOHfVF8F"); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if api.Proto() != "HTTP/3.0" {
+		t.Errorf("HTTP/3 should be used but %q", api.Proto())
+	}
+	if n, ok := api.HTTP3Fallbacks(); !ok || n != 0 {
+		t.Errorf("HTTP/3 should not fall back: %d, %t", n, ok)
+	}
+}
+
+func TestEnableHTTP3_fallback(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(res, `{"success":true}`)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	rootCAs = ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	defer func() { rootCAs = nil }()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	api.EnableHTTP3()
+	api.transport.(*http3Transport).h3.QUICConfig = &quic.Config{HandshakeIdleTimeout: 200 * time.Millisecond}
+	for i := 0; i < 2; i++ {
+		if err := api.RetireHost("9rxGOHfVF8F"); err != nil {
+			t.Fatalf("should fall back without error: %v", err)
+		}
+	}
+	if api.Proto() != "HTTP/2.0" {
+		t.Errorf("HTTP/2 should be used after HTTP/3 failed but %q", api.Proto())
+	}
+	if n, ok := api.HTTP3Fallbacks(); !ok || n != 2 {
+		t.Errorf("the requests should fall back: %d, %t", n, ok)
+	}
+}
+
+func TestHTTP3Fallbacks_disabled(t *testing.T) {
+	api, _ := NewAPI("https://example.com", "dummy-key", false)
+	if _, ok := api.HTTP3Fallbacks(); ok {
+		t.Error("HTTP/3 should not be enabled by default")
+	}
+}
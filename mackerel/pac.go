@@ -0,0 +1,128 @@
+package mackerel
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyPACAuto is the value of SetProxyPAC to discover the PAC file by WPAD (DHCP and DNS).
+const ProxyPACAuto = "auto"
+
+// how long the proxy found by the PAC file is used for the host
+var pacCacheTTL = 10 * time.Minute
+
+// pacResolver finds the proxy list of the PAC file for the URL, like "PROXY proxy.example.com:8080; DIRECT".
+type pacResolver func(u *url.URL) (string, error)
+
+// pacProxy finds the proxy by the PAC file, caching the results per the scheme and the host.
+type pacProxy struct {
+	resolve pacResolver
+
+	mu    sync.Mutex
+	cache map[string]pacCacheEntry
+}
+
+type pacCacheEntry struct {
+	proxy   *url.URL
+	expires time.Time
+}
+
+// SetProxyPAC makes the API client connect through the proxy found by the PAC (proxy auto-config) file
+// at pacURL, or discovered by WPAD if pacURL is ProxyPACAuto. The proxy set by SetProxy is preferred to it,
+// and the environment variables (HTTP_PROXY, HTTPS_PROXY and NO_PROXY) are used when the PAC file is not
+// available. The PAC file is evaluated by WinHTTP, which is available only on Windows.
+func (api *API) SetProxyPAC(pacURL string) error {
+	if pacURL == "" {
+		api.pac = nil
+		return nil
+	}
+	if pacURL != ProxyPACAuto {
+		u, err := url.Parse(pacURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid proxy_pac %q: should be %q or the URL of the PAC file", pacURL, ProxyPACAuto)
+		}
+	}
+	resolve, err := newPACResolver(pacURL)
+	if err != nil {
+		return err
+	}
+	api.pac = &pacProxy{resolve: resolve, cache: make(map[string]pacCacheEntry)}
+	if api.transport == nil {
+		api.transport = api.newTransport()
+	}
+	return nil
+}
+
+// proxy returns the proxy for req found by the PAC file, falling back to the environment variables
+// when the PAC file fails.
+func (p *pacProxy) proxy(req *http.Request) (*url.URL, error) {
+	key := req.URL.Scheme + "://" + req.URL.Host
+	p.mu.Lock()
+	entry, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.proxy, nil
+	}
+
+	list, err := p.resolve(req.URL)
+	if err != nil {
+		logger.Warningf("Failed to find the proxy by the PAC file (the environment variables are used): %s", err)
+		return http.ProxyFromEnvironment(req)
+	}
+	proxy, err := parsePACProxyList(list, req.URL.Scheme)
+	if err != nil {
+		logger.Warningf("Failed to find the proxy by the PAC file (the environment variables are used): %s", err)
+		return http.ProxyFromEnvironment(req)
+	}
+	p.mu.Lock()
+	p.cache[key] = pacCacheEntry{proxy: proxy, expires: time.Now().Add(pacCacheTTL)}
+	p.mu.Unlock()
+	return proxy, nil
+}
+
+// parsePACProxyList returns the first proxy in the list returned by the PAC file, or nil if it is DIRECT.
+// Both the form of FindProxyForURL ("PROXY host:port; DIRECT") and the one of WinHTTP
+// ("host:port;host:port" or "http=host:port;https=host:port") are accepted.
+func parsePACProxyList(list, scheme string) (*url.URL, error) {
+	entries := strings.FieldsFunc(list, func(r rune) bool { return r == ';' })
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil, nil
+		case "PROXY", "HTTP":
+			if len(fields) > 1 {
+				return url.Parse("http://" + fields[1])
+			}
+			continue
+		case "HTTPS":
+			if len(fields) > 1 {
+				return url.Parse("https://" + fields[1])
+			}
+			continue
+		case "SOCKS", "SOCKS4", "SOCKS5":
+			// not supported by net/http
+			continue
+		}
+		if i := strings.Index(fields[0], "="); i >= 0 {
+			// the proxy per the scheme of the destination
+			if fields[0][:i] == scheme {
+				return url.Parse("http://" + fields[0][i+1:])
+			}
+			continue
+		}
+		return url.Parse("http://" + fields[0])
+	}
+	if strings.TrimSpace(strings.Replace(list, ";", "", -1)) == "" {
+		// no proxy
+		return nil, nil
+	}
+	return nil, fmt.Errorf("no available proxy in %q", list)
+}
@@ -0,0 +1,9 @@
+// +build !windows
+
+package mackerel
+
+import "errors"
+
+func newPACResolver(pacURL string) (pacResolver, error) {
+	return nil, errors.New("proxy_pac is supported only on Windows")
+}
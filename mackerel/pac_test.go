@@ -0,0 +1,68 @@
+package mackerel
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParsePACProxyList(t *testing.T) {
+	testCases := []struct {
+		list, scheme string
+		expected     string
+	}{
+		{"PROXY proxy.example.com:8080; DIRECT", "https", "http://proxy.example.com:8080"},
+		{"SOCKS socks.example.com:1080; HTTPS secure.example.com:443", "https", "https://secure.example.com:443"},
+		{"DIRECT", "https", ""},
+		{"", "https", ""},
+		{"proxy1.example.com:8080;proxy2.example.com:8080", "https", "http://proxy1.example.com:8080"},
+		{"http=web.example.com:80;https=secure.example.com:8443", "https", "http://secure.example.com:8443"},
+	}
+	for _, tc := range testCases {
+		u, err := parsePACProxyList(tc.list, tc.scheme)
+		if err != nil {
+			t.Errorf("%q: should not raise error: %v", tc.list, err)
+			continue
+		}
+		if (u == nil && tc.expected != "") || (u != nil && u.String() != tc.expected) {
+			t.Errorf("%q: the proxy should be %q but %v", tc.list, tc.expected, u)
+		}
+	}
+
+	if _, err := parsePACProxyList("SOCKS socks.example.com:1080", "https"); err == nil {
+		t.Errorf("should raise error without the available proxy")
+	}
+}
+
+func TestPACProxy(t *testing.T) {
+	resolved := 0
+	list := "PROXY proxy.example.com:8080"
+	p := &pacProxy{
+		resolve: func(u *url.URL) (string, error) {
+			resolved++
+			if list == "" {
+				return "", errors.New("the PAC file is not available")
+			}
+			return list, nil
+		},
+		cache: make(map[string]pacCacheEntry),
+	}
+	req, _ := http.NewRequest("GET", "https://api.mackerelio.com/api/v0/hosts", nil)
+
+	for i := 0; i < 2; i++ {
+		proxy, err := p.proxy(req)
+		if err != nil || proxy == nil || proxy.Host != "proxy.example.com:8080" {
+			t.Errorf("the proxy should be found by the PAC file: %v, %v", proxy, err)
+		}
+	}
+	if resolved != 1 {
+		t.Errorf("the proxy should be cached per host but resolved %d times", resolved)
+	}
+
+	list = ""
+	other, _ := http.NewRequest("GET", "https://other.example.com/", nil)
+	if _, err := p.proxy(other); err != nil {
+		t.Errorf("the environment variables should be used when the PAC file fails: %v", err)
+	}
+}
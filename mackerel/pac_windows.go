@@ -0,0 +1,105 @@
+// +build windows
+
+package mackerel
+
+import (
+	"fmt"
+	"net/url"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	winhttp                   = windows.NewLazySystemDLL("winhttp.dll")
+	procWinHttpOpen           = winhttp.NewProc("WinHttpOpen")
+	procWinHttpGetProxyForUrl = winhttp.NewProc("WinHttpGetProxyForUrl")
+
+	kernel32       = windows.NewLazySystemDLL("kernel32.dll")
+	procGlobalFree = kernel32.NewProc("GlobalFree")
+)
+
+// https://docs.microsoft.com/windows/win32/api/winhttp/
+const (
+	winhttpAccessTypeNoProxy    = 1
+	winhttpAccessTypeNamedProxy = 3
+	winhttpAutoProxyAutoDetect  = 0x00000001
+	winhttpAutoProxyConfigURL   = 0x00000002
+	winhttpAutoDetectTypeDHCP   = 0x00000001
+	winhttpAutoDetectTypeDNSA   = 0x00000002
+)
+
+type winhttpAutoProxyOptions struct {
+	flags                 uint32
+	autoDetectFlags       uint32
+	autoConfigURL         *uint16
+	reserved1             uintptr
+	reserved2             uint32
+	autoLogonIfChallenged int32
+}
+
+type winhttpProxyInfo struct {
+	accessType  uint32
+	proxy       *uint16
+	proxyBypass *uint16
+}
+
+// newPACResolver returns the resolver evaluating the PAC file by WinHTTP,
+// which caches the PAC file in the session.
+func newPACResolver(pacURL string) (pacResolver, error) {
+	if err := procWinHttpGetProxyForUrl.Find(); err != nil {
+		return nil, err
+	}
+	agent, _ := syscall.UTF16PtrFromString("mackerel-agent")
+	session, _, err := procWinHttpOpen.Call(uintptr(unsafe.Pointer(agent)), winhttpAccessTypeNoProxy, 0, 0, 0)
+	if session == 0 {
+		return nil, fmt.Errorf("WinHttpOpen failed: %s", err)
+	}
+
+	options := winhttpAutoProxyOptions{autoLogonIfChallenged: 1}
+	if pacURL == ProxyPACAuto {
+		options.flags = winhttpAutoProxyAutoDetect
+		options.autoDetectFlags = winhttpAutoDetectTypeDHCP | winhttpAutoDetectTypeDNSA
+	} else {
+		u, err := syscall.UTF16PtrFromString(pacURL)
+		if err != nil {
+			return nil, err
+		}
+		options.flags = winhttpAutoProxyConfigURL
+		options.autoConfigURL = u
+	}
+
+	return func(u *url.URL) (string, error) {
+		target, err := syscall.UTF16PtrFromString(u.String())
+		if err != nil {
+			return "", err
+		}
+		var info winhttpProxyInfo
+		ok, _, err := procWinHttpGetProxyForUrl.Call(session, uintptr(unsafe.Pointer(target)),
+			uintptr(unsafe.Pointer(&options)), uintptr(unsafe.Pointer(&info)))
+		if ok == 0 {
+			return "", fmt.Errorf("WinHttpGetProxyForUrl failed: %s", err)
+		}
+		defer globalFree(info.proxy)
+		defer globalFree(info.proxyBypass)
+		if info.accessType != winhttpAccessTypeNamedProxy || info.proxy == nil {
+			return "DIRECT", nil
+		}
+		return utf16PtrToString(info.proxy), nil
+	}, nil
+}
+
+func globalFree(p *uint16) {
+	if p != nil {
+		procGlobalFree.Call(uintptr(unsafe.Pointer(p)))
+	}
+}
+
+func utf16PtrToString(p *uint16) string {
+	var s []uint16
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Pointer(uintptr(ptr) + 2) {
+		s = append(s, *(*uint16)(ptr))
+	}
+	return syscall.UTF16ToString(s)
+}
@@ -0,0 +1,93 @@
+package mackerel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const pinPrefix = "sha256/"
+
+// The root CAs to verify the certificate chain. The system roots are used when nil.
+var rootCAs *x509.CertPool
+
+// PinningError is returned when none of the certificates presented by the API endpoint
+// matches the pinned public keys. It is distinct from generic TLS failures
+// (e.g. an expired or untrusted certificate), which are reported as they are.
+type PinningError struct {
+	Host   string
+	Hashes []string // the pins of the presented certificate chain
+}
+
+func (e *PinningError) Error() string {
+	return fmt.Sprintf("certificate pinning failed for %s: the presented certificate chain [%s] matches none of the pinned keys", e.Host, strings.Join(e.Hashes, ", "))
+}
+
+// SetPinnedKeys pins the public keys of the API endpoint.
+// Each pin is the base64 encoded SHA-256 hash of the certificate's SubjectPublicKeyInfo
+// prefixed by "sha256/", which can be calculated by
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+//
+// The connection is accepted if any certificate in the verified chain matches any of the pins,
+// so that the keys can be rotated by pinning both the current and the next ones.
+// No pins are enforced when pins is empty.
+func (api *API) SetPinnedKeys(pins []string) error {
+	if len(pins) == 0 {
+		api.pinned = nil
+		api.transport = nil
+		return nil
+	}
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		if !strings.HasPrefix(pin, pinPrefix) {
+			return fmt.Errorf("invalid pinned key %q: should start with %q", pin, pinPrefix)
+		}
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("invalid pinned key %q: should be a base64 encoded SHA-256 hash", pin)
+		}
+		pinned[pin] = true
+	}
+
+	// The pins are verified by the handshake of TLS (see tlsConfig) before sending any request
+	// (including the API key) to the server, even through the tunnel of the proxy.
+	api.pinned = pinned
+	api.transport = &pinningTransport{Transport: api.newTransport()}
+	return nil
+}
+
+// pinningTransport refuses the API endpoints without TLS, whose keys cannot be pinned.
+type pinningTransport struct {
+	*http.Transport
+}
+
+func (t *pinningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("certificate pinning requires https but the API base is %s", req.URL.Scheme)
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+func verifyPins(pinned map[string]bool, host string, state tls.ConnectionState) error {
+	var hashes []string
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			pin := pinOf(cert)
+			if pinned[pin] {
+				return nil
+			}
+			hashes = append(hashes, pin)
+		}
+	}
+	return &PinningError{Host: host, Hashes: hashes}
+}
+
+func pinOf(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
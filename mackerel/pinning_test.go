@@ -0,0 +1,142 @@
+package mackerel
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func newPinningTestServer(t *testing.T) (*httptest.Server, *x509.Certificate) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(res, `{"host":{"id":"9rxGOHfVF8F","name":"mydb001"}}`)
+	}))
+	cert, err := x509.ParseCertificate(ts.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts, cert
+}
+
+func TestSetPinnedKeys(t *testing.T) {
+	ts, cert := newPinningTestServer(t)
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	rootCAs = pool
+	defer func() { rootCAs = nil }()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	if err := api.SetPinnedKeys([]string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", pinOf(cert)}); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	host, err := api.FindHost("9rxGOHfVF8F")
+	if err != nil {
+		t.Errorf("should not raise error when a pinned key matches: %v", err)
+	} else if host.ID != "9rxGOHfVF8F" {
+		t.Errorf("unexpected host: %+v", host)
+	}
+
+	api, _ = NewAPI(ts.URL, "dummy-key", false)
+	api.SetPinnedKeys([]string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="})
+	_, err = api.FindHost("9rxGOHfVF8F")
+	pinErr, ok := err.(*PinningError)
+	if !ok {
+		t.Fatalf("should raise PinningError when no pinned key matches: %v", err)
+	}
+	if len(pinErr.Hashes) == 0 || pinErr.Hashes[0] != pinOf(cert) {
+		t.Errorf("PinningError should contain the pins of the presented certificates: %v", pinErr)
+	}
+}
+
+func TestSetPinnedKeys_untrusted(t *testing.T) {
+	ts, cert := newPinningTestServer(t)
+	defer ts.Close()
+
+	// the self-signed certificate of the test server is not trusted by the system roots
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	api.SetPinnedKeys([]string{pinOf(cert)})
+	_, err := api.FindHost("9rxGOHfVF8F")
+	if err == nil {
+		t.Fatal("should raise error for an untrusted certificate")
+	}
+	if _, ok := err.(*PinningError); ok {
+		t.Errorf("should not raise PinningError for generic TLS failures: %v", err)
+	}
+}
+
+func TestSetPinnedKeys_invalid(t *testing.T) {
+	api, _ := NewAPI("https://example.com", "dummy-key", false)
+	for _, pin := range []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", "sha256/invalid", "sha256/AAAA"} {
+		if err := api.SetPinnedKeys([]string{pin}); err == nil {
+			t.Errorf("should raise error for the invalid pin %q", pin)
+		}
+	}
+}
+
+// newConnectProxy returns the proxy tunneling the connections by CONNECT
+func newConnectProxy(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			http.Error(res, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadGateway)
+			return
+		}
+		res.WriteHeader(http.StatusOK)
+		conn, _, err := res.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+}
+
+func TestSetPinnedKeys_proxy(t *testing.T) {
+	var requests int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(res, `{"host":{"id":"9rxGOHfVF8F","name":"mydb001"}}`)
+	}))
+	defer ts.Close()
+	cert, _ := x509.ParseCertificate(ts.TLS.Certificates[0].Certificate[0])
+	proxy := newConnectProxy(t)
+	defer proxy.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	rootCAs = pool
+	defer func() { rootCAs = nil }()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	api.SetPinnedKeys([]string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="})
+	api.SetProxy(proxy.URL)
+	_, err := api.FindHost("9rxGOHfVF8F")
+	if _, ok := err.(*PinningError); !ok {
+		t.Errorf("should raise PinningError through the proxy: %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("the request should not be sent to the server whose key is not pinned: %d requests", n)
+	}
+
+	api, _ = NewAPI(ts.URL, "dummy-key", false)
+	api.SetPinnedKeys([]string{pinOf(cert)})
+	api.SetProxy(proxy.URL)
+	if _, err := api.FindHost("9rxGOHfVF8F"); err != nil {
+		t.Errorf("should not raise error when a pinned key matches through the proxy: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package mackerel
+
+import (
+	"strings"
+	"time"
+)
+
+// RequestStats is the statistics of the requests to an endpoint of the API
+type RequestStats struct {
+	Requests int
+	Errors   int           // the requests failed to be sent and the error responses
+	Latency  time.Duration // the total time taken by the requests
+}
+
+// RequestStats returns the statistics of the requests by the endpoints (the first segment of the path
+// after /api/v0/, e.g. "tsdb" and "hosts") since the previous call.
+func (api *API) RequestStats() map[string]RequestStats {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	stats := make(map[string]RequestStats, len(api.stats))
+	for endpoint, s := range api.stats {
+		stats[endpoint] = *s
+	}
+	api.stats = nil
+	return stats
+}
+
+func (api *API) recordRequest(path string, latency time.Duration, failed bool) {
+	endpoint := endpointOf(path)
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.stats == nil {
+		api.stats = make(map[string]*RequestStats)
+	}
+	s, ok := api.stats[endpoint]
+	if !ok {
+		s = &RequestStats{}
+		api.stats[endpoint] = s
+	}
+	s.Requests++
+	s.Latency += latency
+	if failed {
+		s.Errors++
+	}
+}
+
+// endpointOf returns the name of the endpoint of path, which does not contain the IDs of the hosts
+func endpointOf(path string) string {
+	path = strings.TrimPrefix(path, "/api/v0/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[:i]
+	}
+	if path == "" {
+		return "unknown"
+	}
+	return path
+}
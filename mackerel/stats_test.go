@@ -0,0 +1,49 @@
+package mackerel
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v0/hosts/9rxGOHfVF8F" {
+			fmt.Fprint(res, `{"host":{"id":"9rxGOHfVF8F","name":"mydb001"}}`)
+			return
+		}
+		res.WriteHeader(500)
+	}))
+	defer ts.Close()
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	api.FindHost("9rxGOHfVF8F")
+	api.FindHost("9rxGOHfVF8F")
+	api.PostMetricsValues([]*CreatingMetricsValue{{HostID: "9rxGOHfVF8F", Name: "loadavg5", Value: 1}})
+
+	stats := api.RequestStats()
+	if s := stats["hosts"]; s.Requests != 2 || s.Errors != 0 || s.Latency <= 0 {
+		t.Errorf("unexpected stats of hosts: %+v", s)
+	}
+	if s := stats["tsdb"]; s.Requests != 1 || s.Errors != 1 {
+		t.Errorf("unexpected stats of tsdb: %+v", s)
+	}
+	if stats := api.RequestStats(); len(stats) != 0 {
+		t.Errorf("the stats should be reset: %+v", stats)
+	}
+}
+
+func TestEndpointOf(t *testing.T) {
+	tests := map[string]string{
+		"/api/v0/tsdb":                     "tsdb",
+		"/api/v0/hosts/9rxGOHfVF8F/retire": "hosts",
+		"/api/v0/monitoring/checks/report": "monitoring",
+		"/":                                "unknown",
+	}
+	for path, expected := range tests {
+		if got := endpointOf(path); got != expected {
+			t.Errorf("endpointOf(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package mackerel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// SetTLSFiles makes the API client trust the CA certificates in the PEM file caFile in addition to
+// the system roots (e.g. the private CA of an on-premises endpoint or a TLS-intercepting proxy),
+// and present the client certificate of the PEM files certFile and keyFile for the mutual TLS.
+// Either of them can be omitted by the empty file names, while certFile and keyFile are required together.
+func (api *API) SetTLSFiles(caFile, certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("both the client certificate and the key should be given for TLS: cert %q, key %q", certFile, keyFile)
+	}
+	var pool *x509.CertPool
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the CA file: %s", err)
+		}
+		pool = systemRootCAs()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates are found in the CA file %q", caFile)
+		}
+	}
+	var certs []tls.Certificate
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load the client certificate: %s", err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+	api.rootCAs = pool
+	api.certificates = certs
+
+	if t := httpTransport(api.transport); t != nil {
+		t.TLSClientConfig = api.tlsConfig("")
+	} else if api.transport == nil && (pool != nil || certs != nil) {
+		api.transport = api.newTransport()
+	}
+	setHTTP3TLSConfig(api.transport, api.tlsConfig(""))
+	return nil
+}
+
+// systemRootCAs returns a copy of the system roots, or an empty pool if they are not available
+func systemRootCAs() *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		logger.Warningf("The system roots are not available: %s", err)
+		return x509.NewCertPool()
+	}
+	return pool
+}
+
+// tlsConfig returns the configuration of TLS to connect to serverName with, which verifies the certificate
+// chain by the roots set by SetTLSFiles (or rootCAs) and the keys pinned by SetPinnedKeys, and presents
+// the client certificate if any.
+func (api *API) tlsConfig(serverName string) *tls.Config {
+	roots := rootCAs
+	if api.rootCAs != nil {
+		roots = api.rootCAs
+	}
+	config := &tls.Config{
+		RootCAs:      roots,
+		Certificates: api.certificates,
+		ServerName:   serverName,
+	}
+	if pinned := api.pinned; pinned != nil {
+		// called after the certificate chain is verified
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(pinned, state.ServerName, state)
+		}
+	}
+	return config
+}
@@ -0,0 +1,140 @@
+package mackerel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert generates a self-signed client certificate, and writes it and its key to dir
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mackerel-agent"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return cert, certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(res, `{"host":{"id":"9rxGOHfVF8F","name":"mydb001"}}`)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.TLS.Certificates[0].Certificate[0])
+
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+	if _, err := api.FindHost("9rxGOHfVF8F"); err == nil {
+		t.Errorf("should raise error without the CA and the client certificate")
+	}
+
+	api, _ = NewAPI(ts.URL, "dummy-key", false)
+	if err := api.SetTLSFiles(caFile, "", ""); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if _, err := api.FindHost("9rxGOHfVF8F"); err == nil {
+		t.Errorf("should raise error without the client certificate")
+	}
+
+	api, _ = NewAPI(ts.URL, "dummy-key", false)
+	if err := api.SetTLSFiles(caFile, certFile, keyFile); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	host, err := api.FindHost("9rxGOHfVF8F")
+	if err != nil {
+		t.Errorf("should not raise error with the CA and the client certificate: %v", err)
+	} else if host.ID != "9rxGOHfVF8F" {
+		t.Errorf("unexpected host: %+v", host)
+	}
+
+	// the files are honored by the pinning transport as well
+	cert, _ := x509.ParseCertificate(ts.TLS.Certificates[0].Certificate[0])
+	if err := api.SetPinnedKeys([]string{pinOf(cert)}); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if _, err := api.FindHost("9rxGOHfVF8F"); err != nil {
+		t.Errorf("should not raise error with the pinned keys: %v", err)
+	}
+}
+
+func TestSetTLSFiles_invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, certFile, keyFile := writeClientCert(t, dir)
+	tests := []struct {
+		caFile, certFile, keyFile string
+	}{
+		{filepath.Join(dir, "not-found.pem"), "", ""},
+		{keyFile, "", ""}, // no certificates
+		{"", certFile, ""},
+		{"", "", keyFile},
+		{"", keyFile, certFile},
+	}
+	for _, tc := range tests {
+		api, _ := NewAPI("https://api.example.com", "dummy-key", false)
+		if err := api.SetTLSFiles(tc.caFile, tc.certFile, tc.keyFile); err == nil {
+			t.Errorf("should raise error: %+v", tc)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -36,6 +37,18 @@ func (r *roleFullnamesFlag) Set(input string) error {
 	return nil
 }
 
+// conffilesFlag is the config files given by the -conf options, which are merged in the order
+type conffilesFlag []string
+
+func (c *conffilesFlag) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *conffilesFlag) Set(input string) error {
+	*c = append(*c, input)
+	return nil
+}
+
 var logger = logging.GetLogger("main")
 
 func main() {
@@ -79,15 +92,19 @@ func resolveConfig(fs *flag.FlagSet, argv []string) (*config.Config, error) {
 	conf := &config.Config{}
 
 	var (
-		conffile      = fs.String("conf", config.DefaultConfig.Conffile, "Config file path (Configs in this file are over-written by command line options)")
-		apibase       = fs.String("apibase", config.DefaultConfig.Apibase, "API base")
-		pidfile       = fs.String("pidfile", config.DefaultConfig.Pidfile, "File containing PID")
-		root          = fs.String("root", config.DefaultConfig.Root, "Directory containing variable state information")
-		apikey        = fs.String("apikey", "", "(DEPRECATED) API key from mackerel.io web site")
-		diagnostic    = fs.Bool("diagnostic", false, "Enables diagnostic features")
-		verbose       bool
-		roleFullnames roleFullnamesFlag
+		apibase        = fs.String("apibase", config.DefaultConfig.Apibase, "API base")
+		pidfile        = fs.String("pidfile", config.DefaultConfig.Pidfile, "File containing PID")
+		root           = fs.String("root", config.DefaultConfig.Root, "Directory containing variable state information")
+		apikey         = fs.String("apikey", "", "(DEPRECATED) API key from mackerel.io web site")
+		diagnostic     = fs.Bool("diagnostic", false, "Enables diagnostic features")
+		forceGraphDefs = fs.Bool("force-graphdefs", false, "Post the graph definitions of the plugins even if they have not changed")
+		profile        = fs.String("profile", "", "Profile of the configuration (e.g. prod), "+config.ProfileEnv+" is used if not specified")
+		verbose        bool
+		roleFullnames  roleFullnamesFlag
+		conffiles      conffilesFlag
 	)
+	fs.Var(&conffiles, "conf", "Config file path (Configs in this file are over-written by command line options). "+
+		"Multiple files can be given by repeating the option, the latter overriding the former (default \""+config.DefaultConfig.Conffile+"\")")
 	fs.BoolVar(&verbose, "verbose", config.DefaultConfig.Verbose, "Toggle verbosity")
 	fs.BoolVar(&verbose, "v", config.DefaultConfig.Verbose, "Toggle verbosity (shorthand)")
 
@@ -97,8 +114,13 @@ func resolveConfig(fs *flag.FlagSet, argv []string) (*config.Config, error) {
 
 	fs.Parse(argv)
 
-	conf, confErr := config.LoadConfig(*conffile)
-	conf.Conffile = *conffile
+	if *profile == "" {
+		*profile = os.Getenv(config.ProfileEnv)
+	}
+	if len(conffiles) == 0 {
+		conffiles = conffilesFlag{config.DefaultConfig.Conffile}
+	}
+	conf, confErr := config.LoadConfigFiles(conffiles, *profile)
 	if confErr != nil {
 		return nil, fmt.Errorf("Failed to load the config file: %s", confErr)
 	}
@@ -116,6 +138,8 @@ func resolveConfig(fs *flag.FlagSet, argv []string) (*config.Config, error) {
 			conf.Root = *root
 		case "diagnostic":
 			conf.Diagnostic = *diagnostic
+		case "force-graphdefs":
+			conf.ForceGraphDefs = *forceGraphDefs
 		case "verbose", "v":
 			conf.Verbose = verbose
 		case "role":
@@ -176,13 +200,16 @@ func removePidFile(pidfile string) {
 	}
 }
 
-func start(conf *config.Config, termCh chan struct{}) error {
+// start runs the agent until termCh is closed. The configuration is reloaded by reloadConfig on SIGHUP
+// if it is not nil.
+func start(conf *config.Config, termCh chan struct{}, reloadConfig func() (*config.Config, error)) error {
 	if conf.Silent {
 		logging.SetLogLevel(logging.ERROR)
 	}
 	if conf.Verbose {
 		logging.SetLogLevel(logging.DEBUG)
 	}
+	logging.SetLogFormat(conf.LogFormat)
 	logger.Infof("Starting mackerel-agent version:%s, rev:%s, apibase:%s", version.VERSION, version.GITCOMMIT, conf.Apibase)
 
 	if err := createPidFile(conf.Pidfile); err != nil {
@@ -190,28 +217,108 @@ func start(conf *config.Config, termCh chan struct{}) error {
 	}
 	defer removePidFile(conf.Pidfile)
 
-	ctx, err := command.Prepare(conf)
+	prepareCtx, cancelPrepare := context.WithCancel(context.Background())
+	stopWatching := cancelOnTermination(cancelPrepare, termCh)
+	ctx, err := command.PrepareContext(prepareCtx, conf)
+	stopWatching()
+	if prepareCtx.Err() != nil {
+		logger.Infof("Stopped while preparing the agent")
+		return nil
+	}
+	cancelPrepare()
 	if err != nil {
-		return fmt.Errorf("command.Prepare failed: %s", err)
+		err = fmt.Errorf("command.Prepare failed: %s", err)
+		command.ReportFatal(conf, nil, err)
+		return err
+	}
+
+	if conf.Control.Enabled {
+		l, err := command.ServeControl(ctx, func() error { return reload(ctx, reloadConfig) })
+		if err != nil {
+			logger.Errorf("Failed to serve the control endpoint: %s", err)
+		} else {
+			defer l.Close()
+		}
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, notifySignals()...)
+	go signalHandler(c, ctx, termCh, reloadConfig)
+
+	defer func() {
+		if r := recover(); r != nil {
+			command.ReportFatal(conf, ctx, fmt.Errorf("panic: %v", r))
+			panic(r)
+		}
+	}()
+	err = command.Run(ctx, termCh)
+	if err != nil && err != command.ErrForceTerminated {
+		command.ReportFatal(conf, ctx, err)
 	}
+	return err
+}
 
+// cancelOnTermination calls cancel on the termination signals or the receive from termCh,
+// which interrupts the retries of the preparation while the API is down, until stop is called.
+func cancelOnTermination(cancel context.CancelFunc, termCh chan struct{}) (stop func()) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
-	go signalHandler(c, ctx, termCh)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case sig := <-c:
+			logger.Infof("Received signal '%v' while preparing, stop retrying.", sig)
+			cancel()
+		case <-termCh:
+			cancel()
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+		<-stopped
+	}
+}
 
-	return command.Run(ctx, termCh)
+// reload applies the configuration reloaded by reloadConfig to the running agent,
+// or only updates the host specs if reloadConfig is nil.
+func reload(ctx *command.Context, reloadConfig func() (*config.Config, error)) error {
+	if reloadConfig == nil {
+		ctx.UpdateHostSpecs()
+		return nil
+	}
+	conf, err := reloadConfig()
+	if err != nil {
+		return err
+	}
+	ctx.Reload(conf)
+	return nil
 }
 
 var maxTerminatingInterval = 30 * time.Second
 
-func signalHandler(c chan os.Signal, ctx *command.Context, termCh chan struct{}) {
+func signalHandler(c chan os.Signal, ctx *command.Context, termCh chan struct{}, reloadConfig func() (*config.Config, error)) {
 	received := false
 	for sig := range c {
 		if sig == syscall.SIGHUP {
 			logger.Debugf("Received signal '%v'", sig)
-			// TODO reload configuration file
-
-			ctx.UpdateHostSpecs()
+			if err := reload(ctx, reloadConfig); err != nil {
+				logger.Errorf("Failed to reload the configuration (the current one is kept): %s", err)
+			}
+		} else if toggleDiagnosticSignal != nil && sig == toggleDiagnosticSignal {
+			logger.Debugf("Received signal '%v'", sig)
+			ctx.ToggleDiagnostic()
+		} else if dumpSignal != nil && sig == dumpSignal {
+			logger.Debugf("Received signal '%v'", sig)
+			file, err := ctx.DumpDiagnostics()
+			if err != nil {
+				logger.Errorf("Failed to write the diagnostics: %s", err)
+				continue
+			}
+			logger.Infof("Wrote the diagnostics to %s", file)
 		} else {
 			if !received {
 				received = true
@@ -58,6 +58,34 @@ diagnostic=false
 	}
 }
 
+func TestParseFlags_multipleConf(t *testing.T) {
+	var files []string
+	for _, content := range []string{"apikey=\"DUMMYAPIKEY\"\nroot=\"/hoge/fuga\"\n", "root=\"/hoge/piyo\"\n"} {
+		confFile, err := ioutil.TempFile("", "mackerel-config-test")
+		if err != nil {
+			t.Fatalf("Could not create temprary config file for test")
+		}
+		confFile.WriteString(content)
+		confFile.Close()
+		defer os.Remove(confFile.Name())
+		files = append(files, confFile.Name())
+	}
+
+	conf, err := resolveConfig(&flag.FlagSet{}, []string{"-conf=" + files[0], "-conf=" + files[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Apikey != "DUMMYAPIKEY" {
+		t.Errorf("Apikey should be kept from the first file but: %v", conf.Apikey)
+	}
+	if conf.Root != "/hoge/piyo" {
+		t.Errorf("Root should be overwritten by the latter file but: %v", conf.Root)
+	}
+	if conf.Conffile != files[0] || len(conf.Conffiles) != 2 {
+		t.Errorf("Conffile should be the first file of %v but: %v", conf.Conffiles, conf.Conffile)
+	}
+}
+
 func TestDetectForce(t *testing.T) {
 	// prepare dummy config
 	confFile, err := ioutil.TempFile("", "mackerel-config-test")
@@ -158,7 +186,7 @@ func TestSignalHandler(t *testing.T) {
 	termCh := make(chan struct{})
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
-	go signalHandler(c, ctx, termCh)
+	go signalHandler(c, ctx, termCh, nil)
 
 	resultCh := make(chan int)
 
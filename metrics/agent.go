@@ -11,15 +11,20 @@ type AgentGenerator struct {
 
 var memStats = new(runtime.MemStats)
 
-// Generate generates the memory usage of the running agent itself
+// Generate generates the memory usage and the number of the goroutines of the running agent itself.
+// The resident set size (custom.agent.memory.rss) is generated only on the platforms supporting it.
 func (g *AgentGenerator) Generate() (Values, error) {
 	runtime.ReadMemStats(memStats)
 
 	ret := map[string]float64{
-		"custom.agent.memory.alloc":     float64(memStats.Alloc),
-		"custom.agent.memory.sys":       float64(memStats.Sys),
-		"custom.agent.memory.heapAlloc": float64(memStats.HeapAlloc),
-		"custom.agent.memory.heapSys":   float64(memStats.HeapSys),
+		"custom.agent.memory.alloc":       float64(memStats.Alloc),
+		"custom.agent.memory.sys":         float64(memStats.Sys),
+		"custom.agent.memory.heapAlloc":   float64(memStats.HeapAlloc),
+		"custom.agent.memory.heapSys":     float64(memStats.HeapSys),
+		"custom.agent.runtime.goroutines": float64(runtime.NumGoroutine()),
+	}
+	if rss, err := residentSetSize(); err == nil {
+		ret["custom.agent.memory.rss"] = float64(rss)
 	}
 
 	return ret, nil
@@ -0,0 +1,12 @@
+// +build !linux
+
+package metrics
+
+import (
+	"errors"
+)
+
+// residentSetSize is not supported on the platform
+func residentSetSize() (uint64, error) {
+	return 0, errors.New("the resident set size is not supported")
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"runtime"
 	"testing"
 )
 
@@ -11,6 +12,7 @@ func TestAgentGenerate(t *testing.T) {
 	agentMetricNames := []string{
 		"custom.agent.memory.alloc", "custom.agent.memory.sys",
 		"custom.agent.memory.heapAlloc", "custom.agent.memory.heapSys",
+		"custom.agent.runtime.goroutines",
 	}
 
 	for _, name := range agentMetricNames {
@@ -21,4 +23,7 @@ func TestAgentGenerate(t *testing.T) {
 			t.Logf("Agent Status '%s' collected: %+v", name, value)
 		}
 	}
+	if runtime.GOOS == "linux" && values["custom.agent.memory.rss"] <= 0 {
+		t.Errorf("AgentGenerator should generate the resident set size on Linux: %v", values["custom.agent.memory.rss"])
+	}
 }
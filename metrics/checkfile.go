@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// checkFileGenerator generates the age and the size of the files
+// configured in [plugin.checkfile.<name>] sections.
+type checkFileGenerator struct {
+	Configs config.PluginConfigs
+}
+
+const checkFilePrefix = "custom.checkfile."
+
+var checkFileNameSanitizer = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// NewCheckFileGenerator returns the generator of the metrics of the files to be checked
+func NewCheckFileGenerator(confs config.PluginConfigs) PluginGenerator {
+	return &checkFileGenerator{Configs: confs}
+}
+
+func (g *checkFileGenerator) names() []string {
+	names := make([]string, 0, len(g.Configs))
+	for name := range g.Configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Generate generates the age (in seconds) and the size (in bytes) of the files.
+// The metrics of missing files are not generated.
+func (g *checkFileGenerator) Generate() (Values, error) {
+	values := Values{}
+	now := time.Now()
+	for name, conf := range g.Configs {
+		fi, err := os.Stat(conf.Path)
+		if err != nil {
+			continue
+		}
+		key := checkFileNameSanitizer.ReplaceAllString(name, "_")
+		values[checkFilePrefix+"age."+key] = now.Sub(fi.ModTime()).Seconds()
+		values[checkFilePrefix+"size."+key] = float64(fi.Size())
+	}
+	return values, nil
+}
+
+func (g *checkFileGenerator) PrepareGraphDefs() ([]mackerel.CreateGraphDefsPayload, error) {
+	age := mackerel.CreateGraphDefsPayload{
+		Name:        checkFilePrefix + "age",
+		DisplayName: "File age (seconds)",
+		Unit:        "integer",
+	}
+	size := mackerel.CreateGraphDefsPayload{
+		Name:        checkFilePrefix + "size",
+		DisplayName: "File size",
+		Unit:        "bytes",
+	}
+	for _, name := range g.names() {
+		key := checkFileNameSanitizer.ReplaceAllString(name, "_")
+		age.Metrics = append(age.Metrics, mackerel.CreateGraphDefsPayloadMetric{
+			Name:        checkFilePrefix + "age." + key,
+			DisplayName: name,
+		})
+		size.Metrics = append(size.Metrics, mackerel.CreateGraphDefsPayloadMetric{
+			Name:        checkFilePrefix + "size." + key,
+			DisplayName: name,
+		})
+	}
+	return []mackerel.CreateGraphDefsPayload{age, size}, nil
+}
+
+func (g *checkFileGenerator) CustomIdentifier() *string {
+	return nil
+}
+
+func (g *checkFileGenerator) Timestamp() string {
+	return ""
+}
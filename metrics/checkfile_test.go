@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestCheckFileGenerate(t *testing.T) {
+	f, err := ioutil.TempFile("", "mackerel-agent-checkfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("0123456789")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	g := NewCheckFileGenerator(config.PluginConfigs{
+		"heart.beat": {Path: f.Name()},
+		"missing":    {Path: f.Name() + ".missing"},
+	})
+
+	values, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+
+	if values["custom.checkfile.size.heart_beat"] != 10 {
+		t.Errorf("size should be 10 but %v", values["custom.checkfile.size.heart_beat"])
+	}
+	if _, ok := values["custom.checkfile.age.heart_beat"]; !ok {
+		t.Errorf("age should be generated")
+	}
+	if len(values) != 2 {
+		t.Errorf("metrics of missing files should not be generated: %v", values)
+	}
+
+	payloads, err := g.PrepareGraphDefs()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if len(payloads) != 2 || len(payloads[0].Metrics) != 2 {
+		t.Errorf("graph defs of age and size should be prepared: %+v", payloads)
+	}
+}
@@ -16,7 +16,8 @@ type FilesystemGenerator struct {
 
 var sanitizerReg = regexp.MustCompile(`[^A-Za-z0-9_-]`)
 
-// Generate the metrics of filesystems
+// Generate the metrics of filesystems: the size and the usage in bytes, and the number of the inodes
+// and the used ones
 func (g *FilesystemGenerator) Generate() (Values, error) {
 	filesystems, err := util.CollectDfValues()
 	if err != nil {
@@ -37,5 +38,22 @@ func (g *FilesystemGenerator) Generate() (Values, error) {
 			ret["filesystem."+device+".used"] = float64(dfs.Used) * 1024
 		}
 	}
+
+	inodes, err := util.CollectDfInodeValues()
+	if err != nil {
+		return nil, err
+	}
+	for _, dfs := range inodes {
+		name := dfs.Name
+		if strings.HasPrefix(name, "/dev/mapper/docker-") ||
+			(g.IgnoreRegexp != nil && g.IgnoreRegexp.MatchString(name)) {
+			continue
+		}
+		if device := strings.TrimPrefix(name, "/dev/"); name != device {
+			device = sanitizerReg.ReplaceAllString(device, "_")
+			ret["filesystem."+device+".inodes_total"] = float64(dfs.Inodes)
+			ret["filesystem."+device+".inodes_used"] = float64(dfs.Used)
+		}
+	}
 	return ret, nil
 }
@@ -0,0 +1,179 @@
+// +build linux
+
+package linux
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+/*
+CgroupGenerator collects the resource usage of the container the agent runs in, by the files of cgroup v2
+(the unified hierarchy) at the root of the cgroup namespace
+
+`cgroup.cpu.{metric}.percentage`: the increased amount of the CPU time as percentage of a CPU core,
+retrieved from cpu.stat
+
+metric = "user", "system", "throttled"
+
+`cgroup.memory.{metric}`: the memory usage and the limit in bytes, retrieved from memory.current and memory.max
+
+metric = "current", "max" (not generated if unlimited)
+
+`cgroup.io.{metric}`: the amount of the I/O per second of all the devices, retrieved from io.stat
+
+metric = "read_bytes", "write_bytes", "read_ios", "write_ios"
+
+graph: `cgroup.cpu.{metric}.percentage`, `cgroup.memory.{metric}`, `cgroup.io.{metric}`
+*/
+type CgroupGenerator struct {
+	Interval time.Duration
+}
+
+var cgroupLogger = logging.GetLogger("metrics.cgroup")
+
+var cgroupRoot = "/sys/fs/cgroup"
+
+// CgroupV2Available reports whether the agent runs in a container with cgroup v2. The root cgroup of
+// the host does not have memory.current, so the metrics are not generated outside the containers.
+func CgroupV2Available() bool {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(cgroupRoot, "memory.current"))
+	return err == nil
+}
+
+// The keys of cpu.stat (in microseconds) and the metric names
+var cgroupCPUStatKeys = map[string]string{
+	"user_usec":      "cgroup.cpu.user.percentage",
+	"system_usec":    "cgroup.cpu.system.percentage",
+	"throttled_usec": "cgroup.cpu.throttled.percentage",
+}
+
+// The keys of io.stat and the metric names
+var cgroupIOStatKeys = map[string]string{
+	"rbytes": "cgroup.io.read_bytes",
+	"wbytes": "cgroup.io.write_bytes",
+	"rios":   "cgroup.io.read_ios",
+	"wios":   "cgroup.io.write_ios",
+}
+
+// Generate generates metrics values
+func (g *CgroupGenerator) Generate() (metrics.Values, error) {
+	prevCPU, prevIO, err := g.collectCounters()
+	if err != nil {
+		cgroupLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+	time.Sleep(g.Interval)
+	currCPU, currIO, err := g.collectCounters()
+	if err != nil {
+		cgroupLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+
+	ret := metrics.Values{}
+	seconds := g.Interval.Seconds()
+	for key, name := range cgroupCPUStatKeys {
+		if curr, ok := currCPU[key]; ok {
+			ret[name] = (curr - prevCPU[key]) / 1e6 / seconds * 100
+		}
+	}
+	for key, name := range cgroupIOStatKeys {
+		if curr, ok := currIO[key]; ok {
+			ret[name] = (curr - prevIO[key]) / seconds
+		}
+	}
+
+	if content, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "memory.current")); err == nil {
+		if v, err := strconv.ParseFloat(strings.TrimSpace(string(content)), 64); err == nil {
+			ret["cgroup.memory.current"] = v
+		}
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "memory.max")); err == nil {
+		// "max" if unlimited
+		if v, err := strconv.ParseFloat(strings.TrimSpace(string(content)), 64); err == nil {
+			ret["cgroup.memory.max"] = v
+		}
+	}
+	return ret, nil
+}
+
+func (g *CgroupGenerator) collectCounters() (map[string]float64, map[string]float64, error) {
+	cpuStat, err := readCgroupKeyValues(filepath.Join(cgroupRoot, "cpu.stat"))
+	if err != nil {
+		return nil, nil, err
+	}
+	ioStat, err := readCgroupIOStat(filepath.Join(cgroupRoot, "io.stat"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		// the io controller is not enabled
+		ioStat = map[string]float64{}
+	}
+	return cpuStat, ioStat, nil
+}
+
+// readCgroupKeyValues reads the flat keyed file like cpu.stat, which has lines like "usage_usec 123456"
+func readCgroupKeyValues(path string) (map[string]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := map[string]float64{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line of %s: %q", path, scanner.Text())
+		}
+		values[fields[0]] = v
+	}
+	return values, scanner.Err()
+}
+
+// readCgroupIOStat reads io.stat, which has lines of the devices like
+// "8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0", and sums up the values.
+func readCgroupIOStat(path string) (map[string]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := map[string]float64{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				continue
+			}
+			values[kv[0]] += v
+		}
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,74 @@
+// +build linux
+
+package linux
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCgroupGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-test-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	original := cgroupRoot
+	cgroupRoot = dir
+	defer func() { cgroupRoot = original }()
+
+	if CgroupV2Available() {
+		t.Errorf("cgroup v2 should not be available without cgroup.controllers")
+	}
+	files := map[string]string{
+		"cgroup.controllers": "cpuset cpu io memory pids\n",
+		"cpu.stat":           "usage_usec 3000000\nuser_usec 2000000\nsystem_usec 1000000\nnr_periods 10\nnr_throttled 1\nthrottled_usec 500000\n",
+		"io.stat":            "8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0\n8:16 rbytes=800 wbytes=0 rios=8 wios=0 dbytes=0 dios=0\n",
+		"memory.current":     "536870912\n",
+		"memory.max":         "max\n",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	if !CgroupV2Available() {
+		t.Errorf("cgroup v2 should be available")
+	}
+
+	g := &CgroupGenerator{Interval: 10 * time.Millisecond}
+	values, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if values["cgroup.memory.current"] != 536870912 {
+		t.Errorf("cgroup.memory.current should be generated: %v", values)
+	}
+	if _, ok := values["cgroup.memory.max"]; ok {
+		t.Errorf("cgroup.memory.max should not be generated if unlimited: %v", values)
+	}
+	for _, name := range []string{"cgroup.cpu.user.percentage", "cgroup.cpu.throttled.percentage", "cgroup.io.read_bytes", "cgroup.io.write_ios"} {
+		if v, ok := values[name]; !ok || v != 0 {
+			t.Errorf("%s should be generated as 0 without the changes: %v", name, values)
+		}
+	}
+}
+
+func TestReadCgroupIOStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-test-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "io.stat")
+	ioutil.WriteFile(path, []byte("8:0 rbytes=1000 wbytes=2000 rios=3 wios=4\n8:16 rbytes=500 wbytes=0 rios=1 wios=0\n"), 0644)
+
+	values, err := readCgroupIOStat(path)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if values["rbytes"] != 1500 || values["wbytes"] != 2000 || values["rios"] != 4 || values["wios"] != 4 {
+		t.Errorf("the values of the devices should be summed up: %v", values)
+	}
+}
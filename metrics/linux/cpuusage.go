@@ -12,6 +12,7 @@ import (
 
 	"github.com/mackerelio/mackerel-agent/logging"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 /*
@@ -85,7 +86,7 @@ func (g *CPUUsageGenerator) Generate() (metrics.Values, error) {
 
 // returns values corresponding to cpuUsageMetricNames, those total and the number of CPUs
 func (g *CPUUsageGenerator) collectProcStatValues() ([]float64, float64, uint, error) {
-	file, err := os.Open("/proc/stat")
+	file, err := os.Open(util.HostPath("/proc/stat"))
 	if err != nil {
 		cpuUsageLogger.Errorf("Failed (skip these metrics): %s", err)
 		return nil, 0, 0, err
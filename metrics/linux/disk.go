@@ -14,6 +14,7 @@ import (
 
 	"github.com/mackerelio/mackerel-agent/logging"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 /*
@@ -82,7 +83,7 @@ func (g *DiskGenerator) Generate() (metrics.Values, error) {
 }
 
 func (g *DiskGenerator) collectDiskstatValues() (metrics.Values, error) {
-	out, err := ioutil.ReadFile("/proc/diskstats")
+	out, err := ioutil.ReadFile(util.HostPath("/proc/diskstats"))
 	if err != nil {
 		diskLogger.Errorf("Failed (skip these metrics): %s", err)
 		return nil, err
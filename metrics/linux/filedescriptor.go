@@ -0,0 +1,87 @@
+// +build linux
+
+package linux
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+/*
+FileDescriptorGenerator collects the usage of the file descriptors
+
+`filedescriptor.allocated`, `filedescriptor.max`: the number of the file descriptors allocated in the system
+and its limit retrieved from /proc/sys/fs/file-nr
+
+`filedescriptor.agent.open`, `filedescriptor.agent.max`: the number of the file descriptors opened by the agent
+and its limit (RLIMIT_NOFILE), if Agent is true
+
+graph: `filedescriptor`, `filedescriptor.agent`
+*/
+type FileDescriptorGenerator struct {
+	Agent bool
+}
+
+var fileDescriptorLogger = logging.GetLogger("metrics.filedescriptor")
+
+var (
+	fileNrFile = "/proc/sys/fs/file-nr"
+	selfFdDir  = "/proc/self/fd"
+)
+
+// Generate generates metrics values
+func (g *FileDescriptorGenerator) Generate() (metrics.Values, error) {
+	contentbytes, err := ioutil.ReadFile(util.HostPath(fileNrFile))
+	if err != nil {
+		fileDescriptorLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+	allocated, max, err := parseFileNr(string(contentbytes))
+	if err != nil {
+		fileDescriptorLogger.Errorf("Failed to parse %s (skip these metrics): %s", fileNrFile, err)
+		return nil, err
+	}
+	ret := metrics.Values{
+		"filedescriptor.allocated": allocated,
+		"filedescriptor.max":       max,
+	}
+
+	if g.Agent {
+		fds, err := ioutil.ReadDir(selfFdDir)
+		if err != nil {
+			fileDescriptorLogger.Warningf("Failed to count the file descriptors of the agent: %s", err)
+			return ret, nil
+		}
+		ret["filedescriptor.agent.open"] = float64(len(fds))
+		var rlimit syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err == nil {
+			ret["filedescriptor.agent.max"] = float64(rlimit.Cur)
+		}
+	}
+	return ret, nil
+}
+
+// parseFileNr parses the content of /proc/sys/fs/file-nr, "<allocated> <unused> <max>".
+// The unused ones are always 0 since Linux 2.6.
+func parseFileNr(content string) (float64, float64, error) {
+	fields := strings.Fields(content)
+	if len(fields) != 3 {
+		return 0, 0, fmt.Errorf("unexpected format: %q", content)
+	}
+	var values [3]float64
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		values[i] = v
+	}
+	return values[0] - values[1], values[2], nil
+}
@@ -0,0 +1,30 @@
+// +build linux
+
+package linux
+
+import "testing"
+
+func TestFileDescriptorGenerate(t *testing.T) {
+	values, err := (&FileDescriptorGenerator{Agent: true}).Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	for _, name := range []string{"filedescriptor.allocated", "filedescriptor.max", "filedescriptor.agent.open", "filedescriptor.agent.max"} {
+		if _, ok := values[name]; !ok {
+			t.Errorf("%s should be generated: %v", name, values)
+		}
+	}
+}
+
+func TestParseFileNr(t *testing.T) {
+	allocated, max, err := parseFileNr("3104\t0\t9223372036854775807\n")
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if allocated != 3104 || max != 9223372036854775807 {
+		t.Errorf("unexpected values: %v, %v", allocated, max)
+	}
+	if _, _, err := parseFileNr("3104 0"); err == nil {
+		t.Errorf("should raise error for the unexpected format")
+	}
+}
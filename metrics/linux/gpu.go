@@ -0,0 +1,92 @@
+// +build linux
+
+package linux
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+/*
+GPUGenerator collects the metrics of NVIDIA GPUs by nvidia-smi
+
+`gpu.{index}.{metric}`: the values of each GPU retrieved by `nvidia-smi --query-gpu`
+
+metric = "utilization" [%], "memory.utilization" [%], "memory.used", "memory.total" [bytes],
+"temperature" [degree Celsius], "power.draw" [W]
+
+The metrics not supported by the GPU are not generated.
+
+graph: `gpu.{index}.{metric}`
+*/
+type GPUGenerator struct {
+}
+
+var gpuLogger = logging.GetLogger("metrics.gpu")
+
+const nvidiaSMI = "nvidia-smi"
+
+// The fields queried by nvidia-smi and the metric names
+var gpuQueryFields = []struct {
+	field  string
+	metric string
+	scale  float64
+}{
+	{"utilization.gpu", "utilization", 1},
+	{"utilization.memory", "memory.utilization", 1},
+	{"memory.used", "memory.used", 1024 * 1024}, // MiB
+	{"memory.total", "memory.total", 1024 * 1024},
+	{"temperature.gpu", "temperature", 1},
+	{"power.draw", "power.draw", 1},
+}
+
+// GPUAvailable reports whether nvidia-smi is installed
+func GPUAvailable() bool {
+	_, err := exec.LookPath(nvidiaSMI)
+	return err == nil
+}
+
+// Generate generates metrics values
+func (g *GPUGenerator) Generate() (metrics.Values, error) {
+	fields := []string{"index"}
+	for _, f := range gpuQueryFields {
+		fields = append(fields, f.field)
+	}
+	out, err := exec.Command(nvidiaSMI, "--query-gpu="+strings.Join(fields, ","), "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		gpuLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+	return parseNvidiaSMI(out), nil
+}
+
+// parseNvidiaSMI parses the lines of the output of nvidia-smi, like "0, 45, 10, 1024, 16160, 60, 75.23".
+// The values not available are "[Not Supported]" or "[N/A]".
+func parseNvidiaSMI(out []byte) metrics.Values {
+	values := metrics.Values{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		cols := strings.Split(scanner.Text(), ",")
+		if len(cols) != len(gpuQueryFields)+1 {
+			continue
+		}
+		index := strings.TrimSpace(cols[0])
+		if _, err := strconv.Atoi(index); err != nil {
+			continue
+		}
+		for i, f := range gpuQueryFields {
+			v, err := strconv.ParseFloat(strings.TrimSpace(cols[i+1]), 64)
+			if err != nil {
+				continue
+			}
+			values["gpu."+index+"."+f.metric] = v * f.scale
+		}
+	}
+	return values
+}
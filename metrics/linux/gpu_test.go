@@ -0,0 +1,33 @@
+// +build linux
+
+package linux
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+func TestParseNvidiaSMI(t *testing.T) {
+	out := []byte(`0, 45, 10, 1024, 16160, 60, 75.23
+1, 0, 0, 0, 16160, 35, [Not Supported]
+invalid line
+`)
+	expected := metrics.Values{
+		"gpu.0.utilization":        45,
+		"gpu.0.memory.utilization": 10,
+		"gpu.0.memory.used":        1024 * 1024 * 1024,
+		"gpu.0.memory.total":       16160 * 1024 * 1024,
+		"gpu.0.temperature":        60,
+		"gpu.0.power.draw":         75.23,
+		"gpu.1.utilization":        0,
+		"gpu.1.memory.utilization": 0,
+		"gpu.1.memory.used":        0,
+		"gpu.1.memory.total":       16160 * 1024 * 1024,
+		"gpu.1.temperature":        35,
+	}
+	if values := parseNvidiaSMI(out); !reflect.DeepEqual(values, expected) {
+		t.Errorf("values should be %v but %v", expected, values)
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/mackerelio/mackerel-agent/logging"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 /*
@@ -23,6 +24,8 @@ collect network interface I/O
 
 interface = "eth0", "eth1" and so on...
 
+metric = "rxBytes", "txBytes", "rxErrors", "txErrors", "rxDrops", "txDrops", "txColls"
+
 see interface_test.go for sample input/output
 */
 
@@ -39,7 +42,7 @@ var interfaceMetrics = []string{
 }
 
 // metrics for posting to Mackerel
-var postInterfaceMetricsRegexp = regexp.MustCompile(`^interface\..+\.(?:rxBytes|txBytes)$`)
+var postInterfaceMetricsRegexp = regexp.MustCompile(`^interface\..+\.(?:rxBytes|txBytes|rxErrors|txErrors|rxDrops|txDrops|txColls)$`)
 
 var interfaceLogger = logging.GetLogger("metrics.interface")
 
@@ -72,7 +75,7 @@ func (g *InterfaceGenerator) Generate() (metrics.Values, error) {
 }
 
 func (g *InterfaceGenerator) collectInterfacesValues() (metrics.Values, error) {
-	out, err := ioutil.ReadFile("/proc/net/dev")
+	out, err := ioutil.ReadFile(util.HostPath("/proc/net/dev"))
 	if err != nil {
 		interfaceLogger.Errorf("Failed (skip these metrics): %s", err)
 		return nil, err
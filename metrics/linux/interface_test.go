@@ -27,7 +27,7 @@ func TestInterfaceGenerator(t *testing.T) {
 	}
 
 	metrics := []string{
-		"rxBytes", "txBytes",
+		"rxBytes", "txBytes", "rxErrors", "txErrors", "rxDrops", "txDrops", "txColls",
 	}
 
 	for _, metric := range metrics {
@@ -98,3 +98,16 @@ docker0: 250219988  333736    0    0    0     0          0         0 2024726607
 		t.Errorf("result is not expected one: %+v", result)
 	}
 }
+
+func TestPostInterfaceMetricsRegexp(t *testing.T) {
+	for _, name := range []string{"interface.eth0.rxBytes", "interface.eth0.rxErrors", "interface.eth0.txDrops", "interface.eth0.txColls"} {
+		if !postInterfaceMetricsRegexp.MatchString(name) {
+			t.Errorf("%s should be posted", name)
+		}
+	}
+	for _, name := range []string{"interface.eth0.rxPackets", "interface.eth0.rxFifo", "interface.eth0.txCarrier"} {
+		if postInterfaceMetricsRegexp.MatchString(name) {
+			t.Errorf("%s should not be posted", name)
+		}
+	}
+}
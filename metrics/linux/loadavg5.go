@@ -9,6 +9,7 @@ import (
 
 	"github.com/mackerelio/mackerel-agent/logging"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 /*
@@ -27,7 +28,7 @@ var loadavg5Logger = logging.GetLogger("metrics.loadavg5")
 
 // Generate XXX
 func (g *Loadavg5Generator) Generate() (metrics.Values, error) {
-	contentbytes, err := ioutil.ReadFile("/proc/loadavg")
+	contentbytes, err := ioutil.ReadFile(util.HostPath("/proc/loadavg"))
 	if err != nil {
 		loadavg5Logger.Errorf("Failed (skip these metrics): %s", err)
 		return nil, err
@@ -11,6 +11,7 @@ import (
 
 	"github.com/mackerelio/mackerel-agent/logging"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 /*
@@ -32,7 +33,7 @@ var memoryLogger = logging.GetLogger("metrics.memory")
 
 // Generate generate metrics values
 func (g *MemoryGenerator) Generate() (metrics.Values, error) {
-	out, err := ioutil.ReadFile("/proc/meminfo")
+	out, err := ioutil.ReadFile(util.HostPath("/proc/meminfo"))
 	if err != nil {
 		memoryLogger.Errorf("Failed (skip these metrics): %s", err)
 		return nil, err
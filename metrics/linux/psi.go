@@ -0,0 +1,114 @@
+// +build linux
+
+package linux
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+/*
+PSIGenerator collects the Pressure Stall Information (Linux 4.20 or later) retrieved from /proc/pressure
+
+`psi.{resource}.{metric}`: the percentage of the wall time in which some (or all) of the tasks were stalled
+waiting for the resource, calculated from the increase of total (in microseconds)
+
+resource = "cpu", "memory", "io"
+
+metric = "some", "full" (not generated for cpu before Linux 5.13)
+
+graph: `psi.{resource}.{metric}`
+*/
+type PSIGenerator struct {
+	Interval time.Duration
+}
+
+var psiLogger = logging.GetLogger("metrics.psi")
+
+var psiRoot = "/proc/pressure"
+
+var psiResources = []string{"cpu", "memory", "io"}
+
+// PSIAvailable reports whether the kernel provides the Pressure Stall Information.
+// It is disabled by psi=0 of the kernel command line, or not built in.
+func PSIAvailable() bool {
+	_, err := os.Stat(util.HostPath(filepath.Join(psiRoot, "cpu")))
+	return err == nil
+}
+
+// Generate generates metrics values
+func (g *PSIGenerator) Generate() (metrics.Values, error) {
+	prev, err := collectPSITotals()
+	if err != nil {
+		psiLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+	time.Sleep(g.Interval)
+	curr, err := collectPSITotals()
+	if err != nil {
+		psiLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+
+	ret := metrics.Values{}
+	microseconds := float64(g.Interval / time.Microsecond)
+	for name, total := range curr {
+		if p, ok := prev[name]; ok && total >= p {
+			ret[name] = (total - p) / microseconds * 100
+		}
+	}
+	return ret, nil
+}
+
+// collectPSITotals returns the totals of the stall time in microseconds keyed by the metric names
+func collectPSITotals() (map[string]float64, error) {
+	totals := map[string]float64{}
+	for _, resource := range psiResources {
+		values, err := readPSIFile(util.HostPath(filepath.Join(psiRoot, resource)))
+		if err != nil {
+			return nil, err
+		}
+		for metric, total := range values {
+			totals["psi."+resource+"."+metric] = total
+		}
+	}
+	return totals, nil
+}
+
+// readPSIFile reads the file of /proc/pressure, which has lines like
+// "some avg10=0.00 avg60=0.00 avg300=0.00 total=12345", and returns the totals keyed by "some" and "full".
+func readPSIFile(path string) (map[string]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := map[string]float64{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || (fields[0] != "some" && fields[0] != "full") {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "total=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimPrefix(field, "total="), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid line of %s: %q", path, scanner.Text())
+			}
+			values[fields[0]] = v
+		}
+	}
+	return values, scanner.Err()
+}
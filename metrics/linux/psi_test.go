@@ -0,0 +1,67 @@
+// +build linux
+
+package linux
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPSIGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-test-psi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	original := psiRoot
+	psiRoot = dir
+	defer func() { psiRoot = original }()
+
+	if PSIAvailable() {
+		t.Errorf("PSI should not be available without /proc/pressure/cpu")
+	}
+	files := map[string]string{
+		"cpu":    "some avg10=0.12 avg60=0.05 avg300=0.01 total=123456\n",
+		"memory": "some avg10=0.00 avg60=0.00 avg300=0.00 total=1000\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=500\n",
+		"io":     "some avg10=1.00 avg60=0.50 avg300=0.10 total=9999\nfull avg10=0.50 avg60=0.20 avg300=0.05 total=8888\n",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	if !PSIAvailable() {
+		t.Errorf("PSI should be available")
+	}
+
+	g := &PSIGenerator{Interval: 10 * time.Millisecond}
+	values, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	for _, name := range []string{"psi.cpu.some", "psi.memory.some", "psi.memory.full", "psi.io.some", "psi.io.full"} {
+		if v, ok := values[name]; !ok || v != 0 {
+			t.Errorf("%s should be generated as 0 without the changes: %v", name, values)
+		}
+	}
+	if _, ok := values["psi.cpu.full"]; ok {
+		t.Errorf("psi.cpu.full should not be generated if the kernel does not provide it: %v", values)
+	}
+}
+
+func TestPSIGenerate_Real(t *testing.T) {
+	if !PSIAvailable() {
+		t.Skip("PSI is not available")
+	}
+	g := &PSIGenerator{Interval: 100 * time.Millisecond}
+	values, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	for name, v := range values {
+		if v < 0 || v > 100 {
+			t.Errorf("%s should be a percentage: %v", name, v)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// +build linux
+
+package linux
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+/*
+TCPGenerator collects the number of the TCP connections in each state
+
+`tcp.{state}`: the number of the IPv4 and IPv6 connections retrieved from /proc/net/tcp and /proc/net/tcp6
+
+state = "established", "syn_sent", "syn_recv", "fin_wait1", "fin_wait2", "time_wait", "close",
+"close_wait", "last_ack", "listen", "closing"
+
+graph: `tcp.{state}`
+*/
+type TCPGenerator struct {
+}
+
+var tcpLogger = logging.GetLogger("metrics.tcp")
+
+var procNetDir = "/proc/net"
+
+// The states in the "st" column of /proc/net/tcp (include/net/tcp_states.h)
+var tcpStates = map[string]string{
+	"01": "established",
+	"02": "syn_sent",
+	"03": "syn_recv",
+	"04": "fin_wait1",
+	"05": "fin_wait2",
+	"06": "time_wait",
+	"07": "close",
+	"08": "close_wait",
+	"09": "last_ack",
+	"0A": "listen",
+	"0B": "closing",
+}
+
+// Generate generates metrics values
+func (g *TCPGenerator) Generate() (metrics.Values, error) {
+	ret := metrics.Values{}
+	for _, state := range tcpStates {
+		ret["tcp."+state] = 0
+	}
+	for _, name := range []string{"tcp", "tcp6"} {
+		file, err := os.Open(util.HostPath(filepath.Join(procNetDir, name)))
+		if err != nil {
+			if os.IsNotExist(err) { // IPv6 is disabled
+				continue
+			}
+			tcpLogger.Errorf("Failed (skip these metrics): %s", err)
+			return nil, err
+		}
+		err = countTCPStates(file, ret)
+		file.Close()
+		if err != nil {
+			tcpLogger.Errorf("Failed to read %s (skip these metrics): %s", name, err)
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// countTCPStates counts the connections listed in the format of /proc/net/tcp by the states
+func countTCPStates(r io.Reader, values metrics.Values) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if state, ok := tcpStates[strings.ToUpper(fields[3])]; ok {
+			values["tcp."+state]++
+		}
+	}
+	return scanner.Err()
+}
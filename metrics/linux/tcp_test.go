@@ -0,0 +1,36 @@
+// +build linux
+
+package linux
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+func TestTCPGenerate(t *testing.T) {
+	values, err := (&TCPGenerator{}).Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if _, ok := values["tcp.established"]; !ok {
+		t.Errorf("tcp.established should be generated: %v", values)
+	}
+}
+
+func TestCountTCPStates(t *testing.T) {
+	content := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 15213 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0CEA 0100007F:A3C2 01 00000000:00000000 00:00000000 00000000   999        0 20641 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:A3C2 0100007F:0CEA 01 00000000:00000000 00:00000000 00000000   999        0 20640 1 0000000000000000 20 4 28 10 -1
+   3: 0F02000A:0016 0202000A:D9A0 06 00000000:00000000 03:00000B5C 00000000     0        0 0 3 0000000000000000
+`
+	values := metrics.Values{}
+	if err := countTCPStates(strings.NewReader(content), values); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if values["tcp.listen"] != 1 || values["tcp.established"] != 2 || values["tcp.time_wait"] != 1 {
+		t.Errorf("the connections should be counted by the states: %v", values)
+	}
+}
@@ -1,6 +1,11 @@
 package metrics
 
-import "github.com/mackerelio/mackerel-agent/mackerel"
+import (
+	"context"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
 
 // Values XXX
 type Values map[string]float64
@@ -13,14 +18,20 @@ func (vs *Values) Merge(other Values) {
 }
 
 // ValuesCustomIdentifier holds the metric values with the optional custom identifier
+// and the optional time when the values were sampled.
+// The zero Time means the start of the collection cycle.
 type ValuesCustomIdentifier struct {
 	Values           Values
 	CustomIdentifier *string
+	Time             time.Time
 }
 
 // MergeValuesCustomIdentifiers merges the metric values and custom identifiers
 func MergeValuesCustomIdentifiers(values []ValuesCustomIdentifier, newValue ValuesCustomIdentifier) []ValuesCustomIdentifier {
 	for _, value := range values {
+		if !value.Time.Equal(newValue.Time) {
+			continue
+		}
 		if value.CustomIdentifier == newValue.CustomIdentifier ||
 			(value.CustomIdentifier != nil && newValue.CustomIdentifier != nil &&
 				*value.CustomIdentifier == *newValue.CustomIdentifier) {
@@ -36,9 +47,38 @@ type Generator interface {
 	Generate() (Values, error)
 }
 
+// ContextGenerator is implemented by the generators running the commands, e.g. the metrics plugins,
+// which are killed when ctx of GenerateContext is done, e.g. when the agent terminates.
+type ContextGenerator interface {
+	GenerateContext(ctx context.Context) (Values, error)
+}
+
+// GenerateContext generates the values of g by GenerateContext if g is a ContextGenerator, or by Generate otherwise.
+func GenerateContext(ctx context.Context, g Generator) (Values, error) {
+	if cg, ok := g.(ContextGenerator); ok {
+		return cg.GenerateContext(ctx)
+	}
+	return g.Generate()
+}
+
+// Resetter is implemented by the generators keeping the baselines of the deltas across the invocations,
+// which are discarded by Reset when the host is resumed from the suspension or live-migrated.
+type Resetter interface {
+	Reset()
+}
+
+// Background is implemented by the generators running in the background, e.g. the commands of the stream plugins.
+// They are started by Start before the collections, and stopped by Stop when they are discarded,
+// e.g. by the reload of the configuration or the termination of the agent.
+type Background interface {
+	Start()
+	Stop()
+}
+
 // PluginGenerator XXX
 type PluginGenerator interface {
 	Generate() (Values, error)
 	PrepareGraphDefs() ([]mackerel.CreateGraphDefsPayload, error)
 	CustomIdentifier() *string
+	Timestamp() string
 }
@@ -2,12 +2,15 @@ package metrics
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/logging"
@@ -20,6 +23,8 @@ import (
 type pluginGenerator struct {
 	Config config.PluginConfig
 	Meta   *pluginMeta
+
+	relabel []relabelRule
 }
 
 // pluginMeta is generated from plugin command. (not the configuration file)
@@ -47,11 +52,60 @@ var pluginConfigurationEnvName = "MACKEREL_AGENT_PLUGIN_META"
 
 // NewPluginGenerator XXX
 func NewPluginGenerator(conf config.PluginConfig) PluginGenerator {
-	return &pluginGenerator{Config: conf}
+	if conf.Stream {
+		return newStreamPluginGenerator(conf)
+	}
+	return newPluginGenerator(conf)
+}
+
+// newPluginGenerator returns the generator with the relabel rules of conf, which ignores them if invalid
+func newPluginGenerator(conf config.PluginConfig) *pluginGenerator {
+	g := &pluginGenerator{Config: conf}
+	var err error
+	if g.relabel, err = compileRelabelRules(conf.Relabel); err != nil {
+		pluginLogger.Errorf("The relabel rules of command %q are ignored: %s", conf.Command, err)
+	}
+	return g
+}
+
+// rename returns the name of the metric renamed by the relabel rules, which are applied to the name
+// without pluginPrefix. It returns "" if the metric is dropped.
+func (g *pluginGenerator) rename(key string) string {
+	if len(g.relabel) == 0 {
+		return key
+	}
+	name := relabel(g.relabel, strings.TrimPrefix(key, pluginPrefix))
+	if name == "" {
+		return ""
+	}
+	return pluginPrefix + name
+}
+
+// String returns the name of the plugin by the command without the arguments,
+// which may contain the credentials.
+func (g *pluginGenerator) String() string {
+	name := ""
+	if fields := strings.Fields(g.Config.Command); len(fields) > 0 {
+		name = filepath.Base(fields[0])
+	}
+	return fmt.Sprintf("plugin %s", name)
+}
+
+func (g *pluginGenerator) conditionSatisfied() bool {
+	return util.ConditionSatisfied(g.Config.Condition, g.Config.ConditionFile, g.Config.User)
 }
 
 func (g *pluginGenerator) Generate() (Values, error) {
-	results, err := g.collectValues()
+	return g.GenerateContext(context.Background())
+}
+
+// GenerateContext runs the command like Generate, but kills it when ctx is done
+func (g *pluginGenerator) GenerateContext(ctx context.Context) (Values, error) {
+	if !g.conditionSatisfied() {
+		pluginLogger.Debugf("Skipped plugin %q because the condition is not satisfied", g.Config.Command)
+		return Values{}, nil
+	}
+	results, err := g.collectValues(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +126,10 @@ func (g *pluginGenerator) CustomIdentifier() *string {
 	return g.Config.CustomIdentifier
 }
 
+func (g *pluginGenerator) Timestamp() string {
+	return g.Config.Timestamp
+}
+
 // loadPluginMeta obtains plugin information (e.g. graph visuals, metric
 // namespaces, etc) from the command specified.
 // mackerel-agent runs the command with MACKEREL_AGENT_PLUGIN_META
@@ -128,7 +186,7 @@ func (g *pluginGenerator) loadPluginMeta() error {
 	os.Setenv(pluginConfigurationEnvName, "1")
 	defer os.Setenv(pluginConfigurationEnvName, "")
 
-	stdout, stderr, exitCode, err := util.RunCommand(command, g.Config.User)
+	stdout, stderr, exitCode, err := util.RunCommandWithEnv(command, g.Config.User, g.Config.EnvList(), 0)
 	if err != nil {
 		return fmt.Errorf("running %q failed: %s, exit=%d stderr=%q", command, err, exitCode, stderr)
 	}
@@ -216,18 +274,35 @@ func (g *pluginGenerator) makeCreateGraphDefsPayload() []mackerel.CreateGraphDef
 	return payloads
 }
 
+// timeout is the time limit of the command configured by the `timeout` option, which is 0 if not
+// configured and the default timeout of util.RunCommand is applied.
+func (g *pluginGenerator) timeout() time.Duration {
+	if g.Config.Timeout == nil || *g.Config.Timeout <= 0 {
+		return 0
+	}
+	return time.Duration(*g.Config.Timeout) * time.Second
+}
+
 var delimReg = regexp.MustCompile(`[\s\t]+`)
 
-func (g *pluginGenerator) collectValues() (Values, error) {
+func (g *pluginGenerator) collectValues(ctx context.Context) (Values, error) {
 	command := g.Config.Command
 	pluginLogger.Debugf("Executing plugin: command = \"%s\"", command)
 
 	os.Setenv(pluginConfigurationEnvName, "")
-	stdout, stderr, _, err := util.RunCommand(command, g.Config.User)
+	timeout := g.timeout()
+	stdout, stderr, _, err := util.RunCommandContext(ctx, command, g.Config.User, g.Config.EnvList(), timeout)
 
 	if stderr != "" {
 		pluginLogger.Infof("command %q outputted to STDERR: %q", command, stderr)
 	}
+	if err == util.ErrCommandTimedOut {
+		countPluginTimeout()
+		if timeout > 0 {
+			pluginLogger.Errorf("Command %q timed out after %s (skip these metrics)", command, timeout)
+		}
+		return nil, err
+	}
 	if err != nil {
 		pluginLogger.Errorf("Failed to execute command %q (skip these metrics):\n", command)
 		return nil, err
@@ -235,22 +310,35 @@ func (g *pluginGenerator) collectValues() (Values, error) {
 
 	results := make(map[string]float64, 0)
 	for _, line := range strings.Split(stdout, "\n") {
-		// Key, value, timestamp
-		// ex.) tcp.CLOSING 0 1397031808
-		items := delimReg.Split(line, 3)
-		if len(items) != 3 {
+		key, value, ok := parsePluginLine(line)
+		if !ok {
 			continue
 		}
-		value, err := strconv.ParseFloat(items[1], 64)
-		if err != nil {
-			pluginLogger.Warningf("Failed to parse values: %s", err)
+		if key = g.rename(key); key == "" {
 			continue
 		}
+		results[key] = value
+	}
 
-		key := items[0]
+	return results, nil
+}
 
-		results[pluginPrefix+key] = value
+// parsePluginLine parses a line of the output of plugins
+// and returns the metric name with pluginPrefix and its value.
+func parsePluginLine(line string) (string, float64, bool) {
+	// Key, value, timestamp
+	// ex.) tcp.CLOSING 0 1397031808
+	items := delimReg.Split(line, 3)
+	if len(items) != 3 {
+		return "", 0, false
+	}
+	value, err := strconv.ParseFloat(items[1], 64)
+	if err != nil {
+		pluginLogger.Warningf("Failed to parse values: %s", err)
+		return "", 0, false
 	}
 
-	return results, nil
+	key := items[0]
+
+	return pluginPrefix + key, value, true
 }
@@ -3,11 +3,15 @@
 package metrics
 
 import (
+	"context"
+	"reflect"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 func containsKeyRegexp(values Values, reg string) bool {
@@ -34,12 +38,53 @@ func TestPluginGenerate(t *testing.T) {
 	}
 }
 
+func TestPluginGenerateWithCondition(t *testing.T) {
+	g := &pluginGenerator{Config: config.PluginConfig{
+		Command:   "echo \"just.echo.1\t1\t1397822016\"",
+		Condition: "test -e /nonexistent/vip",
+	}}
+	values, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if len(values) != 0 {
+		t.Errorf("no values should be generated if the condition is not satisfied: %v", values)
+	}
+
+	g.Config.Condition = "true"
+	values, err = g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if len(values) != 1 {
+		t.Errorf("values should be generated if the condition is satisfied: %v", values)
+	}
+}
+
+func TestPluginGenerateWithRelabel(t *testing.T) {
+	g := NewPluginGenerator(config.PluginConfig{
+		Command: "printf 'vendor.requests\t10\t1397822016\nvendor.debug.gc\t1\t1397822016\nother.value\t2\t1397822016\n'",
+		Relabel: []config.Relabel{
+			{Regex: `^vendor\.(.*)$`, Replacement: "myapp.$1"},
+			{Regex: `^myapp\.debug\..*`, Replacement: ""},
+		},
+	})
+	values, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	expected := Values{"custom.myapp.requests": 10, "custom.other.value": 2}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("the metrics should be renamed to %v but %v", expected, values)
+	}
+}
+
 func TestPluginCollectValues(t *testing.T) {
 	g := &pluginGenerator{Config: config.PluginConfig{
 		Command: "ruby ../example/metrics-plugins/dice.rb",
 	},
 	}
-	values, err := g.collectValues()
+	values, err := g.collectValues(context.Background())
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -54,7 +99,7 @@ func TestPluginCollectValuesCommand(t *testing.T) {
 	},
 	}
 
-	values, err := g.collectValues()
+	values, err := g.collectValues(context.Background())
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -73,12 +118,39 @@ func TestPluginCollectValuesCommand(t *testing.T) {
 	}
 }
 
+func TestPluginCollectValuesTimeout(t *testing.T) {
+	timeout := int32(1)
+	g := &pluginGenerator{Config: config.PluginConfig{
+		Command: "echo \"just.echo.1\t1\t1397822016\"; sleep 10",
+		Timeout: &timeout,
+	},
+	}
+
+	started := time.Now()
+	_, err := g.collectValues(context.Background())
+	if err != util.ErrCommandTimedOut {
+		t.Errorf("err should be ErrCommandTimedOut but %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("the plugin should be killed after the timeout: %s", elapsed)
+	}
+
+	values, _ := (&PluginTimeoutsGenerator{}).Generate()
+	if values["custom.agent.plugin.timeouts"] != 1 {
+		t.Errorf("the timeout should be counted: %v", values)
+	}
+	values, _ = (&PluginTimeoutsGenerator{}).Generate()
+	if values["custom.agent.plugin.timeouts"] != 0 {
+		t.Errorf("the count should be reset: %v", values)
+	}
+}
+
 func TestPluginCollectValuesCommandWithSpaces(t *testing.T) {
 	g := &pluginGenerator{Config: config.PluginConfig{
 		Command: `echo "just.echo.2   2   1397822016"`,
 	}}
 
-	values, err := g.collectValues()
+	values, err := g.collectValues(context.Background())
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
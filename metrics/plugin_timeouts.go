@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"sync/atomic"
+)
+
+// pluginTimeouts is the number of the runs of the metrics plugins killed by the timeouts
+var pluginTimeouts int64
+
+func countPluginTimeout() {
+	atomic.AddInt64(&pluginTimeouts, 1)
+}
+
+// PluginTimeoutsGenerator generates the number of the runs of the metrics plugins killed by the timeouts
+// since the previous collection, which helps to find the plugins slowing down the collections.
+//
+// `custom.agent.plugin.timeouts`: the number of the runs timed out
+type PluginTimeoutsGenerator struct {
+}
+
+// Generate generates the number of the timeouts, and resets it
+func (g *PluginTimeoutsGenerator) Generate() (Values, error) {
+	return Values{
+		"custom.agent.plugin.timeouts": float64(atomic.SwapInt64(&pluginTimeouts, 0)),
+	}, nil
+}
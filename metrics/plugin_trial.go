@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// PluginTrial is the result of running a metrics plugin once, which is shown to the developers of the plugin
+type PluginTrial struct {
+	Values    Values
+	GraphDefs []mackerel.CreateGraphDefsPayload
+	Stderr    string
+	ExitCode  int
+	Warnings  []string
+}
+
+// TryPlugin runs the metrics plugin of conf once like the agent does, and returns the values parsed
+// from the output, the graph definitions from the meta output (MACKEREL_AGENT_PLUGIN_META=1) and
+// the warnings about the output which the agent ignores silently or with the logs.
+func TryPlugin(conf config.PluginConfig) (*PluginTrial, error) {
+	if conf.Stream {
+		return nil, fmt.Errorf("the stream plugins cannot be run once")
+	}
+	g := newPluginGenerator(conf)
+	trial := &PluginTrial{Values: Values{}}
+	if !g.conditionSatisfied() {
+		trial.warn("the condition is not satisfied, so the agent skips the plugin for now")
+	}
+
+	stdout, stderr, exitCode, err := util.RunCommandWithEnv(conf.Command, conf.User, conf.EnvList(), g.timeout())
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %q: %s", conf.Command, err)
+	}
+	trial.Stderr, trial.ExitCode = stderr, exitCode
+	if exitCode != 0 {
+		trial.warn("the plugin exited with %d", exitCode)
+	}
+
+	lines := make(map[string]int)
+	for i, line := range strings.Split(stdout, "\n") {
+		lineno := i + 1
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		items := delimReg.Split(line, 3)
+		if len(items) != 3 {
+			trial.warn("line %d: not in the format of \"<name>\\t<value>\\t<epoch seconds>\": %q", lineno, line)
+			continue
+		}
+		value, err := strconv.ParseFloat(items[1], 64)
+		if err != nil {
+			trial.warn("line %d: invalid value: %q", lineno, items[1])
+			continue
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			trial.warn("line %d: the value %s cannot be posted", lineno, items[1])
+			continue
+		}
+		if _, err := strconv.ParseFloat(strings.TrimSpace(items[2]), 64); err != nil {
+			trial.warn("line %d: invalid timestamp: %q", lineno, items[2])
+		}
+		key := g.rename(pluginPrefix + items[0])
+		if key == "" {
+			continue
+		}
+		if prev, ok := lines[key]; ok {
+			trial.warn("line %d: %s is output at line %d as well, and the last value is used", lineno, key, prev)
+		}
+		lines[key] = lineno
+		trial.Values[key] = value
+	}
+
+	if trial.GraphDefs, err = g.PrepareGraphDefs(); err != nil {
+		trial.warn("no graph definitions: %s", err)
+	}
+	if len(trial.GraphDefs) > 0 {
+		var names []string
+		for name := range trial.Values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !graphDefined(trial.GraphDefs, name) {
+				trial.warn("%s matches none of the graph definitions", name)
+			}
+		}
+	}
+	return trial, nil
+}
+
+func (trial *PluginTrial) warn(format string, args ...interface{}) {
+	trial.Warnings = append(trial.Warnings, fmt.Sprintf(format, args...))
+}
+
+// graphDefined reports whether the metric matches any metric of the graph definitions,
+// whose names can contain the wildcards ("#" or "*") matching a component of the names.
+func graphDefined(graphDefs []mackerel.CreateGraphDefsPayload, name string) bool {
+	for _, graph := range graphDefs {
+		for _, metric := range graph.Metrics {
+			if matchMetricName(metric.Name, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchMetricName(pattern, name string) bool {
+	ps, ns := strings.Split(pattern, "."), strings.Split(name, ".")
+	if len(ps) != len(ns) {
+		return false
+	}
+	for i := range ps {
+		if ps[i] != ns[i] && ps[i] != "#" && ps[i] != "*" {
+			return false
+		}
+	}
+	return true
+}
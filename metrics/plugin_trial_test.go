@@ -0,0 +1,72 @@
+// +build linux darwin freebsd netbsd
+
+package metrics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestTryPlugin(t *testing.T) {
+	script := `if [ "$MACKEREL_AGENT_PLUGIN_META" = 1 ]; then
+  echo '# mackerel-agent-plugin'
+  echo '{"graphs":{"app.requests":{"label":"Requests","metrics":[{"name":"#","label":"Requests"}]}}}'
+  exit 0
+fi
+printf 'app.requests.get\t10\t1397822016\n'
+printf 'app.requests.get\t12\t1397822016\n'
+printf 'app.requests.post\tmany\t1397822016\n'
+printf 'app.latency\t0.5\t1397822016\n'
+printf 'broken line\n'
+echo 'debug output' >&2`
+	trial, err := TryPlugin(config.PluginConfig{Command: script})
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+
+	expected := Values{"custom.app.requests.get": 12, "custom.app.latency": 0.5}
+	if !reflect.DeepEqual(trial.Values, expected) {
+		t.Errorf("values should be %v but %v", expected, trial.Values)
+	}
+	if len(trial.GraphDefs) != 1 || trial.GraphDefs[0].Name != "custom.app.requests" || trial.GraphDefs[0].Metrics[0].Name != "custom.app.requests.#" {
+		t.Errorf("unexpected graph definitions: %+v", trial.GraphDefs)
+	}
+	if trial.Stderr != "debug output\n" {
+		t.Errorf("unexpected stderr: %q", trial.Stderr)
+	}
+
+	warnings := strings.Join(trial.Warnings, "\n")
+	for _, w := range []string{
+		"line 2: custom.app.requests.get is output at line 1 as well",
+		`line 3: invalid value: "many"`,
+		`line 5: not in the format`,
+		"custom.app.latency matches none of the graph definitions",
+	} {
+		if !strings.Contains(warnings, w) {
+			t.Errorf("the warnings should contain %q but:\n%s", w, warnings)
+		}
+	}
+	if len(trial.Warnings) != 4 {
+		t.Errorf("4 warnings should be reported but %d:\n%s", len(trial.Warnings), warnings)
+	}
+}
+
+func TestTryPluginWithoutMeta(t *testing.T) {
+	trial, err := TryPlugin(config.PluginConfig{Command: "printf 'just.echo\t1\t1397822016\n'; exit 1"})
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if trial.ExitCode != 1 || trial.Values["custom.just.echo"] != 1 {
+		t.Errorf("unexpected result: %+v", trial)
+	}
+	if len(trial.GraphDefs) != 0 || len(trial.Warnings) != 2 {
+		t.Errorf("the warnings of the exit code and the graph definitions should be reported: %v", trial.Warnings)
+	}
+
+	if _, err := TryPlugin(config.PluginConfig{Command: "true", Stream: true}); err == nil {
+		t.Error("should raise error for the stream plugins")
+	}
+}
@@ -0,0 +1,334 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+var prometheusLogger = logging.GetLogger("metrics.prometheus")
+
+var prometheusClient = &http.Client{Timeout: 10 * time.Second}
+
+var prometheusNameSanitizer = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// prometheusGenerator scrapes the endpoint of the Prometheus exposition format configured in
+// [plugin.prometheus.<name>] and converts the samples into the custom metrics:
+//
+//	custom.<prefix>.<metric name>.<label values joined with "_">
+//
+// where <prefix> is "prometheus.<name>" by default, and the label values are "value" for the samples
+// without labels. The names are renamed by the relabel rules after the prefix is removed.
+// The counters are converted into the rates per second since the previous scrape,
+// and the buckets of the histograms are ignored.
+type prometheusGenerator struct {
+	Config config.PluginConfig
+
+	prefix  string
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+	relabel []relabelRule
+
+	mu          sync.Mutex
+	counters    map[string]float64 // the values of the counters at the previous scrape
+	collectedAt time.Time
+}
+
+type prometheusSample struct {
+	name    string
+	labels  []string // the values of the labels in order
+	value   float64
+	counter bool
+}
+
+// NewPrometheusGenerator returns the generator scraping the endpoint of the Prometheus exposition format
+func NewPrometheusGenerator(name string, conf config.PluginConfig) (PluginGenerator, error) {
+	g := &prometheusGenerator{
+		Config:   conf,
+		prefix:   pluginPrefix + conf.Prefix,
+		counters: make(map[string]float64),
+	}
+	if conf.Prefix == "" {
+		g.prefix = pluginPrefix + "prometheus." + prometheusNameSanitizer.ReplaceAllString(name, "_")
+	}
+	if conf.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	var err error
+	if conf.Include != "" {
+		if g.include, err = regexp.Compile(conf.Include); err != nil {
+			return nil, fmt.Errorf("invalid include: %s", err)
+		}
+	}
+	if conf.Exclude != "" {
+		if g.exclude, err = regexp.Compile(conf.Exclude); err != nil {
+			return nil, fmt.Errorf("invalid exclude: %s", err)
+		}
+	}
+	if g.relabel, err = compileRelabelRules(conf.Relabel); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *prometheusGenerator) scrape() ([]prometheusSample, error) {
+	resp, err := prometheusClient.Get(g.Config.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", g.Config.URL, resp.Status)
+	}
+	return parsePrometheusText(resp.Body)
+}
+
+// metricName returns the name of the custom metric of the sample, or "" if it is not posted
+func (g *prometheusGenerator) metricName(s prometheusSample) string {
+	if g.include != nil && !g.include.MatchString(s.name) {
+		return ""
+	}
+	if g.exclude != nil && g.exclude.MatchString(s.name) {
+		return ""
+	}
+	labels := "value"
+	if len(s.labels) > 0 {
+		labels = prometheusNameSanitizer.ReplaceAllString(strings.Join(s.labels, "_"), "_")
+	}
+	name := relabel(g.relabel, strings.Replace(s.name, ":", "_", -1)+"."+labels)
+	if name == "" {
+		return ""
+	}
+	return g.prefix + "." + name
+}
+
+// Generate scrapes the endpoint and returns the values of the gauges and the rates of the counters.
+func (g *prometheusGenerator) Generate() (Values, error) {
+	if !util.ConditionSatisfied(g.Config.Condition, g.Config.ConditionFile, g.Config.User) {
+		prometheusLogger.Debugf("Skipped scraping %q because the condition is not satisfied", g.Config.URL)
+		return Values{}, nil
+	}
+	samples, err := g.scrape()
+	if err != nil {
+		prometheusLogger.Warningf("Failed to scrape %q: %s", g.Config.URL, err)
+		return nil, err
+	}
+	return g.convert(samples, time.Now()), nil
+}
+
+func (g *prometheusGenerator) convert(samples []prometheusSample, now time.Time) Values {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	values := Values{}
+	counters := make(map[string]float64)
+	elapsed := now.Sub(g.collectedAt).Seconds()
+	for _, s := range samples {
+		name := g.metricName(s)
+		if name == "" {
+			continue
+		}
+		if !s.counter {
+			values[name] = s.value
+			continue
+		}
+		counters[name] = s.value
+		// the rate is not available at the first scrape or after the counter is reset
+		if prev, ok := g.counters[name]; ok && s.value >= prev && elapsed > 0 {
+			values[name] = (s.value - prev) / elapsed
+		}
+	}
+	g.counters = counters
+	g.collectedAt = now
+	return values
+}
+
+// Reset discards the values of the counters at the previous scrape
+func (g *prometheusGenerator) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.counters = make(map[string]float64)
+	g.collectedAt = time.Time{}
+}
+
+// PrepareGraphDefs scrapes the endpoint and defines a graph for each group of the metrics
+// which differ only in the last part of the names (e.g. the label values).
+func (g *prometheusGenerator) PrepareGraphDefs() ([]mackerel.CreateGraphDefsPayload, error) {
+	samples, err := g.scrape()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]bool)
+	for _, s := range samples {
+		name := g.metricName(s)
+		if name == "" {
+			continue
+		}
+		groups[name[:strings.LastIndex(name, ".")]] = true
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	payloads := []mackerel.CreateGraphDefsPayload{}
+	for _, name := range names {
+		payloads = append(payloads, mackerel.CreateGraphDefsPayload{
+			Name:        name,
+			DisplayName: strings.TrimPrefix(name, pluginPrefix),
+			Unit:        "float",
+			Metrics: []mackerel.CreateGraphDefsPayloadMetric{
+				{Name: name + ".*", DisplayName: "%1"},
+			},
+		})
+	}
+	return payloads, nil
+}
+
+func (g *prometheusGenerator) CustomIdentifier() *string {
+	return g.Config.CustomIdentifier
+}
+
+func (g *prometheusGenerator) Timestamp() string {
+	return g.Config.Timestamp
+}
+
+// parsePrometheusText parses the text format of Prometheus:
+//
+//	# TYPE http_requests_total counter
+//	http_requests_total{method="post",code="200"} 1027 1395066363000
+//
+// The samples of NaN or infinity, and the buckets of the histograms are ignored.
+func parsePrometheusText(r io.Reader) ([]prometheusSample, error) {
+	types := make(map[string]string)
+	typeOf := func(name string) string {
+		if typ, ok := types[name]; ok {
+			return typ
+		}
+		for _, suffix := range []string{"_sum", "_count", "_bucket"} {
+			if strings.HasSuffix(name, suffix) {
+				return types[strings.TrimSuffix(name, suffix)]
+			}
+		}
+		return ""
+	}
+
+	var samples []prometheusSample
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		s, err := parsePrometheusSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q: %s", line, err)
+		}
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+		switch typ := typeOf(s.name); typ {
+		case "counter":
+			s.counter = true
+		case "histogram", "summary":
+			if strings.HasSuffix(s.name, "_bucket") {
+				continue
+			}
+			s.counter = strings.HasSuffix(s.name, "_sum") || strings.HasSuffix(s.name, "_count")
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// parsePrometheusSample parses a line of a sample: <name>[{<label>="<value>",...}] <value> [<timestamp>]
+func parsePrometheusSample(line string) (prometheusSample, error) {
+	var s prometheusSample
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return s, fmt.Errorf("no value")
+	}
+	s.name = line[:i]
+	rest := line[i:]
+	if rest[0] == '{' {
+		var err error
+		s.labels, rest, err = parsePrometheusLabels(rest[1:])
+		if err != nil {
+			return s, err
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("no value")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, err
+	}
+	s.value = value
+	return s, nil
+}
+
+// parsePrometheusLabels parses the labels after "{", and returns the values and the rest after "}"
+func parsePrometheusLabels(text string) ([]string, string, error) {
+	var values []string
+	for {
+		text = strings.TrimLeft(text, " \t,")
+		if text == "" {
+			return nil, "", fmt.Errorf("unterminated labels")
+		}
+		if text[0] == '}' {
+			return values, text[1:], nil
+		}
+		eq := strings.Index(text, "=")
+		if eq <= 0 || len(text) < eq+2 || text[eq+1] != '"' {
+			return nil, "", fmt.Errorf("invalid label")
+		}
+		text = text[eq+2:]
+		var value []byte
+		closed := false
+		for j := 0; j < len(text); j++ {
+			c := text[j]
+			if c == '\\' && j+1 < len(text) {
+				j++
+				if text[j] == 'n' {
+					value = append(value, '\n')
+				} else {
+					value = append(value, text[j])
+				}
+				continue
+			}
+			if c == '"' {
+				text = text[j+1:]
+				closed = true
+				break
+			}
+			value = append(value, c)
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("unterminated label value")
+		}
+		values = append(values, string(value))
+	}
+}
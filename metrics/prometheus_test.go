@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+const testPrometheusText = `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="get",code="400"} 3 1395066363000
+# TYPE temperature gauge
+temperature{room="a \"b\", c"} 21.5
+up 1
+not_a_number NaN
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 10
+latency_seconds_bucket{le="+Inf"} 12
+latency_seconds_sum 3.5
+latency_seconds_count 12
+`
+
+func TestParsePrometheusText(t *testing.T) {
+	samples, err := parsePrometheusText(strings.NewReader(testPrometheusText))
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	expected := []prometheusSample{
+		{name: "http_requests_total", labels: []string{"post", "200"}, value: 1027, counter: true},
+		{name: "http_requests_total", labels: []string{"get", "400"}, value: 3, counter: true},
+		{name: "temperature", labels: []string{`a "b", c`}, value: 21.5},
+		{name: "up", value: 1},
+		{name: "latency_seconds_sum", value: 3.5, counter: true},
+		{name: "latency_seconds_count", value: 12, counter: true},
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("samples should be %v but %v", expected, samples)
+	}
+
+	for _, line := range []string{"novalue", `broken{label="x} 1`, `broken{label=x} 1`, "value abc"} {
+		if _, err := parsePrometheusText(strings.NewReader(line)); err == nil {
+			t.Errorf("%q should be invalid", line)
+		}
+	}
+}
+
+func TestPrometheusGenerator(t *testing.T) {
+	requests := 1027
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Replace(testPrometheusText, "1027", fmt.Sprint(requests), 1))
+	}))
+	defer ts.Close()
+
+	g, err := NewPrometheusGenerator("app", config.PluginConfig{
+		URL:     ts.URL,
+		Exclude: "^latency",
+		Relabel: []config.Relabel{{Regex: `^http_requests_total\.(\w+)_(\d+)$`, Replacement: "requests.${1}_$2"}, {Regex: "^up.*", Replacement: ""}},
+	})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	payloads, err := g.PrepareGraphDefs()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if len(payloads) != 2 || payloads[0].Name != "custom.prometheus.app.requests" || payloads[1].Name != "custom.prometheus.app.temperature" {
+		t.Errorf("graphs should be defined for each metric: %v", payloads)
+	}
+	if payloads[0].Metrics[0].Name != "custom.prometheus.app.requests.*" {
+		t.Errorf("the metrics of the graph should be a wildcard: %v", payloads[0].Metrics)
+	}
+
+	pg := g.(*prometheusGenerator)
+	samples, _ := pg.scrape()
+	now := time.Now()
+	values := pg.convert(samples, now)
+	expected := Values{"custom.prometheus.app.temperature.a__b___c": 21.5}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("values should be %v but %v", expected, values)
+	}
+
+	requests = 1087
+	samples, _ = pg.scrape()
+	values = pg.convert(samples, now.Add(time.Minute))
+	if values["custom.prometheus.app.requests.post_200"] != 1 || values["custom.prometheus.app.requests.get_400"] != 0 {
+		t.Errorf("the counters should be converted into the rates: %v", values)
+	}
+
+	pg.Reset()
+	values = pg.convert(samples, now.Add(2*time.Minute))
+	if _, ok := values["custom.prometheus.app.requests.post_200"]; ok {
+		t.Errorf("the rates should not be available after Reset: %v", values)
+	}
+
+	if _, err := NewPrometheusGenerator("app", config.PluginConfig{URL: ts.URL, Include: "("}); err == nil {
+		t.Errorf("should raise error for the invalid include")
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// relabelRule is the compiled config.Relabel
+type relabelRule struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
+func compileRelabelRules(rules []config.Relabel) ([]relabelRule, error) {
+	var compiled []relabelRule
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex of relabel: %s", err)
+		}
+		compiled = append(compiled, relabelRule{regex: re, replacement: r.Replacement})
+	}
+	return compiled, nil
+}
+
+// relabel renames the metric by the rules in order, and returns "" if the metric is dropped
+func relabel(rules []relabelRule, name string) string {
+	for _, r := range rules {
+		name = r.regex.ReplaceAllString(name, r.replacement)
+	}
+	return name
+}
@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+)
+
+var samplingLogger = logging.GetLogger("metrics.sampling")
+
+// defaultSamplingIdleTimeout is the time after which the sampling stops when the values are not taken,
+// e.g. the generator has been discarded without Stop.
+const defaultSamplingIdleTimeout = 5 * time.Minute
+
+// samplingGenerator samples the values of the generator every interval in the background,
+// and generates the values aggregated since the previous invocation of Generate.
+// It implements Background, so the sampling is stopped when the generator is discarded by the reload.
+type samplingGenerator struct {
+	generator   Generator
+	interval    time.Duration
+	aggregate   func(a *aggregation) float64
+	idleTimeout time.Duration
+
+	genMu sync.Mutex // serializes the invocations of generator by the sampling and Generate
+
+	mu      sync.Mutex
+	buckets map[string]*aggregation
+	taken   time.Time // the last invocation of Generate
+	running bool
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewSamplingGenerator returns the generator sampling g every interval, whose values are aggregated per collection
+// by aggregationName ("avg", "max" or "min"). The sampling starts by Start or at the first invocation of Generate,
+// which generates the values of g directly if no values are sampled yet, and stops by Stop.
+func NewSamplingGenerator(g Generator, interval time.Duration, aggregationName string) Generator {
+	aggregate, ok := aggregateFuncs[aggregationName]
+	if !ok {
+		aggregate = aggregateFuncs["avg"]
+	}
+	return &samplingGenerator{
+		generator:   g,
+		interval:    interval,
+		aggregate:   aggregate,
+		idleTimeout: defaultSamplingIdleTimeout,
+		buckets:     make(map[string]*aggregation),
+	}
+}
+
+// Start implements Background, starting the sampling
+func (g *samplingGenerator) Start() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stopped = false
+	g.taken = time.Now()
+	g.start()
+}
+
+// Stop implements Background, stopping the sampling and waiting for it
+func (g *samplingGenerator) Stop() {
+	g.mu.Lock()
+	g.stopped = true
+	if g.running {
+		g.running = false
+		close(g.stop)
+	}
+	done := g.done
+	g.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// start starts the sampling if it is not running. The caller must hold g.mu.
+func (g *samplingGenerator) start() {
+	if g.running || g.stopped {
+		return
+	}
+	g.running = true
+	g.stop = make(chan struct{})
+	g.done = make(chan struct{})
+	go g.run(g.stop, g.done)
+}
+
+// Generate returns the values aggregated since the previous invocation, starting the sampling if it is not running
+func (g *samplingGenerator) Generate() (Values, error) {
+	g.mu.Lock()
+	buckets := g.buckets
+	g.buckets = make(map[string]*aggregation)
+	g.taken = time.Now()
+	g.start()
+	g.mu.Unlock()
+
+	if len(buckets) == 0 {
+		return g.sample()
+	}
+	results := make(Values, len(buckets))
+	for key, a := range buckets {
+		results[key] = g.aggregate(a)
+	}
+	return results, nil
+}
+
+// sample generates the values of the generator, which is not invoked concurrently
+func (g *samplingGenerator) sample() (Values, error) {
+	g.genMu.Lock()
+	defer g.genMu.Unlock()
+	return g.generator.Generate()
+}
+
+// run samples the values until stop is closed or they are not taken for idleTimeout, and closes done
+func (g *samplingGenerator) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for {
+		start := time.Now()
+		values, err := g.sample()
+		if err != nil {
+			samplingLogger.Warningf("Failed to sample %s: %s", g, err)
+		}
+
+		g.mu.Lock()
+		select {
+		case <-stop:
+			g.mu.Unlock()
+			return
+		default:
+		}
+		for key, value := range values {
+			a, ok := g.buckets[key]
+			if !ok {
+				a = &aggregation{}
+				g.buckets[key] = a
+			}
+			a.add(value)
+		}
+		idle := time.Since(g.taken) > g.idleTimeout
+		if idle {
+			g.running = false
+			g.buckets = make(map[string]*aggregation)
+		}
+		g.mu.Unlock()
+		if idle {
+			samplingLogger.Debugf("Stopped sampling %s because the values are not taken", g)
+			return
+		}
+
+		// the generators of the deltas take the interval by themselves
+		if d := g.interval - time.Since(start); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-stop:
+				t.Stop()
+				return
+			}
+		}
+	}
+}
+
+func (g *samplingGenerator) String() string {
+	if s, ok := g.generator.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", g.generator)
+}
+
+// Reset implements Resetter, discarding the values sampled before the suspension
+func (g *samplingGenerator) Reset() {
+	g.mu.Lock()
+	g.buckets = make(map[string]*aggregation)
+	g.mu.Unlock()
+	if r, ok := g.generator.(Resetter); ok {
+		g.genMu.Lock()
+		r.Reset()
+		g.genMu.Unlock()
+	}
+}
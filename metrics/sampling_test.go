@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// sequenceGenerator generates the values in order, repeating the last one
+type sequenceGenerator struct {
+	mu     sync.Mutex
+	values []float64
+}
+
+func (g *sequenceGenerator) Generate() (Values, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v := g.values[0]
+	if len(g.values) > 1 {
+		g.values = g.values[1:]
+	}
+	return Values{"cpu.user.percentage": v}, nil
+}
+
+func TestSamplingGenerator(t *testing.T) {
+	g := NewSamplingGenerator(&sequenceGenerator{values: []float64{5, 10, 90, 20}}, 10*time.Millisecond, "max")
+	defer g.(Background).Stop()
+
+	// no values are sampled at the first invocation
+	values, err := g.Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if values["cpu.user.percentage"] != 5 {
+		t.Errorf("the values should be generated directly at first: %v", values)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	values, _ = g.Generate()
+	if values["cpu.user.percentage"] != 90 {
+		t.Errorf("the max of the sampled values should be generated: %v", values)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	values, _ = g.Generate()
+	if values["cpu.user.percentage"] != 20 {
+		t.Errorf("the values sampled since the previous invocation should be aggregated: %v", values)
+	}
+}
+
+func TestSamplingGenerator_idle(t *testing.T) {
+	g := NewSamplingGenerator(&sequenceGenerator{values: []float64{1}}, 10*time.Millisecond, "avg").(*samplingGenerator)
+	g.idleTimeout = 30 * time.Millisecond
+	defer g.Stop()
+	g.Generate()
+	time.Sleep(100 * time.Millisecond)
+
+	g.mu.Lock()
+	running := g.running
+	g.mu.Unlock()
+	if running {
+		t.Error("the sampling should stop when the values are not taken")
+	}
+}
+
+func TestSamplingGenerator_stop(t *testing.T) {
+	inner := &sequenceGenerator{values: []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}
+	g := NewSamplingGenerator(inner, 10*time.Millisecond, "avg").(*samplingGenerator)
+	g.Start()
+	time.Sleep(30 * time.Millisecond)
+	g.Stop()
+
+	inner.mu.Lock()
+	remaining := len(inner.values)
+	inner.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	inner.mu.Lock()
+	defer inner.mu.Unlock()
+	if len(inner.values) != remaining {
+		t.Error("the sampling should stop by Stop")
+	}
+
+	g.mu.Lock()
+	running := g.running
+	g.mu.Unlock()
+	if running {
+		t.Error("the sampling should not be running after Stop")
+	}
+}
@@ -0,0 +1,232 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+)
+
+var statsdLogger = logging.GetLogger("metrics.statsd")
+
+// DefaultStatsdPrefix is the prefix of the metric names translated from StatsD by default
+const DefaultStatsdPrefix = "custom.statsd"
+
+// StatsdGenerator listens on the StatsD port (both UDP and TCP) and translates the received
+// counters, gauges, timers and sets into the metrics:
+//
+//	<prefix>.counters.<name>                         the sum of the counts in the collection cycle
+//	<prefix>.gauges.<name>                           the last value, kept across the cycles
+//	<prefix>.timers.<name>.{count,mean,min,max,p90}  the statistics of the timings in the cycle
+//	<prefix>.sets.<name>                             the number of the unique values in the cycle
+type StatsdGenerator struct {
+	Prefix string
+
+	address string
+	udp     net.PacketConn
+	tcp     net.Listener
+
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string][]float64
+	sets     map[string]map[string]bool
+}
+
+// NewStatsdGenerator starts listening on the address, and returns the generator of the received metrics.
+func NewStatsdGenerator(address, prefix string) (*StatsdGenerator, error) {
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = DefaultStatsdPrefix
+	}
+	g := &StatsdGenerator{
+		Prefix:   prefix,
+		address:  address,
+		udp:      udp,
+		tcp:      tcp,
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		timers:   make(map[string][]float64),
+		sets:     make(map[string]map[string]bool),
+	}
+	go g.serveUDP()
+	go g.serveTCP()
+	statsdLogger.Infof("Listening StatsD on %s", address)
+	return g, nil
+}
+
+// Address returns the address the generator listens on, as given to NewStatsdGenerator.
+func (g *StatsdGenerator) Address() string {
+	return g.address
+}
+
+// Close stops listening.
+func (g *StatsdGenerator) Close() error {
+	err := g.udp.Close()
+	if e := g.tcp.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (g *StatsdGenerator) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := g.udp.ReadFrom(buf)
+		if err != nil {
+			if isClosedError(err) {
+				return
+			}
+			statsdLogger.Warningf("Failed to read StatsD packet: %s", err)
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			g.handleLine(line)
+		}
+	}
+}
+
+func (g *StatsdGenerator) serveTCP() {
+	for {
+		conn, err := g.tcp.Accept()
+		if err != nil {
+			if isClosedError(err) {
+				return
+			}
+			statsdLogger.Warningf("Failed to accept StatsD connection: %s", err)
+			continue
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				g.handleLine(scanner.Text())
+			}
+		}(conn)
+	}
+}
+
+func isClosedError(err error) bool {
+	// net.ErrClosed is not available in old Go
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+func (g *StatsdGenerator) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if err := g.parseLine(line); err != nil {
+		statsdLogger.Debugf("Ignoring invalid StatsD line %q: %s", line, err)
+	}
+}
+
+var statsdInvalidChars = regexp.MustCompile(`[^-a-zA-Z0-9_.]`)
+
+// parseLine parses the line of the form "<name>:<value>|<type>[|@<sample rate>][|#<tags>]".
+// Multiple values can be given in a line separated by ":".
+func (g *StatsdGenerator) parseLine(line string) error {
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return fmt.Errorf("no value")
+	}
+	name := statsdInvalidChars.ReplaceAllString(line[:i], "_")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, sample := range strings.Split(line[i+1:], ":") {
+		fields := strings.Split(sample, "|")
+		if len(fields) < 2 {
+			return fmt.Errorf("no type")
+		}
+		value, typ := fields[0], fields[1]
+		rate := 1.0
+		for _, f := range fields[2:] {
+			if strings.HasPrefix(f, "@") {
+				r, err := strconv.ParseFloat(f[1:], 64)
+				if err != nil || r <= 0 || r > 1 {
+					return fmt.Errorf("invalid sample rate %q", f)
+				}
+				rate = r
+			}
+		}
+
+		if typ == "s" {
+			if g.sets[name] == nil {
+				g.sets[name] = make(map[string]bool)
+			}
+			g.sets[name][value] = true
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("invalid value %q", value)
+		}
+		switch typ {
+		case "c":
+			g.counters[name] += v / rate
+		case "g":
+			if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+				g.gauges[name] += v
+			} else {
+				g.gauges[name] = v
+			}
+		case "ms", "h":
+			g.timers[name] = append(g.timers[name], v)
+		default:
+			return fmt.Errorf("unknown type %q", typ)
+		}
+	}
+	return nil
+}
+
+// Generate returns the metrics received since the previous invocation.
+func (g *StatsdGenerator) Generate() (Values, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	values := Values{}
+	for name, count := range g.counters {
+		values[g.Prefix+".counters."+name] = count
+		// the counters are reported as 0 while they are not incremented
+		g.counters[name] = 0
+	}
+	for name, v := range g.gauges {
+		values[g.Prefix+".gauges."+name] = v
+	}
+	for name, timings := range g.timers {
+		sort.Float64s(timings)
+		sum := 0.0
+		for _, t := range timings {
+			sum += t
+		}
+		n := len(timings)
+		prefix := g.Prefix + ".timers." + name
+		values[prefix+".count"] = float64(n)
+		values[prefix+".mean"] = sum / float64(n)
+		values[prefix+".min"] = timings[0]
+		values[prefix+".max"] = timings[n-1]
+		values[prefix+".p90"] = timings[int(math.Ceil(float64(n)*0.9))-1]
+	}
+	g.timers = make(map[string][]float64)
+	for name, set := range g.sets {
+		values[g.Prefix+".sets."+name] = float64(len(set))
+	}
+	g.sets = make(map[string]map[string]bool)
+	return values, nil
+}
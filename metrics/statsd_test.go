@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestStatsdGenerator(t *testing.T) *StatsdGenerator {
+	g, err := NewStatsdGenerator("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	return g
+}
+
+func TestStatsdGenerator_parseLine(t *testing.T) {
+	g := newTestStatsdGenerator(t)
+	defer g.Close()
+
+	for _, line := range []string{
+		"app.requests:1|c",
+		"app.requests:2|c|@0.5",
+		"app.requests:1|c:1|c",
+		"app.temperature:20|g",
+		"app.temperature:+5|g",
+		"app.latency:100|ms",
+		"app.latency:300|ms|#region:tokyo",
+		"app.latency:200|ms",
+		"app.users:alice|s",
+		"app.users:bob|s",
+		"app.users:alice|s",
+		"app/invalid name:1|c",
+	} {
+		g.handleLine(line)
+	}
+	for _, line := range []string{"novalue", "app.x:1", "app.x:abc|c", "app.x:1|c|@2", "app.x:1|unknown"} {
+		if err := g.parseLine(line); err == nil {
+			t.Errorf("%q should be invalid", line)
+		}
+	}
+
+	values, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	expected := Values{
+		"custom.statsd.counters.app.requests":     7,
+		"custom.statsd.counters.app_invalid_name": 1,
+		"custom.statsd.gauges.app.temperature":    25,
+		"custom.statsd.timers.app.latency.count":  3,
+		"custom.statsd.timers.app.latency.mean":   200,
+		"custom.statsd.timers.app.latency.min":    100,
+		"custom.statsd.timers.app.latency.max":    300,
+		"custom.statsd.timers.app.latency.p90":    300,
+		"custom.statsd.sets.app.users":            2,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("values should be %v but %v", expected, values)
+	}
+
+	values, _ = g.Generate()
+	expected = Values{
+		"custom.statsd.counters.app.requests":     0,
+		"custom.statsd.counters.app_invalid_name": 0,
+		"custom.statsd.gauges.app.temperature":    25,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("counters should be reset and gauges should be kept: %v", values)
+	}
+}
+
+func TestStatsdGenerator_listen(t *testing.T) {
+	g := newTestStatsdGenerator(t)
+	defer g.Close()
+
+	udp, err := net.Dial("udp", g.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer udp.Close()
+	udp.Write([]byte("udp.count:1|c\nudp.gauge:3|g"))
+
+	tcp, err := net.Dial("tcp", g.tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	tcp.Write([]byte("tcp.count:2|c\n"))
+	tcp.Close()
+
+	expected := Values{
+		"custom.statsd.counters.udp.count": 1,
+		"custom.statsd.gauges.udp.gauge":   3,
+		"custom.statsd.counters.tcp.count": 2,
+	}
+	received := Values{}
+	for i := 0; i < 100 && len(received) < len(expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+		values, _ := g.Generate()
+		for k, v := range values {
+			if v != 0 {
+				received[k] = v
+			}
+		}
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("values should be %v but %v", expected, received)
+	}
+}
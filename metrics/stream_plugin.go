@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// streamPluginGenerator collects user-defined metrics from a plugin command which keeps running
+// and outputs metric lines continuously on its stdout.
+// The values received between two invocations of Generate() are aggregated into one value per metric.
+type streamPluginGenerator struct {
+	*pluginGenerator
+
+	aggregate func(a *aggregation) float64
+
+	mu      sync.Mutex
+	buckets map[string]*aggregation
+
+	runMu sync.Mutex
+	stop  context.CancelFunc // stops the running command, nil if not running
+	done  chan struct{}      // closed when the command has stopped
+}
+
+// aggregation holds the statistics of the values of a metric received in a collection cycle
+type aggregation struct {
+	count int
+	sum   float64
+	min   float64
+	max   float64
+	last  float64
+}
+
+func (a *aggregation) add(value float64) {
+	if a.count == 0 {
+		a.min, a.max = value, value
+	}
+	a.count++
+	a.sum += value
+	a.min = math.Min(a.min, value)
+	a.max = math.Max(a.max, value)
+	a.last = value
+}
+
+var aggregateFuncs = map[string]func(a *aggregation) float64{
+	"last":  func(a *aggregation) float64 { return a.last },
+	"sum":   func(a *aggregation) float64 { return a.sum },
+	"avg":   func(a *aggregation) float64 { return a.sum / float64(a.count) },
+	"min":   func(a *aggregation) float64 { return a.min },
+	"max":   func(a *aggregation) float64 { return a.max },
+	"count": func(a *aggregation) float64 { return float64(a.count) },
+}
+
+const defaultAggregation = "last"
+
+// Interval before restarting the stream plugin command which has exited.
+var streamPluginRestartInterval = 10 * time.Second
+
+func newStreamPluginGenerator(conf config.PluginConfig) *streamPluginGenerator {
+	name := conf.Aggregation
+	if name == "" {
+		name = defaultAggregation
+	}
+	aggregate, ok := aggregateFuncs[name]
+	if !ok {
+		pluginLogger.Warningf("Unknown aggregation %q for command %q. %q is used instead.", name, conf.Command, defaultAggregation)
+		aggregate = aggregateFuncs[defaultAggregation]
+	}
+	return &streamPluginGenerator{
+		pluginGenerator: newPluginGenerator(conf),
+		aggregate:       aggregate,
+		buckets:         make(map[string]*aggregation),
+	}
+}
+
+// Generate returns the values aggregated since the previous invocation.
+// The values are received while the plugin command is started by Start.
+func (g *streamPluginGenerator) Generate() (Values, error) {
+	g.mu.Lock()
+	buckets := g.buckets
+	g.buckets = make(map[string]*aggregation)
+	g.mu.Unlock()
+
+	if !g.conditionSatisfied() {
+		pluginLogger.Debugf("Discarded the values of stream plugin %q because the condition is not satisfied", g.Config.Command)
+		return Values{}, nil
+	}
+
+	results := make(Values, len(buckets))
+	for key, a := range buckets {
+		results[key] = g.aggregate(a)
+	}
+	return results, nil
+}
+
+func (g *streamPluginGenerator) add(key string, value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	a, ok := g.buckets[key]
+	if !ok {
+		a = &aggregation{}
+		g.buckets[key] = a
+	}
+	a.add(value)
+}
+
+// Start implements Background, starting the plugin command which is kept running until Stop.
+func (g *streamPluginGenerator) Start() {
+	g.runMu.Lock()
+	defer g.runMu.Unlock()
+	if g.stop != nil {
+		return
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	g.stop, g.done = stop, done
+	go func() {
+		defer close(done)
+		g.run(ctx)
+	}()
+}
+
+// Stop implements Background, killing the plugin command with its descendants and waiting for it to exit.
+// It can be started again by Start.
+func (g *streamPluginGenerator) Stop() {
+	g.runMu.Lock()
+	defer g.runMu.Unlock()
+	if g.stop == nil {
+		return
+	}
+	g.stop()
+	<-g.done
+	g.stop, g.done = nil, nil
+	pluginLogger.Debugf("Stream plugin %q stopped", g.Config.Command)
+}
+
+// run keeps the plugin command running and reads the metric lines from it until ctx is done.
+func (g *streamPluginGenerator) run(ctx context.Context) {
+	command := g.Config.Command
+	for {
+		pluginLogger.Debugf("Starting stream plugin: command = %q", command)
+		err := g.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			pluginLogger.Errorf("Stream plugin %q stopped: %s", command, err)
+		} else {
+			pluginLogger.Warningf("Stream plugin %q exited", command)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(streamPluginRestartInterval):
+		}
+	}
+}
+
+// stream runs the plugin command in its own process group, which is killed when ctx is done.
+func (g *streamPluginGenerator) stream(ctx context.Context) error {
+	cmd, err := util.NewCommandWithEnv(g.Config.Command, g.Config.User, g.Config.EnvList())
+	if err != nil {
+		return err
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, pluginConfigurationEnvName+"=")
+	util.SetCommandGroup(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := util.StartCommand(cmd, g.Config.User); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			util.KillCommandGroup(cmd)
+			// the descendants which have left the process group may keep the output open
+			stdout.Close()
+		case <-exited:
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := parsePluginLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		if key = g.rename(key); key == "" {
+			continue
+		}
+		g.add(key, value)
+	}
+	if err := scanner.Err(); err != nil {
+		util.KillCommandGroup(cmd)
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
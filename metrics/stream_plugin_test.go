@@ -0,0 +1,101 @@
+// +build linux darwin freebsd netbsd
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestStreamPluginGenerate(t *testing.T) {
+	g := NewPluginGenerator(config.PluginConfig{
+		Command:     "printf 'stream.a\t1\t1397822016\nstream.a\t3\t1397822016\nstream.b\t5\t1397822016\n'; sleep 5",
+		Stream:      true,
+		Aggregation: "sum",
+	})
+	if _, ok := g.(*streamPluginGenerator); !ok {
+		t.Fatalf("stream plugin generator should be created but %T", g)
+	}
+	g.(Background).Start()
+	defer g.(Background).Stop()
+
+	// wait for the plugin to output the lines
+	received := func() int {
+		sg := g.(*streamPluginGenerator)
+		sg.mu.Lock()
+		defer sg.mu.Unlock()
+		return len(sg.buckets)
+	}
+	for i := 0; i < 50 && received() < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	values, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if values["custom.stream.a"] != 4 {
+		t.Errorf("custom.stream.a should be summed up to 4 but %v", values["custom.stream.a"])
+	}
+	if values["custom.stream.b"] != 5 {
+		t.Errorf("custom.stream.b should be 5 but %v", values["custom.stream.b"])
+	}
+
+	values, _ = g.Generate()
+	if len(values) != 0 {
+		t.Errorf("values should be reset after Generate() but %v", values)
+	}
+}
+
+func TestStreamPluginStop(t *testing.T) {
+	g := newStreamPluginGenerator(config.PluginConfig{
+		Command: "sleep 60 & sleep 60",
+		Stream:  true,
+	})
+	g.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		g.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop should kill the command with its descendants")
+	}
+
+	if _, err := g.Generate(); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	g.runMu.Lock()
+	defer g.runMu.Unlock()
+	if g.stop != nil {
+		t.Error("Generate should not start the command stopped")
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	a := &aggregation{}
+	for _, v := range []float64{3, 1, 2} {
+		a.add(v)
+	}
+
+	expected := map[string]float64{
+		"last":  2,
+		"sum":   6,
+		"avg":   2,
+		"min":   1,
+		"max":   3,
+		"count": 3,
+	}
+	for name, value := range expected {
+		if got := aggregateFuncs[name](a); got != value {
+			t.Errorf("%s should be %v but %v", name, value, got)
+		}
+	}
+}
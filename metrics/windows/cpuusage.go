@@ -3,24 +3,48 @@
 package windows
 
 import (
+	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/mackerelio/mackerel-agent/logging"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	"github.com/mackerelio/mackerel-agent/util/windows"
 )
 
+/*
+collect CPU usage
+
+`cpu.{metric}.percentage`: The CPU time in the interval as percentage of total CPU cores x 100, the same as linux
+
+metric = "user", "system", "idle", "irq" (% Interrupt Time) and "softirq" (% DPC Time)
+
+"system" excludes the interrupts and the DPCs, which are included in "% Privileged Time",
+so that the metrics are stacked up to the number of the cores x 100.
+*/
+
 // CPUUsageGenerator is struct of windows api
 type CPUUsageGenerator struct {
+	Interval time.Duration
 	query    syscall.Handle
 	counters []*windows.CounterInfo
 }
 
-var cpuUsageLogger = logging.GetLogger("cpu.user.percentage")
+var cpuUsageLogger = logging.GetLogger("metrics.cpuUsage")
+
+var cpuUsageCounters = []struct {
+	name, path string
+}{
+	{"user", `\Processor(_Total)\% User Time`},
+	{"privileged", `\Processor(_Total)\% Privileged Time`},
+	{"idle", `\Processor(_Total)\% Idle Time`},
+	{"interrupt", `\Processor(_Total)\% Interrupt Time`},
+	{"dpc", `\Processor(_Total)\% DPC Time`},
+}
 
 // NewCPUUsageGenerator is set up windows api
-func NewCPUUsageGenerator() (*CPUUsageGenerator, error) {
-	g := &CPUUsageGenerator{0, nil}
+func NewCPUUsageGenerator(interval time.Duration) (*CPUUsageGenerator, error) {
+	g := &CPUUsageGenerator{interval, 0, nil}
 
 	var err error
 	g.query, err = windows.CreateQuery()
@@ -28,52 +52,43 @@ func NewCPUUsageGenerator() (*CPUUsageGenerator, error) {
 		cpuUsageLogger.Criticalf(err.Error())
 		return nil, err
 	}
-	var counter *windows.CounterInfo
-
-	counter, err = windows.CreateCounter(g.query, "cpu.user.percentage", `\Processor(_Total)\% User Time`)
-	if err != nil {
-		cpuUsageLogger.Criticalf(err.Error())
-		return nil, err
-	}
-	g.counters = append(g.counters, counter)
 
-	counter, err = windows.CreateCounter(g.query, "cpu.system.percentage", `\Processor(_Total)\% Privileged Time`)
-	if err != nil {
-		cpuUsageLogger.Criticalf(err.Error())
-		return nil, err
-	}
-	g.counters = append(g.counters, counter)
-
-	counter, err = windows.CreateCounter(g.query, "cpu.idle.percentage", `\Processor(_Total)\% Idle Time`)
-	if err != nil {
-		cpuUsageLogger.Criticalf(err.Error())
-		return nil, err
+	for _, c := range cpuUsageCounters {
+		counter, err := windows.CreateCounter(g.query, c.name, c.path)
+		if err != nil {
+			cpuUsageLogger.Criticalf(err.Error())
+			return nil, err
+		}
+		g.counters = append(g.counters, counter)
 	}
-	g.counters = append(g.counters, counter)
 	return g, nil
 }
 
 // Generate XXX
 func (g *CPUUsageGenerator) Generate() (metrics.Values, error) {
-
-	r, _, err := windows.PdhCollectQueryData.Call(uintptr(g.query))
-	if r != 0 && err != nil {
-		if r == windows.PDH_NO_DATA {
-			cpuUsageLogger.Infof("this metric has not data. ")
-			return nil, err
-		}
+	raw, err := collectCounterValues(g.query, g.counters, g.Interval, cpuUsageLogger)
+	if err != nil {
 		return nil, err
 	}
-
-	results := make(map[string]float64)
-	for _, v := range g.counters {
-		results[v.PostName], err = windows.GetCounterValue(v.Counter)
-		if err != nil {
-			return nil, err
-		}
-	}
+	results := cpuUsageValues(raw, runtime.NumCPU())
 
 	cpuUsageLogger.Debugf("cpuusage: %q", results)
 
 	return results, nil
 }
+
+// cpuUsageValues converts the percentages of the counters averaged among the cores into the metrics
+func cpuUsageValues(raw metrics.Values, cpuCount int) metrics.Values {
+	system := raw["privileged"] - raw["interrupt"] - raw["dpc"]
+	if system < 0 {
+		system = 0
+	}
+	scale := float64(cpuCount)
+	return metrics.Values{
+		"cpu.user.percentage":    raw["user"] * scale,
+		"cpu.system.percentage":  system * scale,
+		"cpu.idle.percentage":    raw["idle"] * scale,
+		"cpu.irq.percentage":     raw["interrupt"] * scale,
+		"cpu.softirq.percentage": raw["dpc"] * scale,
+	}
+}
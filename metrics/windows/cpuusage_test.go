@@ -4,15 +4,18 @@ package windows
 
 import "math"
 import "testing"
+import "time"
 
 var cpuUsageMetricNames = []string{
 	"cpu.user.percentage",
 	"cpu.idle.percentage",
 	"cpu.system.percentage",
+	"cpu.irq.percentage",
+	"cpu.softirq.percentage",
 }
 
 func TestCPUUsageGenerate(t *testing.T) {
-	g, err := NewCPUUsageGenerator()
+	g, err := NewCPUUsageGenerator(1 * time.Second)
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -57,3 +60,30 @@ func TestCPUUsageGenerate(t *testing.T) {
 
 	g.Generate()
 }
+
+func TestCPUUsageValues(t *testing.T) {
+	values := cpuUsageValues(map[string]float64{
+		"user":       20,
+		"privileged": 15,
+		"idle":       65,
+		"interrupt":  3,
+		"dpc":        2,
+	}, 4)
+	expected := map[string]float64{
+		"cpu.user.percentage":    80,
+		"cpu.system.percentage":  40,
+		"cpu.idle.percentage":    260,
+		"cpu.irq.percentage":     12,
+		"cpu.softirq.percentage": 8,
+	}
+	sum := float64(0)
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("%s should be %f but %f", name, value, values[name])
+		}
+		sum += values[name]
+	}
+	if sum != 400 {
+		t.Errorf("the percentages should be stacked up to the number of the cores x 100 but %f", sum)
+	}
+}
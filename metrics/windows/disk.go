@@ -74,40 +74,16 @@ func NewDiskGenerator(interval time.Duration) (*DiskGenerator, error) {
 		}
 	}
 
-	r, _, err = windows.PdhCollectQueryData.Call(uintptr(g.query))
-	if r != 0 && err != nil {
-		if r == windows.PDH_NO_DATA {
-			diskLogger.Infof("this metric has not data. ")
-			return nil, err
-		}
-		diskLogger.Criticalf(err.Error())
-		return nil, err
-	}
-
 	return g, nil
 }
 
 // Generate XXX
 func (g *DiskGenerator) Generate() (metrics.Values, error) {
-	time.Sleep(g.Interval)
-
-	r, _, err := windows.PdhCollectQueryData.Call(uintptr(g.query))
-	if r != 0 && err != nil {
-		if r == windows.PDH_NO_DATA {
-			diskLogger.Infof("this metric has not data. ")
-			return nil, err
-		}
+	results, err := collectCounterValues(g.query, g.counters, g.Interval, diskLogger)
+	if err != nil {
 		return nil, err
 	}
 
-	results := make(map[string]float64)
-	for _, v := range g.counters {
-		results[v.PostName], err = windows.GetCounterValue(v.Counter)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	diskLogger.Debugf("%q", results)
 	return results, nil
 }
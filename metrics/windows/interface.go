@@ -47,9 +47,9 @@ func NewInterfaceGenerator(interval time.Duration) (*InterfaceGenerator, error)
 	}
 
 	for _, ifi := range ifs {
-		for ; ai != nil; ai = ai.Next {
-			if ifi.Index == int(ai.Index) {
-				name := windows.BytePtrToString(&ai.Description[0])
+		for a := ai; a != nil; a = a.Next {
+			if ifi.Index == int(a.Index) {
+				name := windows.BytePtrToString(&a.Description[0])
 				name = strings.Replace(name, "(", "[", -1)
 				name = strings.Replace(name, ")", "]", -1)
 				name = strings.Replace(name, "#", "_", -1)
@@ -77,42 +77,16 @@ func NewInterfaceGenerator(interval time.Duration) (*InterfaceGenerator, error)
 		}
 	}
 
-	r, _, err := windows.PdhCollectQueryData.Call(uintptr(g.query))
-	if r != 0 && err != nil {
-		if r == windows.PDH_NO_DATA {
-			interfaceLogger.Infof("this metric has not data. ")
-			return nil, err
-		}
-		interfaceLogger.Criticalf(err.Error())
-		return nil, err
-	}
-
 	return g, nil
 }
 
 // Generate XXX
 func (g *InterfaceGenerator) Generate() (metrics.Values, error) {
-
-	time.Sleep(g.Interval)
-
-	r, _, err := windows.PdhCollectQueryData.Call(uintptr(g.query))
-	if r != 0 && err != nil {
-		if r == windows.PDH_NO_DATA {
-			interfaceLogger.Infof("this metric has not data. ")
-			return nil, err
-		}
+	results, err := collectCounterValues(g.query, g.counters, g.Interval, interfaceLogger)
+	if err != nil {
 		return nil, err
 	}
 
-	results := make(map[string]float64)
-	for _, v := range g.counters {
-		results[v.PostName], err = windows.GetCounterValue(v.Counter)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	interfaceLogger.Debugf("%q", results)
-
 	return results, nil
 }
@@ -0,0 +1,48 @@
+// +build windows
+
+package windows
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util/windows"
+)
+
+// collectCounterValues collects the values of the counters in the query twice interval apart,
+// so that the rate counters (such as "Bytes Received/sec" and "% User Time") are the averages in
+// the interval, the same as the deltas per second and the percentages of the unix generators.
+func collectCounterValues(query syscall.Handle, counters []*windows.CounterInfo, interval time.Duration, logger *logging.Logger) (metrics.Values, error) {
+	if err := collectQueryData(query, logger); err != nil {
+		return nil, err
+	}
+
+	time.Sleep(interval)
+
+	if err := collectQueryData(query, logger); err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]float64)
+	for _, v := range counters {
+		var err error
+		results[v.PostName], err = windows.GetCounterValue(v.Counter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func collectQueryData(query syscall.Handle, logger *logging.Logger) error {
+	r, _, err := windows.PdhCollectQueryData.Call(uintptr(query))
+	if r != 0 && err != nil {
+		if r == windows.PDH_NO_DATA {
+			logger.Infof("this metric has not data. ")
+		}
+		return err
+	}
+	return nil
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/logging"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 // PluginGenerator XXX
@@ -36,6 +37,10 @@ func (g *PluginGenerator) Generate() (metrics.Values, error) {
 		pluginLogger.Criticalf(err.Error())
 		return nil, err
 	}
+	if !util.ConditionSatisfied(g.Config.Condition, g.Config.ConditionFile, g.Config.User) {
+		pluginLogger.Debugf("Skipped plugin %q because the condition is not satisfied", g.Config.Command)
+		return metrics.Values{}, nil
+	}
 	results, err := g.collectValues(g.Config.Command)
 	if err != nil {
 		pluginLogger.Criticalf(err.Error())
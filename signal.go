@@ -0,0 +1,18 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// toggleDiagnosticSignal toggles the diagnostic mode of the running agent.
+var toggleDiagnosticSignal os.Signal = syscall.SIGUSR1
+
+// dumpSignal makes the running agent write the diagnostics dump instead of terminating it.
+var dumpSignal os.Signal = syscall.SIGQUIT
+
+func notifySignals() []os.Signal {
+	return []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, toggleDiagnosticSignal, dumpSignal}
+}
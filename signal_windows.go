@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// toggleDiagnosticSignal is never delivered on Windows, which has no SIGUSR1.
+var toggleDiagnosticSignal os.Signal
+
+// dumpSignal is nil on Windows, where SIGQUIT terminates the agent as before.
+var dumpSignal os.Signal
+
+func notifySignals() []os.Signal {
+	return []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP}
+}
@@ -13,10 +13,15 @@ import (
 )
 
 // This Generator collects metadata about cloud instances.
-// Currently only EC2 is supported.
-// EC2: http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/AESDG-chapter-instancedata.html
+// Currently EC2, GCE, Azure, OCI, OpenStack, VMware vSphere and the tasks of Amazon ECS are supported.
+// EC2: http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/AESDG-chapter-instancedata.html (IMDSv2, see imds.go)
 // GCE: https://developers.google.com/compute/docs/metadata
+// Azure: https://docs.microsoft.com/azure/virtual-machines/windows/instance-metadata-service
 // DigitalOcean: https://developers.digitalocean.com/metadata/
+// OCI: see cloud_oci.go
+// OpenStack: see cloud_openstack.go
+// VMware vSphere: see cloud_vmware.go
+// Amazon ECS: see cloud_ecs.go
 
 // CloudGenerator definition
 type CloudGenerator struct {
@@ -36,11 +41,12 @@ func (g *CloudGenerator) Key() string {
 
 var cloudLogger = logging.GetLogger("spec.cloud")
 
-var ec2BaseURL, gceMetaURL, digitalOceanBaseURL *url.URL
+var ec2BaseURL, gceMetaURL, azureMetaURL, digitalOceanBaseURL *url.URL
 
 func init() {
 	ec2BaseURL, _ = url.Parse("http://169.254.169.254/latest/meta-data")
 	gceMetaURL, _ = url.Parse("http://metadata.google.internal/computeMetadata/v1/?recursive=true")
+	azureMetaURL, _ = url.Parse("http://169.254.169.254/metadata/instance?api-version=2017-08-01")
 	digitalOceanBaseURL, _ = url.Parse("http://169.254.169.254/metadata/v1") // has not been yet used
 }
 
@@ -48,22 +54,36 @@ var timeout = 100 * time.Millisecond
 
 // SuggestCloudGenerator returns suitable CloudGenerator
 func SuggestCloudGenerator() *CloudGenerator {
+	// the tasks of ECS on EC2 are detected prior to the instances they run on
+	if g := suggestECSGenerator(); g != nil {
+		return &CloudGenerator{g}
+	}
+	// OpenStack is detected prior to EC2 since its metadata service is compatible with EC2's
+	if g := suggestOpenStackGenerator(); g != nil {
+		return &CloudGenerator{g}
+	}
 	if isEC2() {
 		return &CloudGenerator{&EC2Generator{ec2BaseURL}}
 	}
 	if isGCE() {
 		return &CloudGenerator{&GCEGenerator{gceMetaURL}}
 	}
+	if isAzure() {
+		return &CloudGenerator{&AzureGenerator{azureMetaURL}}
+	}
+	if isOCI() {
+		return &CloudGenerator{&OCIGenerator{ociMetaURL}}
+	}
+	if g := suggestVMwareGenerator(); g != nil {
+		return &CloudGenerator{g}
+	}
 
 	return nil
 }
 
 func isEC2() bool {
-	cl := http.Client{
-		Timeout: timeout,
-	}
 	// '/ami-id` is may be aws specific URL
-	resp, err := cl.Get(ec2BaseURL.String() + "/ami-id")
+	resp, err := requestEC2Meta(ec2BaseURL, "ami-id")
 	if err != nil {
 		return false
 	}
@@ -73,15 +93,15 @@ func isEC2() bool {
 }
 
 func isGCE() bool {
-	_, err := requestGCEMeta()
+	_, err := requestGCEMeta(gceMetaURL)
 	return err == nil
 }
 
-func requestGCEMeta() ([]byte, error) {
+func requestGCEMeta(metaURL *url.URL) ([]byte, error) {
 	cl := http.Client{
 		Timeout: timeout,
 	}
-	req, err := http.NewRequest("GET", gceMetaURL.String(), nil)
+	req, err := http.NewRequest("GET", metaURL.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -106,10 +126,6 @@ type EC2Generator struct {
 
 // Generate collects metadata from cloud platform.
 func (g *EC2Generator) Generate() (interface{}, error) {
-	client := http.Client{
-		Timeout: timeout,
-	}
-
 	metadataKeys := []string{
 		"instance-id",
 		"instance-type",
@@ -128,7 +144,7 @@ func (g *EC2Generator) Generate() (interface{}, error) {
 	metadata := make(map[string]string)
 
 	for _, key := range metadataKeys {
-		resp, err := client.Get(g.baseURL.String() + "/" + key)
+		resp, err := requestEC2Meta(g.baseURL, key)
 		if err != nil {
 			cloudLogger.Debugf("This host may not be running on EC2. Error while reading '%s'", key)
 			return nil, nil
@@ -156,9 +172,7 @@ func (g *EC2Generator) Generate() (interface{}, error) {
 
 // SuggestCustomIdentifier suggests the identifier of the EC2 instance
 func (g *EC2Generator) SuggestCustomIdentifier() (string, error) {
-	client := http.Client{Timeout: timeout}
-	key := "instance-id"
-	resp, err := client.Get(g.baseURL.String() + "/" + key)
+	resp, err := requestEC2Meta(g.baseURL, "instance-id")
 	if err != nil {
 		return "", fmt.Errorf("Error while retrieving instance-id.")
 	}
@@ -184,15 +198,25 @@ type GCEGenerator struct {
 
 // Generate collects metadata from cloud platform.
 func (g *GCEGenerator) Generate() (interface{}, error) {
-	bytes, err := requestGCEMeta()
+	data, err := g.requestMeta()
 	if err != nil {
 		return nil, err
 	}
-	var data gceMeta
-	json.Unmarshal(bytes, &data)
 	return data.toGeneratorResults(), nil
 }
 
+func (g *GCEGenerator) requestMeta() (*gceMeta, error) {
+	bytes, err := requestGCEMeta(g.metaURL)
+	if err != nil {
+		return nil, err
+	}
+	var data gceMeta
+	if err := json.Unmarshal(bytes, &data); err != nil {
+		return nil, fmt.Errorf("Results of requesting gce meta cannot be parsed: '%s'", err)
+	}
+	return &data, nil
+}
+
 type gceInstance struct {
 	Zone         string
 	InstanceType string `json:"machineType"`
@@ -240,7 +264,130 @@ func (g gceMeta) toGeneratorResults() interface{} {
 	return results
 }
 
-// SuggestCustomIdentifier for GCE is not implemented yet
+// SuggestCustomIdentifier suggests the identifier of the GCE instance, which is unique
+// across the projects since the instance id is unique only in the project.
 func (g *GCEGenerator) SuggestCustomIdentifier() (string, error) {
-	return "", nil
+	data, err := g.requestMeta()
+	if err != nil {
+		return "", err
+	}
+	return data.customIdentifier()
+}
+
+func (g gceMeta) customIdentifier() (string, error) {
+	if g.Instance == nil || g.Instance.InstanceID == 0 {
+		return "", fmt.Errorf("Invalid instance id")
+	}
+	if g.Project == nil || g.Project.ProjectID == "" {
+		return "", fmt.Errorf("Invalid project id")
+	}
+	return fmt.Sprintf("%d.%s.gce.cloud.google.com", g.Instance.InstanceID, g.Project.ProjectID), nil
+}
+
+func isAzure() bool {
+	_, err := requestAzureMeta(azureMetaURL)
+	return err == nil
+}
+
+func requestAzureMeta(metaURL *url.URL) ([]byte, error) {
+	cl := http.Client{
+		Timeout: timeout,
+	}
+	req, err := http.NewRequest("GET", metaURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to request azure meta. response code: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// AzureGenerator meta generator for Azure
+type AzureGenerator struct {
+	metaURL *url.URL
+}
+
+type azureCompute struct {
+	VMID              string `json:"vmId"`
+	VMSize            string `json:"vmSize"`
+	Name              string `json:"name"`
+	Location          string `json:"location"`
+	ResourceGroupName string `json:"resourceGroupName"`
+	SubscriptionID    string `json:"subscriptionId"`
+	VMScaleSetName    string `json:"vmScaleSetName"`
+}
+
+type azureMeta struct {
+	Compute *azureCompute `json:"compute"`
+}
+
+// Generate collects metadata from cloud platform.
+func (g *AzureGenerator) Generate() (interface{}, error) {
+	data, err := g.requestMeta()
+	if err != nil {
+		return nil, err
+	}
+	return data.toGeneratorResults(), nil
+}
+
+func (g *AzureGenerator) requestMeta() (*azureMeta, error) {
+	bytes, err := requestAzureMeta(g.metaURL)
+	if err != nil {
+		return nil, err
+	}
+	var data azureMeta
+	if err := json.Unmarshal(bytes, &data); err != nil {
+		return nil, fmt.Errorf("Results of requesting azure meta cannot be parsed: '%s'", err)
+	}
+	return &data, nil
+}
+
+func (g azureMeta) toGeneratorMeta() map[string]string {
+	meta := make(map[string]string)
+	if c := g.Compute; c != nil {
+		meta["vmId"] = c.VMID
+		meta["vmSize"] = c.VMSize
+		meta["name"] = c.Name
+		meta["location"] = c.Location
+		meta["resourceGroupName"] = c.ResourceGroupName
+		meta["subscriptionId"] = c.SubscriptionID
+		if c.VMScaleSetName != "" {
+			meta["vmScaleSetName"] = c.VMScaleSetName
+		}
+	}
+	return meta
+}
+
+func (g azureMeta) toGeneratorResults() interface{} {
+	results := make(map[string]interface{})
+	results["provider"] = "azure"
+	results["metadata"] = g.toGeneratorMeta()
+
+	return results
+}
+
+// SuggestCustomIdentifier suggests the identifier of the Azure virtual machine by the vmId,
+// which is unique also among the instances of the scale sets.
+func (g *AzureGenerator) SuggestCustomIdentifier() (string, error) {
+	data, err := g.requestMeta()
+	if err != nil {
+		return "", err
+	}
+	return data.customIdentifier()
+}
+
+func (g azureMeta) customIdentifier() (string, error) {
+	if g.Compute == nil || g.Compute.VMID == "" {
+		return "", fmt.Errorf("Invalid vm id")
+	}
+	return g.Compute.VMID + ".virtual_machine.azure.microsoft.com", nil
 }
@@ -0,0 +1,138 @@
+package spec
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Amazon ECS: https://docs.aws.amazon.com/AmazonECS/latest/developerguide/task-metadata-endpoint-v4.html
+// The tasks (including the ones on Fargate) are detected by the task metadata endpoint (v4) given to the containers
+// by the environment variable, and each task is registered as a host identified by the task ARN.
+
+// ecsMetadataEnv is the environment variable of the URI of the task metadata endpoint of the container
+var ecsMetadataEnv = "ECS_CONTAINER_METADATA_URI_V4"
+
+// ECSGenerator meta generator for the tasks of Amazon ECS
+type ECSGenerator struct {
+	// metaURI is the metadata endpoint of the container, whose task metadata is at metaURI/task
+	metaURI string
+}
+
+type ecsLimits struct {
+	CPU    float64 `json:"CPU"`
+	Memory int64   `json:"Memory"` // in MiB
+}
+
+type ecsContainerMeta struct {
+	DockerID string     `json:"DockerId"`
+	Name     string     `json:"Name"`
+	Limits   *ecsLimits `json:"Limits"`
+}
+
+type ecsTaskMeta struct {
+	Cluster          string     `json:"Cluster"`
+	TaskARN          string     `json:"TaskARN"`
+	Family           string     `json:"Family"`
+	Revision         string     `json:"Revision"`
+	AvailabilityZone string     `json:"AvailabilityZone"`
+	LaunchType       string     `json:"LaunchType"`
+	Limits           *ecsLimits `json:"Limits"`
+}
+
+func suggestECSGenerator() *ECSGenerator {
+	uri := os.Getenv(ecsMetadataEnv)
+	if uri == "" {
+		return nil
+	}
+	g := &ECSGenerator{metaURI: strings.TrimSuffix(uri, "/")}
+	if _, err := g.requestTaskMeta(); err != nil {
+		cloudLogger.Debugf("The task metadata endpoint of ECS is not available: %s", err)
+		return nil
+	}
+	return g
+}
+
+func (g *ECSGenerator) request(path string, v interface{}) error {
+	cl := http.Client{
+		Timeout: timeout,
+	}
+	resp, err := cl.Get(g.metaURI + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to request ecs meta. response code: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Results of requesting ecs meta cannot be parsed: '%s'", err)
+	}
+	return nil
+}
+
+func (g *ECSGenerator) requestTaskMeta() (*ecsTaskMeta, error) {
+	var task ecsTaskMeta
+	if err := g.request("/task", &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// Generate collects metadata of the task and the limits of the task and the container the agent runs in.
+func (g *ECSGenerator) Generate() (interface{}, error) {
+	task, err := g.requestTaskMeta()
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{
+		"cluster":           task.Cluster,
+		"task-arn":          task.TaskARN,
+		"family":            task.Family,
+		"revision":          task.Revision,
+		"availability-zone": task.AvailabilityZone,
+		"launch-type":       task.LaunchType,
+	}
+	if task.Limits != nil {
+		meta["cpu-limit"] = fmt.Sprint(task.Limits.CPU)
+		meta["memory-limit"] = fmt.Sprintf("%dMiB", task.Limits.Memory)
+	}
+
+	var container ecsContainerMeta
+	if err := g.request("", &container); err != nil {
+		cloudLogger.Warningf("Failed to request the metadata of the container: %s", err)
+	} else {
+		meta["container-name"] = container.Name
+		if container.Limits != nil {
+			meta["container-cpu-limit"] = fmt.Sprint(container.Limits.CPU)
+			if container.Limits.Memory > 0 {
+				meta["container-memory-limit"] = fmt.Sprintf("%dMiB", container.Limits.Memory)
+			}
+		}
+	}
+	for key, value := range meta {
+		if value == "" {
+			delete(meta, key)
+		}
+	}
+
+	results := make(map[string]interface{})
+	results["provider"] = "ecs"
+	results["metadata"] = meta
+
+	return results, nil
+}
+
+// SuggestCustomIdentifier suggests the task ARN as the identifier, so that each task is registered as a host.
+func (g *ECSGenerator) SuggestCustomIdentifier() (string, error) {
+	task, err := g.requestTaskMeta()
+	if err != nil {
+		return "", err
+	}
+	if task.TaskARN == "" {
+		return "", fmt.Errorf("Invalid task arn")
+	}
+	return task.TaskARN, nil
+}
@@ -0,0 +1,77 @@
+package spec
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestECSGenerator(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v4/abc":
+			fmt.Fprint(res, `{"DockerId":"abc","Name":"mackerel-agent","Limits":{"CPU":256,"Memory":512}}`)
+		case "/v4/abc/task":
+			fmt.Fprint(res, `{
+				"Cluster": "arn:aws:ecs:ap-northeast-1:123456789012:cluster/default",
+				"TaskARN": "arn:aws:ecs:ap-northeast-1:123456789012:task/default/158d1c8083dd49d6b527399fd6414f5c",
+				"Family": "app",
+				"Revision": "3",
+				"AvailabilityZone": "ap-northeast-1a",
+				"LaunchType": "FARGATE",
+				"Limits": {"CPU": 0.5, "Memory": 1024}
+			}`)
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+	defer ts.Close()
+
+	defer os.Unsetenv(ecsMetadataEnv)
+	os.Setenv(ecsMetadataEnv, ts.URL+"/v4/abc")
+	cGen := SuggestCloudGenerator()
+	if cGen == nil {
+		t.Fatal("cGen should not be nil")
+	}
+	g, ok := cGen.CloudMetaGenerator.(*ECSGenerator)
+	if !ok {
+		t.Fatalf("cGen should be *ECSGenerator but %T", cGen.CloudMetaGenerator)
+	}
+
+	value, err := g.Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := map[string]interface{}{
+		"provider": "ecs",
+		"metadata": map[string]string{
+			"cluster":                "arn:aws:ecs:ap-northeast-1:123456789012:cluster/default",
+			"task-arn":               "arn:aws:ecs:ap-northeast-1:123456789012:task/default/158d1c8083dd49d6b527399fd6414f5c",
+			"family":                 "app",
+			"revision":               "3",
+			"availability-zone":      "ap-northeast-1a",
+			"launch-type":            "FARGATE",
+			"cpu-limit":              "0.5",
+			"memory-limit":           "1024MiB",
+			"container-name":         "mackerel-agent",
+			"container-cpu-limit":    "256",
+			"container-memory-limit": "512MiB",
+		},
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("unexpected metadata: %#v", value)
+	}
+
+	customIdentifier, err := g.SuggestCustomIdentifier()
+	if err != nil || customIdentifier != "arn:aws:ecs:ap-northeast-1:123456789012:task/default/158d1c8083dd49d6b527399fd6414f5c" {
+		t.Errorf("the task arn should be the custom identifier: %q, %v", customIdentifier, err)
+	}
+
+	os.Setenv(ecsMetadataEnv, ts.URL+"/nonexistent")
+	if g := suggestECSGenerator(); g != nil {
+		t.Error("ECS should not be detected without the task metadata")
+	}
+}
@@ -0,0 +1,117 @@
+package spec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Oracle Cloud Infrastructure: https://docs.oracle.com/iaas/Content/Compute/Tasks/gettingmetadata.htm
+// The metadata is requested from the instance metadata service v2, which requires the Authorization header.
+
+var ociMetaURL *url.URL
+
+func init() {
+	ociMetaURL, _ = url.Parse("http://169.254.169.254/opc/v2/instance/")
+}
+
+// OCIGenerator meta generator for Oracle Cloud Infrastructure
+type OCIGenerator struct {
+	metaURL *url.URL
+}
+
+type ociMeta struct {
+	ID                 string `json:"id"`
+	DisplayName        string `json:"displayName"`
+	Hostname           string `json:"hostname"`
+	Shape              string `json:"shape"`
+	Region             string `json:"canonicalRegionName"`
+	AvailabilityDomain string `json:"availabilityDomain"`
+	FaultDomain        string `json:"faultDomain"`
+	CompartmentID      string `json:"compartmentId"`
+	Image              string `json:"image"`
+}
+
+func isOCI() bool {
+	_, err := requestOCIMeta(ociMetaURL)
+	return err == nil
+}
+
+func requestOCIMeta(metaURL *url.URL) ([]byte, error) {
+	cl := http.Client{
+		Timeout: timeout,
+	}
+	req, err := http.NewRequest("GET", metaURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer Oracle")
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to request oci meta. response code: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (g *OCIGenerator) requestMeta() (*ociMeta, error) {
+	bytes, err := requestOCIMeta(g.metaURL)
+	if err != nil {
+		return nil, err
+	}
+	var data ociMeta
+	if err := json.Unmarshal(bytes, &data); err != nil {
+		return nil, fmt.Errorf("Results of requesting oci meta cannot be parsed: '%s'", err)
+	}
+	return &data, nil
+}
+
+// Generate collects metadata from cloud platform.
+func (g *OCIGenerator) Generate() (interface{}, error) {
+	data, err := g.requestMeta()
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{
+		"ocid":                data.ID,
+		"display-name":        data.DisplayName,
+		"hostname":            data.Hostname,
+		"shape":               data.Shape,
+		"region":              data.Region,
+		"availability-domain": data.AvailabilityDomain,
+		"fault-domain":        data.FaultDomain,
+		"compartment-id":      data.CompartmentID,
+		"image":               data.Image,
+	}
+	for key, value := range meta {
+		if value == "" {
+			delete(meta, key)
+		}
+	}
+
+	results := make(map[string]interface{})
+	results["provider"] = "oci"
+	results["metadata"] = meta
+
+	return results, nil
+}
+
+// SuggestCustomIdentifier suggests the OCID of the instance, which is unique across the tenancies
+// (e.g. "ocid1.instance.oc1.ap-tokyo-1.xxx").
+func (g *OCIGenerator) SuggestCustomIdentifier() (string, error) {
+	data, err := g.requestMeta()
+	if err != nil {
+		return "", err
+	}
+	if data.ID == "" {
+		return "", fmt.Errorf("Invalid instance ocid")
+	}
+	return data.ID, nil
+}
@@ -0,0 +1,80 @@
+package spec
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestOCIGenerator(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/opc/v2/instance/" {
+			http.NotFound(res, req)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer Oracle" {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(res, `{
+			"id": "ocid1.instance.oc1.ap-tokyo-1.anxhiljrexample",
+			"displayName": "web-1",
+			"hostname": "web-1",
+			"shape": "VM.Standard.E4.Flex",
+			"region": "nrt",
+			"canonicalRegionName": "ap-tokyo-1",
+			"availabilityDomain": "Uocm:AP-TOKYO-1-AD-1",
+			"faultDomain": "FAULT-DOMAIN-2",
+			"compartmentId": "ocid1.compartment.oc1..aaaaexample",
+			"image": "ocid1.image.oc1.ap-tokyo-1.aaaaexample",
+			"metadata": {"ssh_authorized_keys": "ssh-rsa AAAA"}
+		}`)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL + "/opc/v2/instance/")
+	g := &OCIGenerator{u}
+
+	value, err := g.Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := map[string]interface{}{
+		"provider": "oci",
+		"metadata": map[string]string{
+			"ocid":                "ocid1.instance.oc1.ap-tokyo-1.anxhiljrexample",
+			"display-name":        "web-1",
+			"hostname":            "web-1",
+			"shape":               "VM.Standard.E4.Flex",
+			"region":              "ap-tokyo-1",
+			"availability-domain": "Uocm:AP-TOKYO-1-AD-1",
+			"fault-domain":        "FAULT-DOMAIN-2",
+			"compartment-id":      "ocid1.compartment.oc1..aaaaexample",
+			"image":               "ocid1.image.oc1.ap-tokyo-1.aaaaexample",
+		},
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("metadata should be generated: %+v", value)
+	}
+
+	customIdentifier, err := g.SuggestCustomIdentifier()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if customIdentifier != "ocid1.instance.oc1.ap-tokyo-1.anxhiljrexample" {
+		t.Errorf("customIdentifier should be the ocid but: %s", customIdentifier)
+	}
+
+	origURL := ociMetaURL
+	defer func() { ociMetaURL = origURL }()
+	ociMetaURL = u
+	if !isOCI() {
+		t.Error("OCI should be detected")
+	}
+	ociMetaURL, _ = url.Parse(ts.URL + "/latest/meta-data/")
+	if isOCI() {
+		t.Error("OCI should not be detected without its metadata")
+	}
+}
@@ -0,0 +1,182 @@
+package spec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// OpenStack: https://docs.openstack.org/nova/latest/user/metadata.html
+// The metadata is read from the config drive if it is mounted, or from the metadata service.
+// The flavor is not in the metadata of OpenStack, and is read from the EC2-compatible metadata (instance-type).
+
+var openStackMetaURL, openStackFlavorURL *url.URL
+
+// the directories where the config drive (labeled "config-2") is mounted commonly
+var openStackConfigDriveDirs = []string{"/mnt/config", "/media/configdrive", "/config-2"}
+
+func init() {
+	openStackMetaURL, _ = url.Parse("http://169.254.169.254/openstack/latest/meta_data.json")
+	openStackFlavorURL, _ = url.Parse("http://169.254.169.254/latest/meta-data/instance-type")
+}
+
+const (
+	openStackConfigDriveMetaPath    = "openstack/latest/meta_data.json"
+	openStackConfigDriveEC2MetaPath = "ec2/latest/meta-data.json"
+)
+
+// OpenStackGenerator meta generator for OpenStack
+type OpenStackGenerator struct {
+	metaURL *url.URL
+	// metaFile is the meta_data.json on the config drive, which is preferred to metaURL if not empty
+	metaFile string
+
+	// flavorURL is the instance-type of the EC2-compatible metadata service, and flavorFile is the EC2-compatible
+	// meta-data.json on the config drive preferred to flavorURL if not empty. The flavor is omitted if both are empty.
+	flavorURL  *url.URL
+	flavorFile string
+}
+
+type openStackMeta struct {
+	UUID             string `json:"uuid"`
+	Name             string `json:"name"`
+	Hostname         string `json:"hostname"`
+	AvailabilityZone string `json:"availability_zone"`
+	ProjectID        string `json:"project_id"`
+
+	// Flavor is read from the EC2-compatible metadata
+	Flavor string `json:"-"`
+}
+
+type openStackEC2Meta struct {
+	InstanceType string `json:"instance-type"`
+}
+
+func suggestOpenStackGenerator() *OpenStackGenerator {
+	for _, dir := range openStackConfigDriveDirs {
+		file := filepath.Join(dir, openStackConfigDriveMetaPath)
+		if _, err := ioutil.ReadFile(file); err == nil {
+			return &OpenStackGenerator{
+				metaURL:    openStackMetaURL,
+				metaFile:   file,
+				flavorURL:  openStackFlavorURL,
+				flavorFile: filepath.Join(dir, openStackConfigDriveEC2MetaPath),
+			}
+		}
+	}
+	if _, err := requestOpenStackMeta(openStackMetaURL); err == nil {
+		return &OpenStackGenerator{metaURL: openStackMetaURL, flavorURL: openStackFlavorURL}
+	}
+	return nil
+}
+
+func requestOpenStackMeta(metaURL *url.URL) ([]byte, error) {
+	cl := http.Client{
+		Timeout: timeout,
+	}
+	resp, err := cl.Get(metaURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to request openstack meta. response code: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Generate collects metadata from cloud platform.
+func (g *OpenStackGenerator) Generate() (interface{}, error) {
+	data, err := g.requestMeta()
+	if err != nil {
+		return nil, err
+	}
+	if data.Flavor, err = g.requestFlavor(); err != nil {
+		cloudLogger.Debugf("The flavor of the OpenStack instance is not available: %s", err)
+	}
+	return data.toGeneratorResults(), nil
+}
+
+// requestFlavor reads the flavor from the config drive, or from the metadata service
+// if the config drive has no EC2-compatible metadata.
+func (g *OpenStackGenerator) requestFlavor() (string, error) {
+	if g.flavorFile != "" {
+		if bytes, err := ioutil.ReadFile(g.flavorFile); err == nil {
+			var data openStackEC2Meta
+			if err := json.Unmarshal(bytes, &data); err != nil {
+				return "", fmt.Errorf("Results of reading %s cannot be parsed: '%s'", g.flavorFile, err)
+			}
+			return data.InstanceType, nil
+		}
+	}
+	if g.flavorURL == nil {
+		return "", fmt.Errorf("no metadata of the flavor")
+	}
+	bytes, err := requestOpenStackMeta(g.flavorURL)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bytes)), nil
+}
+
+func (g *OpenStackGenerator) requestMeta() (*openStackMeta, error) {
+	var bytes []byte
+	var err error
+	if g.metaFile != "" {
+		bytes, err = ioutil.ReadFile(g.metaFile)
+	} else {
+		bytes, err = requestOpenStackMeta(g.metaURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data openStackMeta
+	if err := json.Unmarshal(bytes, &data); err != nil {
+		return nil, fmt.Errorf("Results of requesting openstack meta cannot be parsed: '%s'", err)
+	}
+	return &data, nil
+}
+
+func (g openStackMeta) toGeneratorMeta() map[string]string {
+	meta := map[string]string{
+		"uuid":              g.UUID,
+		"name":              g.Name,
+		"hostname":          g.Hostname,
+		"availability_zone": g.AvailabilityZone,
+		"project_id":        g.ProjectID,
+	}
+	if g.Flavor != "" {
+		meta["flavor"] = g.Flavor
+	}
+	return meta
+}
+
+func (g openStackMeta) toGeneratorResults() interface{} {
+	results := make(map[string]interface{})
+	results["provider"] = "openstack"
+	results["metadata"] = g.toGeneratorMeta()
+
+	return results
+}
+
+// SuggestCustomIdentifier suggests the identifier of the OpenStack instance by the uuid,
+// which is unique across the projects.
+func (g *OpenStackGenerator) SuggestCustomIdentifier() (string, error) {
+	data, err := g.requestMeta()
+	if err != nil {
+		return "", err
+	}
+	return data.customIdentifier()
+}
+
+func (g openStackMeta) customIdentifier() (string, error) {
+	if g.UUID == "" {
+		return "", fmt.Errorf("Invalid instance uuid")
+	}
+	return g.UUID + ".instance.openstack.org", nil
+}
@@ -0,0 +1,114 @@
+package spec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const sampleOpenStackMeta = `{
+  "uuid": "d8e02d56-2648-49a3-bf97-6be8f1204f38",
+  "name": "test-instance",
+  "hostname": "test-instance.novalocal",
+  "availability_zone": "nova",
+  "project_id": "f7ac731cc11f40efbc03a9f9e1d1d21f",
+  "launch_index": 0
+}`
+
+func TestOpenStackGenerate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/openstack/latest/meta_data.json":
+			fmt.Fprint(res, sampleOpenStackMeta)
+		case "/latest/meta-data/instance-type":
+			fmt.Fprint(res, "m1.small")
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL + "/openstack/latest/meta_data.json")
+	flavorURL, _ := url.Parse(ts.URL + "/latest/meta-data/instance-type")
+	g := &OpenStackGenerator{metaURL: u, flavorURL: flavorURL}
+
+	value, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	expected := map[string]interface{}{
+		"provider": "openstack",
+		"metadata": map[string]string{
+			"uuid":              "d8e02d56-2648-49a3-bf97-6be8f1204f38",
+			"name":              "test-instance",
+			"hostname":          "test-instance.novalocal",
+			"availability_zone": "nova",
+			"project_id":        "f7ac731cc11f40efbc03a9f9e1d1d21f",
+			"flavor":            "m1.small",
+		},
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("metadata should be generated: %+v", value)
+	}
+
+	g.flavorURL, _ = url.Parse(ts.URL + "/nonexistent")
+	value, err = g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error without the flavor: %s", err)
+	}
+	if _, ok := value.(map[string]interface{})["metadata"].(map[string]string)["flavor"]; ok {
+		t.Errorf("the flavor should be omitted if not available: %+v", value)
+	}
+
+	customIdentifier, err := g.SuggestCustomIdentifier()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if customIdentifier != "d8e02d56-2648-49a3-bf97-6be8f1204f38.instance.openstack.org" {
+		t.Errorf("customIdentifier should be retrieved but: %s", customIdentifier)
+	}
+
+	if _, err := (openStackMeta{}).customIdentifier(); err == nil {
+		t.Error("should raise error without the uuid")
+	}
+}
+
+func TestSuggestOpenStackGenerator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-openstack")
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	origDirs, origURL := openStackConfigDriveDirs, openStackMetaURL
+	defer func() { openStackConfigDriveDirs, openStackMetaURL = origDirs, origURL }()
+
+	openStackConfigDriveDirs = []string{dir}
+	openStackMetaURL, _ = url.Parse("http://unreachable.localhost")
+	if g := suggestOpenStackGenerator(); g != nil {
+		t.Errorf("OpenStack should not be detected: %+v", g)
+	}
+
+	file := filepath.Join(dir, "openstack", "latest", "meta_data.json")
+	os.MkdirAll(filepath.Dir(file), 0755)
+	ioutil.WriteFile(file, []byte(sampleOpenStackMeta), 0644)
+	g := suggestOpenStackGenerator()
+	if g == nil || g.metaFile != file {
+		t.Fatalf("the metadata should be read from the config drive: %+v", g)
+	}
+	customIdentifier, err := g.SuggestCustomIdentifier()
+	if err != nil || customIdentifier != "d8e02d56-2648-49a3-bf97-6be8f1204f38.instance.openstack.org" {
+		t.Errorf("customIdentifier should be retrieved from the config drive: %s, %v", customIdentifier, err)
+	}
+
+	ec2File := filepath.Join(dir, "ec2", "latest", "meta-data.json")
+	os.MkdirAll(filepath.Dir(ec2File), 0755)
+	ioutil.WriteFile(ec2File, []byte(`{"instance-id": "i-00000001", "instance-type": "m1.large"}`), 0644)
+	if flavor, err := g.requestFlavor(); err != nil || flavor != "m1.large" {
+		t.Errorf("the flavor should be read from the config drive: %s, %v", flavor, err)
+	}
+}
@@ -172,13 +172,110 @@ func TestGCEGenerate(t *testing.T) {
 		t.Errorf("data.Project should be assigned")
 	}
 
+	if id, err := data.customIdentifier(); err != nil || id != "4567890123456789123.dummyprof-987.gce.cloud.google.com" {
+		t.Errorf("customIdentifier should be generated from the instance id and the project id but: %s, %v", id, err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Metadata-Flavor") != "Google" {
+			t.Error("Metadata-Flavor header should be sent")
+		}
+		res.Write(sampleJSON)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	g := &GCEGenerator{u}
+	customIdentifier, err := g.SuggestCustomIdentifier()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if customIdentifier != "4567890123456789123.dummyprof-987.gce.cloud.google.com" {
+		t.Errorf("customIdentifier should be retrieved but: %s", customIdentifier)
+	}
+
+	if _, err := (gceMeta{}).customIdentifier(); err == nil {
+		t.Error("should raise error without the instance")
+	}
+}
+
+func TestAzureGenerate(t *testing.T) {
+	// curl -H Metadata:true "http://169.254.169.254/metadata/instance?api-version=2017-08-01"
+	sampleJSON := []byte(`{
+	  "compute": {
+		"location": "japaneast",
+		"name": "vmss_1",
+		"offer": "UbuntuServer",
+		"osType": "Linux",
+		"platformFaultDomain": "0",
+		"platformUpdateDomain": "0",
+		"publisher": "Canonical",
+		"resourceGroupName": "dummy-rg",
+		"sku": "16.04-LTS",
+		"subscriptionId": "8d10da13-8125-4ba9-a717-bf7490507b3d",
+		"tags": "",
+		"version": "16.04.201708030",
+		"vmId": "5c08b38e-4d57-4c23-ac45-aca61037f084",
+		"vmScaleSetName": "vmss",
+		"vmSize": "Standard_D1_v2"
+	  },
+	  "network": {
+		"interface": []
+	  }
+	}`)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Metadata") != "true" {
+			t.Error("Metadata header should be sent")
+		}
+		res.Write(sampleJSON)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	g := &AzureGenerator{u}
+
+	results, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if !reflect.DeepEqual(results, map[string]interface{}{
+		"provider": "azure",
+		"metadata": map[string]string{
+			"vmId":              "5c08b38e-4d57-4c23-ac45-aca61037f084",
+			"vmSize":            "Standard_D1_v2",
+			"name":              "vmss_1",
+			"location":          "japaneast",
+			"resourceGroupName": "dummy-rg",
+			"subscriptionId":    "8d10da13-8125-4ba9-a717-bf7490507b3d",
+			"vmScaleSetName":    "vmss",
+		},
+	}) {
+		t.Errorf("unexpected results: %v", results)
+	}
+
+	customIdentifier, err := g.SuggestCustomIdentifier()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if customIdentifier != "5c08b38e-4d57-4c23-ac45-aca61037f084.virtual_machine.azure.microsoft.com" {
+		t.Errorf("customIdentifier should be retrieved but: %s", customIdentifier)
+	}
+
+	if _, err := (azureMeta{}).customIdentifier(); err == nil {
+		t.Error("should raise error without the vm id")
+	}
 }
 
 func TestSuggestCloudGenerator(t *testing.T) {
-	// both of ec2BaseURL and gceMetaURL are unreachable
+	// all of ec2BaseURL, gceMetaURL, azureMetaURL and openStackMetaURL are unreachable,
+	// and neither the config drive of OpenStack nor VMware is found
 	unreachableURL, _ := url.Parse("http://unreachable.localhost")
 	ec2BaseURL = unreachableURL
 	gceMetaURL = unreachableURL
+	azureMetaURL = unreachableURL
+	openStackMetaURL = unreachableURL
+	openStackConfigDriveDirs = nil
+	vmwareDMIDir = "/nonexistent"
+	vmtoolsdCommand = "/nonexistent/vmtoolsd"
 	cGen := SuggestCloudGenerator()
 	if cGen != nil {
 		t.Errorf("cGen should be nil but, %s", cGen)
@@ -0,0 +1,88 @@
+package spec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// VMware vSphere: the virtual machines are detected by the vendor in the DMI table,
+// or by guestinfo.ip published by VMware Tools (open-vm-tools) and read by vmtoolsd.
+
+var (
+	vmwareDMIDir    = "/sys/class/dmi/id"
+	vmtoolsdCommand = "vmtoolsd"
+)
+
+// VMwareGenerator meta generator for VMware vSphere
+type VMwareGenerator struct {
+	dmiDir   string
+	vmtoolsd string
+}
+
+func suggestVMwareGenerator() *VMwareGenerator {
+	g := &VMwareGenerator{dmiDir: vmwareDMIDir, vmtoolsd: vmtoolsdCommand}
+	if strings.HasPrefix(g.readDMI("sys_vendor"), "VMware") {
+		return g
+	}
+	if _, err := g.guestInfo("ip"); err == nil {
+		return g
+	}
+	return nil
+}
+
+// readDMI returns the value of the DMI table, or the empty string if it is not available
+// (e.g. on the platforms other than Linux, or product_uuid readable only by root)
+func (g *VMwareGenerator) readDMI(name string) string {
+	content, err := ioutil.ReadFile(filepath.Join(g.dmiDir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// guestInfo reads the guestinfo variable of the virtual machine by vmtoolsd,
+// which fails outside the virtual machines of VMware.
+func (g *VMwareGenerator) guestInfo(key string) (string, error) {
+	out, err := exec.Command(g.vmtoolsd, "--cmd", "info-get guestinfo."+key).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Generate collects metadata from cloud platform.
+func (g *VMwareGenerator) Generate() (interface{}, error) {
+	meta := make(map[string]string)
+	if uuid := g.uuid(); uuid != "" {
+		meta["uuid"] = uuid
+	}
+	if serial := g.readDMI("product_serial"); serial != "" {
+		meta["serial"] = serial
+	}
+	if ip, err := g.guestInfo("ip"); err == nil && ip != "" {
+		meta["ip"] = ip
+	}
+
+	results := make(map[string]interface{})
+	results["provider"] = "vmware"
+	results["metadata"] = meta
+
+	return results, nil
+}
+
+// uuid returns the BIOS UUID of the virtual machine, which is kept across the reboots and the migrations
+func (g *VMwareGenerator) uuid() string {
+	return strings.ToLower(g.readDMI("product_uuid"))
+}
+
+// SuggestCustomIdentifier suggests the identifier of the virtual machine by the BIOS UUID.
+func (g *VMwareGenerator) SuggestCustomIdentifier() (string, error) {
+	uuid := g.uuid()
+	if uuid == "" {
+		return "", fmt.Errorf("Invalid vm uuid")
+	}
+	return uuid + ".virtual_machine.vmware.com", nil
+}
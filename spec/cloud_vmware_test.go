@@ -0,0 +1,60 @@
+package spec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVMwareGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-vmware")
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	g := &VMwareGenerator{dmiDir: dir, vmtoolsd: "/nonexistent/vmtoolsd"}
+
+	if _, err := g.SuggestCustomIdentifier(); err == nil {
+		t.Error("should raise error without the uuid")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "sys_vendor"), []byte("VMware, Inc.\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "product_uuid"), []byte("421A6B5C-2E2D-4D3F-8C2B-0A1B2C3D4E5F\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "product_serial"), []byte("VMware-42 1a 6b 5c 2e 2d 4d 3f-8c 2b 0a 1b 2c 3d 4e 5f\n"), 0644)
+
+	value, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	expected := map[string]interface{}{
+		"provider": "vmware",
+		"metadata": map[string]string{
+			"uuid":   "421a6b5c-2e2d-4d3f-8c2b-0a1b2c3d4e5f",
+			"serial": "VMware-42 1a 6b 5c 2e 2d 4d 3f-8c 2b 0a 1b 2c 3d 4e 5f",
+		},
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("metadata should be generated: %+v", value)
+	}
+
+	customIdentifier, err := g.SuggestCustomIdentifier()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if customIdentifier != "421a6b5c-2e2d-4d3f-8c2b-0a1b2c3d4e5f.virtual_machine.vmware.com" {
+		t.Errorf("customIdentifier should be retrieved but: %s", customIdentifier)
+	}
+
+	origDir, origCommand := vmwareDMIDir, vmtoolsdCommand
+	defer func() { vmwareDMIDir, vmtoolsdCommand = origDir, origCommand }()
+	vmwareDMIDir, vmtoolsdCommand = dir, "/nonexistent/vmtoolsd"
+	if suggestVMwareGenerator() == nil {
+		t.Error("VMware should be detected by the vendor")
+	}
+	vmwareDMIDir = "/nonexistent"
+	if g := suggestVMwareGenerator(); g != nil {
+		t.Errorf("VMware should not be detected: %+v", g)
+	}
+}
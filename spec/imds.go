@@ -0,0 +1,136 @@
+package spec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The versions of the instance metadata service of EC2 (IMDS) used by the agent (see SetEC2MetadataVersion)
+const (
+	// EC2MetadataAuto uses IMDSv2 with the session token, falling back to IMDSv1 when the token is not available.
+	EC2MetadataAuto = "auto"
+	// EC2MetadataV2 always uses IMDSv2, e.g. not to request IMDSv1 on the hardened instances.
+	EC2MetadataV2 = "v2"
+	// EC2MetadataV1 always uses IMDSv1, e.g. in the containers which the token cannot reach
+	// because of the hop limit of the response (HttpPutResponseHopLimit).
+	EC2MetadataV1 = "v1"
+)
+
+var ec2MetadataVersion = EC2MetadataAuto
+
+// SetEC2MetadataVersion sets the version of the instance metadata service of EC2.
+// EC2MetadataAuto is used if version is empty or unknown.
+func SetEC2MetadataVersion(version string) {
+	switch version {
+	case EC2MetadataAuto, EC2MetadataV2, EC2MetadataV1:
+		ec2MetadataVersion = version
+	case "":
+		ec2MetadataVersion = EC2MetadataAuto
+	default:
+		cloudLogger.Warningf("Unknown version of the EC2 instance metadata service %q. %q is used instead.", version, EC2MetadataAuto)
+		ec2MetadataVersion = EC2MetadataAuto
+	}
+}
+
+const (
+	ec2TokenTTL = 6 * time.Hour
+	// ec2TokenRetryInterval is the interval of retrying to get the token after falling back to IMDSv1
+	ec2TokenRetryInterval = 10 * time.Minute
+)
+
+// ec2Token caches the session token of IMDSv2
+var ec2Token struct {
+	sync.Mutex
+	baseURL string
+	token   string
+	expires time.Time
+	failed  time.Time // when the token was not available
+	warned  bool      // whether the fallback to IMDSv1 has been warned since the failure
+}
+
+// ec2MetadataToken returns the session token of IMDSv2 for the metadata service at baseURL (".../latest/meta-data"),
+// which is cached until shortly before it expires.
+func ec2MetadataToken(baseURL *url.URL) (string, error) {
+	ec2Token.Lock()
+	defer ec2Token.Unlock()
+	now := time.Now()
+	if ec2Token.baseURL == baseURL.String() {
+		if ec2Token.token != "" && now.Before(ec2Token.expires) {
+			return ec2Token.token, nil
+		}
+		if ec2MetadataVersion == EC2MetadataAuto && now.Sub(ec2Token.failed) < ec2TokenRetryInterval {
+			return "", fmt.Errorf("the token of IMDSv2 is not available")
+		}
+	}
+	ec2Token.baseURL, ec2Token.token = baseURL.String(), ""
+
+	token, err := requestEC2MetadataToken(baseURL)
+	if err != nil {
+		ec2Token.failed, ec2Token.warned = now, false
+		return "", err
+	}
+	ec2Token.token = token
+	ec2Token.expires = now.Add(ec2TokenTTL - time.Minute)
+	return token, nil
+}
+
+func requestEC2MetadataToken(baseURL *url.URL) (string, error) {
+	u := baseURL.ResolveReference(&url.URL{Path: "api/token"})
+	req, err := http.NewRequest("PUT", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", fmt.Sprint(int(ec2TokenTTL.Seconds())))
+	cl := http.Client{Timeout: timeout}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("failed to request the token of IMDSv2. response code: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// requestEC2Meta requests the metadata of the key (e.g. "instance-id") by the version set by SetEC2MetadataVersion
+func requestEC2Meta(baseURL *url.URL, key string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", baseURL.String()+"/"+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	fallback := false
+	if ec2MetadataVersion != EC2MetadataV1 {
+		token, err := ec2MetadataToken(baseURL)
+		if err != nil {
+			if ec2MetadataVersion == EC2MetadataV2 {
+				return nil, err
+			}
+			cloudLogger.Debugf("Falling back to IMDSv1: %s", err)
+			fallback = true
+		} else {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+	}
+
+	cl := http.Client{Timeout: timeout}
+	resp, err := cl.Do(req)
+	if err == nil && fallback && resp.StatusCode == 200 {
+		ec2Token.Lock()
+		if !ec2Token.warned {
+			ec2Token.warned = true
+			cloudLogger.Warningf("The token of IMDSv2 is not available, and IMDSv1 is used instead. If the agent runs in a container, the hop limit of the instance metadata (HttpPutResponseHopLimit) should be 2 at least, or ec2_metadata of [host_spec] should be %q.", EC2MetadataV1)
+		}
+		ec2Token.Unlock()
+	}
+	return resp, err
+}
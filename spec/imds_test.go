@@ -0,0 +1,66 @@
+package spec
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newIMDSServer returns the metadata service serving the instance-id, which requires the token of IMDSv2 if v1 is false
+func newIMDSServer(v1, v2 bool) (*httptest.Server, *url.URL, *int) {
+	tokens := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "PUT" && req.URL.Path == "/api/token":
+			if !v2 || req.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				res.WriteHeader(http.StatusForbidden)
+				return
+			}
+			tokens++
+			fmt.Fprint(res, "session-token")
+		case req.Method == "GET" && req.URL.Path == "/instance-id":
+			if req.Header.Get("X-aws-ec2-metadata-token") != "session-token" && !v1 {
+				res.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(res, "i-4f90d537")
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+	u, _ := url.Parse(ts.URL)
+	return ts, u, &tokens
+}
+
+func TestEC2MetadataVersions(t *testing.T) {
+	defer SetEC2MetadataVersion("")
+
+	testCases := []struct {
+		name       string
+		version    string
+		v1, v2     bool
+		identifier string
+	}{
+		{"IMDSv2", EC2MetadataAuto, false, true, "i-4f90d537.ec2.amazonaws.com"},
+		{"fallback to IMDSv1", EC2MetadataAuto, true, false, "i-4f90d537.ec2.amazonaws.com"},
+		{"IMDSv2 only", EC2MetadataV2, true, false, ""},
+		{"IMDSv1 only", EC2MetadataV1, false, true, ""},
+	}
+	for _, tc := range testCases {
+		ts, u, tokens := newIMDSServer(tc.v1, tc.v2)
+		SetEC2MetadataVersion(tc.version)
+		g := &EC2Generator{u}
+		for i := 0; i < 2; i++ {
+			identifier, err := g.SuggestCustomIdentifier()
+			if identifier != tc.identifier || (tc.identifier == "") != (err != nil) {
+				t.Errorf("%s: unexpected custom identifier: %q, %v", tc.name, identifier, err)
+			}
+		}
+		if *tokens > 1 {
+			t.Errorf("%s: the token should be cached but requested %d times", tc.name, *tokens)
+		}
+		ts.Close()
+	}
+}
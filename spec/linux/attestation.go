@@ -0,0 +1,175 @@
+// +build linux
+
+package linux
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// AttestationGenerator collects the identities of the TPM 2.0 and the status of Secure Boot,
+// which are cross-checked with the attestation systems. The keys are identified by their names
+// (the name algorithm and the digest of the public area, as printed by tpm2_readpublic).
+type AttestationGenerator struct {
+	// AKHandle is the persistent handle of the attestation key, which is not read if zero
+	AKHandle uint32
+}
+
+// Key XXX
+func (g *AttestationGenerator) Key() string {
+	return "attestation"
+}
+
+var attestationLogger = logging.GetLogger("spec.attestation")
+
+// Attestation represents the identities for the attestation. The empty fields are not available.
+type Attestation struct {
+	SecureBoot string `json:"secure_boot,omitempty"` // "enabled", "disabled" or "setup_mode"
+	TPMVersion string `json:"tpm_version,omitempty"`
+	EKName     string `json:"ek_name,omitempty"`
+	AKName     string `json:"ak_name,omitempty"`
+}
+
+var (
+	tpmDevices    = []string{"/dev/tpmrm0", "/dev/tpm0"}
+	tpmClassDir   = "/sys/class/tpm/tpm0"
+	efivarsDir    = "/sys/firmware/efi/efivars"
+	efiGlobalGUID = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+	tpmEKHandles  = []uint32{0x81010001, 0x81010002} // RSA and ECC of the TCG EK Credential Profile
+	tpmReadPublic = readTPMPublicName
+)
+
+// Generate generates the attestation spec
+func (g *AttestationGenerator) Generate() (interface{}, error) {
+	var attestation Attestation
+	attestation.SecureBoot = secureBootStatus()
+
+	if content, err := ioutil.ReadFile(util.HostPath(filepath.Join(tpmClassDir, "tpm_version_major"))); err == nil {
+		attestation.TPMVersion = strings.TrimSpace(string(content))
+	}
+	if attestation.TPMVersion == "1" {
+		// TPM 1.2 does not support the commands below
+		return attestation, nil
+	}
+	for _, handle := range tpmEKHandles {
+		name, err := tpmReadPublic(handle)
+		if err != nil {
+			attestationLogger.Debugf("Failed to read the EK at 0x%x: %s", handle, err)
+			continue
+		}
+		attestation.EKName = name
+		attestation.TPMVersion = "2"
+		break
+	}
+	if g.AKHandle != 0 {
+		name, err := tpmReadPublic(g.AKHandle)
+		if err != nil {
+			attestationLogger.Warningf("Failed to read the AK at 0x%x: %s", g.AKHandle, err)
+		} else {
+			attestation.AKName = name
+		}
+	}
+	return attestation, nil
+}
+
+// secureBootStatus reads the UEFI variables SecureBoot and SetupMode, whose values follow the 4 bytes
+// of the attributes. The empty string is returned if the host is not booted by UEFI.
+func secureBootStatus() string {
+	readVar := func(name string) (byte, bool) {
+		content, err := ioutil.ReadFile(util.HostPath(filepath.Join(efivarsDir, name+"-"+efiGlobalGUID)))
+		if err != nil || len(content) < 5 {
+			return 0, false
+		}
+		return content[4], true
+	}
+	if setup, ok := readVar("SetupMode"); ok && setup == 1 {
+		return "setup_mode"
+	}
+	enabled, ok := readVar("SecureBoot")
+	if !ok {
+		return ""
+	}
+	if enabled == 1 {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+const (
+	tpmSTNoSessions   = 0x8001
+	tpmCCReadPublic   = 0x00000173
+	tpmCommandHdrSize = 10
+	tpmMaxResponse    = 4096
+)
+
+// readTPMPublicName sends TPM2_ReadPublic of the persistent handle to the TPM, and returns the name
+// of the object in hex.
+func readTPMPublicName(handle uint32) (string, error) {
+	var device *os.File
+	var err error
+	for _, path := range tpmDevices {
+		device, err = os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	defer device.Close()
+
+	command := make([]byte, tpmCommandHdrSize+4)
+	binary.BigEndian.PutUint16(command[0:], tpmSTNoSessions)
+	binary.BigEndian.PutUint32(command[2:], uint32(len(command)))
+	binary.BigEndian.PutUint32(command[6:], tpmCCReadPublic)
+	binary.BigEndian.PutUint32(command[10:], handle)
+	if _, err := device.Write(command); err != nil {
+		return "", err
+	}
+	response := make([]byte, tpmMaxResponse)
+	n, err := device.Read(response)
+	if err != nil {
+		return "", err
+	}
+	return parseReadPublicResponse(response[:n])
+}
+
+// parseReadPublicResponse parses the response of TPM2_ReadPublic, which consists of the header,
+// outPublic (TPM2B_PUBLIC), name (TPM2B_NAME) and qualifiedName (TPM2B_NAME).
+func parseReadPublicResponse(response []byte) (string, error) {
+	if len(response) < tpmCommandHdrSize {
+		return "", fmt.Errorf("too short response of TPM2_ReadPublic: %d bytes", len(response))
+	}
+	if code := binary.BigEndian.Uint32(response[6:]); code != 0 {
+		return "", fmt.Errorf("TPM2_ReadPublic failed with the response code 0x%x", code)
+	}
+	rest := response[tpmCommandHdrSize:]
+	readTPM2B := func() ([]byte, error) {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("malformed response of TPM2_ReadPublic")
+		}
+		size := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 2+size {
+			return nil, fmt.Errorf("malformed response of TPM2_ReadPublic")
+		}
+		b := rest[2 : 2+size]
+		rest = rest[2+size:]
+		return b, nil
+	}
+	if _, err := readTPM2B(); err != nil { // outPublic
+		return "", err
+	}
+	name, err := readTPM2B()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(name), nil
+}
@@ -0,0 +1,85 @@
+// +build linux
+
+package linux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttestationGenerator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-test-attestation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origEfivars, origClass, origRead := efivarsDir, tpmClassDir, tpmReadPublic
+	defer func() { efivarsDir, tpmClassDir, tpmReadPublic = origEfivars, origClass, origRead }()
+	efivarsDir = dir
+	tpmClassDir = filepath.Join(dir, "tpm0")
+	tpmReadPublic = func(handle uint32) (string, error) {
+		switch handle {
+		case 0x81010002:
+			return "000b1234", nil
+		case 0x81000002:
+			return "000b5678", nil
+		}
+		return "", fmt.Errorf("TPM2_ReadPublic failed with the response code 0x18b")
+	}
+
+	g := &AttestationGenerator{}
+	if g.Key() != "attestation" {
+		t.Error("key should be attestation")
+	}
+	value, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	attestation := value.(Attestation)
+	expected := Attestation{TPMVersion: "2", EKName: "000b1234"}
+	if attestation != expected {
+		t.Errorf("the attestation should be %+v but %+v", expected, attestation)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "SecureBoot-"+efiGlobalGUID), []byte{6, 0, 0, 0, 1}, 0644)
+	g.AKHandle = 0x81000002
+	value, _ = g.Generate()
+	attestation = value.(Attestation)
+	expected = Attestation{SecureBoot: "enabled", TPMVersion: "2", EKName: "000b1234", AKName: "000b5678"}
+	if attestation != expected {
+		t.Errorf("the attestation should be %+v but %+v", expected, attestation)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "SetupMode-"+efiGlobalGUID), []byte{6, 0, 0, 0, 1}, 0644)
+	if status := secureBootStatus(); status != "setup_mode" {
+		t.Errorf("secure boot should be in the setup mode but %q", status)
+	}
+}
+
+func TestParseReadPublicResponse(t *testing.T) {
+	response := []byte{0x80, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+	response = append(response, 0, 3, 0xaa, 0xbb, 0xcc)       // outPublic
+	response = append(response, 0, 4, 0x00, 0x0b, 0x12, 0x34) // name
+	response = append(response, 0, 2, 0x00, 0x0b)             // qualifiedName
+	binary.BigEndian.PutUint32(response[2:], uint32(len(response)))
+
+	name, err := parseReadPublicResponse(response)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if name != "000b1234" {
+		t.Errorf("the name should be 000b1234 but %q", name)
+	}
+
+	binary.BigEndian.PutUint32(response[6:], 0x18b)
+	if _, err := parseReadPublicResponse(response); err == nil {
+		t.Error("the error response should raise error")
+	}
+	if _, err := parseReadPublicResponse(response[:12]); err == nil {
+		t.Error("the truncated response should raise error")
+	}
+}
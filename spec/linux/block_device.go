@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 // BlockDeviceGenerator XXX
@@ -24,7 +25,7 @@ var blockDeviceLogger = logging.GetLogger("spec.block_device")
 
 // Generate generate metric values
 func (g *BlockDeviceGenerator) Generate() (interface{}, error) {
-	fileInfos, err := ioutil.ReadDir("/sys/block")
+	fileInfos, err := ioutil.ReadDir(util.HostPath("/sys/block"))
 	if err != nil {
 		blockDeviceLogger.Errorf("Failed (skip this spec): %s", err)
 		return nil, err
@@ -37,7 +38,7 @@ func (g *BlockDeviceGenerator) Generate() (interface{}, error) {
 		result := map[string]interface{}{}
 
 		for _, key := range []string{"size", "removable"} {
-			filename := path.Join("/sys/block", deviceName, key)
+			filename := util.HostPath(path.Join("/sys/block", deviceName, key))
 			if _, err := os.Stat(filename); err == nil {
 				bytes, err := ioutil.ReadFile(filename)
 				if err != nil {
@@ -49,7 +50,7 @@ func (g *BlockDeviceGenerator) Generate() (interface{}, error) {
 		}
 
 		for _, key := range []string{"model", "rev", "state", "timeout", "vendor"} {
-			filename := path.Join("/sys/block", deviceName, "device", key)
+			filename := util.HostPath(path.Join("/sys/block", deviceName, "device", key))
 			if _, err := os.Stat(filename); err == nil {
 				bytes, err := ioutil.ReadFile(filename)
 				if err != nil {
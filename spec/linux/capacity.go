@@ -0,0 +1,203 @@
+// +build linux
+
+package linux
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+)
+
+// CapacityGenerator collects the effective resource limits of the environment the agent runs in,
+// such as the cgroup CPU quota and memory limit of a container, and the size of the root filesystem
+// (which reflects the quota of the filesystem, e.g. the project quota of overlay on XFS)
+type CapacityGenerator struct {
+}
+
+// Key XXX
+func (g *CapacityGenerator) Key() string {
+	return "capacity"
+}
+
+var capacityLogger = logging.GetLogger("spec.capacity")
+
+// Capacity represents the effective resource limits. The zero value of a field means unlimited
+// (or unknown), in which case the physical hardware specs should be referred to.
+type Capacity struct {
+	CPU    float64 `json:"cpu,omitempty"`    // the number of CPU cores available
+	Memory uint64  `json:"memory,omitempty"` // in bytes
+	Disk   uint64  `json:"disk,omitempty"`   // in bytes, of the root filesystem
+	Cgroup string  `json:"cgroup,omitempty"` // "v1" or "v2"
+}
+
+var (
+	cgroupRoot     = "/sys/fs/cgroup"
+	procSelfCgroup = "/proc/self/cgroup"
+	diskRoot       = "/"
+)
+
+// memory limits larger than this are regarded as unlimited (cgroup v1 reports a huge number
+// rounded down to the page size, e.g. 9223372036854771712)
+const unlimitedMemory = 1 << 62
+
+// Generate generates the capacity spec
+func (g *CapacityGenerator) Generate() (interface{}, error) {
+	var capacity Capacity
+
+	paths := selfCgroupPaths()
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		capacity.Cgroup = "v2"
+		dirs := cgroupDirs("", paths)
+		capacity.CPU = cgroupV2CPU(dirs)
+		capacity.Memory = cgroupV2Memory(dirs)
+	} else if _, err := os.Stat(filepath.Join(cgroupRoot, "memory")); err == nil {
+		capacity.Cgroup = "v1"
+		capacity.CPU = cgroupV1CPU(cgroupDirs("cpu", paths))
+		capacity.Memory = cgroupV1Memory(cgroupDirs("memory", paths))
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(diskRoot, &stat); err != nil {
+		capacityLogger.Warningf("Failed to get the size of %s: %s", diskRoot, err)
+	} else {
+		capacity.Disk = stat.Blocks * uint64(stat.Bsize)
+	}
+
+	return capacity, nil
+}
+
+// selfCgroupPaths reads /proc/self/cgroup ("<id>:<controllers>:<path>" in each line), and returns the paths
+// of the cgroup the agent belongs to by the controllers of cgroup v1 (e.g. "memory"), or by "" of cgroup v2
+func selfCgroupPaths() map[string]string {
+	paths := make(map[string]string)
+	content, err := ioutil.ReadFile(procSelfCgroup)
+	if err != nil {
+		capacityLogger.Debugf("Failed to read %s: %s", procSelfCgroup, err)
+		return paths
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+	return paths
+}
+
+// cgroupDirs returns the directories of the cgroup of the agent and its ancestors in the hierarchy (the controller
+// of cgroup v1 like "memory", or "" of cgroup v2) from the nearest, whose limits are all effective.
+// The path in /proc/self/cgroup is relative to the root of the hierarchy with the host cgroup namespace (e.g. the
+// agent runs as a systemd service), or "/" with the private one of a container. The container of cgroup v1 without
+// the namespace sees its own cgroup mounted as the root, which is used if the path is not found.
+func cgroupDirs(hierarchy string, paths map[string]string) []string {
+	root := filepath.Join(cgroupRoot, hierarchy)
+	dir := filepath.Join(root, paths[hierarchy])
+	if rel, err := filepath.Rel(root, dir); err != nil || strings.HasPrefix(rel, "..") {
+		dir = root
+	} else if _, err := os.Stat(dir); err != nil {
+		dir = root
+	}
+	dirs := []string{dir}
+	for dir != root {
+		dir = filepath.Dir(dir)
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func readCgroupFile(dir, name string) (string, bool) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(content)), true
+}
+
+// cgroupV1CPU reads cpu.cfs_quota_us (-1 if unlimited) and cpu.cfs_period_us, and returns the smallest quota
+func cgroupV1CPU(dirs []string) float64 {
+	var cpu float64
+	for _, dir := range dirs {
+		quota, ok := readCgroupFile(dir, "cpu.cfs_quota_us")
+		if !ok {
+			continue
+		}
+		period, ok := readCgroupFile(dir, "cpu.cfs_period_us")
+		if !ok {
+			continue
+		}
+		if q := cpuQuota(quota, period); q > 0 && (cpu == 0 || q < cpu) {
+			cpu = q
+		}
+	}
+	return cpu
+}
+
+// cgroupV2CPU reads cpu.max, which contains "$MAX $PERIOD" ($MAX is "max" if unlimited), and returns the smallest quota
+func cgroupV2CPU(dirs []string) float64 {
+	var cpu float64
+	for _, dir := range dirs {
+		content, ok := readCgroupFile(dir, "cpu.max")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(content)
+		if len(fields) != 2 {
+			continue
+		}
+		if q := cpuQuota(fields[0], fields[1]); q > 0 && (cpu == 0 || q < cpu) {
+			cpu = q
+		}
+	}
+	return cpu
+}
+
+func cpuQuota(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return q / p
+}
+
+func cgroupV1Memory(dirs []string) uint64 {
+	return cgroupMemory(dirs, "memory.limit_in_bytes")
+}
+
+func cgroupV2Memory(dirs []string) uint64 {
+	return cgroupMemory(dirs, "memory.max")
+}
+
+// cgroupMemory returns the smallest memory limit of the file in dirs
+func cgroupMemory(dirs []string, name string) uint64 {
+	var memory uint64
+	for _, dir := range dirs {
+		content, ok := readCgroupFile(dir, name)
+		if !ok {
+			continue
+		}
+		if limit := memoryLimit(content); limit > 0 && (memory == 0 || limit < memory) {
+			memory = limit
+		}
+	}
+	return memory
+}
+
+func memoryLimit(content string) uint64 {
+	limit, err := strconv.ParseUint(content, 10, 64)
+	if err != nil || limit >= unlimitedMemory {
+		return 0
+	}
+	return limit
+}
@@ -0,0 +1,127 @@
+// +build linux
+
+package linux
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCapacityGenerator(t *testing.T) {
+	g := &CapacityGenerator{}
+
+	if g.Key() != "capacity" {
+		t.Error("key should be capacity")
+	}
+}
+
+// withCgroupRoot runs f with the cgroup hierarchy of files, where the agent belongs to the cgroup of selfCgroup
+// (the content of /proc/self/cgroup)
+func withCgroupRoot(t *testing.T, selfCgroup string, files map[string]string, f func()) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-test-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	self := filepath.Join(dir, "self_cgroup")
+	if err := ioutil.WriteFile(self, []byte(selfCgroup), 0644); err != nil {
+		t.Fatal(err)
+	}
+	originalSelf := procSelfCgroup
+	procSelfCgroup = self
+	defer func() { procSelfCgroup = originalSelf }()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	original := cgroupRoot
+	cgroupRoot = dir
+	defer func() { cgroupRoot = original }()
+	f()
+}
+
+func TestCapacityGenerate_cgroupV1(t *testing.T) {
+	withCgroupRoot(t, "4:memory:/\n3:cpu,cpuacct:/\n", map[string]string{
+		"cpu/cpu.cfs_quota_us":         "150000\n",
+		"cpu/cpu.cfs_period_us":        "100000\n",
+		"memory/memory.limit_in_bytes": "536870912\n",
+	}, func() {
+		value, err := (&CapacityGenerator{}).Generate()
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		capacity := value.(Capacity)
+		if capacity.Cgroup != "v1" || capacity.CPU != 1.5 || capacity.Memory != 536870912 {
+			t.Errorf("unexpected capacity: %+v", capacity)
+		}
+		if capacity.Disk == 0 {
+			t.Errorf("size of the root filesystem should be collected")
+		}
+	})
+
+	withCgroupRoot(t, "4:memory:/\n3:cpu,cpuacct:/\n", map[string]string{
+		"cpu/cpu.cfs_quota_us":         "-1\n",
+		"cpu/cpu.cfs_period_us":        "100000\n",
+		"memory/memory.limit_in_bytes": "9223372036854771712\n",
+	}, func() {
+		value, _ := (&CapacityGenerator{}).Generate()
+		capacity := value.(Capacity)
+		if capacity.CPU != 0 || capacity.Memory != 0 {
+			t.Errorf("unlimited resources should be zero: %+v", capacity)
+		}
+	})
+}
+
+func TestCapacityGenerate_cgroupV2(t *testing.T) {
+	withCgroupRoot(t, "0::/\n", map[string]string{
+		"cgroup.controllers": "cpuset cpu io memory pids\n",
+		"cpu.max":            "200000 100000\n",
+		"memory.max":         "max\n",
+	}, func() {
+		value, err := (&CapacityGenerator{}).Generate()
+		if err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		capacity := value.(Capacity)
+		if capacity.Cgroup != "v2" || capacity.CPU != 2 || capacity.Memory != 0 {
+			t.Errorf("unexpected capacity: %+v", capacity)
+		}
+	})
+}
+
+func TestCapacityGenerate_selfCgroup(t *testing.T) {
+	// cgroup v2 with the host cgroup namespace, e.g. the agent runs as a systemd service in a limited slice
+	withCgroupRoot(t, "0::/system.slice/mackerel-agent.service\n", map[string]string{
+		"cgroup.controllers":                             "cpuset cpu io memory pids\n",
+		"system.slice/cpu.max":                           "max 100000\n",
+		"system.slice/memory.max":                        "1073741824\n",
+		"system.slice/mackerel-agent.service/cpu.max":    "50000 100000\n",
+		"system.slice/mackerel-agent.service/memory.max": "max\n",
+		"system.slice/other.service/memory.max":          "1048576\n",
+	}, func() {
+		value, _ := (&CapacityGenerator{}).Generate()
+		capacity := value.(Capacity)
+		if capacity.CPU != 0.5 || capacity.Memory != 1073741824 {
+			t.Errorf("the limits of the cgroup of the agent and its ancestors should be collected: %+v", capacity)
+		}
+	})
+
+	// cgroup v1 of a container without the cgroup namespace, whose own cgroup is mounted as the root
+	withCgroupRoot(t, "4:memory:/docker/0123456789ab\n3:cpu,cpuacct:/docker/0123456789ab\n", map[string]string{
+		"cpu/cpu.cfs_quota_us":         "200000\n",
+		"cpu/cpu.cfs_period_us":        "100000\n",
+		"memory/memory.limit_in_bytes": "536870912\n",
+	}, func() {
+		value, _ := (&CapacityGenerator{}).Generate()
+		capacity := value.(Capacity)
+		if capacity.Cgroup != "v1" || capacity.CPU != 2 || capacity.Memory != 536870912 {
+			t.Errorf("the root should be used if the cgroup is not found: %+v", capacity)
+		}
+	})
+}
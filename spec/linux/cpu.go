@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 // CPUGenerator Collects CPU specs
@@ -73,7 +74,7 @@ func (g *CPUGenerator) generate(file io.Reader) (interface{}, error) {
 
 // Generate cpu specs
 func (g *CPUGenerator) Generate() (interface{}, error) {
-	file, err := os.Open("/proc/cpuinfo")
+	file, err := os.Open(util.HostPath("/proc/cpuinfo"))
 	if err != nil {
 		cpuLogger.Errorf("Failed (skip this spec): %s", err)
 		return nil, err
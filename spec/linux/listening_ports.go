@@ -0,0 +1,203 @@
+// +build linux
+
+package linux
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// ListeningPortsGenerator collects the listening TCP/UDP ports and their owning processes
+type ListeningPortsGenerator struct {
+}
+
+// Key XXX
+func (g *ListeningPortsGenerator) Key() string {
+	return "listening_ports"
+}
+
+var listeningPortsLogger = logging.GetLogger("spec.listening_ports")
+
+// Generate generates the list of the listening ports
+func (g *ListeningPortsGenerator) Generate() (interface{}, error) {
+	ports, err := CollectListeningPorts()
+	if err != nil {
+		listeningPortsLogger.Errorf("Failed (skip this spec): %s", err)
+		return nil, err
+	}
+	return ports, nil
+}
+
+// ListeningPort represents a listening socket on the host
+type ListeningPort struct {
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Process  string `json:"process,omitempty"`
+
+	inode string
+}
+
+// String returns the representation like "tcp 0.0.0.0:22 (sshd)"
+func (p ListeningPort) String() string {
+	s := fmt.Sprintf("%s %s", p.Protocol, net.JoinHostPort(p.Address, strconv.Itoa(p.Port)))
+	if p.Process != "" {
+		s += " (" + p.Process + ")"
+	}
+	return s
+}
+
+var procRoot = "/proc"
+
+// CollectListeningPorts reads /proc/net/{tcp,tcp6,udp,udp6} and returns the listening sockets
+// sorted by protocol, port and address.
+// The process names are resolved only for the sockets the agent is permitted to inspect.
+func CollectListeningPorts() ([]ListeningPort, error) {
+	var ports []ListeningPort
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		file, err := os.Open(util.HostPath(filepath.Join(procRoot, "net", proto)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// IPv6 may be disabled
+				continue
+			}
+			return nil, err
+		}
+		ps, err := parseProcNet(file, proto)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, ps...)
+	}
+
+	processes := socketProcesses()
+	for i := range ports {
+		ports[i].Process = processes[ports[i].inode]
+	}
+
+	sort.Sort(listeningPorts(ports))
+	return ports, nil
+}
+
+type listeningPorts []ListeningPort
+
+func (ps listeningPorts) Len() int      { return len(ps) }
+func (ps listeningPorts) Swap(i, j int) { ps[i], ps[j] = ps[j], ps[i] }
+func (ps listeningPorts) Less(i, j int) bool {
+	if ps[i].Protocol != ps[j].Protocol {
+		return ps[i].Protocol < ps[j].Protocol
+	}
+	if ps[i].Port != ps[j].Port {
+		return ps[i].Port < ps[j].Port
+	}
+	return ps[i].Address < ps[j].Address
+}
+
+const (
+	tcpStateListen = "0A"
+	udpStateClose  = "07" // unconnected UDP sockets are in TCP_CLOSE
+)
+
+// parseProcNet parses the content of /proc/net/{tcp,tcp6,udp,udp6}.
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//	 0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12345 ...
+func parseProcNet(r io.Reader, proto string) ([]ListeningPort, error) {
+	protocol := strings.TrimSuffix(proto, "6")
+
+	var ports []ListeningPort
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // skip the header line
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		state := fields[3]
+		if protocol == "tcp" && state != tcpStateListen {
+			continue
+		}
+		if protocol == "udp" && (state != udpStateClose || !strings.HasSuffix(fields[2], ":0000")) {
+			continue
+		}
+
+		address, port, err := parseHexAddress(fields[1])
+		if err != nil {
+			listeningPortsLogger.Warningf("Failed to parse the address %q in %s: %s", fields[1], proto, err)
+			continue
+		}
+		ports = append(ports, ListeningPort{
+			Protocol: protocol,
+			Address:  address,
+			Port:     port,
+			inode:    fields[9],
+		})
+	}
+	return ports, scanner.Err()
+}
+
+// parseHexAddress parses an address like "0100007F:0035",
+// where the IP address is the sequence of 32bit words in host byte order (little endian).
+func parseHexAddress(s string) (string, int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid format")
+	}
+	b, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return "", 0, err
+	}
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return "", 0, fmt.Errorf("invalid length of the IP address")
+	}
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return ip.String(), int(port), nil
+}
+
+// socketProcesses returns the map from socket inodes to the names of the processes owning them.
+func socketProcesses() map[string]string {
+	processes := make(map[string]string)
+	fds, _ := filepath.Glob(util.HostPath(filepath.Join(procRoot, "[0-9]*", "fd", "[0-9]*")))
+	comms := make(map[string]string)
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+		if _, ok := processes[inode]; ok {
+			continue
+		}
+		pidDir := filepath.Dir(filepath.Dir(fd))
+		comm, ok := comms[pidDir]
+		if !ok {
+			content, err := ioutil.ReadFile(filepath.Join(pidDir, "comm"))
+			if err == nil {
+				comm = strings.TrimSpace(string(content))
+			}
+			comms[pidDir] = comm
+		}
+		processes[inode] = comm
+	}
+	return processes
+}
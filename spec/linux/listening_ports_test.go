@@ -0,0 +1,70 @@
+// +build linux
+
+package linux
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListeningPortsGenerator(t *testing.T) {
+	g := &ListeningPortsGenerator{}
+
+	if g.Key() != "listening_ports" {
+		t.Error("key should be listening_ports")
+	}
+}
+
+func TestListeningPortsGenerate(t *testing.T) {
+	g := &ListeningPortsGenerator{}
+
+	value, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+
+	if _, ok := value.([]ListeningPort); !ok {
+		t.Errorf("value should be slice of ListeningPort. %+v", value)
+	}
+}
+
+func TestParseProcNet(t *testing.T) {
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 11111 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000   106        0 22222 1 0000000000000000 100 0 0 10 0
+   2: 0200000A:0016 0100000A:D2B4 01 00000000:00000000 02:000A7B1E 00000000     0        0 33333 4 0000000000000000 20 4 29 10 -1
+`
+	ports, err := parseProcNet(strings.NewReader(tcp), "tcp")
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	expected := []ListeningPort{
+		{Protocol: "tcp", Address: "0.0.0.0", Port: 22, inode: "11111"},
+		{Protocol: "tcp", Address: "127.0.0.1", Port: 3306, inode: "22222"},
+	}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("listening ports should be %+v but %+v", expected, ports)
+	}
+
+	udp6 := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  0: 00000000000000000000000001000000:0035 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 44444 2 0000000000000000 0
+`
+	ports, err = parseProcNet(strings.NewReader(udp6), "udp6")
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	expected = []ListeningPort{
+		{Protocol: "udp", Address: "::1", Port: 53, inode: "44444"},
+	}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("listening ports should be %+v but %+v", expected, ports)
+	}
+}
+
+func TestListeningPortString(t *testing.T) {
+	p := ListeningPort{Protocol: "tcp", Address: "::", Port: 80, Process: "nginx"}
+	if p.String() != "tcp [::]:80 (nginx)" {
+		t.Errorf("unexpected string: %q", p.String())
+	}
+}
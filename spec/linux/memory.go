@@ -8,6 +8,7 @@ import (
 	"regexp"
 
 	"github.com/mackerelio/mackerel-agent/logging"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
 var memItems = map[string]*regexp.Regexp{
@@ -54,7 +55,7 @@ var memoryLogger = logging.GetLogger("spec.memory")
 
 // Generate XXX
 func (g *MemoryGenerator) Generate() (interface{}, error) {
-	file, err := os.Open("/proc/meminfo")
+	file, err := os.Open(util.HostPath("/proc/meminfo"))
 	if err != nil {
 		memoryLogger.Errorf("Failed (skip this spec): %s", err)
 		return nil, err
@@ -0,0 +1,110 @@
+package spec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TerminationWatcher checks whether the ephemeral (spot/preemptible) instance
+// is going to be interrupted by the cloud platform.
+type TerminationWatcher interface {
+	// TerminationNotice returns the interruption scheduled, or nil if the instance is not going to be interrupted.
+	TerminationNotice() (*Interruption, error)
+}
+
+// The actions of the interruptions
+const (
+	InterruptionTerminate = "terminate"
+	InterruptionStop      = "stop"
+	InterruptionHibernate = "hibernate"
+)
+
+// Interruption is the interruption of the ephemeral instance scheduled by the cloud platform.
+type Interruption struct {
+	// Action is InterruptionTerminate, InterruptionStop or InterruptionHibernate
+	Action      string
+	Description string
+}
+
+// Terminates reports whether the instance is terminated, while it can be started again when it is stopped or
+// hibernated.
+func (i *Interruption) Terminates() bool {
+	return i.Action == InterruptionTerminate
+}
+
+// SuggestTerminationWatcher returns the TerminationWatcher for the cloud platform
+// the agent runs on, or nil if the platform is not supported.
+func SuggestTerminationWatcher() TerminationWatcher {
+	if g := SuggestCloudGenerator(); g != nil {
+		if w, ok := g.CloudMetaGenerator.(TerminationWatcher); ok {
+			return w
+		}
+	}
+	return nil
+}
+
+// TerminationNotice reads the spot instance interruption notice,
+// which is available two minutes before the termination.
+// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/spot-interruptions.html
+func (g *EC2Generator) TerminationNotice() (*Interruption, error) {
+	resp, err := requestEC2Meta(g.baseURL, "spot/instance-action")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// not a spot instance, or not scheduled to be interrupted
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to request spot/instance-action. response code: %d", resp.StatusCode)
+	}
+
+	var action struct {
+		Action string `json:"action"`
+		Time   string `json:"time"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&action); err != nil {
+		return nil, err
+	}
+	if action.Action == "" {
+		return nil, nil
+	}
+	return &Interruption{
+		Action:      action.Action,
+		Description: fmt.Sprintf("spot instance is scheduled to %s at %s", action.Action, action.Time),
+	}, nil
+}
+
+// TerminationNotice reads whether the preemptible instance has been preempted, which stops the instance.
+// https://cloud.google.com/compute/docs/instances/preemptible#detecting_if_an_instance_was_preempted
+func (g *GCEGenerator) TerminationNotice() (*Interruption, error) {
+	client := http.Client{Timeout: timeout}
+	u := g.metaURL.ResolveReference(&url.URL{Path: "instance/preempted"})
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to request instance/preempted. response code: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(body)) != "TRUE" {
+		return nil, nil
+	}
+	return &Interruption{Action: InterruptionStop, Description: "preemptible instance has been preempted"}, nil
+}
@@ -0,0 +1,71 @@
+package spec
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestEC2TerminationNotice(t *testing.T) {
+	scheduled := false
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/spot/instance-action" || !scheduled {
+			http.NotFound(res, req)
+			return
+		}
+		fmt.Fprint(res, `{"action": "terminate", "time": "2016-09-18T08:22:00Z"}`)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	g := &EC2Generator{u}
+
+	notice, err := g.TerminationNotice()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if notice != nil {
+		t.Errorf("notice should be nil before the termination is scheduled: %+v", notice)
+	}
+
+	scheduled = true
+	notice, err = g.TerminationNotice()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if notice == nil || notice.Description != "spot instance is scheduled to terminate at 2016-09-18T08:22:00Z" || !notice.Terminates() {
+		t.Errorf("unexpected notice: %+v", notice)
+	}
+}
+
+func TestGCETerminationNotice(t *testing.T) {
+	preempted := "FALSE"
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/computeMetadata/v1/instance/preempted" || req.Header.Get("Metadata-Flavor") != "Google" {
+			http.NotFound(res, req)
+			return
+		}
+		fmt.Fprint(res, preempted)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL + "/computeMetadata/v1/?recursive=true")
+	g := &GCEGenerator{u}
+
+	notice, err := g.TerminationNotice()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if notice != nil {
+		t.Errorf("notice should be nil before the instance is preempted: %+v", notice)
+	}
+
+	preempted = "TRUE"
+	notice, err = g.TerminationNotice()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if notice == nil || notice.Terminates() {
+		t.Errorf("notice of stopping the instance should be returned after the instance is preempted: %+v", notice)
+	}
+}
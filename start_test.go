@@ -89,7 +89,7 @@ func TestStart(t *testing.T) {
 	termCh := make(chan struct{})
 	done := make(chan struct{})
 	go func() {
-		err = start(conf, termCh)
+		err = start(conf, termCh, nil)
 		done <- struct{}{}
 	}()
 	time.Sleep(5 * time.Second)
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"os"
+)
+
+// ConditionSatisfied reports whether the condition to run a plugin is satisfied,
+// that is, the file exists if file is not empty and the command exits with 0 if command is not empty.
+// It is satisfied when neither of them is specified.
+func ConditionSatisfied(command, file, user string) bool {
+	if file != "" {
+		if _, err := os.Stat(file); err != nil {
+			utilLogger.Debugf("Condition file %q does not exist: %s", file, err)
+			return false
+		}
+	}
+	if command != "" {
+		_, _, exitCode, err := RunCommand(command, user)
+		if err != nil || exitCode != 0 {
+			utilLogger.Debugf("Condition command %q failed: exit code = %d, error = %v", command, exitCode, err)
+			return false
+		}
+	}
+	return true
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/mackerelio/mackerel-agent/logging"
 )
 
+// DfStat is the usage of the blocks of a filesystem in kilo bytes
 type DfStat struct {
 	Name      string
 	Blocks    uint64
@@ -35,6 +36,15 @@ type DfStat struct {
 //  udev                  512780       96  512684   1% /dev
 //  tmpfs                 517224        4  517220   1% /dev/shm
 
+// DfInodeStat is the usage of the inodes of a filesystem
+type DfInodeStat struct {
+	Name    string
+	Inodes  uint64
+	Used    uint64
+	Free    uint64
+	Mounted string
+}
+
 var dfHeaderPattern = regexp.MustCompile(
 	// 1024-blocks or 1k-blocks
 	`^Filesystem\s+(?:1024|1[Kk])-block`,
@@ -42,24 +52,60 @@ var dfHeaderPattern = regexp.MustCompile(
 
 var logger = logging.GetLogger("util.filesystem")
 
-var dfOpt []string
+var dfOpt, dfInodeOpt []string
 
 func init() {
 	switch runtime.GOOS {
 	case "darwin":
 		dfOpt = []string{"-Pkl"}
+		dfInodeOpt = []string{"-ikl"}
 	case "freebsd":
 		dfOpt = []string{"-Pkt", "noprocfs,devfs,fdescfs,nfs,cd9660"}
+		dfInodeOpt = []string{"-ikt", "noprocfs,devfs,fdescfs,nfs,cd9660"}
 	case "netbsd":
 		dfOpt = []string{"-Pkl"}
+		dfInodeOpt = []string{"-ikl"}
 	default:
 		dfOpt = []string{"-P"}
+		dfInodeOpt = []string{"-iP"}
 	}
 }
 
-// CollectDfValues collects disk free statistics from df command
+// CollectDfValues collects disk free statistics from df command.
+// Only the filesystems of the host are collected if the host root is set (see SetHostRoot).
 func CollectDfValues() ([]*DfStat, error) {
-	cmd := exec.Command("df", dfOpt...)
+	stdout, err := runDf(dfOpt)
+	if err != nil {
+		return nil, nil
+	}
+	var filesystems []*DfStat
+	for _, stat := range parseDfLines(stdout) {
+		if mounted, ok := hostMountPoint(stat.Mounted); ok {
+			stat.Mounted = mounted
+			filesystems = append(filesystems, stat)
+		}
+	}
+	return filesystems, nil
+}
+
+// CollectDfInodeValues collects the usage of the inodes from df command
+func CollectDfInodeValues() ([]*DfInodeStat, error) {
+	stdout, err := runDf(dfInodeOpt)
+	if err != nil {
+		return nil, nil
+	}
+	var filesystems []*DfInodeStat
+	for _, stat := range parseDfInodeLines(stdout, runtime.GOOS != "linux") {
+		if mounted, ok := hostMountPoint(stat.Mounted); ok {
+			stat.Mounted = mounted
+			filesystems = append(filesystems, stat)
+		}
+	}
+	return filesystems, nil
+}
+
+func runDf(opts []string) (string, error) {
+	cmd := exec.Command("df", opts...)
 	cmd.Env = append(os.Environ(), "LANG=C")
 	tio := &timeout.Timeout{
 		Cmd:       cmd,
@@ -71,10 +117,9 @@ func CollectDfValues() ([]*DfStat, error) {
 	_, stdout, _, err := tio.Run()
 
 	if err != nil {
-		logger.Warningf("'df %s' command exited with a non-zero status: '%s'", strings.Join(dfOpt, " "), err)
-		return nil, nil
+		logger.Warningf("'df %s' command exited with a non-zero status: '%s'", strings.Join(opts, " "), err)
 	}
-	return parseDfLines(stdout), nil
+	return stdout, err
 }
 
 func parseDfLines(out string) []*DfStat {
@@ -118,3 +163,50 @@ func parseDfLine(line string) (*DfStat, error) {
 		Mounted:   mounted,
 	}, nil
 }
+
+// `df -iP` sample on Linux:
+//  Filesystem      Inodes  IUsed   IFree IUse% Mounted on
+//  /dev/sda1      1310720 312345  998375   24% /
+//  tmpfs           129306      1  129305    1% /dev/shm
+//
+// `df -ikl` sample on BSDs:
+//  Filesystem 1024-blocks     Used Available Capacity iused   ifree %iused  Mounted on
+//  /dev/ada0p2   30450716 12345678  15669982    44%  423456 3456789   11%   /
+
+var (
+	dfInodeColumnsPattern    = regexp.MustCompile(`^(.+?)\s+(\d+)\s+(\d+)\s+(\d+)\s+\d+%\s+(.+)$`)
+	dfBSDInodeColumnsPattern = regexp.MustCompile(`^(.+?)\s+\d+\s+\d+\s+-?\d+\s+\d+%\s+(\d+)\s+(\d+)\s+\d+%\s+(.+)$`)
+)
+
+// parseDfInodeLines parses the output of `df -i` on Linux, or on BSDs if bsd is true.
+// The filesystems without the inodes (e.g. the ones allocating them dynamically,
+// whose usage is shown as "-") are skipped.
+func parseDfInodeLines(out string, bsd bool) []*DfInodeStat {
+	pattern := dfInodeColumnsPattern
+	if bsd {
+		pattern = dfBSDInodeColumnsPattern
+	}
+	lineScanner := bufio.NewScanner(strings.NewReader(out))
+	var filesystems []*DfInodeStat
+	for lineScanner.Scan() {
+		matches := pattern.FindStringSubmatch(lineScanner.Text())
+		if matches == nil {
+			continue
+		}
+		stat := &DfInodeStat{Name: matches[1], Mounted: matches[len(matches)-1]}
+		if bsd {
+			stat.Used, _ = strconv.ParseUint(matches[2], 10, 64)
+			stat.Free, _ = strconv.ParseUint(matches[3], 10, 64)
+			stat.Inodes = stat.Used + stat.Free
+		} else {
+			stat.Inodes, _ = strconv.ParseUint(matches[2], 10, 64)
+			stat.Used, _ = strconv.ParseUint(matches[3], 10, 64)
+			stat.Free, _ = strconv.ParseUint(matches[4], 10, 64)
+		}
+		if stat.Inodes == 0 {
+			continue
+		}
+		filesystems = append(filesystems, stat)
+	}
+	return filesystems
+}
@@ -60,3 +60,36 @@ tmpfs                 517224        4  517220   1% /dev/shm
 		t.Errorf("dfvalues are not expected: %#v", ret)
 	}
 }
+
+func TestCollectDfInodeValues(t *testing.T) {
+	_, err := CollectDfInodeValues()
+	if err != nil {
+		t.Errorf("err should be nil but: %s", err)
+	}
+}
+
+func TestParseDfInodeLines(t *testing.T) {
+	dfout := `Filesystem      Inodes  IUsed   IFree IUse% Mounted on
+/dev/sda1      1310720 312345  998375   24% /
+tmpfs           129306      1  129305    1% /dev/shm
+/dev/sdb1            0      0       0     - /mnt/btrfs
+`
+	expect := []*DfInodeStat{
+		{Name: "/dev/sda1", Inodes: 1310720, Used: 312345, Free: 998375, Mounted: "/"},
+		{Name: "tmpfs", Inodes: 129306, Used: 1, Free: 129305, Mounted: "/dev/shm"},
+	}
+	if ret := parseDfInodeLines(dfout, false); !reflect.DeepEqual(ret, expect) {
+		t.Errorf("inode values are not expected: %#v", ret)
+	}
+
+	dfout = `Filesystem 1024-blocks     Used Available Capacity iused   ifree %iused  Mounted on
+/dev/ada0p2   30450716 12345678  15669982    44%  423456 3456789   11%   /
+devfs                1        1         0   100%       0       0  100%   /dev
+`
+	expect = []*DfInodeStat{
+		{Name: "/dev/ada0p2", Inodes: 3880245, Used: 423456, Free: 3456789, Mounted: "/"},
+	}
+	if ret := parseDfInodeLines(dfout, true); !reflect.DeepEqual(ret, expect) {
+		t.Errorf("inode values are not expected: %#v", ret)
+	}
+}
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// hostRoot is the directory where the root filesystem of the host is mounted, when the agent runs
+// in a container like a DaemonSet of Kubernetes, e.g. "/host" for /host/proc and /host/sys.
+var hostRoot string
+
+// SetHostRoot makes HostPath resolve the paths under root. The empty root means the agent runs
+// on the host itself.
+func SetHostRoot(root string) {
+	hostRoot = root
+}
+
+// HostRoot returns the directory set by SetHostRoot.
+func HostRoot() string {
+	return hostRoot
+}
+
+// HostPath returns the path of the file of the host like /proc/meminfo, which is under the host root if set.
+// /proc/net is resolved to the one of the init process, since it is a symbolic link to /proc/self/net,
+// the network namespace of the agent in the container.
+func HostPath(path string) string {
+	if hostRoot == "" {
+		return path
+	}
+	if path == "/proc/net" || strings.HasPrefix(path, "/proc/net/") {
+		path = "/proc/1/net" + strings.TrimPrefix(path, "/proc/net")
+	}
+	return filepath.Join(hostRoot, path)
+}
+
+// hostMountPoint returns the mount point on the host of mounted, which is seen under the host root
+// by the agent in a container, and reports whether it is of the host.
+func hostMountPoint(mounted string) (string, bool) {
+	if hostRoot == "" {
+		return mounted, true
+	}
+	root := filepath.Clean(hostRoot)
+	if mounted == root {
+		return "/", true
+	}
+	if strings.HasPrefix(mounted, root+"/") {
+		return strings.TrimPrefix(mounted, root), true
+	}
+	return "", false
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHostPath(t *testing.T) {
+	defer SetHostRoot("")
+
+	if p := HostPath("/proc/meminfo"); p != "/proc/meminfo" {
+		t.Errorf("the path should not be changed without the host root but %q", p)
+	}
+
+	SetHostRoot("/host")
+	testCases := []struct {
+		path, expected string
+	}{
+		{"/proc/meminfo", "/host/proc/meminfo"},
+		{"/sys/block", "/host/sys/block"},
+		{"/proc/net/dev", "/host/proc/1/net/dev"},
+		{"/proc/net", "/host/proc/1/net"},
+		{"/proc/netstat", "/host/proc/netstat"},
+	}
+	for _, tc := range testCases {
+		if p := HostPath(tc.path); p != filepath.FromSlash(tc.expected) {
+			t.Errorf("HostPath(%q) should be %q but %q", tc.path, tc.expected, p)
+		}
+	}
+}
+
+func TestHostMountPoint(t *testing.T) {
+	defer SetHostRoot("")
+	SetHostRoot("/host/")
+
+	testCases := []struct {
+		mounted  string
+		expected string
+		ok       bool
+	}{
+		{"/host", "/", true},
+		{"/host/boot", "/boot", true},
+		{"/", "", false},
+		{"/hostname", "", false},
+		{"/etc/hosts", "", false},
+	}
+	for _, tc := range testCases {
+		mounted, ok := hostMountPoint(tc.mounted)
+		if mounted != tc.expected || ok != tc.ok {
+			t.Errorf("hostMountPoint(%q) should be (%q, %t) but (%q, %t)", tc.mounted, tc.expected, tc.ok, mounted, ok)
+		}
+	}
+}
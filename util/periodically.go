@@ -1,14 +1,29 @@
 package util
 
 import (
+	"context"
 	"time"
 )
 
-// Periodically invokes function proc with specified interval. The precision is 1/100 of the interval.
-func Periodically(proc func(), interval time.Duration, cancel <-chan struct{}) {
-	checkInterval := interval / 100
+// Periodically invokes function proc with specified interval until ctx is done. The precision is 1/100 of the interval.
+func Periodically(ctx context.Context, proc func(), interval time.Duration) {
+	periodically(ctx, proc, interval, time.Now().Add(interval))
+}
+
+// PeriodicallyAlignedToClock invokes function proc with specified interval like Periodically,
+// but at the boundaries of the wall clock, e.g. at :00, :05, :10, ... for the interval of 5 minutes.
+// The invocations are delayed by offset from the boundaries, which can be used to spread the load.
+func PeriodicallyAlignedToClock(ctx context.Context, proc func(), interval, offset time.Duration) {
+	periodically(ctx, proc, interval, nextBoundary(time.Now(), interval).Add(offset))
+}
 
-	nextTime := time.Now().Add(interval)
+// nextBoundary returns the first multiple of interval after t, counted from the zero time in UTC.
+func nextBoundary(t time.Time, interval time.Duration) time.Time {
+	return t.Truncate(interval).Add(interval)
+}
+
+func periodically(ctx context.Context, proc func(), interval time.Duration, nextTime time.Time) {
+	checkInterval := interval / 100
 
 	ticker := time.NewTicker(checkInterval)
 	defer ticker.Stop()
@@ -21,7 +36,7 @@ func Periodically(proc func(), interval time.Duration, cancel <-chan struct{}) {
 				go proc()
 			}
 
-		case <-cancel:
+		case <-ctx.Done():
 			return
 		}
 	}
@@ -1,24 +1,63 @@
 package util
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestPeriodically(t *testing.T) {
-	quit := make(chan struct{})
-	counter := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	var counter int32
 	go Periodically(
+		ctx,
 		func() {
-			counter++
+			atomic.AddInt32(&counter, 1)
 		},
 		400*time.Millisecond,
-		quit,
 	)
 	time.Sleep(time.Second)
-	quit <- struct{}{}
+	cancel()
 
-	if counter != 2 {
+	if counter := atomic.LoadInt32(&counter); counter != 2 {
 		t.Error("counter should be 2, but", counter)
 	}
 }
+
+func TestNextBoundary(t *testing.T) {
+	now := time.Date(2016, 9, 18, 8, 22, 31, 0, time.UTC)
+	if b := nextBoundary(now, 5*time.Minute); !b.Equal(time.Date(2016, 9, 18, 8, 25, 0, 0, time.UTC)) {
+		t.Error("next boundary should be 08:25:00, but", b)
+	}
+	if b := nextBoundary(now, time.Hour); !b.Equal(time.Date(2016, 9, 18, 9, 0, 0, 0, time.UTC)) {
+		t.Error("next boundary should be 09:00:00, but", b)
+	}
+}
+
+func TestPeriodicallyAlignedToClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	invoked := make(chan time.Time, 10)
+	go PeriodicallyAlignedToClock(
+		ctx,
+		func() {
+			invoked <- time.Now()
+		},
+		200*time.Millisecond,
+		50*time.Millisecond,
+	)
+	time.Sleep(time.Second)
+	cancel()
+
+	count := len(invoked)
+	for i := 0; i < count; i++ {
+		at := <-invoked
+		// invoked between offset and offset + precision (and some scheduling latency) after the boundaries
+		if elapsed := at.Sub(at.Truncate(200 * time.Millisecond)); elapsed < 50*time.Millisecond || elapsed > 150*time.Millisecond {
+			t.Error("should be invoked at 50ms after the boundaries, but", elapsed)
+		}
+	}
+	if count < 4 {
+		t.Error("should be invoked at least 4 times, but", count)
+	}
+}
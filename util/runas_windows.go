@@ -0,0 +1,141 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The commands with the `user` option are run as the user, by the token of LogonUserW given to os/exec.
+// The password is read from the generic credential of Windows Credential Manager whose target name is
+// runAsCredentialPrefix + the user, which is stored like
+//   cmdkey /generic:mackerel-agent:CORP\svc_mssql /user:CORP\svc_mssql /pass
+// so that the password is not written in the configuration files.
+//
+// os/exec creates the process by CreateProcessAsUser with the token, which requires SeAssignPrimaryTokenPrivilege
+// (and SeIncreaseQuotaPrivilege) held by LocalSystem, i.e. the agent running as the service by default.
+// The agent running as another account (even an administrator) fails to run the commands with `user` unless
+// the privileges are granted to the account by the local security policy ("Replace a process level token").
+// The tokens are kept while the agent runs, and dropped when the process fails to be created by them
+// (e.g. the privileges are missing or the token has been invalidated), so that the user logs on again,
+// e.g. with the password updated in Credential Manager, on the next run.
+
+const runAsCredentialPrefix = "mackerel-agent:"
+
+var (
+	modadvapi32    = syscall.NewLazyDLL("advapi32.dll")
+	procLogonUserW = modadvapi32.NewProc("LogonUserW")
+	procCredReadW  = modadvapi32.NewProc("CredReadW")
+	procCredFree   = modadvapi32.NewProc("CredFree")
+)
+
+const (
+	logon32LogonInteractive = 2
+	logon32ProviderDefault  = 0
+	credTypeGeneric         = 1
+)
+
+// https://docs.microsoft.com/windows/win32/api/wincred/ns-wincred-credentialw
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+var (
+	runAsTokensMu sync.Mutex
+	runAsTokens   = make(map[string]syscall.Token) // user -> the token kept while the agent runs
+)
+
+// runAsToken returns the token of user logged on with the password in Credential Manager.
+// The token is kept for the next runs only when LogonUserW succeeds.
+func runAsToken(user string) (syscall.Token, error) {
+	runAsTokensMu.Lock()
+	defer runAsTokensMu.Unlock()
+	if token, ok := runAsTokens[user]; ok {
+		return token, nil
+	}
+	password, err := readCredential(runAsCredentialPrefix + user)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the password of %q from Credential Manager (%s%s): %s", user, runAsCredentialPrefix, user, err)
+	}
+	name, domain := splitDomainUser(user)
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	var domainp *uint16
+	if domain != "" {
+		if domainp, err = syscall.UTF16PtrFromString(domain); err != nil {
+			return 0, err
+		}
+	}
+	passwordp, err := syscall.UTF16PtrFromString(password)
+	if err != nil {
+		return 0, err
+	}
+	var token syscall.Token
+	ok, _, err := procLogonUserW.Call(
+		uintptr(unsafe.Pointer(namep)), uintptr(unsafe.Pointer(domainp)), uintptr(unsafe.Pointer(passwordp)),
+		logon32LogonInteractive, logon32ProviderDefault, uintptr(unsafe.Pointer(&token)))
+	if ok == 0 {
+		return 0, fmt.Errorf("failed to log on as %q: %s", user, err)
+	}
+	runAsTokens[user] = token
+	return token, nil
+}
+
+// dropRunAsToken closes the token of user kept by runAsToken, if any
+func dropRunAsToken(user string) {
+	runAsTokensMu.Lock()
+	defer runAsTokensMu.Unlock()
+	if token, ok := runAsTokens[user]; ok {
+		token.Close()
+		delete(runAsTokens, user)
+	}
+}
+
+// splitDomainUser splits "DOMAIN\user" into the user and the domain. The domain of the local accounts
+// is ".", and the one of "user@domain" (UPN) is empty.
+func splitDomainUser(user string) (string, string) {
+	if i := strings.Index(user, `\`); i >= 0 {
+		return user[i+1:], user[:i]
+	}
+	if strings.Contains(user, "@") {
+		return user, ""
+	}
+	return user, "."
+}
+
+// readCredential reads the password of the generic credential of target.
+func readCredential(target string) (string, error) {
+	targetp, err := syscall.UTF16PtrFromString(target)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	ok, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(targetp)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ok == 0 {
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	// the password stored by cmdkey is UTF-16
+	n := int(cred.CredentialBlobSize / 2)
+	blob := make([]uint16, n)
+	for i := 0; i < n; i++ {
+		blob[i] = *(*uint16)(unsafe.Pointer(uintptr(unsafe.Pointer(cred.CredentialBlob)) + uintptr(i*2)))
+	}
+	return syscall.UTF16ToString(blob), nil
+}
@@ -0,0 +1,19 @@
+package util
+
+import "testing"
+
+func TestSplitDomainUser(t *testing.T) {
+	testCases := []struct {
+		user, name, domain string
+	}{
+		{`CORP\svc_mssql`, "svc_mssql", "CORP"},
+		{"svc_mssql@corp.example.com", "svc_mssql@corp.example.com", ""},
+		{"svc_mssql", "svc_mssql", "."},
+	}
+	for _, tc := range testCases {
+		name, domain := splitDomainUser(tc.user)
+		if name != tc.name || domain != tc.domain {
+			t.Errorf("%q should be split into %q and %q but %q and %q", tc.user, tc.name, tc.domain, name, domain)
+		}
+	}
+}
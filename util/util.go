@@ -3,11 +3,18 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/Songmu/timeout"
 	"github.com/mackerelio/mackerel-agent/logging"
 )
 
@@ -19,24 +26,200 @@ var TimeoutDuration = 30 * time.Second
 // TimeoutKillAfter is option of `RunCommand()` set waiting limit to `kill -kill` after terminating the command.
 var TimeoutKillAfter = 10 * time.Second
 
+// ErrCommandTimedOut is returned by RunCommand when the command is killed by the timeout.
+var ErrCommandTimedOut = errors.New("command timed out")
+
+// NewCommand returns the exec.Cmd to run command by the shell as user.
+func NewCommand(command, user string) (*exec.Cmd, error) {
+	return NewCommandWithEnv(command, user, nil)
+}
+
+// NewCommandWithEnv returns the exec.Cmd like NewCommand, adding the environment variables env
+// ("KEY=value") to the ones of the agent. The command is run as user by setuid if the agent runs as root
+// (see newCommandAsUser), or by sudo otherwise. The variables are passed through sudo by --preserve-env,
+// so that the values do not appear in the arguments seen by ps.
+func NewCommandWithEnv(command, user string, env []string) (*exec.Cmd, error) {
+	if user != "" && os.Geteuid() == 0 {
+		return newCommandAsUser(command, user, env)
+	}
+	var cmd *exec.Cmd
+	if user != "" {
+		args := []string{"-u", user}
+		if len(env) > 0 {
+			keys := make([]string, len(env))
+			for i, kv := range env {
+				keys[i] = strings.SplitN(kv, "=", 2)[0]
+			}
+			args = append(args, "--preserve-env="+strings.Join(keys, ","))
+		}
+		cmd = exec.Command("sudo", append(args, "/bin/sh", "-c", command)...)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd, nil
+}
+
+// userCommandEnvKeys are the environment variables of the agent passed to the commands run as another user.
+// The others (e.g. the credentials of the agent) are not passed, like sudo.
+var userCommandEnvKeys = []string{"PATH", "LANG", "LC_ALL", "TZ", "MACKEREL_AGENT_PLUGIN_META", "MACKEREL_AGENT_CACHE_DIR"}
+
+// newCommandAsUser returns the exec.Cmd to run command as the user, which switches to the user and its groups
+// (including the supplementary ones) before exec like cron, without sudo. HOME, USER, LOGNAME and SHELL
+// are set for the user.
+func newCommandAsUser(command, username string, env []string) (*exec.Cmd, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid of user %s: %s", username, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid of user %s: %s", username, u.Gid)
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the groups of user %s: %s", username, err)
+	}
+	groups := make([]uint32, 0, len(groupIDs))
+	for _, id := range groupIDs {
+		if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+			groups = append(groups, uint32(g))
+		}
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups},
+	}
+	cmd.Env = []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username, "SHELL=/bin/sh"}
+	for _, key := range userCommandEnvKeys {
+		if value, ok := os.LookupEnv(key); ok {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
+	cmd.Env = append(cmd.Env, env...)
+	return cmd, nil
+}
+
+// terminateCommandGroup terminates the process group of cmd by SIGTERM, and kills it by SIGKILL
+// if it still runs after TimeoutKillAfter. It reports whether cmd has exited (done is received).
+func terminateCommandGroup(cmd *exec.Cmd, done <-chan error) bool {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case <-done:
+		return true
+	case <-time.After(TimeoutKillAfter):
+	}
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	select {
+	case <-done:
+		return true
+	case <-time.After(TimeoutKillAfter):
+		return false
+	}
+}
+
+// StartCommand starts cmd created by NewCommand for user. It is the same as cmd.Start except on Windows,
+// where the token of user is dropped if the process fails to be created by it.
+func StartCommand(cmd *exec.Cmd, user string) error {
+	return cmd.Start()
+}
+
+// SetCommandGroup makes cmd run in a new process group, which is killed with the descendants
+// of the command by KillCommandGroup. It must be called before cmd is started.
+func SetCommandGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// KillCommandGroup kills the process group of cmd started after SetCommandGroup.
+func KillCommandGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
 // RunCommand runs command (in two string) and returns stdout, stderr strings and its exit code.
+// The command is killed after TimeoutDuration.
 func RunCommand(command, user string) (string, string, int, error) {
-	cmd := exec.Command("/bin/sh", "-c", command)
-	if user != "" {
-		cmd = exec.Command("sudo", "-u", user, "/bin/sh", "-c", command)
+	return RunCommandWithTimeout(command, user, TimeoutDuration)
+}
+
+// RunCommandWithTimeout runs command like RunCommand, but kills it with its process group after duration
+// and returns ErrCommandTimedOut. The command is terminated by SIGTERM, and killed by SIGKILL if it still
+// runs after TimeoutKillAfter.
+func RunCommandWithTimeout(command, user string, duration time.Duration) (string, string, int, error) {
+	return RunCommandWithEnv(command, user, nil, duration)
+}
+
+// RunCommandWithEnv runs command like RunCommandWithTimeout with the environment variables env
+// ("KEY=value") added. TimeoutDuration is applied if duration is 0.
+func RunCommandWithEnv(command, user string, env []string, duration time.Duration) (string, string, int, error) {
+	return RunCommandContext(context.Background(), command, user, env, duration)
+}
+
+// RunCommandContext runs command like RunCommandWithEnv, but also kills it with its process group
+// when ctx is done, e.g. when the agent terminates, and returns the error of ctx.
+func RunCommandContext(ctx context.Context, command, user string, env []string, duration time.Duration) (string, string, int, error) {
+	if duration <= 0 {
+		duration = TimeoutDuration
+	}
+	var outBuffer, errBuffer bytes.Buffer
+	cmd, err := NewCommandWithEnv(command, user, env)
+	if err != nil {
+		utilLogger.Errorf("RunCommand error command: %s, error: %s", command, err)
+		return "", "", -1, err
+	}
+	cmd.Stdout = &outBuffer
+	cmd.Stderr = &errBuffer
+	// kill the descendants as well as the shell, which may keep the output open
+	SetCommandGroup(cmd)
+
+	if err := StartCommand(cmd, user); err != nil {
+		utilLogger.Errorf("RunCommand error command: %s, error: %s", command, err)
+		return "", "", -1, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	var killed error
+	select {
+	case err = <-done:
+	case <-timer.C:
+		killed = ErrCommandTimedOut
+	case <-ctx.Done():
+		killed = ctx.Err()
 	}
-	tio := &timeout.Timeout{
-		Cmd:       cmd,
-		Duration:  TimeoutDuration,
-		KillAfter: TimeoutKillAfter,
+	if killed != nil {
+		if !terminateCommandGroup(cmd, done) {
+			// the output is kept open by the descendants which have left the process group,
+			// which are not waited for not to block the caller
+			utilLogger.Errorf("RunCommand error command: %s, error: %s (the output is abandoned)", command, killed)
+			return "", "", -1, killed
+		}
+		err = killed
 	}
-	exitStatus, stdout, stderr, err := tio.Run()
 
-	if err == nil && exitStatus.IsTimedOut() {
-		err = fmt.Errorf("command timed out")
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if waitStatus, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			exitCode = waitStatus.ExitStatus()
+			err = nil
+		}
 	}
 	if err != nil {
+		exitCode = -1
 		utilLogger.Errorf("RunCommand error command: %s, error: %s", command, err)
 	}
-	return stdout, stderr, exitStatus.GetChildExitCode(), err
+	return outBuffer.String(), errBuffer.String(), exitCode, err
 }
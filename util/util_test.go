@@ -3,6 +3,13 @@
 package util
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -39,3 +46,109 @@ func TestRunCommandWithTimeout(t *testing.T) {
 		t.Error("err should have error but nil")
 	}
 }
+
+func TestRunCommandWithTimeout_escaped(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid is not available")
+	}
+	origKillAfter := TimeoutKillAfter
+	TimeoutKillAfter = 100 * time.Millisecond
+	defer func() { TimeoutKillAfter = origKillAfter }()
+
+	// the child in another session keeps the output open after the shell is killed
+	started := time.Now()
+	_, _, _, err := RunCommandWithTimeout("setsid sleep 3 & sleep 3", "", 100*time.Millisecond)
+	if err != ErrCommandTimedOut {
+		t.Errorf("err should be ErrCommandTimedOut but %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("the escaped descendants should not be waited for: %s", elapsed)
+	}
+}
+
+func TestRunCommandWithEnv(t *testing.T) {
+	stdout, _, exitCode, err := RunCommandWithEnv(`echo "$FOO $BAR"`, "", []string{"FOO=foo", "BAR=bar baz"}, 0)
+	if err != nil || exitCode != 0 {
+		t.Errorf("the command should succeed: exitCode=%d err=%v", exitCode, err)
+	}
+	if stdout != "foo bar baz\n" {
+		t.Errorf("the environment variables should be passed: %q", stdout)
+	}
+}
+
+func TestRunCommandContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	started := time.Now()
+	_, _, exitCode, err := RunCommandContext(ctx, "sleep 3", "", nil, 0)
+	if err != context.Canceled || exitCode != -1 {
+		t.Errorf("the command should be canceled: exitCode=%d err=%v", exitCode, err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("the command should be killed when the context is done: %s", elapsed)
+	}
+}
+
+func TestNewCommandWithEnv_user(t *testing.T) {
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("the user nobody is not available")
+	}
+	cmd, err := NewCommandWithEnv("env", "nobody", []string{"FOO=secret", "BAR=x"})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	expected := []string{"sudo", "-u", "nobody", "--preserve-env=FOO,BAR", "/bin/sh", "-c", "env"}
+	if os.Geteuid() == 0 {
+		// switches to the user without sudo
+		expected = []string{"/bin/sh", "-c", "env"}
+	}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("the values should not be in the arguments: %q", cmd.Args)
+	}
+}
+
+func TestNewCommandAsUser(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("the current user is not available: %s", err)
+	}
+	os.Setenv("MACKEREL_TEST_SECRET", "secret")
+	defer os.Unsetenv("MACKEREL_TEST_SECRET")
+
+	cmd, err := newCommandAsUser("env", current.Username, []string{"FOO=foo"})
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if cred := cmd.SysProcAttr.Credential; cred == nil || fmt.Sprint(cred.Uid) != current.Uid || fmt.Sprint(cred.Gid) != current.Gid {
+		t.Errorf("the command should run as the user: %+v", cred)
+	}
+	env := strings.Join(cmd.Env, "\n")
+	if !strings.Contains(env, "HOME="+current.HomeDir) || !strings.Contains(env, "FOO=foo") {
+		t.Errorf("the environment of the user should be set: %q", cmd.Env)
+	}
+	if strings.Contains(env, "MACKEREL_TEST_SECRET") {
+		t.Errorf("the environment of the agent should not be passed: %q", cmd.Env)
+	}
+
+	if _, err := newCommandAsUser("env", "mackerel-agent-no-such-user", nil); err == nil {
+		t.Errorf("should raise error for the unknown user")
+	}
+}
+
+func TestConditionSatisfied(t *testing.T) {
+	if !ConditionSatisfied("", "", "") {
+		t.Error("condition should be satisfied if nothing is specified")
+	}
+	if !ConditionSatisfied("true", "", "") {
+		t.Error("condition should be satisfied if the command succeeds")
+	}
+	if ConditionSatisfied("false", "", "") {
+		t.Error("condition should not be satisfied if the command fails")
+	}
+	if !ConditionSatisfied("", "/", "") {
+		t.Error("condition should be satisfied if the file exists")
+	}
+	if ConditionSatisfied("true", "/nonexistent/file", "") {
+		t.Error("condition should not be satisfied if the file does not exist")
+	}
+}
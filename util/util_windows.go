@@ -2,34 +2,126 @@ package util
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/mackerelio/mackerel-agent/logging"
 )
 
 var utilLogger = logging.GetLogger("util")
 
-// RunCommand XXX
-func RunCommand(command, user string) (string, string, int, error) {
-	var outBuffer, errBuffer bytes.Buffer
+// NewCommand returns the exec.Cmd to run command by cmd.exe in the current directory as user
+// with the password in Credential Manager (see runAsToken).
+func NewCommand(command, user string) (*exec.Cmd, error) {
+	return NewCommandWithEnv(command, user, nil)
+}
 
+// NewCommandWithEnv returns the exec.Cmd like NewCommand, adding the environment variables env
+// ("KEY=value") to the ones of the agent.
+func NewCommandWithEnv(command, user string, env []string) (*exec.Cmd, error) {
 	wd, err := os.Getwd()
 	if err != nil {
-		return "", "", -1, err
+		return nil, err
 	}
 	cmd := exec.Command("cmd", "/c", "pushd "+wd+" & "+command)
 	if user != "" {
-		utilLogger.Warningf("RunCommand ignore option: user = %q", user)
+		token, err := runAsToken(user)
+		if err != nil {
+			utilLogger.Errorf("RunCommand error command: %s, error: %s", command, err)
+			return nil, err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Token: token}
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd, nil
+}
+
+// StartCommand starts cmd created by NewCommand for user. The token of user is dropped if the process
+// fails to be created by it, so that the user logs on again on the next run (see runAsToken).
+func StartCommand(cmd *exec.Cmd, user string) error {
+	err := cmd.Start()
+	if err != nil && user != "" {
+		dropRunAsToken(user)
+	}
+	return err
+}
+
+// SetCommandGroup does nothing on Windows, where the descendants of the command are killed
+// by KillCommandGroup as the process tree.
+func SetCommandGroup(cmd *exec.Cmd) {
+}
+
+// KillCommandGroup kills cmd with its descendants.
+func KillCommandGroup(cmd *exec.Cmd) error {
+	// taskkill kills the process tree, which cmd.Process.Kill does not
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
+
+// ErrCommandTimedOut is returned by RunCommandWithTimeout when the command is killed by the timeout.
+var ErrCommandTimedOut = errors.New("command timed out")
+
+// RunCommand XXX
+func RunCommand(command, user string) (string, string, int, error) {
+	return RunCommandWithTimeout(command, user, 0)
+}
+
+// RunCommandWithTimeout runs command like RunCommand, but kills it with its descendants after duration
+// and returns ErrCommandTimedOut. The command is not killed if duration is 0.
+func RunCommandWithTimeout(command, user string, duration time.Duration) (string, string, int, error) {
+	return RunCommandWithEnv(command, user, nil, duration)
+}
+
+// RunCommandWithEnv runs command like RunCommandWithTimeout with the environment variables env
+// ("KEY=value") added. The command is not killed if duration is 0.
+func RunCommandWithEnv(command, user string, env []string, duration time.Duration) (string, string, int, error) {
+	return RunCommandContext(context.Background(), command, user, env, duration)
+}
+
+// RunCommandContext runs command like RunCommandWithEnv, but also kills it with its descendants
+// when ctx is done, e.g. when the agent terminates, and returns the error of ctx.
+func RunCommandContext(ctx context.Context, command, user string, env []string, duration time.Duration) (string, string, int, error) {
+	var outBuffer, errBuffer bytes.Buffer
+
+	cmd, err := NewCommandWithEnv(command, user, env)
+	if err != nil {
+		return "", "", -1, err
 	}
 	cmd.Stdout = &outBuffer
 	cmd.Stderr = &errBuffer
 
-	err = cmd.Run()
+	if err = StartCommand(cmd, user); err != nil {
+		return "", "", -1, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var timer <-chan time.Time
+	if duration > 0 {
+		timer = time.After(duration)
+	}
+	select {
+	case err = <-done:
+	case <-timer:
+		KillCommandGroup(cmd)
+		<-done
+		utilLogger.Errorf("RunCommand error command: %s, error: %s", command, ErrCommandTimedOut)
+		return outBuffer.String(), errBuffer.String(), -1, ErrCommandTimedOut
+	case <-ctx.Done():
+		KillCommandGroup(cmd)
+		<-done
+		utilLogger.Errorf("RunCommand error command: %s, error: %s", command, ctx.Err())
+		return outBuffer.String(), errBuffer.String(), -1, ctx.Err()
+	}
 
 	stdout := outBuffer.String()
 	stderr := errBuffer.String()